@@ -330,8 +330,12 @@ func (h *Handler) deliverBlocks(ctx context.Context, srv *Server, envelope *cb.E
 
 		logger.Debugf("[channel: %s] Delivering block [%d] for (%p) for %s", chdr.ChannelId, block.Header.Number, seekInfo, addr)
 
-		// Send block using Fabric machine protocol.
-		fmprotocol.SendToHardware(ctx, block)
+		// Send block using Fabric machine protocol, as it is serialized in the ledger.
+		fmprotocol.SendToHardware(ctx, block, func(number uint64) *cb.Block {
+			return blockledger.GetBlock(chain.Reader(), number)
+		}, func(number uint64) []byte {
+			return getBlockBytes(chain.Reader(), number)
+		})
 
 		signedData := &protoutil.SignedData{Data: envelope.Payload, Identity: shdr.Creator, Signature: envelope.Signature}
 		if err := srv.SendBlockResponse(block, chdr.ChannelId, chain, signedData); err != nil {
@@ -351,6 +355,21 @@ func (h *Handler) deliverBlocks(ctx context.Context, srv *Server, envelope *cb.E
 	return cb.Status_SUCCESS, nil
 }
 
+// getBlockBytes returns a block as it is serialized in the ledger, or nil when the ledger does not
+// return serialized blocks.
+func getBlockBytes(reader blockledger.Reader, number uint64) []byte {
+	bytesReader, ok := reader.(fmprotocol.BlockBytesReader)
+	if !ok {
+		return nil
+	}
+	data, err := bytesReader.RetrieveBlockBytesByNumber(number)
+	if err != nil {
+		logger.Warningf("Cannot read serialized block [%d]: %s", number, err)
+		return nil
+	}
+	return data
+}
+
 func (h *Handler) parseEnvelope(ctx context.Context, envelope *cb.Envelope) (*cb.Payload, *cb.ChannelHeader, *cb.SignatureHeader, error) {
 	payload, err := protoutil.UnmarshalPayload(envelope.Payload)
 	if err != nil {
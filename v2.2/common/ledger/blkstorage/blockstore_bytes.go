@@ -0,0 +1,17 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package blkstorage
+
+// RetrieveBlockBytesByNumber returns the block at a given blockchain height as it is serialized in
+// the block files, so that it can be sent to the Fabric machine without serializing it again.
+func (store *BlockStore) RetrieveBlockBytesByNumber(blockNum uint64) ([]byte, error) {
+	loc, err := store.fileMgr.index.getBlockLocByBlockNum(blockNum)
+	if err != nil {
+		return nil, err
+	}
+	return store.fileMgr.fetchBlockBytes(loc)
+}
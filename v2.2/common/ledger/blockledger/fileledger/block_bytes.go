@@ -0,0 +1,23 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fileledger
+
+import (
+	"github.com/pkg/errors"
+)
+
+// RetrieveBlockBytesByNumber returns a block as it is serialized in the ledger, when the block
+// store supports it.
+func (fl *FileLedger) RetrieveBlockBytesByNumber(number uint64) ([]byte, error) {
+	store, ok := fl.blockStore.(interface {
+		RetrieveBlockBytesByNumber(number uint64) ([]byte, error)
+	})
+	if !ok {
+		return nil, errors.New("block store does not return serialized blocks")
+	}
+	return store.RetrieveBlockBytesByNumber(number)
+}
@@ -118,9 +118,10 @@ type TxValidator struct {
 var logger = flogging.MustGetLogger("committer.txvalidator")
 
 type blockValidationRequest struct {
-	block *common.Block
-	d     []byte
-	tIdx  int
+	block    *common.Block
+	d        []byte
+	tIdx     int
+	software bool
 }
 
 type blockValidationResult struct {
@@ -191,6 +192,15 @@ func (v *TxValidator) Validate(block *common.Block) error {
 	// array of txids
 	txidArray := make([]string, len(block.Data.Data))
 
+	// Hardware does not see the writes of the txs validated in software, and reports any invalid
+	// tx as an MVCC conflict, so the ledger validates again in software the txs that hardware
+	// found invalid when the statedb is kept up to date in software.
+	if fmapi.IsEnabled() && fmapi.IsSwStateDbEnabled() && !fmapi.IsSoftwareValidatedBlock(block) {
+		fmapi.SetTxRevalidator(block.Header.Number, func(tIdx int) (peer.TxValidationCode, error) {
+			return v.revalidateTx(block, tIdx)
+		})
+	}
+
 	results := make(chan *blockValidationResult)
 	go func() {
 		for tIdx, d := range block.Data.Data {
@@ -296,6 +306,22 @@ func markTXIdDuplicates(txids []string, txsfltr txflags.ValidationFlags) {
 	}
 }
 
+// revalidateTx validates a tx of a block entirely in software.
+func (v *TxValidator) revalidateTx(block *common.Block, tIdx int) (peer.TxValidationCode, error) {
+	if tIdx < 0 || tIdx >= len(block.Data.Data) {
+		return peer.TxValidationCode_INVALID_OTHER_REASON, errors.Errorf("transaction %d not in block %d", tIdx, block.Header.Number)
+	}
+	results := make(chan *blockValidationResult, 1)
+	v.validateTx(&blockValidationRequest{
+		d:        block.Data.Data[tIdx],
+		block:    block,
+		tIdx:     tIdx,
+		software: true,
+	}, results)
+	res := <-results
+	return res.validationCode, res.err
+}
+
 func (v *TxValidator) validateTx(req *blockValidationRequest, results chan<- *blockValidationResult) {
 	block := req.block
 	d := req.d
@@ -309,7 +335,9 @@ func (v *TxValidator) validateTx(req *blockValidationRequest, results chan<- *bl
 		return
 	}
 
-	hwEnabled := fmapi.IsEnabled()
+	// Config blocks and ill-formed blocks are not sent to hardware, their txs are validated in
+	// software.
+	hwEnabled := fmapi.IsEnabled() && !fmapi.IsSoftwareValidatedBlock(block) && !req.software
 
 	if env, err := protoutil.GetEnvelopeFromBlock(d); err != nil {
 		logger.Warningf("Error getting tx from block: %+v", err)
@@ -330,7 +358,17 @@ func (v *TxValidator) validateTx(req *blockValidationRequest, results chan<- *bl
 		var err error
 		var txResult peer.TxValidationCode
 
-		if payload, txResult = validation.ValidateTransaction(env, v.CryptoProvider); txResult != peer.TxValidationCode_VALID {
+		// Transactions that hardware does not support are validated in software, and the ledger
+		// is told so that it checks them for MVCC conflicts as well.
+		if hwEnabled {
+			if reason := fmapi.GetSoftwareValidationReason(env); reason != "" {
+				logger.Debugf("[%s] Validating txn %d of block %d in software: %s", v.ChannelID, tIdx, block.Header.Number, reason)
+				fmapi.SetSoftwareValidated(block.Header.Number, tIdx)
+				hwEnabled = false
+			}
+		}
+
+		if payload, txResult = validation.ValidateTransactionForHardware(env, hwEnabled, v.CryptoProvider); txResult != peer.TxValidationCode_VALID {
 			logger.Errorf("Invalid transaction with index %d", tIdx)
 			results <- &blockValidationResult{
 				tIdx:           tIdx,
@@ -366,15 +404,21 @@ func (v *TxValidator) validateTx(req *blockValidationRequest, results chan<- *bl
 			txID = chdr.TxId
 
 			// Check duplicate transactions
-			erroneousResultEntry := v.checkTxIdDupsLedger(tIdx, chdr, v.LedgerResources)
-			if erroneousResultEntry != nil {
-				results <- erroneousResultEntry
-				return
+			// Skip the ledger lookup when the TX ID index of hardware holds all the TX IDs of the
+			// ledger, since hardware reports duplicate TX IDs along with the validation results of
+			// the block. They are confirmed against the ledger when the block is committed.
+			if !hwEnabled || !fmapi.IsTxIdIndexComplete(v.ChannelID) || block.Header.Number < fmapi.GetStartingBlock() {
+				erroneousResultEntry := v.checkTxIdDupsLedger(tIdx, chdr, v.LedgerResources)
+				if erroneousResultEntry != nil {
+					results <- erroneousResultEntry
+					return
+				}
 			}
 
 			// Validate tx with plugins
-			// Skip vscc when hardware is used since its handled in hardware.
-			if !hwEnabled {
+			// Skip vscc when hardware is used since its handled in hardware, unless the tx has
+			// more endorsements than hardware can check.
+			if !hwEnabled || fmapi.ExceedsEndorserLimit(payload) {
 				logger.Debug("Validating transaction with plugins")
 				err, cde := v.Dispatcher.Dispatch(tIdx, payload, d, block)
 				if err != nil {
@@ -248,6 +248,15 @@ func validateEndorserTransaction(data []byte, hdr *common.Header) error {
 
 // ValidateTransaction checks that the transaction envelope is properly formed
 func ValidateTransaction(e *common.Envelope, cryptoProvider bccsp.BCCSP) (*common.Payload, pb.TxValidationCode) {
+	// Transactions that hardware does not support are validated in software.
+	hwEnabled := e != nil && fmapi.IsEnabled() && fmapi.GetSoftwareValidationReason(e) == ""
+	return ValidateTransactionForHardware(e, hwEnabled, cryptoProvider)
+}
+
+// ValidateTransactionForHardware checks that the transaction envelope is properly formed, leaving
+// the checks done by hardware out when hwEnabled is true, i.e. when the transaction is validated by
+// hardware.
+func ValidateTransactionForHardware(e *common.Envelope, hwEnabled bool, cryptoProvider bccsp.BCCSP) (*common.Payload, pb.TxValidationCode) {
 	putilsLogger.Debugf("ValidateTransactionEnvelope starts for envelope %p", e)
 
 	// check for nil argument
@@ -256,8 +265,6 @@ func ValidateTransaction(e *common.Envelope, cryptoProvider bccsp.BCCSP) (*commo
 		return nil, pb.TxValidationCode_NIL_ENVELOPE
 	}
 
-	hwEnabled := fmapi.IsEnabled()
-
 	// get the payload from the envelope
 	payload, err := protoutil.UnmarshalPayload(e.Payload)
 	if err != nil {
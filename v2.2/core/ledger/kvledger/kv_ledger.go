@@ -32,6 +32,7 @@ import (
 	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/validation"
 	"github.com/hyperledger/fabric/core/ledger/pvtdatapolicy"
 	"github.com/hyperledger/fabric/core/ledger/pvtdatastorage"
+	"github.com/hyperledger/fabric/fabricmachine/api"
 	"github.com/hyperledger/fabric/internal/pkg/txflags"
 	"github.com/hyperledger/fabric/protoutil"
 	"github.com/pkg/errors"
@@ -151,12 +152,87 @@ func newKVLedger(initializer *lgrInitializer) (*kvLedger, error) {
 	if err := l.recoverDBs(); err != nil {
 		return nil, err
 	}
+
+	// Transactions are routed to the Fabric machine depending on the channel config.
+	if fmapi.IsEnabled() {
+		if err := l.loadFabricMachineChannelConfig(); err != nil {
+			return nil, err
+		}
+		if err := l.countFabricMachineTxIds(); err != nil {
+			return nil, err
+		}
+		fmapi.SetTxIdLookup(l.ledgerID, l.txIDExists)
+	}
 	l.configHistoryRetriever = initializer.configHistoryMgr.GetRetriever(ledgerID, l)
 
 	l.stats = initializer.stats
 	return l, nil
 }
 
+// loadFabricMachineChannelConfig sets the channel config that the Fabric machine checks chaincode
+// endorsement policies against, from the last config block of the ledger.
+func (l *kvLedger) loadFabricMachineChannelConfig() error {
+	info, err := l.blockStore.GetBlockchainInfo()
+	if err != nil {
+		return err
+	}
+	if info.Height == 0 {
+		return nil
+	}
+	lastBlock, err := l.blockStore.RetrieveBlockByNumber(info.Height - 1)
+	if err != nil {
+		return err
+	}
+	if fmapi.IsConfigBlock(lastBlock) {
+		return fmapi.SetChannelConfigFromBlock(lastBlock)
+	}
+	configIndex, err := protoutil.GetLastConfigIndexFromBlock(lastBlock)
+	if err != nil {
+		return err
+	}
+	configBlock, err := l.blockStore.RetrieveBlockByNumber(configIndex)
+	if err != nil {
+		return err
+	}
+	return fmapi.SetChannelConfigFromBlock(configBlock)
+}
+
+// countFabricMachineTxIds counts the TX IDs of the ledger, until there are more than the TX ID
+// index of the Fabric machine holds, so that TX IDs are looked up in the ledger once it is full.
+// Counting stops right away when the Fabric machine has been reset.
+func (l *kvLedger) countFabricMachineTxIds() error {
+	if fmapi.GetTxIdIndexBits() == 0 {
+		return nil
+	}
+	info, err := l.blockStore.GetBlockchainInfo()
+	if err != nil {
+		return err
+	}
+	for number := uint64(0); number < info.Height && fmapi.IsTxIdIndexComplete(l.ledgerID); number++ {
+		block, err := l.blockStore.RetrieveBlockByNumber(number)
+		if err != nil {
+			return err
+		}
+		fmapi.CountTxIds(l.ledgerID, block)
+	}
+	return nil
+}
+
+// txIDExists returns true when a transaction of the ledger has the given TX ID
+func (l *kvLedger) txIDExists(txID string) (bool, error) {
+	l.blockAPIsRWLock.RLock()
+	defer l.blockAPIsRWLock.RUnlock()
+	_, err := l.blockStore.RetrieveTxByID(txID)
+	switch err.(type) {
+	case nil:
+		return true, nil
+	case ledger.NotFoundInIndexErr:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
 func (l *kvLedger) initTxMgr(initializer *txmgr.Initializer) error {
 	var err error
 	txmgr, err := txmgr.NewLockBasedTxMgr(initializer)
@@ -471,11 +547,30 @@ func (l *kvLedger) CommitLegacy(pvtdataAndBlock *ledger.BlockAndPvtData, commitO
 		pvtdataAndBlock.PvtData = convertTxPvtDataArrayToMap(txPvtData)
 	}
 
+	// Results read from the Fabric machine are checked against the transactions of the block.
+	// Orderers do not send config blocks and ill-formed blocks to the Fabric machine, they are
+	// validated in software. Chaincode definitions and channel config of the block decide which txs of the following
+	// blocks are validated in software, the same way as on orderers, and its TX IDs whether the
+	// TX IDs of the following blocks are looked up in the ledger. Definitions of valid txs are
+	// also recorded once the block is validated.
+	if fmapi.IsEnabled() {
+		if fmapi.IsSoftwareValidatedBlock(block) {
+			fmapi.SetSoftwareBlock(blockNo)
+		} else {
+			fmapi.SetExpectedResult(blockNo, block.Data.Data)
+		}
+		fmapi.UpdateChaincodeDefinitions(block)
+		fmapi.CountTxIds(l.ledgerID, block)
+	}
+
 	logger.Debugf("[%s] Validating state for block [%d]", l.ledgerID, blockNo)
 	txstatsInfo, updateBatchBytes, err := l.txmgr.ValidateAndPrepare(pvtdataAndBlock, true)
 	if err != nil {
 		return err
 	}
+	if fmapi.IsEnabled() {
+		fmapi.CommitChaincodeDefinitions(block)
+	}
 	l.printTxsFilter(block)
 	elapsedBlockProcessing := time.Since(startBlockProcessing)
 
@@ -488,6 +583,14 @@ func (l *kvLedger) CommitLegacy(pvtdataAndBlock *ledger.BlockAndPvtData, commitO
 		l.addBlockCommitHash(pvtdataAndBlock.Block, updateBatchBytes)
 	}
 
+	// Store the signature of the block results by the Fabric machine, so that auditors can check
+	// that validation flags come from it.
+	if fmapi.IsEnabled() {
+		if err := fmapi.AddResultAttestation(block); err != nil {
+			return err
+		}
+	}
+
 	// create go routines for ledger and statedb write if enabled
 	if commitOpts.LedgerStateDBParallelCommit {
 		go func() {
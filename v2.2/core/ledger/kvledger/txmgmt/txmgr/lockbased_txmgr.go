@@ -132,6 +132,7 @@ func NewLockBasedTxMgr(initializer *Initializer) (*LockBasedTxMgr, error) {
 		initializer.DB,
 		initializer.CustomTxProcessors,
 		initializer.HashFunc)
+	txmgr.commitBatchPreparer.SetLedgerID(initializer.LedgerID)
 
 	if err = validation.InitFabricMachine(); err != nil {
 		return nil, err
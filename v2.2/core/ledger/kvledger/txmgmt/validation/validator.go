@@ -42,6 +42,15 @@ func CloseFabricMachine() {
 type validator struct {
 	db       *privacyenabledstate.DB
 	hashFunc rwsetutil.HashFunc
+
+	// Ledger whose TX IDs confirm the duplicate TX IDs reported by the Fabric machine.
+	ledgerID string
+}
+
+// SetLedgerID sets the ledger whose TX IDs confirm the duplicate TX IDs reported by the Fabric
+// machine.
+func (p *CommitBatchPreparer) SetLedgerID(ledgerID string) {
+	p.validator.ledgerID = ledgerID
 }
 
 // preLoadCommittedVersionOfRSet loads committed version of all keys in each
@@ -107,9 +116,9 @@ func (v *validator) validateAndPrepareBatch(blk *block, doMVCCValidation bool) (
 	updates := newPubAndHashUpdates()
 
 	// Skip mvcc when hardware is used since its handled in hardware.
-	// Note that a few initial blocks (e.g. block0 is the genesis block) are not handled in hardware,
-	// hence are always processed here.
-	if blk.num < hwStartingBlock || !hwEnabled {
+	// Note that a few initial blocks (e.g. block0 is the genesis block) and config blocks are not
+	// handled in hardware, hence are always processed here.
+	if blk.num < hwStartingBlock || !hwEnabled || fmapi.IsSoftwareBlock(blk.num) {
 		// Check whether statedb implements BulkOptimizable interface. For now,
 		// only CouchDB implements BulkOptimizable to reduce the number of REST
 		// API calls from peer to CouchDB instance.
@@ -151,16 +160,81 @@ func (v *validator) validateAndPrepareBatch(blk *block, doMVCCValidation bool) (
 			return nil, errors.Errorf(`Block [%d] is invalid`, blk.num)
 		}
 
+		// Results of another block, e.g. after dropped or reordered packets, must not be
+		// committed. When configured, the txs validated by hardware are invalidated instead of
+		// failing the commit.
+		resultAccepted, err := fmapi.AcceptBlockResult(fmBlock)
+		if err != nil {
+			return nil, err
+		}
+
+		// Txs already marked as invalid by the software stack (e.g. by endorsement policies
+		// evaluated in software) are not part of blk.txs, so hardware results are looked up by
+		// the index of the tx in the block.
+		//
+		// Txs that hardware does not support are validated here in block order, against the
+		// statedb and the writes of the preceding valid txs. Since hardware does not see their
+		// writes, txs that hardware found valid are checked against them as well: against the
+		// whole statedb when it is kept up to date in software, and against the writes of the
+		// current block otherwise.
+		//
+		// Hardware only tells whether a tx is valid, and whether its TX ID is a duplicate. It
+		// reports any invalid tx as an MVCC conflict, possibly because of a key that only a tx
+		// validated in software wrote, so such txs are validated again entirely in software when
+		// the statedb is kept up to date in software.
+		softwareTxs := fmapi.TakeSoftwareValidated(blk.num)
+		revalidate := fmapi.TakeTxRevalidator(blk.num)
+		swStateDbEnabled := fmapi.IsSwStateDbEnabled()
 		fmTxsProcessed := make([]bool, fmBlock.NumTxs)
-		for i, tx := range blk.txs {
-			validationCode := fmBlock.TxsVldFlags.Flag(i)
-			fmTxsProcessed[i] = true
+		for _, tx := range blk.txs {
+			if resultAccepted {
+				if tx.indexInBlock >= int(fmBlock.NumTxs) {
+					return nil, errors.Errorf("Block [%d] tx%d missing in hardware result with %d transaction(s)", blk.num, tx.indexInBlock, fmBlock.NumTxs)
+				}
+				fmTxsProcessed[tx.indexInBlock] = true
+			}
+
+			var validationCode peer.TxValidationCode
+			if softwareTxs[tx.indexInBlock] {
+				if !swStateDbEnabled {
+					logger.Warningf("Block [%d] tx%d cannot be validated in software without hardware.swStateDbEnabled", blk.num, tx.indexInBlock)
+					validationCode = peer.TxValidationCode_INVALID_OTHER_REASON
+				} else if validationCode, err = v.validateEndorserTX(tx.rwset, doMVCCValidation, updates); err != nil {
+					return nil, err
+				}
+			} else if !resultAccepted {
+				validationCode = peer.TxValidationCode_INVALID_OTHER_REASON
+			} else {
+				validationCode = fmBlock.TxsVldFlags.Flag(tx.indexInBlock)
+				if validationCode == peer.TxValidationCode_DUPLICATE_TXID {
+					if validationCode, err = v.confirmDuplicateTxID(blk.num, tx, doMVCCValidation, updates); err != nil {
+						return nil, err
+					}
+				} else if validationCode == peer.TxValidationCode_VALID && swStateDbEnabled {
+					if validationCode, err = v.validateEndorserTX(tx.rwset, doMVCCValidation, updates); err != nil {
+						return nil, err
+					}
+				} else if validationCode == peer.TxValidationCode_VALID && readsBlockUpdates(tx.rwset, updates) {
+					validationCode = peer.TxValidationCode_MVCC_READ_CONFLICT
+				} else if validationCode == peer.TxValidationCode_VALID && rangeQueriesBlockUpdates(tx.rwset, updates) {
+					validationCode = peer.TxValidationCode_PHANTOM_READ_CONFLICT
+				} else if validationCode == peer.TxValidationCode_MVCC_READ_CONFLICT && swStateDbEnabled {
+					if validationCode, err = v.revalidateTx(blk.num, tx, revalidate, doMVCCValidation, updates); err != nil {
+						return nil, err
+					}
+				}
+			}
 
 			tx.validationCode = validationCode
 			if validationCode == peer.TxValidationCode_VALID {
 				// logger.Infof("Block [%d] Transaction index [%d] TxId [%s] marked as valid by state validator", blk.num, tx.indexInBlock, tx.id)
 				committingTxHeight := version.NewHeight(blk.num, uint64(tx.indexInBlock))
-				updates.applyWriteSet(tx.rwset, committingTxHeight, v.db, tx.containsPostOrderWrites)
+				// Hashed writes to private data collections are applied along with the public
+				// writes, so that the hash state stays consistent with the private data committed
+				// for the valid txs.
+				if err := updates.applyWriteSet(tx.rwset, committingTxHeight, v.db, tx.containsPostOrderWrites); err != nil {
+					return nil, err
+				}
 			} else {
 				// logger.Warningf("Block [%d] Transaction index [%d] TxId [%s] marked as invalid by state validator. Reason code [%s]", blk.num, tx.indexInBlock, tx.id, validationCode.String())
 			}
@@ -168,9 +242,11 @@ func (v *validator) validateAndPrepareBatch(blk *block, doMVCCValidation bool) (
 
 		// This is just a check to ensure that hardware doesn't mark a tx valid which has already
 		// been marked as invalid by the software stack (e.g. during proto unmarshalling).
-		for i, tp := range fmTxsProcessed {
-			if !tp && fmBlock.TxsVldFlags.Flag(i) == peer.TxValidationCode_VALID {
-				logger.Warningf("Block [%d] tx%d invalid in software but valid in hardware", fmBlock.Num, i)
+		if resultAccepted {
+			for i, tp := range fmTxsProcessed {
+				if !tp && fmBlock.TxsVldFlags.Flag(i) == peer.TxValidationCode_VALID {
+					logger.Warningf("Block [%d] tx%d invalid in software but valid in hardware", fmBlock.Num, i)
+				}
 			}
 		}
 		logger.Infof("Hardware committed block [%d] with %d transaction(s) in %dus", fmBlock.Num, fmBlock.NumTxs, fmBlock.Latency/time.Microsecond)
@@ -178,6 +254,78 @@ func (v *validator) validateAndPrepareBatch(blk *block, doMVCCValidation bool) (
 	return updates, nil
 }
 
+// confirmDuplicateTxID looks up the TX ID of a tx that hardware found to be a duplicate in the
+// ledger, since hardware may report TX IDs that are not in the ledger as duplicates. Such a tx is
+// validated in software like the txs that hardware does not support, or invalidated when the
+// statedb is not kept up to date in software.
+func (v *validator) confirmDuplicateTxID(blockNum uint64, tx *transaction, doMVCCValidation bool, updates *publicAndHashUpdates) (peer.TxValidationCode, error) {
+	exists, err := fmapi.TxIdExists(v.ledgerID, tx.id)
+	if err != nil {
+		return peer.TxValidationCode(-1), err
+	}
+	if exists {
+		return peer.TxValidationCode_DUPLICATE_TXID, nil
+	}
+	logger.Errorf("Block [%d] tx%d reported as duplicate by hardware but TX ID [%s] is not in the ledger", blockNum, tx.indexInBlock, tx.id)
+	if !fmapi.IsSwStateDbEnabled() {
+		return peer.TxValidationCode_INVALID_OTHER_REASON, nil
+	}
+	return v.validateEndorserTX(tx.rwset, doMVCCValidation, updates)
+}
+
+// revalidateTx validates a tx that hardware found invalid entirely in software: through the
+// committer up to its endorsement policy, then against the statedb. The hardware result stands
+// when the committer did not validate the block, e.g. when it is recommitted.
+func (v *validator) revalidateTx(blockNum uint64, tx *transaction, revalidate fmapi.TxRevalidator, doMVCCValidation bool, updates *publicAndHashUpdates) (peer.TxValidationCode, error) {
+	if revalidate == nil {
+		logger.Warningf("Block [%d] tx%d cannot be validated again in software", blockNum, tx.indexInBlock)
+		return peer.TxValidationCode_MVCC_READ_CONFLICT, nil
+	}
+	validationCode, err := revalidate(tx.indexInBlock)
+	if err != nil {
+		return peer.TxValidationCode(-1), err
+	}
+	if validationCode != peer.TxValidationCode_VALID {
+		return validationCode, nil
+	}
+	return v.validateEndorserTX(tx.rwset, doMVCCValidation, updates)
+}
+
+// readsBlockUpdates returns true when a tx reads a key, or the hash of a private data key, written
+// by a preceding valid tx of the same block.
+func readsBlockUpdates(txRWSet *rwsetutil.TxRwSet, updates *publicAndHashUpdates) bool {
+	for _, nsRWSet := range txRWSet.NsRwSets {
+		for _, kvRead := range nsRWSet.KvRwSet.Reads {
+			if updates.publicUpdates.Exists(nsRWSet.NameSpace, kvRead.Key) {
+				return true
+			}
+		}
+		for _, collHashedRWSet := range nsRWSet.CollHashedRwSets {
+			for _, kvReadHash := range collHashedRWSet.HashedRwSet.HashedReads {
+				if updates.hashUpdates.Contains(nsRWSet.NameSpace, collHashedRWSet.CollectionName, kvReadHash.KeyHash) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// rangeQueriesBlockUpdates returns true when a range query of a tx covers a key written by a
+// preceding valid tx of the same block.
+func rangeQueriesBlockUpdates(txRWSet *rwsetutil.TxRwSet, updates *publicAndHashUpdates) bool {
+	for _, nsRWSet := range txRWSet.NsRwSets {
+		for _, rqi := range nsRWSet.KvRwSet.RangeQueriesInfo {
+			for key := range updates.publicUpdates.GetUpdates(nsRWSet.NameSpace) {
+				if key >= rqi.StartKey && (rqi.EndKey == "" || key < rqi.EndKey || (!rqi.ItrExhausted && key == rqi.EndKey)) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 // validateEndorserTX validates endorser transaction
 func (v *validator) validateEndorserTX(
 	txRWSet *rwsetutil.TxRwSet,
@@ -29,24 +29,43 @@ type BlockData struct {
 	Valid       bool
 	TxsVldFlags txflags.ValidationFlags
 	Latency     time.Duration
+
+	// First 64 bits of the block data hash computed by the Fabric machine, 0 when neither the
+	// result data hash check nor result signatures are enabled.
+	DataHash uint64
+
+	// Signature of the block results by the Fabric machine, nil when result signatures are
+	// disabled.
+	Attestation *ResultAttestation
 }
 
 // NewFabricMachine returns a Fabric machine instance.
 // It resets the Fabric machine to ensure a consistent initial state.
 func NewFabricMachine(pcieResourceFile string) (*FabricMachine, error) {
 	logger.Infof("Initializing Fabric machine with %s ...", pcieResourceFile)
-	regmap, err := NewRegMap(pcieResourceFile)
+	fm, err := OpenFabricMachine(pcieResourceFile)
 	if err != nil {
 		return nil, err
 	}
 
 	if ResetFpgaCard() {
-		regmap.resetSystem()
+		fm.regmap.resetSystem()
+		InvalidateTxIdIndex()
 		logger.Info("Fabric machine has been reset.")
 	}
-	regmap.readSysVersion()
-	logger.Infof("OpenNIC build version: 0x%x Fabric machine build version: 0x%x\n", regmap.shellVersion, regmap.fmVersion)
+	fm.regmap.readSysVersion()
+	logger.Infof("OpenNIC build version: 0x%x Fabric machine build version: 0x%x\n", fm.regmap.shellVersion, fm.regmap.fmVersion)
 
+	return fm, nil
+}
+
+// OpenFabricMachine returns a Fabric machine instance without resetting it, for inspecting a
+// Fabric machine that a peer is using.
+func OpenFabricMachine(pcieResourceFile string) (*FabricMachine, error) {
+	regmap, err := NewRegMap(pcieResourceFile)
+	if err != nil {
+		return nil, err
+	}
 	return &FabricMachine{regmap}, nil
 }
 
@@ -58,10 +77,13 @@ func (fm *FabricMachine) Close() error {
 func (fm *FabricMachine) getBlockTxsVldFlags() txflags.ValidationFlags {
 	numTxs := int(fm.regmap.getBlockNumTxs())
 	fmVldFlags := fm.regmap.getBlockTxsVldFlags()
+	fmDupFlags := fm.regmap.getBlockTxsDupFlags()
 	vldFlags := txflags.NewWithValues(numTxs, peer.TxValidationCode_VALID)
 
 	for i := 0; i < numTxs; i++ {
-		if fmVldFlags[i] == 0 {
+		if fmVldFlags[i] == 0 && fmDupFlags[i] == 1 {
+			vldFlags.SetFlag(i, peer.TxValidationCode_DUPLICATE_TXID)
+		} else if fmVldFlags[i] == 0 {
 			// For now, we use mvcc as the reason for every invalid transction. In future, the
 			// hardware should be updated to also report the reason for invalid transactions.
 			// vldFlags.SetFlag(i, peer.TxValidationCode_INVALID_OTHER_REASON)
@@ -100,18 +122,103 @@ func (fm *FabricMachine) GetBlockData(blockNum uint64, numTries int) (*BlockData
 			return &BlockData{Num: bn}, fmt.Errorf("Expected block %d but Fabric machine has block %d", blockNum, bn)
 		}
 
-		// Now, we have the expected block. Let's read all of its data.
-		if err := rm.readResRegs(0, kNumResRegs); err != nil {
+		// Now, we have the expected block.
+		logger.Infof("Got block %d ...", bn)
+		return fm.ReadResultWindow()
+	}
+}
+
+// ReadResultWindow reads and decodes all the block data related registers, whichever block they
+// hold. Reading them releases the next block, so it must not be called while a peer is reading
+// blocks from the Fabric machine.
+func (fm *FabricMachine) ReadResultWindow() (*BlockData, error) {
+	rm := fm.regmap
+
+	// The duplicate TX ID flags and the block data hash are read first since reading all the
+	// block data related registers releases the next block.
+	if GetTxIdIndexBits() > 0 {
+		if err := rm.readTxIdDupRegs(); err != nil {
 			return nil, err
 		}
-		logger.Infof("Got block %d ...", bn)
+	}
+	if readsResultDataHash() {
+		if err := rm.readResHashRegs(); err != nil {
+			return nil, err
+		}
+	}
+	if IsResultSignatureEnabled() {
+		if err := rm.readResSigRegs(); err != nil {
+			return nil, err
+		}
+	}
+	if err := rm.readResRegs(0, kNumResRegs); err != nil {
+		return nil, err
+	}
+
+	data := &BlockData{
+		Num:         rm.getBlockNum(),
+		NumTxs:      rm.getBlockNumTxs(),
+		Valid:       rm.isBlockValid(),
+		TxsVldFlags: fm.getBlockTxsVldFlags(),
+		Latency:     rm.getBlockLatency(),
+	}
+	if readsResultDataHash() {
+		data.DataHash = rm.getBlockDataHash()
+	}
+	if IsResultSignatureEnabled() {
+		algorithm := GetResultSignatureAlgorithm()
+		keyId, signature := rm.getBlockSignature(resultSignatureSize(algorithm))
+		data.Attestation = &ResultAttestation{
+			Algorithm:  algorithm,
+			KeyId:      keyId,
+			BlockNum:   data.Num,
+			NumTxs:     data.NumTxs,
+			DataHash:   data.DataHash,
+			ValidFlags: rm.getBlockTxsVldBitmap(),
+			Signature:  signature,
+		}
+	}
+	return data, nil
+}
+
+// PeekResultWindow returns the number, number of txs and validity of the block in the block data
+// related registers, without releasing the next block.
+func (fm *FabricMachine) PeekResultWindow() (*BlockData, error) {
+	rm := fm.regmap
+	if err := rm.readResRegs(kNumResRegs-3, kNumResRegs); err != nil {
+		return nil, err
+	}
+	return &BlockData{
+		Num:    rm.getBlockNum(),
+		NumTxs: rm.getBlockNumTxs(),
+		Valid:  rm.isBlockValid(),
+	}, nil
+}
 
-		return &BlockData{
-			Num:         rm.getBlockNum(),
-			NumTxs:      rm.getBlockNumTxs(),
-			Valid:       rm.isBlockValid(),
-			TxsVldFlags: fm.getBlockTxsVldFlags(),
-			Latency:     rm.getBlockLatency(),
-		}, nil
+// ResultRegisters returns the block data related registers last read, most significant first.
+func (fm *FabricMachine) ResultRegisters() string {
+	return fm.regmap.getResRegsAsString()
+}
+
+// Versions returns the OpenNIC shell and Fabric machine build versions.
+func (fm *FabricMachine) Versions() (shellVersion uint32, fmVersion uint32, err error) {
+	if err := fm.regmap.readSysVersion(); err != nil {
+		return 0, 0, err
 	}
+	return fm.regmap.shellVersion, fm.regmap.fmVersion, nil
+}
+
+// Reset resets the user logic of the Fabric machine.
+func (fm *FabricMachine) Reset() error {
+	return fm.regmap.resetSystem()
+}
+
+// ReadRegister reads the register at offset in the PCIe resource.
+func (fm *FabricMachine) ReadRegister(offset uint32) (uint32, error) {
+	return fm.regmap.pcie.ReadAt(offset)
+}
+
+// WriteRegister writes the register at offset in the PCIe resource.
+func (fm *FabricMachine) WriteRegister(offset uint32, value uint32) error {
+	return fm.regmap.pcie.WriteAt(offset, value)
 }
@@ -0,0 +1,338 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// attestation.go implements the signatures of block results computed by the Fabric machine with
+// its device key, and the block metadata entry where peers store them.
+package fmapi
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+)
+
+// Result signature algorithms
+const (
+	ResultSignatureNone       = "none"
+	ResultSignatureHmacSha256 = "hmac-sha256"
+	ResultSignatureEd25519    = "ed25519"
+)
+
+// BlockMetadataIndexResultAttestation is the index of the block metadata entry holding the
+// attestation of the block results, after the entries defined by Fabric.
+const BlockMetadataIndexResultAttestation = common.BlockMetadataIndex_COMMIT_HASH + 1
+
+// Size of the validation flags bitmap, one bit per tx.
+const kResultFlagsSize = kBlockMaxTxs / 8
+
+// Signed messages start with this prefix, so that a device key never signs anything else that
+// could be taken for a block result.
+var resultMessagePrefix = []byte("FMRESULT")
+
+// Encoded attestations start with a version byte, followed by the algorithm (1B), key id (1B),
+// block number (8B), number of txs (4B), data hash (8B), flags bitmap and signature.
+const (
+	kAttestationVersion    = 1
+	kAttestationHeaderSize = 1 + 1 + 1 + 8 + 4 + 8 + kResultFlagsSize
+)
+
+var resultSignatureCodes = map[string]uint8{
+	ResultSignatureHmacSha256: 1,
+	ResultSignatureEd25519:    2,
+}
+
+// ResultAttestation is the signature by the Fabric machine of the results of a block.
+type ResultAttestation struct {
+	Algorithm string
+	KeyId     uint8
+	BlockNum  uint64
+	NumTxs    uint32
+	DataHash  uint64
+
+	// Validation flags computed by the Fabric machine, bit i%8 of byte i/8 set when tx i is
+	// valid. They do not account for the txs validated in software by the peer.
+	ValidFlags []byte
+
+	Signature []byte
+}
+
+// Message returns the message signed by the Fabric machine.
+func (a *ResultAttestation) Message() []byte {
+	msg := make([]byte, 0, len(resultMessagePrefix)+8+4+8+kResultFlagsSize)
+	msg = append(msg, resultMessagePrefix...)
+	msg = appendUint64(msg, a.BlockNum)
+	msg = appendUint32(msg, a.NumTxs)
+	msg = appendUint64(msg, a.DataHash)
+	flags := make([]byte, kResultFlagsSize)
+	copy(flags, a.ValidFlags)
+	return append(msg, flags...)
+}
+
+// IsValid returns true when the Fabric machine found tx valid.
+func (a *ResultAttestation) IsValid(tx int) bool {
+	return tx/8 < len(a.ValidFlags) && a.ValidFlags[tx/8]&(1<<uint(tx%8)) != 0
+}
+
+// Verify checks the signature with the key of the attestation among keys, indexed by key id.
+// Keys are the device keys for HMAC-SHA256, and the public keys of the devices for Ed25519.
+func (a *ResultAttestation) Verify(keys map[uint8][]byte) error {
+	key, ok := keys[a.KeyId]
+	if !ok {
+		return fmt.Errorf("Unknown result signature key %d", a.KeyId)
+	}
+	switch a.Algorithm {
+	case ResultSignatureHmacSha256:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(a.Message())
+		if subtle.ConstantTimeCompare(mac.Sum(nil), a.Signature) != 1 {
+			return fmt.Errorf("Invalid result signature of block [%d]", a.BlockNum)
+		}
+	case ResultSignatureEd25519:
+		if len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("Result signature key %d is not an Ed25519 public key", a.KeyId)
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key), a.Message(), a.Signature) {
+			return fmt.Errorf("Invalid result signature of block [%d]", a.BlockNum)
+		}
+	default:
+		return fmt.Errorf("Unknown result signature algorithm %s", a.Algorithm)
+	}
+	return nil
+}
+
+// Marshal encodes the attestation as stored in block metadata.
+func (a *ResultAttestation) Marshal() []byte {
+	data := make([]byte, 0, kAttestationHeaderSize+len(a.Signature))
+	data = append(data, kAttestationVersion, resultSignatureCodes[a.Algorithm], a.KeyId)
+	data = appendUint64(data, a.BlockNum)
+	data = appendUint32(data, a.NumTxs)
+	data = appendUint64(data, a.DataHash)
+	flags := make([]byte, kResultFlagsSize)
+	copy(flags, a.ValidFlags)
+	data = append(data, flags...)
+	return append(data, a.Signature...)
+}
+
+// UnmarshalResultAttestation decodes an attestation encoded by Marshal.
+func UnmarshalResultAttestation(data []byte) (*ResultAttestation, error) {
+	if len(data) < kAttestationHeaderSize {
+		return nil, fmt.Errorf("Result attestation too short: %d bytes", len(data))
+	}
+	if data[0] != kAttestationVersion {
+		return nil, fmt.Errorf("Unknown result attestation version %d", data[0])
+	}
+	a := &ResultAttestation{KeyId: data[2]}
+	for algorithm, code := range resultSignatureCodes {
+		if code == data[1] {
+			a.Algorithm = algorithm
+		}
+	}
+	if a.Algorithm == "" {
+		return nil, fmt.Errorf("Unknown result signature algorithm %d", data[1])
+	}
+	a.BlockNum = binary.BigEndian.Uint64(data[3:11])
+	a.NumTxs = binary.BigEndian.Uint32(data[11:15])
+	a.DataHash = binary.BigEndian.Uint64(data[15:23])
+	a.ValidFlags = append([]byte(nil), data[23:kAttestationHeaderSize]...)
+	a.Signature = append([]byte(nil), data[kAttestationHeaderSize:]...)
+	return a, nil
+}
+
+// GetResultAttestation returns the attestation stored in the metadata of a block, nil when the
+// block has none.
+func GetResultAttestation(block *common.Block) (*ResultAttestation, error) {
+	if block.Metadata == nil || len(block.Metadata.Metadata) <= int(BlockMetadataIndexResultAttestation) {
+		return nil, nil
+	}
+	entry := block.Metadata.Metadata[BlockMetadataIndexResultAttestation]
+	if len(entry) == 0 {
+		return nil, nil
+	}
+	metadata := &common.Metadata{}
+	if err := proto.Unmarshal(entry, metadata); err != nil {
+		return nil, fmt.Errorf("Cannot unmarshal result attestation metadata of block [%d]: %v", block.Header.Number, err)
+	}
+	return UnmarshalResultAttestation(metadata.Value)
+}
+
+// resultSignatureSize returns the size of the signatures of an algorithm.
+func resultSignatureSize(algorithm string) int {
+	if algorithm == ResultSignatureEd25519 {
+		return ed25519.SignatureSize
+	}
+	return sha256.Size
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// ResultKeyFile is the format of the result signature key file.
+type ResultKeyFile struct {
+	Keys []ResultKey `json:"keys"`
+}
+
+type ResultKey struct {
+	Id  uint8  `json:"id"`
+	Key string `json:"key"` // hex
+}
+
+// ReadResultKeyFile reads the keys of a result signature key file, indexed by key id.
+func ReadResultKeyFile(path string) (map[uint8][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file ResultKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("Cannot parse result signature key file %s: %v", path, err)
+	}
+	keys := make(map[uint8][]byte)
+	for _, k := range file.Keys {
+		if _, prs := keys[k.Id]; prs {
+			return nil, fmt.Errorf("Duplicate result signature key %d in %s", k.Id, path)
+		}
+		key, err := hex.DecodeString(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid result signature key %d in %s: %v", k.Id, path, err)
+		}
+		keys[k.Id] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No result signature key in %s", path)
+	}
+	return keys, nil
+}
+
+// Keys used to verify result signatures. Keys are rotated by provisioning the Fabric machine with
+// a key with a new id, after adding the key to the key file: the file is read again when it has
+// changed.
+var resultKeys struct {
+	sync.Mutex
+	keys    map[uint8][]byte
+	modTime time.Time
+}
+
+// getResultKeys returns the keys of the configured key file.
+func getResultKeys() (map[uint8][]byte, error) {
+	resultKeys.Lock()
+	defer resultKeys.Unlock()
+
+	path := GetResultSignatureKeyFile()
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if resultKeys.keys != nil && info.ModTime().Equal(resultKeys.modTime) {
+		return resultKeys.keys, nil
+	}
+	keys, err := ReadResultKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	resultKeys.keys = keys
+	resultKeys.modTime = info.ModTime()
+	return keys, nil
+}
+
+// IsResultSignatureEnabled returns true when the Fabric machine signs block results.
+func IsResultSignatureEnabled() bool {
+	algorithm := GetResultSignatureAlgorithm()
+	return algorithm != "" && algorithm != ResultSignatureNone
+}
+
+// Verified attestations of the blocks being committed, keyed by block number, until they are added
+// to the metadata of their block. Blocks whose hardware results are not committed have a nil
+// attestation.
+var attestations = struct {
+	sync.Mutex
+	blocks map[uint64]*ResultAttestation
+}{blocks: make(map[uint64]*ResultAttestation)}
+
+// verifyResultAttestation verifies the attestation of the results of a block, and keeps it until
+// it is added to the metadata of the block.
+func verifyResultAttestation(data *BlockData) error {
+	a := data.Attestation
+	if a == nil {
+		return fmt.Errorf("Block [%d] hardware result is not signed", data.Num)
+	}
+	if a.Algorithm != GetResultSignatureAlgorithm() {
+		return fmt.Errorf("Block [%d] hardware result signed with %s instead of %s", data.Num, a.Algorithm, GetResultSignatureAlgorithm())
+	}
+	keys, err := getResultKeys()
+	if err != nil {
+		return fmt.Errorf("Cannot read result signature keys: %v", err)
+	}
+	if err := a.Verify(keys); err != nil {
+		return err
+	}
+
+	attestations.Lock()
+	defer attestations.Unlock()
+	attestations.blocks[data.Num] = a
+	return nil
+}
+
+// SkipResultAttestation records that the hardware results of a block are not committed, its txs
+// validated by hardware being invalidated instead, so that the block is committed without
+// attestation.
+func SkipResultAttestation(blockNum uint64) {
+	attestations.Lock()
+	defer attestations.Unlock()
+	attestations.blocks[blockNum] = nil
+}
+
+// AddResultAttestation adds the verified attestation of the results of a block to its metadata,
+// and forgets about the attestations of the block and earlier ones. It fails when result
+// signatures are enabled and the block has no verified attestation, unless the block is validated
+// in software or its hardware results are not committed.
+func AddResultAttestation(block *common.Block) error {
+	num := block.Header.Number
+	attestations.Lock()
+	a, prs := attestations.blocks[num]
+	for n := range attestations.blocks {
+		if n <= num {
+			delete(attestations.blocks, n)
+		}
+	}
+	attestations.Unlock()
+	if a == nil {
+		if IsResultSignatureEnabled() && !prs && num >= GetStartingBlock() && !IsSoftwareBlock(num) {
+			return fmt.Errorf("Block [%d] hardware result has no verified signature", num)
+		}
+		return nil
+	}
+
+	entry, err := proto.Marshal(&common.Metadata{Value: a.Marshal()})
+	if err != nil {
+		return err
+	}
+	for len(block.Metadata.Metadata) <= int(BlockMetadataIndexResultAttestation) {
+		block.Metadata.Metadata = append(block.Metadata.Metadata, nil)
+	}
+	block.Metadata.Metadata[BlockMetadataIndexResultAttestation] = entry
+	return nil
+}
@@ -0,0 +1,153 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmapi
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger/fabric/fabricmachine/testutil"
+)
+
+// initResultSignature enables Ed25519 result signatures with a new key, and returns its private
+// key.
+func initResultSignature(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(&ResultKeyFile{Keys: []ResultKey{{Id: 1, Key: hex.EncodeToString(public)}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "result_keys.pub")
+	if err := ioutil.WriteFile(keyFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fmConfig.resultSignatureAlgorithm = ResultSignatureEd25519
+	fmConfig.resultSignatureKeyFile = keyFile
+	fmConfig.startingBlock = 2
+	return private
+}
+
+// signedResult returns the results of a block signed with key.
+func signedResult(num uint64, data [][]byte, key ed25519.PrivateKey) *BlockData {
+	result := &BlockData{Num: num, NumTxs: uint32(len(data)), Valid: true, DataHash: BlockDataHash(data)}
+	result.Attestation = &ResultAttestation{
+		Algorithm:  ResultSignatureEd25519,
+		KeyId:      1,
+		BlockNum:   num,
+		NumTxs:     result.NumTxs,
+		DataHash:   result.DataHash,
+		ValidFlags: []byte{0x01},
+	}
+	result.Attestation.Signature = ed25519.Sign(key, result.Attestation.Message())
+	return result
+}
+
+func TestResultAttestation(t *testing.T) {
+	saved := fmConfig
+	defer func() { fmConfig = saved }()
+	key := initResultSignature(t)
+
+	env := testutil.NewEnvelope(&testutil.Tx{TxId: "tx", Chaincode: "mycc", Args: []string{"put"}})
+	orderer := testutil.Identity("OrdererMSP", testutil.NewCertificate("orderer"))
+	block := testutil.NewBlock(5, orderer, env)
+	SetExpectedResult(5, block.Data.Data)
+	if err := CheckBlockResult(signedResult(5, block.Data.Data, key)); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddResultAttestation(block); err != nil {
+		t.Fatal(err)
+	}
+	a, err := GetResultAttestation(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == nil || a.BlockNum != 5 || !a.IsValid(0) {
+		t.Fatalf("attestation %+v stored for block 5", a)
+	}
+	keys, err := ReadResultKeyFile(fmConfig.resultSignatureKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify(keys); err != nil {
+		t.Errorf("stored attestation does not verify: %s", err)
+	}
+	a.ValidFlags[0] = 0
+	if err := a.Verify(keys); err == nil {
+		t.Error("attestation with tampered validation flags verifies")
+	}
+}
+
+func TestResultAttestationForged(t *testing.T) {
+	saved := fmConfig
+	defer func() { fmConfig = saved }()
+	initResultSignature(t)
+	_, forger, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := testutil.NewBlock(5, nil, testutil.NewEnvelope(&testutil.Tx{TxId: "tx", Chaincode: "mycc"}))
+	SetExpectedResult(5, block.Data.Data)
+	if err := CheckBlockResult(signedResult(5, block.Data.Data, forger)); err == nil {
+		t.Fatal("result signed with another key accepted")
+	}
+	if err := AddResultAttestation(block); err == nil {
+		t.Error("block committed without verified result signature")
+	}
+}
+
+func TestResultAttestationMissing(t *testing.T) {
+	saved := fmConfig
+	defer func() { fmConfig = saved }()
+	initResultSignature(t)
+
+	// Results of the hardware block have not been verified.
+	block := testutil.NewBlock(6, nil)
+	SetExpectedResult(6, nil)
+	if err := AddResultAttestation(block); err == nil {
+		t.Error("block committed without result signature")
+	}
+
+	// Blocks validated in software have no result signature.
+	block = testutil.NewBlock(7, nil)
+	SetSoftwareBlock(7)
+	if err := AddResultAttestation(block); err != nil {
+		t.Errorf("software block: %s", err)
+	}
+	block = testutil.NewBlock(1, nil)
+	if err := AddResultAttestation(block); err != nil {
+		t.Errorf("block before the starting block: %s", err)
+	}
+
+	// Neither do blocks whose txs validated by hardware are invalidated.
+	block = testutil.NewBlock(8, nil)
+	SetExpectedResult(8, nil)
+	SkipResultAttestation(8)
+	if err := AddResultAttestation(block); err != nil {
+		t.Errorf("block with invalidated hardware results: %s", err)
+	}
+	if a, _ := GetResultAttestation(block); a != nil {
+		t.Error("attestation stored for block with invalidated hardware results")
+	}
+
+	// Nothing is required without result signatures.
+	fmConfig.resultSignatureAlgorithm = ResultSignatureNone
+	block = testutil.NewBlock(9, nil)
+	SetExpectedResult(9, nil)
+	if err := AddResultAttestation(block); err != nil {
+		t.Errorf("result signatures disabled: %s", err)
+	}
+}
@@ -9,11 +9,26 @@ package fmapi
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
+// ChaincodeConfig describes how the transactions of a chaincode are validated.
+type ChaincodeConfig struct {
+	Name   string `mapstructure:"name"`
+	Policy string `mapstructure:"policy"`
+
+	// Either hardware or software, defaults to hardware.protocol.chaincodeValidation.
+	Validation string `mapstructure:"validation"`
+
+	// Functions that do not write to the ledger.
+	ReadOnlyFunctions []string `mapstructure:"readOnlyFunctions"`
+}
+
 type FabricMachineConfig struct {
 	configFile   string
 	configReader *viper.Viper
@@ -25,11 +40,98 @@ type FabricMachineConfig struct {
 	orderers      []string
 	startingBlock uint64
 
+	certificateCacheFile  string
+	certificateMiss       string
+	certificateAckTimeout time.Duration
+
+	endorsementPolicyFile    string
+	chaincodePolicyFile      string
+	annotationDescriptorFile string
+
+	transportType            string
+	transportSourceInterface string
+	transportDscp            int
+
+	sendBatchSize          int
+	pacingBytesPerSecond   int
+	pacingPacketsPerSecond int
+
+	authenticationAlgorithm   string
+	authenticationKeyFile     string
+	authenticationSessionFile string
+
+	captureFile string
+
+	certificateCacheSize  int
+	certificateIdRoleBits int
+	certificateIdOrgBits  int
+	maxIdentitySize       int
+	maxEndorsers          int
+	maxTransactionSize    int
+	maxRangeQueries       int
+	maxCollections        int
+	txIdIndexBits         int
+
 	swStateDbEnabled bool
+
+	resultDataHashEnabled bool
+	resultMismatchAction  string
+
+	resultSignatureAlgorithm string
+	resultSignatureKeyFile   string
+
+	chaincodeValidation string
+	chaincodes          map[string]ChaincodeConfig
 }
 
 var fmConfig FabricMachineConfig
 
+// setDefaults sets the defaults of the settings that transactions are routed by, which match the
+// sample configuration, so that a config file leaving them out does not route every transaction
+// to software.
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("hardware.protocol.chaincodeValidation", "hardware")
+	v.SetDefault("hardware.protocol.capabilities.certificateCacheSize", 4096)
+	v.SetDefault("hardware.protocol.capabilities.certificateIdRoleBits", 4)
+	v.SetDefault("hardware.protocol.capabilities.certificateIdOrgBits", 4)
+	v.SetDefault("hardware.protocol.capabilities.maxIdentitySize", 2048)
+	v.SetDefault("hardware.protocol.capabilities.maxEndorsers", 8)
+	v.SetDefault("hardware.protocol.capabilities.maxTransactionSize", 65535)
+	v.SetDefault("hardware.swStateDbEnabled", true)
+}
+
+// checkConfig returns an error when transactions are routed to software by configuration although
+// they cannot be validated in software, or when every transaction is.
+func checkConfig() error {
+	if fmConfig.maxEndorsers < 1 {
+		return fmt.Errorf("Invalid hardware.protocol.capabilities.maxEndorsers %d", fmConfig.maxEndorsers)
+	}
+	if fmConfig.maxTransactionSize < 1 {
+		return fmt.Errorf("Invalid hardware.protocol.capabilities.maxTransactionSize %d", fmConfig.maxTransactionSize)
+	}
+	if fmConfig.chaincodeValidation != "hardware" && fmConfig.chaincodeValidation != "software" {
+		return fmt.Errorf("Invalid hardware.protocol.chaincodeValidation %s", fmConfig.chaincodeValidation)
+	}
+	for name, cc := range fmConfig.chaincodes {
+		if cc.Validation != "" && cc.Validation != "hardware" && cc.Validation != "software" {
+			return fmt.Errorf("Invalid validation %s of chaincode %s", cc.Validation, name)
+		}
+	}
+	if fmConfig.swStateDbEnabled {
+		return nil
+	}
+	if fmConfig.chaincodeValidation == "software" {
+		return fmt.Errorf("Transactions validated in software by hardware.protocol.chaincodeValidation need hardware.swStateDbEnabled")
+	}
+	for name, cc := range fmConfig.chaincodes {
+		if cc.Validation == "software" {
+			return fmt.Errorf("Transactions of chaincode %s validated in software need hardware.swStateDbEnabled", name)
+		}
+	}
+	logger.Warning("Transactions that the hardware peer does not support are invalidated without hardware.swStateDbEnabled")
+	return nil
+}
+
 func readConfig() {
 	fmConfig.pcieResourceFile = fmConfig.configReader.GetString("hardware.pcieResourceFile")
 	fmConfig.resetFpgaCard = fmConfig.configReader.GetBool("hardware.resetFpgaCard")
@@ -37,8 +139,48 @@ func readConfig() {
 	fmConfig.address = fmConfig.configReader.GetString("hardware.protocol.address")
 	fmConfig.orderers = fmConfig.configReader.GetStringSlice("hardware.protocol.orderers")
 	fmConfig.startingBlock = uint64(fmConfig.configReader.GetInt("hardware.protocol.startingBlock"))
+	fmConfig.certificateCacheFile = fmConfig.configReader.GetString("hardware.protocol.certificateCacheFile")
+	fmConfig.certificateMiss = fmConfig.configReader.GetString("hardware.protocol.certificateMiss")
+	fmConfig.certificateAckTimeout = fmConfig.configReader.GetDuration("hardware.protocol.certificateAckTimeout")
+	fmConfig.endorsementPolicyFile = fmConfig.configReader.GetString("hardware.protocol.endorsementPolicyFile")
+	fmConfig.chaincodePolicyFile = fmConfig.configReader.GetString("hardware.chaincodePolicyFile")
+	fmConfig.annotationDescriptorFile = fmConfig.configReader.GetString("hardware.protocol.annotationDescriptorFile")
+	fmConfig.transportType = fmConfig.configReader.GetString("hardware.protocol.transport.type")
+	fmConfig.transportSourceInterface = fmConfig.configReader.GetString("hardware.protocol.transport.sourceInterface")
+	fmConfig.transportDscp = fmConfig.configReader.GetInt("hardware.protocol.transport.dscp")
+	fmConfig.sendBatchSize = fmConfig.configReader.GetInt("hardware.protocol.sendBatchSize")
+	fmConfig.pacingBytesPerSecond = fmConfig.configReader.GetInt("hardware.protocol.pacing.bytesPerSecond")
+	fmConfig.pacingPacketsPerSecond = fmConfig.configReader.GetInt("hardware.protocol.pacing.packetsPerSecond")
+	fmConfig.authenticationAlgorithm = fmConfig.configReader.GetString("hardware.protocol.authentication.algorithm")
+	fmConfig.authenticationKeyFile = fmConfig.configReader.GetString("hardware.protocol.authentication.keyFile")
+	fmConfig.authenticationSessionFile = fmConfig.configReader.GetString("hardware.protocol.authentication.sessionFile")
+	fmConfig.captureFile = fmConfig.configReader.GetString("hardware.protocol.captureFile")
+
+	fmConfig.certificateCacheSize = fmConfig.configReader.GetInt("hardware.protocol.capabilities.certificateCacheSize")
+	fmConfig.certificateIdRoleBits = fmConfig.configReader.GetInt("hardware.protocol.capabilities.certificateIdRoleBits")
+	fmConfig.certificateIdOrgBits = fmConfig.configReader.GetInt("hardware.protocol.capabilities.certificateIdOrgBits")
+	fmConfig.maxIdentitySize = fmConfig.configReader.GetInt("hardware.protocol.capabilities.maxIdentitySize")
+	fmConfig.maxEndorsers = fmConfig.configReader.GetInt("hardware.protocol.capabilities.maxEndorsers")
+	fmConfig.maxTransactionSize = fmConfig.configReader.GetInt("hardware.protocol.capabilities.maxTransactionSize")
+	fmConfig.maxRangeQueries = fmConfig.configReader.GetInt("hardware.protocol.capabilities.maxRangeQueries")
+	fmConfig.maxCollections = fmConfig.configReader.GetInt("hardware.protocol.capabilities.maxCollections")
+	fmConfig.txIdIndexBits = fmConfig.configReader.GetInt("hardware.protocol.capabilities.txIdIndexBits")
 
 	fmConfig.swStateDbEnabled = fmConfig.configReader.GetBool("hardware.swStateDbEnabled")
+	fmConfig.resultDataHashEnabled = fmConfig.configReader.GetBool("hardware.resultChecks.dataHash")
+	fmConfig.resultMismatchAction = fmConfig.configReader.GetString("hardware.resultChecks.mismatchAction")
+	fmConfig.resultSignatureAlgorithm = fmConfig.configReader.GetString("hardware.resultChecks.signature.algorithm")
+	fmConfig.resultSignatureKeyFile = fmConfig.configReader.GetString("hardware.resultChecks.signature.keyFile")
+
+	fmConfig.chaincodeValidation = fmConfig.configReader.GetString("hardware.protocol.chaincodeValidation")
+	var chaincodes []ChaincodeConfig
+	if err := fmConfig.configReader.UnmarshalKey("Chaincodes", &chaincodes); err != nil {
+		logger.Errorf("Cannot read chaincodes config: %s", err)
+	}
+	fmConfig.chaincodes = make(map[string]ChaincodeConfig)
+	for _, cc := range chaincodes {
+		fmConfig.chaincodes[cc.Name] = cc
+	}
 }
 
 func InitConfig(fabricConfigReader *viper.Viper) error {
@@ -74,9 +216,14 @@ func InitConfig(fabricConfigReader *viper.Viper) error {
 		return fmt.Errorf("Could not read config file %v: %v", configFile, err.Error())
 	}
 
+	setDefaults(v)
 	fmConfig.configFile = configFile
 	fmConfig.configReader = v
 	readConfig()
+	if err := checkConfig(); err != nil {
+		fmConfig.configReader = nil
+		return err
+	}
 	logger.Info("Initialized Fabric machine configuration.")
 	return nil
 }
@@ -105,6 +252,163 @@ func GetStartingBlock() uint64 {
 	return fmConfig.startingBlock
 }
 
+func GetCertificateCacheFile() string {
+	return fmConfig.certificateCacheFile
+}
+
+func GetCertificateMiss() string {
+	return fmConfig.certificateMiss
+}
+
+func GetCertificateAckTimeout() time.Duration {
+	return fmConfig.certificateAckTimeout
+}
+
+func GetEndorsementPolicyFile() string {
+	return fmConfig.endorsementPolicyFile
+}
+
+func GetChaincodePolicyFile() string {
+	return fmConfig.chaincodePolicyFile
+}
+
+func GetAnnotationDescriptorFile() string {
+	return fmConfig.annotationDescriptorFile
+}
+
+func GetTransportType() string {
+	return fmConfig.transportType
+}
+
+func GetTransportSourceInterface() string {
+	return fmConfig.transportSourceInterface
+}
+
+func GetTransportDscp() int {
+	return fmConfig.transportDscp
+}
+
+func GetSendBatchSize() int {
+	return fmConfig.sendBatchSize
+}
+
+func GetPacingBytesPerSecond() int {
+	return fmConfig.pacingBytesPerSecond
+}
+
+func GetPacingPacketsPerSecond() int {
+	return fmConfig.pacingPacketsPerSecond
+}
+
+func GetAuthenticationAlgorithm() string {
+	return fmConfig.authenticationAlgorithm
+}
+
+func GetAuthenticationKeyFile() string {
+	return fmConfig.authenticationKeyFile
+}
+
+// GetAuthenticationSessionFile returns the file holding the last session id, which defaults to
+// the key file name followed by .session.
+func GetAuthenticationSessionFile() string {
+	if fmConfig.authenticationSessionFile == "" && fmConfig.authenticationKeyFile != "" {
+		return fmConfig.authenticationKeyFile + ".session"
+	}
+	return fmConfig.authenticationSessionFile
+}
+
+func GetCaptureFile() string {
+	return fmConfig.captureFile
+}
+
+func GetCertificateCacheSize() int {
+	return fmConfig.certificateCacheSize
+}
+
+func GetCertificateIdRoleBits() int {
+	return fmConfig.certificateIdRoleBits
+}
+
+func GetCertificateIdOrgBits() int {
+	return fmConfig.certificateIdOrgBits
+}
+
+func GetMaxIdentitySize() int {
+	return fmConfig.maxIdentitySize
+}
+
+func GetMaxEndorsers() int {
+	return fmConfig.maxEndorsers
+}
+
+func GetMaxTransactionSize() int {
+	return fmConfig.maxTransactionSize
+}
+
+func GetMaxRangeQueries() int {
+	return fmConfig.maxRangeQueries
+}
+
+func GetMaxCollections() int {
+	return fmConfig.maxCollections
+}
+
+func GetTxIdIndexBits() int {
+	return fmConfig.txIdIndexBits
+}
+
 func IsSwStateDbEnabled() bool {
 	return fmConfig.swStateDbEnabled
 }
+
+func IsResultDataHashEnabled() bool {
+	return fmConfig.resultDataHashEnabled
+}
+
+func GetResultMismatchAction() string {
+	return fmConfig.resultMismatchAction
+}
+
+func GetResultSignatureAlgorithm() string {
+	return fmConfig.resultSignatureAlgorithm
+}
+
+func GetResultSignatureKeyFile() string {
+	return fmConfig.resultSignatureKeyFile
+}
+
+// IsSoftwareChaincode returns true when the transactions of a chaincode are configured to be
+// validated in software.
+func IsSoftwareChaincode(name string) bool {
+	validation := fmConfig.chaincodeValidation
+	if cc, prs := fmConfig.chaincodes[name]; prs && cc.Validation != "" {
+		validation = cc.Validation
+	}
+	return validation == "software"
+}
+
+// IsReadOnlyFunction returns true when a function of a chaincode is configured as read-only.
+func IsReadOnlyFunction(chaincode, function string) bool {
+	for _, f := range fmConfig.chaincodes[chaincode].ReadOnlyFunctions {
+		if f == function {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteFile writes data to a file through a temporary file, so that a crash never leaves a
+// partial file behind.
+func WriteFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Cannot create directory for %s: %v", path, err)
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("Cannot write to %s: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("Cannot rename %s to %s: %v", tmpPath, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmapi
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// initConfig initializes the Fabric machine configuration from the given config file content.
+func initConfig(t *testing.T, config string) error {
+	t.Helper()
+	saved := fmConfig
+	t.Cleanup(func() { fmConfig = saved })
+	configFile := filepath.Join(t.TempDir(), "fabric_machine.yaml")
+	if err := ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	v.Set("fabric.hw.config.file", configFile)
+	return InitConfig(v)
+}
+
+func TestConfigDefaults(t *testing.T) {
+	if err := initConfig(t, "hardware:\n  protocol:\n    address: 127.0.0.1:7100\n"); err != nil {
+		t.Fatal(err)
+	}
+	if GetMaxEndorsers() != 8 || GetMaxTransactionSize() != 65535 {
+		t.Errorf("got maxEndorsers %d and maxTransactionSize %d, want 8 and 65535", GetMaxEndorsers(), GetMaxTransactionSize())
+	}
+	if !IsSwStateDbEnabled() {
+		t.Error("software state database disabled by default")
+	}
+	if IsSoftwareChaincode("mycc") {
+		t.Error("chaincode validated in software by default")
+	}
+}
+
+func TestConfigSoftwareValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{
+			name:   "software chaincodes",
+			config: "hardware:\n  protocol:\n    chaincodeValidation: software\n",
+			valid:  true,
+		},
+		{
+			name:   "hardware chaincodes without software state database",
+			config: "hardware:\n  swStateDbEnabled: false\n",
+			valid:  true,
+		},
+		{
+			name:   "software chaincodes without software state database",
+			config: "hardware:\n  swStateDbEnabled: false\n  protocol:\n    chaincodeValidation: software\n",
+		},
+		{
+			name:   "software chaincode without software state database",
+			config: "hardware:\n  swStateDbEnabled: false\nChaincodes:\n  - name: mycc\n    validation: software\n",
+		},
+		{
+			name:   "no endorsement checked in hardware",
+			config: "hardware:\n  protocol:\n    capabilities:\n      maxEndorsers: 0\n",
+		},
+		{
+			name:   "unknown validation",
+			config: "hardware:\n  protocol:\n    chaincodeValidation: fpga\n",
+		},
+	}
+	for _, test := range tests {
+		err := initConfig(t, test.config)
+		if test.valid && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: config accepted", test.name)
+		}
+		if !test.valid && IsEnabled() {
+			t.Errorf("%s: enabled with an invalid config", test.name)
+		}
+	}
+}
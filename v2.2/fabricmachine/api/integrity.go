@@ -0,0 +1,126 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// integrity.go implements the checks of the results read from the Fabric machine against the
+// blocks being committed.
+package fmapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// Actions taken when the results of a block do not match the block.
+const (
+	ResultMismatchHalt       = "halt"
+	ResultMismatchInvalidate = "invalidate"
+)
+
+// expectedResult describes a block being committed
+type expectedResult struct {
+	numTxs   int
+	dataHash uint64
+	software bool // block not sent to the Fabric machine
+}
+
+// Blocks being committed, keyed by block number. The ledger records them before validating their
+// state, where only the transactions not invalidated yet are known.
+var expectedResults = struct {
+	sync.Mutex
+	blocks map[uint64]expectedResult
+}{blocks: make(map[uint64]expectedResult)}
+
+// SetExpectedResult records the number of transactions and the data hash of a block being
+// committed, given its transactions.
+func SetExpectedResult(blockNum uint64, data [][]byte) {
+	result := expectedResult{numTxs: len(data)}
+	if readsResultDataHash() {
+		result.dataHash = BlockDataHash(data)
+	}
+
+	expectedResults.Lock()
+	defer expectedResults.Unlock()
+	expectedResults.blocks[blockNum] = result
+}
+
+// SetSoftwareBlock records that a block being committed is validated in software, since orderers
+// do not send it to the Fabric machine, e.g. a config block.
+func SetSoftwareBlock(blockNum uint64) {
+	expectedResults.Lock()
+	defer expectedResults.Unlock()
+	expectedResults.blocks[blockNum] = expectedResult{software: true}
+}
+
+// IsSoftwareBlock returns true when a block being committed is validated in software.
+func IsSoftwareBlock(blockNum uint64) bool {
+	expectedResults.Lock()
+	defer expectedResults.Unlock()
+	return expectedResults.blocks[blockNum].software
+}
+
+// CheckBlockResult checks that results read from the Fabric machine belong to the block being
+// committed with the same number, and that they are signed by the Fabric machine when result
+// signatures are enabled. It forgets about that block as well as about earlier ones.
+func CheckBlockResult(data *BlockData) error {
+	expectedResults.Lock()
+	expected, prs := expectedResults.blocks[data.Num]
+	for num := range expectedResults.blocks {
+		if num <= data.Num {
+			delete(expectedResults.blocks, num)
+		}
+	}
+	expectedResults.Unlock()
+
+	if !prs {
+		return fmt.Errorf("Block [%d] is not being committed", data.Num)
+	}
+	if expected.software {
+		return fmt.Errorf("Block [%d] is validated in software, not by hardware", data.Num)
+	}
+	if int(data.NumTxs) != expected.numTxs {
+		return fmt.Errorf("Block [%d] has %d transaction(s) but hardware result has %d", data.Num, expected.numTxs, data.NumTxs)
+	}
+	if readsResultDataHash() && data.DataHash != expected.dataHash {
+		return fmt.Errorf("Block [%d] data hash %016x does not match hardware result %016x", data.Num, expected.dataHash, data.DataHash)
+	}
+	if IsResultSignatureEnabled() {
+		return verifyResultAttestation(data)
+	}
+	return nil
+}
+
+// AcceptBlockResult checks results read from the Fabric machine, see CheckBlockResult, and
+// returns true when the validation flags they carry can be committed. Results that do not match
+// the block fail the commit, unless the configured mismatch action is to invalidate the
+// transactions validated by hardware instead, in which case it returns false.
+func AcceptBlockResult(data *BlockData) (bool, error) {
+	err := CheckBlockResult(data)
+	if err == nil {
+		return true, nil
+	}
+	if GetResultMismatchAction() != ResultMismatchInvalidate {
+		return false, err
+	}
+	logger.Errorf("Invalidating txs validated by hardware: %s", err)
+	SkipResultAttestation(data.Num)
+	return false, nil
+}
+
+// BlockDataHash returns the first 64 bits of the block data hash, as computed by the Fabric
+// machine, given the transactions of a block.
+func BlockDataHash(data [][]byte) uint64 {
+	hash := sha256.Sum256(bytes.Join(data, nil))
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+// readsResultDataHash returns true when the block data hash is read from the Fabric machine, to
+// be checked or because it is part of the signed results.
+func readsResultDataHash() bool {
+	return IsResultDataHashEnabled() || IsResultSignatureEnabled()
+}
@@ -0,0 +1,149 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmapi
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric/fabricmachine/testutil"
+)
+
+// testBlockData returns the transactions of a block with n transactions.
+func testBlockData(n int) [][]byte {
+	var data [][]byte
+	for i := 0; i < n; i++ {
+		env := testutil.NewEnvelope(&testutil.Tx{TxId: fmt.Sprintf("tx%d", i), Chaincode: "mycc"})
+		data = append(data, testutil.Marshal(env))
+	}
+	return data
+}
+
+// testResult returns the results of a block matching its transactions.
+func testResult(num uint64, data [][]byte) *BlockData {
+	return &BlockData{Num: num, NumTxs: uint32(len(data)), Valid: true, DataHash: BlockDataHash(data)}
+}
+
+func TestCheckBlockResult(t *testing.T) {
+	saved := fmConfig
+	defer func() { fmConfig = saved }()
+	fmConfig.resultDataHashEnabled = true
+
+	data := testBlockData(2)
+	tests := []struct {
+		name   string
+		result *BlockData
+		valid  bool
+	}{
+		{
+			name:   "matching result",
+			result: testResult(5, data),
+			valid:  true,
+		},
+		{
+			name:   "result of another block",
+			result: testResult(6, data),
+		},
+		{
+			name:   "missing transaction",
+			result: &BlockData{Num: 5, NumTxs: 1, Valid: true, DataHash: BlockDataHash(data)},
+		},
+		{
+			name:   "other transactions",
+			result: testResult(5, testBlockData(3)[1:]),
+		},
+	}
+	for _, test := range tests {
+		SetExpectedResult(5, data)
+		err := CheckBlockResult(test.result)
+		if test.valid && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: result accepted", test.name)
+		}
+	}
+
+	// Blocks are forgotten once their results have been checked, as well as earlier blocks.
+	SetExpectedResult(4, testBlockData(1))
+	SetExpectedResult(5, data)
+	if err := CheckBlockResult(testResult(5, data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckBlockResult(testResult(5, data)); err == nil {
+		t.Error("result of a committed block accepted")
+	}
+	if err := CheckBlockResult(testResult(4, testBlockData(1))); err == nil {
+		t.Error("result of an earlier block accepted")
+	}
+
+	// Orderers do not send blocks validated in software to the Fabric machine.
+	SetSoftwareBlock(5)
+	if err := CheckBlockResult(testResult(5, nil)); err == nil {
+		t.Error("result of a block validated in software accepted")
+	}
+}
+
+func TestCheckBlockResultWithoutDataHash(t *testing.T) {
+	saved := fmConfig
+	defer func() { fmConfig = saved }()
+	fmConfig.resultDataHashEnabled = false
+
+	// The data hash is not read from the Fabric machine then, but the number of transactions is
+	// still checked.
+	data := testBlockData(2)
+	SetExpectedResult(5, data)
+	if err := CheckBlockResult(&BlockData{Num: 5, NumTxs: 2, Valid: true}); err != nil {
+		t.Error(err)
+	}
+	SetExpectedResult(5, data)
+	if err := CheckBlockResult(&BlockData{Num: 5, NumTxs: 3, Valid: true}); err == nil {
+		t.Error("result with another number of transactions accepted")
+	}
+}
+
+func TestAcceptBlockResult(t *testing.T) {
+	saved := fmConfig
+	defer func() { fmConfig = saved }()
+	fmConfig.resultDataHashEnabled = true
+	data := testBlockData(2)
+	mismatch := testResult(5, testBlockData(3)[1:])
+
+	// The commit fails by default.
+	SetExpectedResult(5, data)
+	if accepted, err := AcceptBlockResult(mismatch); accepted || err == nil {
+		t.Errorf("mismatching result accepted %t with error %v, want an error", accepted, err)
+	}
+
+	// Txs validated by hardware are invalidated when configured.
+	fmConfig.resultMismatchAction = ResultMismatchInvalidate
+	SetExpectedResult(5, data)
+	if accepted, err := AcceptBlockResult(mismatch); accepted || err != nil {
+		t.Errorf("mismatching result accepted %t with error %v, want it rejected", accepted, err)
+	}
+
+	SetExpectedResult(5, data)
+	if accepted, err := AcceptBlockResult(testResult(5, data)); !accepted || err != nil {
+		t.Errorf("matching result accepted %t with error %v", accepted, err)
+	}
+}
+
+func TestAcceptBlockResultWithoutAttestation(t *testing.T) {
+	saved := fmConfig
+	defer func() { fmConfig = saved }()
+	initResultSignature(t)
+	fmConfig.resultMismatchAction = ResultMismatchInvalidate
+
+	// Blocks whose txs validated by hardware are invalidated are committed without attestation.
+	block := testutil.NewBlock(5, nil, testutil.NewEnvelope(&testutil.Tx{TxId: "tx", Chaincode: "mycc"}))
+	SetExpectedResult(5, block.Data.Data)
+	if accepted, err := AcceptBlockResult(testResult(5, testBlockData(2))); accepted || err != nil {
+		t.Fatalf("mismatching result accepted %t with error %v, want it rejected", accepted, err)
+	}
+	if err := AddResultAttestation(block); err != nil {
+		t.Error(err)
+	}
+}
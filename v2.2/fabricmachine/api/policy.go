@@ -0,0 +1,602 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// policy.go implements the compilation of the endorsement policies of chaincode definitions into
+// the policies the Fabric machine enforces. The transactions of chaincodes whose policy it cannot
+// enforce are validated in software. Orderers and peers follow the same ordered chaincode
+// definitions and channel config, so that peers validate in software at least the transactions
+// that orderers do not send to the Fabric machine.
+package fmapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	lb "github.com/hyperledger/fabric-protos-go/peer/lifecycle"
+	"github.com/hyperledger/fabric/internal/pkg/txflags"
+)
+
+// Chaincode definitions are written by _lifecycle to its public namespace under
+// namespaces/fields/<chaincode>/<field>. These are hard-coded in Fabric codebase (core/chaincode/lifecycle).
+const (
+	LifecycleNamespace           = "_lifecycle"
+	lifecycleFieldsPrefix        = "namespaces/fields/"
+	lifecycleValidationInfoField = "ValidationInfo"
+)
+
+// The only validation plugin implemented by hardware.
+const DefaultValidationPlugin = "vscc"
+
+// GetValidationInfoChaincode returns the chaincode whose validation info is written to a
+// _lifecycle key, if any
+func GetValidationInfoChaincode(key string) (chaincode string, ok bool) {
+	if !strings.HasPrefix(key, lifecycleFieldsPrefix) {
+		return "", false
+	}
+	elements := strings.Split(strings.TrimPrefix(key, lifecycleFieldsPrefix), "/")
+	if len(elements) != 2 || elements[1] != lifecycleValidationInfoField {
+		return "", false
+	}
+	return elements[0], true
+}
+
+// ValidationInfoKey returns the _lifecycle key holding the validation info of a chaincode
+func ValidationInfoKey(chaincode string) string {
+	return lifecycleFieldsPrefix + chaincode + "/" + lifecycleValidationInfoField
+}
+
+// UnmarshalValidationInfo unmarshals a _lifecycle validation info field
+func UnmarshalValidationInfo(value []byte) (*lb.ChaincodeValidationInfo, error) {
+	stateData := &lb.StateData{}
+	if err := proto.Unmarshal(value, stateData); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling StateData: %v", err)
+	}
+	info := &lb.ChaincodeValidationInfo{}
+	if err := proto.Unmarshal(stateData.GetBytes(), info); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling ChaincodeValidationInfo: %v", err)
+	}
+	return info, nil
+}
+
+// Compiled endorsement policies, as enforced by the Fabric machine, are trees of nodes. An N out
+// of node is 1B code, 1B N, 1B number of children followed by the children, a signed by node is 1B
+// code, 1B org id, 1B role id.
+const (
+	PolicyNodeNOutOf   byte = 0x01
+	PolicyNodeSignedBy byte = 0x02
+)
+
+// Largest N and number of children of the N out of nodes of compiled policies.
+const kPolicyMaxRules = 0xFF
+
+// PolicyNeverSatisfied is the compiled policy that no set of signatures satisfies, the same as
+// Fabric uses for missing policies.
+var PolicyNeverSatisfied = []byte{PolicyNodeNOutOf, 1, 0}
+
+// PrincipalCompiler compiles the role of an MSP into a signed by node. Orderers map MSPs to the
+// organization ids of their certificate cache.
+type PrincipalCompiler func(mspId string, role msp.MSPRole_MSPRoleType) ([]byte, error)
+
+// CheckEndorsementPolicy returns why the Fabric machine cannot enforce the endorsement policy of a
+// chaincode definition, a marshaled peer.ApplicationPolicy, or nil when it can. Policies referring
+// to channel config policies are resolved in config.
+func CheckEndorsementPolicy(applicationPolicy []byte, config *common.Config) error {
+	_, err := CompileEndorsementPolicy(applicationPolicy, config, func(string, msp.MSPRole_MSPRoleType) ([]byte, error) {
+		return []byte{PolicyNodeSignedBy, 0, 0}, nil
+	})
+	return err
+}
+
+// CompileEndorsementPolicy compiles the endorsement policy of a chaincode definition, a marshaled
+// peer.ApplicationPolicy, into the policy enforced by the Fabric machine. Policies referring to
+// channel config policies are resolved in config, and principals are compiled by compilePrincipal.
+func CompileEndorsementPolicy(applicationPolicy []byte, config *common.Config, compilePrincipal PrincipalCompiler) ([]byte, error) {
+	policy := &peer.ApplicationPolicy{}
+	if err := proto.Unmarshal(applicationPolicy, policy); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling ApplicationPolicy: %v", err)
+	}
+
+	switch t := policy.Type.(type) {
+	case *peer.ApplicationPolicy_SignaturePolicy:
+		return compileSignaturePolicyEnvelope(t.SignaturePolicy, compilePrincipal)
+	case *peer.ApplicationPolicy_ChannelConfigPolicyReference:
+		if config == nil || config.ChannelGroup == nil {
+			return nil, fmt.Errorf("Channel config is not known")
+		}
+		return compileChannelConfigPolicy(config, t.ChannelConfigPolicyReference, compilePrincipal)
+	default:
+		return nil, fmt.Errorf("Unknown application policy type %T", policy.Type)
+	}
+}
+
+// compilePrincipal compiles an MSP principal into a signed by node
+func compilePrincipal(principal *msp.MSPPrincipal, compileRole PrincipalCompiler) ([]byte, error) {
+	if principal.PrincipalClassification != msp.MSPPrincipal_ROLE {
+		return nil, fmt.Errorf("Principal classification %s is not supported by hardware", principal.PrincipalClassification)
+	}
+	mspRole := &msp.MSPRole{}
+	if err := proto.Unmarshal(principal.Principal, mspRole); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling MSPRole: %v", err)
+	}
+	switch mspRole.Role {
+	case msp.MSPRole_MEMBER, msp.MSPRole_ADMIN, msp.MSPRole_ORDERER, msp.MSPRole_PEER, msp.MSPRole_CLIENT:
+		return compileRole(mspRole.MspIdentifier, mspRole.Role)
+	default:
+		return nil, fmt.Errorf("MSP role %s is not supported by hardware", mspRole.Role)
+	}
+}
+
+// compileNOutOf compiles an N out of node with the given compiled children
+func compileNOutOf(n int, children [][]byte) ([]byte, error) {
+	if n < 0 || n > kPolicyMaxRules || len(children) > kPolicyMaxRules {
+		return nil, fmt.Errorf("%d out of %d policy is too large for hardware", n, len(children))
+	}
+	rule := []byte{PolicyNodeNOutOf, byte(n), byte(len(children))}
+	for _, child := range children {
+		rule = append(rule, child...)
+	}
+	return rule, nil
+}
+
+// compileSignaturePolicy compiles a signature policy rule
+func compileSignaturePolicy(rule *common.SignaturePolicy, identities []*msp.MSPPrincipal, compileRole PrincipalCompiler) ([]byte, error) {
+	switch t := rule.Type.(type) {
+	case *common.SignaturePolicy_SignedBy:
+		if t.SignedBy < 0 || int(t.SignedBy) >= len(identities) {
+			return nil, fmt.Errorf("Identity index %d out of range", t.SignedBy)
+		}
+		return compilePrincipal(identities[t.SignedBy], compileRole)
+	case *common.SignaturePolicy_NOutOf_:
+		var children [][]byte
+		for _, r := range t.NOutOf.Rules {
+			child, err := compileSignaturePolicy(r, identities, compileRole)
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, child)
+		}
+		return compileNOutOf(int(t.NOutOf.N), children)
+	default:
+		return nil, fmt.Errorf("Unknown signature policy rule type %T", rule.Type)
+	}
+}
+
+// compileSignaturePolicyEnvelope compiles a signature policy
+func compileSignaturePolicyEnvelope(envelope *common.SignaturePolicyEnvelope, compileRole PrincipalCompiler) ([]byte, error) {
+	if envelope.Rule == nil {
+		return nil, fmt.Errorf("Missing signature policy rule")
+	}
+	return compileSignaturePolicy(envelope.Rule, envelope.Identities, compileRole)
+}
+
+// compileConfigPolicy compiles a policy of a channel config group. Implicit meta policies are
+// expanded into N out of nodes over the policies of the subgroups, in the order of their names.
+func compileConfigPolicy(group *common.ConfigGroup, name string, compileRole PrincipalCompiler) ([]byte, error) {
+	configPolicy, prs := group.Policies[name]
+	if !prs || configPolicy.Policy == nil {
+		return nil, fmt.Errorf("Policy %s not found", name)
+	}
+
+	policy := configPolicy.Policy
+	switch common.Policy_PolicyType(policy.Type) {
+	case common.Policy_SIGNATURE:
+		envelope := &common.SignaturePolicyEnvelope{}
+		if err := proto.Unmarshal(policy.Value, envelope); err != nil {
+			return nil, fmt.Errorf("Error unmarshaling signature policy %s: %v", name, err)
+		}
+		return compileSignaturePolicyEnvelope(envelope, compileRole)
+	case common.Policy_IMPLICIT_META:
+		meta := &common.ImplicitMetaPolicy{}
+		if err := proto.Unmarshal(policy.Value, meta); err != nil {
+			return nil, fmt.Errorf("Error unmarshaling implicit meta policy %s: %v", name, err)
+		}
+		var names []string
+		for subgroupName := range group.Groups {
+			names = append(names, subgroupName)
+		}
+		sort.Strings(names)
+
+		var children [][]byte
+		for _, subgroupName := range names {
+			subgroup := group.Groups[subgroupName]
+			if _, prs := subgroup.Policies[meta.SubPolicy]; !prs {
+				children = append(children, PolicyNeverSatisfied)
+				continue
+			}
+			child, err := compileConfigPolicy(subgroup, meta.SubPolicy, compileRole)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot compile policy %s of %s: %v", meta.SubPolicy, subgroupName, err)
+			}
+			children = append(children, child)
+		}
+
+		// Same thresholds as Fabric (common/policies/implicitmeta.go).
+		var n int
+		switch meta.Rule {
+		case common.ImplicitMetaPolicy_ANY:
+			n = 1
+		case common.ImplicitMetaPolicy_ALL:
+			n = len(children)
+		case common.ImplicitMetaPolicy_MAJORITY:
+			n = len(children)/2 + 1
+		default:
+			return nil, fmt.Errorf("Unknown implicit meta policy rule %s", meta.Rule)
+		}
+		return compileNOutOf(n, children)
+	default:
+		return nil, fmt.Errorf("Policy type %s is not supported by hardware", common.Policy_PolicyType(policy.Type))
+	}
+}
+
+// compileChannelConfigPolicy compiles a channel config policy given its path, e.g.
+// /Channel/Application/Endorsement. Relative paths are relative to /Channel.
+func compileChannelConfigPolicy(config *common.Config, reference string, compileRole PrincipalCompiler) ([]byte, error) {
+	path := reference
+	if strings.HasPrefix(reference, "/") {
+		if !strings.HasPrefix(reference, "/Channel/") {
+			return nil, fmt.Errorf("Invalid policy reference %s", reference)
+		}
+		path = strings.TrimPrefix(reference, "/Channel/")
+	}
+
+	elements := strings.Split(path, "/")
+	group := config.ChannelGroup
+	for _, groupName := range elements[:len(elements)-1] {
+		subgroup, prs := group.Groups[groupName]
+		if !prs {
+			return nil, fmt.Errorf("Group %s of policy reference %s not found", groupName, reference)
+		}
+		group = subgroup
+	}
+	return compileConfigPolicy(group, elements[len(elements)-1], compileRole)
+}
+
+// chaincodeDefinition holds what decides whether the Fabric machine can validate the
+// transactions of a chaincode defined through _lifecycle.
+type chaincodeDefinition struct {
+	ValidationPlugin  string `json:"validation_plugin"`
+	ApplicationPolicy []byte `json:"application_policy"`
+}
+
+// chaincodeDefinitions holds the chaincode definitions written by _lifecycle transactions.
+// Orderers cannot tell whether these transactions are valid, so the ordered definitions are those
+// of all of them; the committed definitions are those of the transactions found valid, which only
+// peers know. Both decide which transactions are validated in software: the ordered ones are what
+// orderers route transactions by, and the committed ones are what the chaincode transactions
+// actually have to satisfy.
+type chaincodeDefinitions struct {
+	Ordered   map[string]chaincodeDefinition `json:"ordered"`
+	Committed map[string]chaincodeDefinition `json:"committed"`
+}
+
+// Chaincode definitions, the channel config their policies are checked against, and the
+// chaincodes whose transactions are validated in software because the Fabric machine cannot
+// enforce their endorsement policy. Definitions are persisted to the chaincode policy file.
+var definitions = struct {
+	sync.Mutex
+	chaincodeDefinitions
+	loaded      bool
+	transient   bool // not persisted
+	config      *common.Config
+	unsupported map[string]bool
+}{
+	chaincodeDefinitions: chaincodeDefinitions{
+		Ordered:   make(map[string]chaincodeDefinition),
+		Committed: make(map[string]chaincodeDefinition),
+	},
+	unsupported: make(map[string]bool),
+}
+
+// checkChaincodeDefinition returns why the Fabric machine cannot validate the transactions of a
+// chaincode definition, or nil when it can.
+func checkChaincodeDefinition(definition chaincodeDefinition, config *common.Config) error {
+	if definition.ValidationPlugin != DefaultValidationPlugin {
+		return fmt.Errorf("Validation plugin %s is not supported by hardware", definition.ValidationPlugin)
+	}
+	return CheckEndorsementPolicy(definition.ApplicationPolicy, config)
+}
+
+// updateUnsupportedPolicy checks the ordered and committed definitions of a chaincode against the
+// current channel config. It must be called with definitions locked.
+func updateUnsupportedPolicy(name string) {
+	var err error
+	if definition, prs := definitions.Ordered[name]; prs {
+		err = checkChaincodeDefinition(definition, definitions.config)
+	}
+	if definition, prs := definitions.Committed[name]; prs && err == nil {
+		if err = checkChaincodeDefinition(definition, definitions.config); err != nil {
+			err = fmt.Errorf("Committed definition: %v", err)
+		}
+	}
+	if err != nil && !definitions.unsupported[name] {
+		logger.Warningf("Validating transactions of chaincode %s in software: %s", name, err)
+	} else if err == nil && definitions.unsupported[name] {
+		logger.Infof("Validating transactions of chaincode %s in hardware", name)
+	}
+	definitions.unsupported[name] = err != nil
+}
+
+// updateUnsupportedPolicies checks the definitions of all chaincodes. It must be called with
+// definitions locked.
+func updateUnsupportedPolicies() {
+	names := make(map[string]bool)
+	for name := range definitions.Ordered {
+		names[name] = true
+	}
+	for name := range definitions.Committed {
+		names[name] = true
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		updateUnsupportedPolicy(name)
+	}
+}
+
+// loadChaincodeDefinitions restores the chaincode definitions from the chaincode policy file. It
+// must be called with definitions locked.
+func loadChaincodeDefinitions() {
+	if definitions.loaded {
+		return
+	}
+	definitions.loaded = true
+
+	path := GetChaincodePolicyFile()
+	if path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Errorf("Cannot read chaincode policy file %s: %v", path, err)
+		}
+		return
+	}
+	persisted := chaincodeDefinitions{}
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		logger.Errorf("Cannot parse chaincode policy file %s: %v", path, err)
+		return
+	}
+	for name, definition := range persisted.Ordered {
+		definitions.Ordered[name] = definition
+	}
+	for name, definition := range persisted.Committed {
+		definitions.Committed[name] = definition
+	}
+	logger.Infof("Loaded %d ordered and %d committed chaincode definition(s) from %s",
+		len(definitions.Ordered), len(definitions.Committed), path)
+}
+
+// saveChaincodeDefinitions writes the chaincode definitions to the chaincode policy file. It must
+// be called with definitions locked.
+func saveChaincodeDefinitions() {
+	path := GetChaincodePolicyFile()
+	if path == "" || definitions.transient {
+		return
+	}
+	data, err := json.MarshalIndent(&definitions.chaincodeDefinitions, "", "  ")
+	if err != nil {
+		logger.Errorf("Cannot serialize chaincode definitions: %v", err)
+		return
+	}
+	if err := WriteFile(path, data); err != nil {
+		logger.Errorf("%s", err)
+	}
+}
+
+// ResetChaincodeDefinitions forgets about all chaincode definitions, which are no longer read from
+// or written to the chaincode policy file, e.g. to replay the blocks of a ledger outside of the
+// orderer.
+func ResetChaincodeDefinitions() {
+	definitions.Lock()
+	defer definitions.Unlock()
+	definitions.loaded = true
+	definitions.transient = true
+	definitions.config = nil
+	definitions.Ordered = make(map[string]chaincodeDefinition)
+	definitions.Committed = make(map[string]chaincodeDefinition)
+	definitions.unsupported = make(map[string]bool)
+}
+
+// SetChannelConfig sets the channel config that endorsement policies are checked against, and
+// checks the policies of all known chaincodes again. Orderers set it from the last config block
+// before sending a block, peers before validating one.
+func SetChannelConfig(config *common.Config) {
+	definitions.Lock()
+	defer definitions.Unlock()
+	loadChaincodeDefinitions()
+
+	definitions.config = config
+	updateUnsupportedPolicies()
+}
+
+// SetChannelConfigFromBlock sets the channel config of a config block.
+func SetChannelConfigFromBlock(block *common.Block) error {
+	config, err := getConfigFromConfigBlock(block)
+	if err != nil {
+		return fmt.Errorf("Cannot read channel config from block [%d]: %v", block.Header.Number, err)
+	}
+	SetChannelConfig(config)
+	return nil
+}
+
+// updateDefinitions records the chaincode definitions written by the transactions of a block for
+// which isApplied returns true. It must be called with definitions locked.
+func updateDefinitions(block *common.Block, view map[string]chaincodeDefinition, isApplied func(int) bool) {
+	changed := false
+	for i, data := range block.Data.Data {
+		if !isApplied(i) {
+			continue
+		}
+		for _, write := range getLifecycleWrites(data) {
+			name, ok := GetValidationInfoChaincode(write.Key)
+			if !ok || write.IsDelete {
+				continue
+			}
+			info, err := UnmarshalValidationInfo(write.Value)
+			if err != nil {
+				logger.Warningf("Cannot read validation info of chaincode %s in block [%d] tx%d: %v", name, block.Header.Number, i, err)
+				continue
+			}
+			view[name] = chaincodeDefinition{
+				ValidationPlugin:  info.ValidationPlugin,
+				ApplicationPolicy: info.ValidationParameter,
+			}
+			updateUnsupportedPolicy(name)
+			changed = true
+		}
+	}
+	if changed {
+		saveChaincodeDefinitions()
+	}
+}
+
+// UpdateChaincodeDefinitions records the ordered chaincode definitions written by the _lifecycle
+// transactions of a block, whether they are valid or not since orderers cannot tell, or the
+// channel config of a config block. They apply to the transactions of the following blocks.
+// Orderers only send blocks from the starting block on, so definitions of earlier blocks are
+// ignored.
+func UpdateChaincodeDefinitions(block *common.Block) {
+	if block.Data == nil {
+		return
+	}
+	if IsConfigBlock(block) {
+		if err := SetChannelConfigFromBlock(block); err != nil {
+			logger.Errorf("%s", err)
+		}
+		return
+	}
+	if block.Header.Number < GetStartingBlock() {
+		return
+	}
+
+	definitions.Lock()
+	defer definitions.Unlock()
+	loadChaincodeDefinitions()
+	updateDefinitions(block, definitions.Ordered, func(int) bool { return true })
+}
+
+// CommitChaincodeDefinitions records the committed chaincode definitions written by the valid
+// _lifecycle transactions of a block, once peers have validated it. They apply to the transactions
+// of the following blocks.
+func CommitChaincodeDefinitions(block *common.Block) {
+	if block.Data == nil || IsConfigBlock(block) {
+		return
+	}
+	var flags txflags.ValidationFlags
+	if block.Metadata != nil && len(block.Metadata.Metadata) > int(common.BlockMetadataIndex_TRANSACTIONS_FILTER) {
+		flags = txflags.ValidationFlags(block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER])
+	}
+	if len(flags) != len(block.Data.Data) {
+		logger.Errorf("Block [%d] has %d validation flags for %d transactions", block.Header.Number, len(flags), len(block.Data.Data))
+		return
+	}
+
+	definitions.Lock()
+	defer definitions.Unlock()
+	loadChaincodeDefinitions()
+	updateDefinitions(block, definitions.Committed, flags.IsValid)
+}
+
+// IsUnsupportedPolicyChaincode returns true when the Fabric machine cannot enforce the endorsement
+// policy of a chaincode.
+func IsUnsupportedPolicyChaincode(name string) bool {
+	definitions.Lock()
+	defer definitions.Unlock()
+	return definitions.unsupported[name]
+}
+
+// getConfigFromConfigBlock extracts the channel config from a config block
+func getConfigFromConfigBlock(block *common.Block) (*common.Config, error) {
+	if block.Data == nil || len(block.Data.Data) == 0 {
+		return nil, fmt.Errorf("Block has no transaction")
+	}
+	env := &common.Envelope{}
+	if err := proto.Unmarshal(block.Data.Data[0], env); err != nil {
+		return nil, err
+	}
+	payload := &common.Payload{}
+	if err := proto.Unmarshal(env.Payload, payload); err != nil {
+		return nil, err
+	}
+	configEnvelope := &common.ConfigEnvelope{}
+	if err := proto.Unmarshal(payload.Data, configEnvelope); err != nil {
+		return nil, err
+	}
+	if configEnvelope.Config == nil || configEnvelope.Config.ChannelGroup == nil {
+		return nil, fmt.Errorf("Missing channel group in config")
+	}
+	return configEnvelope.Config, nil
+}
+
+// getLifecycleWrites returns the public _lifecycle writes of an endorser transaction, none for
+// other or malformed transactions.
+func getLifecycleWrites(data []byte) []*kvrwset.KVWrite {
+	env := &common.Envelope{}
+	if err := proto.Unmarshal(data, env); err != nil {
+		return nil
+	}
+	payload := &common.Payload{}
+	if err := proto.Unmarshal(env.Payload, payload); err != nil || payload.Header == nil {
+		return nil
+	}
+	chdr := &common.ChannelHeader{}
+	if err := proto.Unmarshal(payload.Header.ChannelHeader, chdr); err != nil {
+		return nil
+	}
+	if common.HeaderType(chdr.Type) != common.HeaderType_ENDORSER_TRANSACTION {
+		return nil
+	}
+	tx := &peer.Transaction{}
+	if err := proto.Unmarshal(payload.Data, tx); err != nil {
+		return nil
+	}
+
+	var writes []*kvrwset.KVWrite
+	for _, action := range tx.Actions {
+		cap := &peer.ChaincodeActionPayload{}
+		if err := proto.Unmarshal(action.Payload, cap); err != nil || cap.Action == nil {
+			continue
+		}
+		prp := &peer.ProposalResponsePayload{}
+		if err := proto.Unmarshal(cap.Action.ProposalResponsePayload, prp); err != nil {
+			continue
+		}
+		chaincodeAction := &peer.ChaincodeAction{}
+		if err := proto.Unmarshal(prp.Extension, chaincodeAction); err != nil {
+			continue
+		}
+		txRWSet := &rwset.TxReadWriteSet{}
+		if err := proto.Unmarshal(chaincodeAction.Results, txRWSet); err != nil {
+			continue
+		}
+		for _, nsRWSet := range txRWSet.NsRwset {
+			if nsRWSet.Namespace != LifecycleNamespace {
+				continue
+			}
+			kvRWSet := &kvrwset.KVRWSet{}
+			if err := proto.Unmarshal(nsRWSet.Rwset, kvRWSet); err != nil {
+				continue
+			}
+			writes = append(writes, kvRWSet.Writes...)
+		}
+	}
+	return writes
+}
@@ -0,0 +1,262 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmapi
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	lb "github.com/hyperledger/fabric-protos-go/peer/lifecycle"
+	"github.com/hyperledger/fabric/fabricmachine/testutil"
+)
+
+// testOrgIds maps MSPs to the organization ids of compiled policies, roles to their MSPRole value.
+var testOrgIds = map[string]byte{"Org1MSP": 1, "Org2MSP": 2, "Org3MSP": 3}
+
+func compileTestPrincipal(mspId string, role msp.MSPRole_MSPRoleType) ([]byte, error) {
+	orgId, prs := testOrgIds[mspId]
+	if !prs {
+		return nil, fmt.Errorf("unknown MSP %s", mspId)
+	}
+	return []byte{PolicyNodeSignedBy, orgId, byte(role)}, nil
+}
+
+// roleEnvelope returns a signature policy requiring n signatures of the given roles.
+func roleEnvelope(n int32, principals ...*msp.MSPRole) *common.SignaturePolicyEnvelope {
+	envelope := &common.SignaturePolicyEnvelope{Rule: &common.SignaturePolicy{
+		Type: &common.SignaturePolicy_NOutOf_{NOutOf: &common.SignaturePolicy_NOutOf{N: n}},
+	}}
+	rules := envelope.Rule.GetNOutOf()
+	for i, principal := range principals {
+		envelope.Identities = append(envelope.Identities, &msp.MSPPrincipal{
+			PrincipalClassification: msp.MSPPrincipal_ROLE,
+			Principal:               testutil.Marshal(principal),
+		})
+		rules.Rules = append(rules.Rules, &common.SignaturePolicy{Type: &common.SignaturePolicy_SignedBy{SignedBy: int32(i)}})
+	}
+	return envelope
+}
+
+func signaturePolicy(envelope *common.SignaturePolicyEnvelope) []byte {
+	return testutil.Marshal(&peer.ApplicationPolicy{Type: &peer.ApplicationPolicy_SignaturePolicy{SignaturePolicy: envelope}})
+}
+
+func policyReference(reference string) []byte {
+	return testutil.Marshal(&peer.ApplicationPolicy{
+		Type: &peer.ApplicationPolicy_ChannelConfigPolicyReference{ChannelConfigPolicyReference: reference},
+	})
+}
+
+// endorsementConfig returns a channel config whose application Endorsement policy is the MAJORITY
+// of the Endorsement policies of the organizations. Org3MSP has no Endorsement policy.
+func endorsementConfig() *common.Config {
+	orgPolicy := func(mspId string) map[string]*common.ConfigPolicy {
+		return map[string]*common.ConfigPolicy{"Endorsement": {Policy: &common.Policy{
+			Type:  int32(common.Policy_SIGNATURE),
+			Value: testutil.Marshal(roleEnvelope(1, &msp.MSPRole{MspIdentifier: mspId, Role: msp.MSPRole_PEER})),
+		}}}
+	}
+	application := &common.ConfigGroup{
+		Groups: map[string]*common.ConfigGroup{
+			"Org1": {Policies: orgPolicy("Org1MSP")},
+			"Org2": {Policies: orgPolicy("Org2MSP")},
+			"Org3": {},
+		},
+		Policies: map[string]*common.ConfigPolicy{"Endorsement": {Policy: &common.Policy{
+			Type: int32(common.Policy_IMPLICIT_META),
+			Value: testutil.Marshal(&common.ImplicitMetaPolicy{
+				SubPolicy: "Endorsement",
+				Rule:      common.ImplicitMetaPolicy_MAJORITY,
+			}),
+		}}},
+	}
+	return &common.Config{ChannelGroup: &common.ConfigGroup{Groups: map[string]*common.ConfigGroup{"Application": application}}}
+}
+
+func TestCompileEndorsementPolicy(t *testing.T) {
+	member := byte(msp.MSPRole_MEMBER)
+	peerRole := byte(msp.MSPRole_PEER)
+	tests := []struct {
+		name   string
+		policy []byte
+		want   []byte
+	}{
+		{
+			name: "signature policy",
+			policy: signaturePolicy(roleEnvelope(2,
+				&msp.MSPRole{MspIdentifier: "Org1MSP", Role: msp.MSPRole_MEMBER},
+				&msp.MSPRole{MspIdentifier: "Org2MSP", Role: msp.MSPRole_PEER})),
+			want: []byte{
+				PolicyNodeNOutOf, 2, 2,
+				PolicyNodeSignedBy, 1, member,
+				PolicyNodeSignedBy, 2, peerRole,
+			},
+		},
+		{
+			// Subgroups are sorted by name, those without the sub policy are never satisfied.
+			name:   "implicit meta policy",
+			policy: policyReference("/Channel/Application/Endorsement"),
+			want: []byte{
+				PolicyNodeNOutOf, 2, 3,
+				PolicyNodeNOutOf, 1, 1, PolicyNodeSignedBy, 1, peerRole,
+				PolicyNodeNOutOf, 1, 1, PolicyNodeSignedBy, 2, peerRole,
+				PolicyNodeNOutOf, 1, 0,
+			},
+		},
+		{
+			name:   "relative reference",
+			policy: policyReference("Application/Org2/Endorsement"),
+			want:   []byte{PolicyNodeNOutOf, 1, 1, PolicyNodeSignedBy, 2, peerRole},
+		},
+	}
+	for _, test := range tests {
+		got, err := CompileEndorsementPolicy(test.policy, endorsementConfig(), compileTestPrincipal)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: compiled %x, want %x", test.name, got, test.want)
+		}
+		if err := CheckEndorsementPolicy(test.policy, endorsementConfig()); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+	}
+}
+
+func TestCheckEndorsementPolicyUnsupported(t *testing.T) {
+	identity := signaturePolicy(&common.SignaturePolicyEnvelope{
+		Rule: &common.SignaturePolicy{Type: &common.SignaturePolicy_SignedBy{SignedBy: 0}},
+		Identities: []*msp.MSPPrincipal{{
+			PrincipalClassification: msp.MSPPrincipal_IDENTITY,
+			Principal:               testutil.Identity("Org1MSP", testutil.NewCertificate("client")),
+		}},
+	})
+	var roles []*msp.MSPRole
+	for i := 0; i < kPolicyMaxRules+1; i++ {
+		roles = append(roles, &msp.MSPRole{MspIdentifier: "Org1MSP", Role: msp.MSPRole_MEMBER})
+	}
+	mspPolicyConfig := endorsementConfig()
+	mspPolicyConfig.ChannelGroup.Groups["Application"].Policies["Endorsement"].Policy.Type = int32(common.Policy_MSP)
+
+	tests := []struct {
+		name   string
+		policy []byte
+		config *common.Config
+	}{
+		{"identity principal", identity, endorsementConfig()},
+		{"too many rules", signaturePolicy(roleEnvelope(1, roles...)), endorsementConfig()},
+		{"unknown channel config", policyReference("/Channel/Application/Endorsement"), nil},
+		{"missing policy", policyReference("/Channel/Application/Missing"), endorsementConfig()},
+		{"invalid reference", policyReference("/Other/Application/Endorsement"), endorsementConfig()},
+		{"policy type", policyReference("/Channel/Application/Endorsement"), mspPolicyConfig},
+		{"malformed policy", []byte("not a policy"), endorsementConfig()},
+	}
+	for _, test := range tests {
+		if err := CheckEndorsementPolicy(test.policy, test.config); err == nil {
+			t.Errorf("%s: policy accepted", test.name)
+		}
+	}
+}
+
+// lifecycleTx returns a _lifecycle transaction defining a chaincode.
+func lifecycleTx(txId, chaincode, plugin string, policy []byte) *common.Envelope {
+	info := &lb.ChaincodeValidationInfo{ValidationPlugin: plugin, ValidationParameter: policy}
+	value := testutil.Marshal(&lb.StateData{Type: &lb.StateData_Bytes{Bytes: testutil.Marshal(info)}})
+	return testutil.NewEnvelope(&testutil.Tx{
+		TxId:      txId,
+		Chaincode: LifecycleNamespace,
+		Args:      []string{"CommitChaincodeDefinition"},
+		Writes: map[string][]*kvrwset.KVWrite{
+			LifecycleNamespace: {{Key: ValidationInfoKey(chaincode), Value: value}},
+		},
+	})
+}
+
+// initTestChaincodeDefinitions starts with no chaincode definitions, persisted to a temporary
+// chaincode policy file.
+func initTestChaincodeDefinitions(t *testing.T) {
+	saved := fmConfig
+	t.Cleanup(func() {
+		fmConfig = saved
+		ResetChaincodeDefinitions()
+	})
+	fmConfig.chaincodePolicyFile = filepath.Join(t.TempDir(), "chaincode_policies.json")
+	fmConfig.startingBlock = 0
+
+	ResetChaincodeDefinitions()
+	definitions.loaded = false
+	definitions.transient = false
+}
+
+func TestChaincodeDefinitions(t *testing.T) {
+	initTestChaincodeDefinitions(t)
+	SetChannelConfig(endorsementConfig())
+	supported := policyReference("/Channel/Application/Endorsement")
+
+	tests := []struct {
+		name        string
+		plugin      string
+		valid       bool
+		unsupported bool
+	}{
+		{"valid definition", DefaultValidationPlugin, true, false},
+		// Orderers route the chaincode transactions to software as soon as the definition is
+		// ordered, so do peers.
+		{"invalid unsupported definition", "custom", false, true},
+		{"invalid definition", DefaultValidationPlugin, false, false},
+		{"valid unsupported definition", "custom", true, true},
+		// The committed definition still applies to the transactions sent to the Fabric machine.
+		{"invalid definition after unsupported one", DefaultValidationPlugin, false, true},
+	}
+	for i, test := range tests {
+		block := testutil.NewBlock(uint64(i+1), nil, lifecycleTx(fmt.Sprintf("tx%d", i), "mycc", test.plugin, supported))
+		UpdateChaincodeDefinitions(block)
+		if !test.valid {
+			block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER][0] = byte(peer.TxValidationCode_ENDORSEMENT_POLICY_FAILURE)
+		}
+		CommitChaincodeDefinitions(block)
+		if got := IsUnsupportedPolicyChaincode("mycc"); got != test.unsupported {
+			t.Errorf("%s: chaincode unsupported is %t, want %t", test.name, got, test.unsupported)
+		}
+	}
+
+	// Both definitions are restored from the chaincode policy file.
+	definitions.Lock()
+	definitions.loaded = false
+	definitions.Ordered = make(map[string]chaincodeDefinition)
+	definitions.Committed = make(map[string]chaincodeDefinition)
+	definitions.unsupported = make(map[string]bool)
+	definitions.Unlock()
+	SetChannelConfig(endorsementConfig())
+	if !IsUnsupportedPolicyChaincode("mycc") {
+		t.Error("committed unsupported definition not restored")
+	}
+	if definitions.Ordered["mycc"].ValidationPlugin != DefaultValidationPlugin {
+		t.Errorf("restored ordered definition %+v", definitions.Ordered["mycc"])
+	}
+}
+
+func TestChaincodeDefinitionsFromConfig(t *testing.T) {
+	initTestChaincodeDefinitions(t)
+	block := testutil.NewBlock(1, nil, lifecycleTx("tx", "mycc", DefaultValidationPlugin, policyReference("/Channel/Application/Endorsement")))
+	UpdateChaincodeDefinitions(block)
+	CommitChaincodeDefinitions(block)
+	if !IsUnsupportedPolicyChaincode("mycc") {
+		t.Error("policy referring to an unknown channel config is supported")
+	}
+	SetChannelConfig(endorsementConfig())
+	if IsUnsupportedPolicyChaincode("mycc") {
+		t.Error("policy not checked again against the channel config")
+	}
+}
@@ -9,6 +9,7 @@ SPDX-License-Identifier: Apache-2.0
 package fmapi
 
 import (
+	"encoding/binary"
 	"fmt"
 	"strings"
 	"time"
@@ -33,6 +34,25 @@ const (
 	kFmVersionRegAddr = uint32(0x50000)
 	kResRegsAddr      = uint32(0x40000)
 
+	// Duplicate TX ID flags of the block, one bit per tx. They are only valid when the TX ID index
+	// is enabled, and must be read before the block data related registers.
+	kTxIdDupRegsAddr = uint32(0x40100)
+	kNumTxIdDupRegs  = kBlockMaxTxs / kAxilDataWidth
+
+	// First 64 bits of the block data hash computed by the Fabric machine (SHA-256 of the
+	// transactions of the block, as in the block header), most significant bits first. They are
+	// only valid when the Fabric machine build reports them, and must be read before the block data
+	// related registers.
+	kResHashRegsAddr = uint32(0x40200)
+	kNumResHashRegs  = 2
+
+	// Signature of the block results with the device key: the id of the key, then the signature,
+	// most significant bytes first. They are only valid when the Fabric machine build signs block
+	// results, and must be read before the block data related registers.
+	kResSigKeyIdRegAddr = uint32(0x40300)
+	kResSigRegsAddr     = uint32(0x40304)
+	kNumResSigRegs      = 64 / 4 // Enough for Ed25519 signatures.
+
 	kUlRstVal = uint32(0xFFFFFFFF)
 )
 
@@ -41,6 +61,10 @@ type RegMap struct {
 	shellVersion uint32
 	fmVersion    uint32
 	resRegs      [kNumResRegs]uint32
+	txIdDupRegs  [kNumTxIdDupRegs]uint32
+	resHashRegs  [kNumResHashRegs]uint32
+	resSigKeyId  uint32
+	resSigRegs   [kNumResSigRegs]uint32
 }
 
 func NewRegMap(pcieResourceFile string) (*RegMap, error) {
@@ -81,6 +105,42 @@ func (regmap *RegMap) readResRegs(start, end int) error {
 	return nil
 }
 
+// readTxIdDupRegs reads the duplicate TX ID flags registers.
+func (regmap *RegMap) readTxIdDupRegs() error {
+	var err error
+	for i := 0; i < kNumTxIdDupRegs; i++ {
+		if regmap.txIdDupRegs[i], err = regmap.pcie.ReadAt(kTxIdDupRegsAddr + 4*uint32(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readResHashRegs reads the block data hash registers.
+func (regmap *RegMap) readResHashRegs() error {
+	var err error
+	for i := 0; i < kNumResHashRegs; i++ {
+		if regmap.resHashRegs[i], err = regmap.pcie.ReadAt(kResHashRegsAddr + 4*uint32(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readResSigRegs reads the block results signature registers.
+func (regmap *RegMap) readResSigRegs() error {
+	var err error
+	if regmap.resSigKeyId, err = regmap.pcie.ReadAt(kResSigKeyIdRegAddr); err != nil {
+		return err
+	}
+	for i := 0; i < kNumResSigRegs; i++ {
+		if regmap.resSigRegs[i], err = regmap.pcie.ReadAt(kResSigRegsAddr + 4*uint32(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // getResRegsAsString returns the block data related registers formatted as a string.
 // It must be called after readResRegs() so that the internal data structure has the correct data.
 func (regmap *RegMap) getResRegsAsString() string {
@@ -134,6 +194,49 @@ func (regmap *RegMap) getBlockTxsVldFlags() [kBlockMaxTxs]uint8 {
 	return vldFlags
 }
 
+// getBlockTxsDupFlags returns the duplicate TX ID flags of txs by decoding the register values.
+// It must be called after readTxIdDupRegs() so that the internal data structure has the correct data.
+func (regmap *RegMap) getBlockTxsDupFlags() [kBlockMaxTxs]uint8 {
+	var dupFlags [kBlockMaxTxs]uint8
+
+	for i := 0; i < kNumTxIdDupRegs; i++ {
+		r := regmap.txIdDupRegs[i]
+		for j := 0; j < kAxilDataWidth; j++ {
+			dupFlags[i*kAxilDataWidth+j] = uint8(r & 0x1)
+			r >>= 1
+		}
+	}
+	return dupFlags
+}
+
+// getBlockDataHash returns the first 64 bits of the block data hash computed by the Fabric machine.
+// It must be called after readResHashRegs() so that the internal data structure has the correct data.
+func (regmap *RegMap) getBlockDataHash() uint64 {
+	return (uint64(regmap.resHashRegs[0]) << kAxilDataWidth) | uint64(regmap.resHashRegs[1])
+}
+
+// getBlockTxsVldBitmap returns the validation flags of txs as a bitmap, bit i%8 of byte i/8 set
+// when tx i is valid.
+// It must be called after readResRegs() so that the internal data structure has the correct data.
+func (regmap *RegMap) getBlockTxsVldBitmap() []byte {
+	bitmap := make([]byte, kBlockMaxTxs/8)
+	for i := 0; i < (kBlockMaxTxs / kAxilDataWidth); i++ {
+		binary.LittleEndian.PutUint32(bitmap[4*i:], regmap.resRegs[2+i])
+	}
+	return bitmap
+}
+
+// getBlockSignature returns the id of the device key and the first size bytes of the signature of
+// the block results.
+// It must be called after readResSigRegs() so that the internal data structure has the correct data.
+func (regmap *RegMap) getBlockSignature(size int) (uint8, []byte) {
+	signature := make([]byte, 4*kNumResSigRegs)
+	for i := 0; i < kNumResSigRegs; i++ {
+		binary.BigEndian.PutUint32(signature[4*i:], regmap.resSigRegs[i])
+	}
+	return uint8(regmap.resSigKeyId), signature[:size]
+}
+
 // getBlockNum returns the block latency by decoding the register values.
 // It must be called after readResRegs() so that the internal data structure has the correct data.
 func (regmap *RegMap) getBlockLatency() time.Duration {
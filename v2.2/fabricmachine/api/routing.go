@@ -0,0 +1,274 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// routing.go implements the rules that decide which parts of transaction validation are done in
+// software instead of the Fabric machine. Orderers and peers must apply the same rules.
+package fmapi
+
+import (
+	"encoding/pem"
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// Reasons for validating a transaction in software.
+const (
+	ReasonTxSize          = "transaction too large"
+	ReasonNonX509Creator  = "creator is not an x.509 identity"
+	ReasonMultipleActions = "multiple actions"
+	ReasonPrivateData     = "private data"
+	ReasonRangeQuery      = "range query"
+	ReasonKeyMetadata     = "key metadata write"
+	ReasonChaincodeConfig = "chaincode configured for software validation"
+	ReasonPolicy          = "endorsement policy not supported by hardware"
+)
+
+// System chaincodes whose transactions are always validated by the Fabric machine, as they were
+// before transactions were routed to software, even when they use features it does not support
+// otherwise (e.g. the implicit collections of _lifecycle). Peers cannot validate them in software
+// without a software statedb, and chaincodes could not be deployed.
+var systemChaincodes = map[string]bool{"_lifecycle": true, "lscc": true, "cscc": true, "qscc": true}
+
+// ExceedsEndorserLimit returns true when an action of an endorser transaction carries more
+// endorsements than the Fabric machine can check. Such transactions are sent to the Fabric machine
+// without their endorsements, so their endorsement policy has to be evaluated in software.
+func ExceedsEndorserLimit(payload *common.Payload) bool {
+	tx := &peer.Transaction{}
+	if err := proto.Unmarshal(payload.Data, tx); err != nil {
+		return false
+	}
+	for _, action := range tx.Actions {
+		cap := &peer.ChaincodeActionPayload{}
+		if err := proto.Unmarshal(action.Payload, cap); err != nil || cap.Action == nil {
+			continue
+		}
+		if len(cap.Action.Endorsements) > GetMaxEndorsers() {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSoftwareValidationReason returns why an endorser transaction has to be validated entirely in
+// software, or an empty string when the Fabric machine can validate it. Malformed transactions are
+// left to the Fabric machine, which rejects them.
+func GetSoftwareValidationReason(env *common.Envelope) string {
+	if proto.Size(env) > GetMaxTransactionSize() {
+		return ReasonTxSize
+	}
+
+	payload := &common.Payload{}
+	if err := proto.Unmarshal(env.Payload, payload); err != nil || payload.Header == nil {
+		return ""
+	}
+	chdr := &common.ChannelHeader{}
+	if err := proto.Unmarshal(payload.Header.ChannelHeader, chdr); err != nil {
+		return ""
+	}
+	if common.HeaderType(chdr.Type) != common.HeaderType_ENDORSER_TRANSACTION {
+		return ""
+	}
+
+	shdr := &common.SignatureHeader{}
+	if err := proto.Unmarshal(payload.Header.SignatureHeader, shdr); err != nil {
+		return ""
+	}
+	creator := &msp.SerializedIdentity{}
+	if err := proto.Unmarshal(shdr.Creator, creator); err != nil {
+		return ""
+	}
+	if block, _ := pem.Decode(creator.IdBytes); block == nil || block.Type != "CERTIFICATE" {
+		return ReasonNonX509Creator
+	}
+
+	hdrExt := &peer.ChaincodeHeaderExtension{}
+	if err := proto.Unmarshal(chdr.Extension, hdrExt); err != nil {
+		return ""
+	}
+	if systemChaincodes[hdrExt.GetChaincodeId().GetName()] {
+		return ""
+	}
+	if IsSoftwareChaincode(hdrExt.GetChaincodeId().GetName()) {
+		return ReasonChaincodeConfig
+	}
+	if IsUnsupportedPolicyChaincode(hdrExt.GetChaincodeId().GetName()) {
+		return ReasonPolicy
+	}
+
+	tx := &peer.Transaction{}
+	if err := proto.Unmarshal(payload.Data, tx); err != nil {
+		return ""
+	}
+	if len(tx.Actions) != 1 {
+		return ReasonMultipleActions
+	}
+	cap := &peer.ChaincodeActionPayload{}
+	if err := proto.Unmarshal(tx.Actions[0].Payload, cap); err != nil || cap.Action == nil {
+		return ""
+	}
+	prp := &peer.ProposalResponsePayload{}
+	if err := proto.Unmarshal(cap.Action.ProposalResponsePayload, prp); err != nil {
+		return ""
+	}
+	chaincodeAction := &peer.ChaincodeAction{}
+	if err := proto.Unmarshal(prp.Extension, chaincodeAction); err != nil {
+		return ""
+	}
+	txRWSet := &rwset.TxReadWriteSet{}
+	if err := proto.Unmarshal(chaincodeAction.Results, txRWSet); err != nil {
+		return ""
+	}
+	rangeQueries := 0
+	collections := 0
+	for _, nsRWSet := range txRWSet.NsRwset {
+		collections += len(nsRWSet.CollectionHashedRwset)
+		kvRWSet := &kvrwset.KVRWSet{}
+		if err := proto.Unmarshal(nsRWSet.Rwset, kvRWSet); err != nil {
+			return ""
+		}
+		if len(kvRWSet.MetadataWrites) > 0 {
+			return ReasonKeyMetadata
+		}
+		rangeQueries += len(kvRWSet.RangeQueriesInfo)
+	}
+	if collections > GetMaxCollections() {
+		return ReasonPrivateData
+	}
+	if rangeQueries > GetMaxRangeQueries() {
+		return ReasonRangeQuery
+	}
+	return ""
+}
+
+// IsConfigBlock returns true for blocks carrying a config transaction, which orderers do not send
+// to the Fabric machine and peers validate in software.
+func IsConfigBlock(block *common.Block) bool {
+	if block.Data == nil || len(block.Data.Data) == 0 {
+		return false
+	}
+	env := &common.Envelope{}
+	if err := proto.Unmarshal(block.Data.Data[0], env); err != nil {
+		return false
+	}
+	payload := &common.Payload{}
+	if err := proto.Unmarshal(env.Payload, payload); err != nil || payload.Header == nil {
+		return false
+	}
+	chdr := &common.ChannelHeader{}
+	if err := proto.Unmarshal(payload.Header.ChannelHeader, chdr); err != nil {
+		return false
+	}
+	return common.HeaderType(chdr.Type) == common.HeaderType_CONFIG ||
+		common.HeaderType(chdr.Type) == common.HeaderType_ORDERER_TRANSACTION
+}
+
+// CheckBlockFormat returns an error for ill-formed blocks, which orderers do not send to the Fabric
+// machine. The first transaction of a block must be a chaincode transaction.
+func CheckBlockFormat(block *common.Block) error {
+	if block.Header == nil || block.Header.Number == 0 {
+		return fmt.Errorf("Missing header or block number 0")
+	}
+	if block.Data == nil || len(block.Data.Data) == 0 {
+		return fmt.Errorf("Block %d has no transaction", block.Header.Number)
+	}
+	env := &common.Envelope{}
+	if err := proto.Unmarshal(block.Data.Data[0], env); err != nil {
+		return fmt.Errorf("Cannot get envelope of block %d tx0: %v", block.Header.Number, err)
+	}
+	payload := &common.Payload{}
+	if err := proto.Unmarshal(env.Payload, payload); err != nil || payload.Header == nil {
+		return fmt.Errorf("Cannot get payload header of block %d tx0", block.Header.Number)
+	}
+	chdr := &common.ChannelHeader{}
+	if err := proto.Unmarshal(payload.Header.ChannelHeader, chdr); err != nil {
+		return fmt.Errorf("Cannot get channel header of block %d tx0: %v", block.Header.Number, err)
+	}
+	hdrExt := &peer.ChaincodeHeaderExtension{}
+	if len(chdr.Extension) == 0 {
+		return fmt.Errorf("Missing chaincode header of block %d tx0", block.Header.Number)
+	}
+	if err := proto.Unmarshal(chdr.Extension, hdrExt); err != nil || hdrExt.ChaincodeId == nil {
+		return fmt.Errorf("Missing chaincode id in block %d tx0", block.Header.Number)
+	}
+	return nil
+}
+
+// IsSoftwareValidatedBlock returns true for the blocks that orderers do not send to the Fabric
+// machine, and that peers validate in software: config blocks, whose config is applied to the
+// Fabric machine instead, and ill-formed blocks.
+func IsSoftwareValidatedBlock(block *common.Block) bool {
+	return IsConfigBlock(block) || CheckBlockFormat(block) != nil
+}
+
+// Transactions validated in software by the committer, keyed by block number and then by index of
+// the transaction in the block. The state validator picks them up when the block is committed.
+var softwareTxs = struct {
+	sync.Mutex
+	blocks map[uint64]map[int]bool
+}{blocks: make(map[uint64]map[int]bool)}
+
+// SetSoftwareValidated records that a transaction of a block has been validated in software.
+func SetSoftwareValidated(blockNum uint64, txIndex int) {
+	softwareTxs.Lock()
+	defer softwareTxs.Unlock()
+	if softwareTxs.blocks[blockNum] == nil {
+		softwareTxs.blocks[blockNum] = make(map[int]bool)
+	}
+	softwareTxs.blocks[blockNum][txIndex] = true
+}
+
+// TakeSoftwareValidated returns the transactions of a block that have been validated in software,
+// and forgets about them as well as about the ones of earlier blocks.
+func TakeSoftwareValidated(blockNum uint64) map[int]bool {
+	softwareTxs.Lock()
+	defer softwareTxs.Unlock()
+	txs := softwareTxs.blocks[blockNum]
+	for num := range softwareTxs.blocks {
+		if num <= blockNum {
+			delete(softwareTxs.blocks, num)
+		}
+	}
+	return txs
+}
+
+// TxRevalidator validates a transaction of a block entirely in software, endorsement policy
+// included, and returns its validation code.
+type TxRevalidator func(txIndex int) (peer.TxValidationCode, error)
+
+// Revalidators of the blocks validated by the committer, keyed by block number. The state
+// validator takes them to validate again in software the txs that hardware found invalid.
+var txRevalidators = struct {
+	sync.Mutex
+	blocks map[uint64]TxRevalidator
+}{blocks: make(map[uint64]TxRevalidator)}
+
+// SetTxRevalidator records how the transactions of a block are validated again in software.
+func SetTxRevalidator(blockNum uint64, revalidate TxRevalidator) {
+	txRevalidators.Lock()
+	defer txRevalidators.Unlock()
+	txRevalidators.blocks[blockNum] = revalidate
+}
+
+// TakeTxRevalidator returns how the transactions of a block are validated again in software, or
+// nil if unknown, and forgets about it as well as about the ones of earlier blocks.
+func TakeTxRevalidator(blockNum uint64) TxRevalidator {
+	txRevalidators.Lock()
+	defer txRevalidators.Unlock()
+	revalidate := txRevalidators.blocks[blockNum]
+	for num := range txRevalidators.blocks {
+		if num <= blockNum {
+			delete(txRevalidators.blocks, num)
+		}
+	}
+	return revalidate
+}
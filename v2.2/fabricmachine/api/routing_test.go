@@ -0,0 +1,184 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmapi
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric/fabricmachine/testutil"
+)
+
+func TestSoftwareValidationReasonPrivateData(t *testing.T) {
+	saved := fmConfig
+	defer func() { fmConfig = saved }()
+	fmConfig.maxTransactionSize = 0xFFFF
+	fmConfig.maxEndorsers = 4
+	fmConfig.maxRangeQueries = 2
+	fmConfig.maxCollections = 1
+
+	creator := testutil.Identity("Org1MSP", testutil.NewCertificate("client"))
+	endorser := testutil.Identity("Org1MSP", testutil.NewCertificate("peer0"))
+	tests := []struct {
+		collections []string
+		reason      string
+	}{
+		{collections: nil, reason: ""},
+		{collections: []string{"collectionA"}, reason: ""},
+		{collections: []string{"collectionA", "collectionB"}, reason: ReasonPrivateData},
+	}
+	for i, test := range tests {
+		env := testutil.NewEnvelope(&testutil.Tx{
+			TxId:        fmt.Sprintf("tx%d", i),
+			Chaincode:   "mycc",
+			Args:        []string{"put", "key", "value"},
+			Creator:     creator,
+			Endorsers:   [][]byte{endorser},
+			Collections: test.collections,
+		})
+		if reason := GetSoftwareValidationReason(env); reason != test.reason {
+			t.Errorf("%d collection(s): got reason %q, want %q", len(test.collections), reason, test.reason)
+		}
+	}
+}
+
+func TestSoftwareValidationReasonRangeQueries(t *testing.T) {
+	saved := fmConfig
+	defer func() { fmConfig = saved }()
+	fmConfig.maxTransactionSize = 0xFFFF
+	fmConfig.maxEndorsers = 4
+	fmConfig.maxCollections = 0
+
+	creator := testutil.Identity("Org1MSP", testutil.NewCertificate("client"))
+	endorser := testutil.Identity("Org1MSP", testutil.NewCertificate("peer0"))
+	tests := []struct {
+		maxRangeQueries int
+		rangeQueries    int
+		reason          string
+	}{
+		{maxRangeQueries: 0, rangeQueries: 0, reason: ""},
+		// Hardware peers that cannot check range queries at all.
+		{maxRangeQueries: 0, rangeQueries: 1, reason: ReasonRangeQuery},
+		{maxRangeQueries: 2, rangeQueries: 2, reason: ""},
+		{maxRangeQueries: 2, rangeQueries: 3, reason: ReasonRangeQuery},
+	}
+	for _, test := range tests {
+		fmConfig.maxRangeQueries = test.maxRangeQueries
+		env := testutil.NewEnvelope(&testutil.Tx{
+			TxId:         "tx",
+			Chaincode:    "mycc",
+			Args:         []string{"scan", "key0", "key9"},
+			Creator:      creator,
+			Endorsers:    [][]byte{endorser},
+			RangeQueries: test.rangeQueries,
+		})
+		if reason := GetSoftwareValidationReason(env); reason != test.reason {
+			t.Errorf("%d range queries, at most %d: got reason %q, want %q", test.rangeQueries, test.maxRangeQueries, reason, test.reason)
+		}
+	}
+}
+
+func TestSoftwareValidationReasonChaincodeConfig(t *testing.T) {
+	saved := fmConfig
+	defer func() { fmConfig = saved }()
+	fmConfig.maxTransactionSize = 0xFFFF
+	fmConfig.maxEndorsers = 4
+	fmConfig.chaincodes = map[string]ChaincodeConfig{
+		"swcc": {Name: "swcc", Validation: "software"},
+		"hwcc": {Name: "hwcc", Validation: "hardware"},
+		"mycc": {Name: "mycc", ReadOnlyFunctions: []string{"query"}},
+	}
+
+	creator := testutil.Identity("Org1MSP", testutil.NewCertificate("client"))
+	endorser := testutil.Identity("Org1MSP", testutil.NewCertificate("peer0"))
+	tests := []struct {
+		defaultValidation string
+		chaincode         string
+		reason            string
+	}{
+		{"hardware", "swcc", ReasonChaincodeConfig},
+		{"hardware", "hwcc", ""},
+		{"hardware", "mycc", ""},
+		// Chaincodes without validation setting follow the default one.
+		{"software", "mycc", ReasonChaincodeConfig},
+		{"software", "hwcc", ""},
+	}
+	for _, test := range tests {
+		fmConfig.chaincodeValidation = test.defaultValidation
+		env := testutil.NewEnvelope(&testutil.Tx{
+			TxId:      "tx",
+			Chaincode: test.chaincode,
+			Args:      []string{"put", "key", "value"},
+			Creator:   creator,
+			Endorsers: [][]byte{endorser},
+		})
+		if reason := GetSoftwareValidationReason(env); reason != test.reason {
+			t.Errorf("%s by default, chaincode %s: got reason %q, want %q", test.defaultValidation, test.chaincode, reason, test.reason)
+		}
+	}
+}
+
+func TestSoftwareValidationReasonSystemChaincode(t *testing.T) {
+	saved := fmConfig
+	defer func() { fmConfig = saved }()
+	fmConfig.maxTransactionSize = 0xFFFF
+	fmConfig.maxEndorsers = 4
+	fmConfig.maxCollections = 0
+
+	// _lifecycle writes the implicit collections of the approving orgs.
+	env := testutil.NewEnvelope(&testutil.Tx{
+		TxId:        "tx",
+		Chaincode:   "_lifecycle",
+		Args:        []string{"ApproveChaincodeDefinitionForMyOrg"},
+		Creator:     testutil.Identity("Org1MSP", testutil.NewCertificate("admin")),
+		Collections: []string{"_implicit_org_Org1MSP"},
+	})
+	if reason := GetSoftwareValidationReason(env); reason != "" {
+		t.Errorf("got reason %q for _lifecycle, want none", reason)
+	}
+}
+
+func TestExceedsEndorserLimit(t *testing.T) {
+	saved := fmConfig
+	defer func() { fmConfig = saved }()
+	fmConfig.maxEndorsers = 2
+
+	endorser := testutil.Identity("Org1MSP", testutil.NewCertificate("peer0"))
+	payloadOf := func(env *common.Envelope) *common.Payload {
+		payload := &common.Payload{}
+		if err := proto.Unmarshal(env.Payload, payload); err != nil {
+			t.Fatal(err)
+		}
+		return payload
+	}
+	twoEndorsers := payloadOf(testutil.NewEnvelope(&testutil.Tx{TxId: "tx0", Chaincode: "mycc", Endorsers: [][]byte{endorser, endorser}}))
+	threeEndorsers := payloadOf(testutil.NewEnvelope(&testutil.Tx{TxId: "tx1", Chaincode: "mycc", Endorsers: [][]byte{endorser, endorser, endorser}}))
+	if ExceedsEndorserLimit(twoEndorsers) {
+		t.Error("transaction within the endorser limit exceeds it")
+	}
+	if !ExceedsEndorserLimit(threeEndorsers) {
+		t.Error("transaction above the endorser limit does not exceed it")
+	}
+
+	// Every action of the transaction is checked.
+	tx := &peer.Transaction{}
+	if err := proto.Unmarshal(twoEndorsers.Data, tx); err != nil {
+		t.Fatal(err)
+	}
+	other := &peer.Transaction{}
+	if err := proto.Unmarshal(threeEndorsers.Data, other); err != nil {
+		t.Fatal(err)
+	}
+	tx.Actions = append(tx.Actions, other.Actions...)
+	twoEndorsers.Data = testutil.Marshal(tx)
+	if !ExceedsEndorserLimit(twoEndorsers) {
+		t.Error("transaction whose second action is above the endorser limit does not exceed it")
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// txid.go keeps track of the TX ID index of the Fabric machine, which detects transactions that
+// reuse the TX ID of a transaction of the ledger. Orderers fill the index with the TX IDs of the
+// ledger and of the blocks they send, and peers skip the ledger lookup of TX IDs as long as the
+// index holds all of them, which they cannot tell once they have reset the Fabric machine.
+package fmapi
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+)
+
+// TX IDs of the ledgers of the peer, keyed by ledger ID. The TX ID index of the Fabric machine is
+// emptied when the Fabric machine is reset, and only orderers seed it again, so it is not known to
+// hold the TX IDs of any ledger after a reset.
+var txIdIndex = struct {
+	sync.Mutex
+	ledgers map[string]*ledgerTxIds
+	reset   bool
+}{ledgers: make(map[string]*ledgerTxIds)}
+
+// ledgerTxIds keeps track of the TX IDs of a ledger
+type ledgerTxIds struct {
+	count  uint64
+	lookup func(txId string) (bool, error)
+}
+
+// getLedgerTxIds returns the TX IDs of a ledger. It must be called with txIdIndex locked.
+func getLedgerTxIds(ledgerId string) *ledgerTxIds {
+	ledger := txIdIndex.ledgers[ledgerId]
+	if ledger == nil {
+		ledger = &ledgerTxIds{}
+		txIdIndex.ledgers[ledgerId] = ledger
+	}
+	return ledger
+}
+
+// GetTxIds returns the non-empty TX IDs of the transactions of a block. Transactions whose TX ID
+// cannot be read are skipped.
+func GetTxIds(block *common.Block) (txIds []string) {
+	if block.Data == nil {
+		return nil
+	}
+	for i, data := range block.Data.Data {
+		env := &common.Envelope{}
+		if err := proto.Unmarshal(data, env); err != nil {
+			logger.Warningf("Cannot get envelope of block %d tx%d: %s", block.Header.Number, i, err)
+			continue
+		}
+		payload := &common.Payload{}
+		if err := proto.Unmarshal(env.Payload, payload); err != nil || payload.Header == nil {
+			logger.Warningf("Cannot get payload of block %d tx%d", block.Header.Number, i)
+			continue
+		}
+		chdr := &common.ChannelHeader{}
+		if err := proto.Unmarshal(payload.Header.ChannelHeader, chdr); err != nil {
+			logger.Warningf("Cannot get channel header of block %d tx%d: %s", block.Header.Number, i, err)
+			continue
+		}
+		if chdr.TxId != "" {
+			txIds = append(txIds, chdr.TxId)
+		}
+	}
+	return txIds
+}
+
+// GetTxIdIndexCapacity returns how many TX IDs the TX ID index of the Fabric machine holds, 0 when
+// it is disabled.
+func GetTxIdIndexCapacity() uint64 {
+	if GetTxIdIndexBits() == 0 {
+		return 0
+	}
+	return uint64(1) << uint(GetTxIdIndexBits())
+}
+
+// CountTxIds adds the TX IDs of a committed block to the number of TX IDs of a ledger, which the
+// TX ID index holds as long as it is not full.
+func CountTxIds(ledgerId string, block *common.Block) {
+	count := uint64(len(GetTxIds(block)))
+	capacity := GetTxIdIndexCapacity()
+	txIdIndex.Lock()
+	defer txIdIndex.Unlock()
+	ledger := getLedgerTxIds(ledgerId)
+	if ledger.count < capacity && ledger.count+count >= capacity {
+		logger.Warningf("TX ID index of the Fabric machine is full with %d TX IDs of ledger %s, duplicate TX IDs are looked up in the ledger from block %d on",
+			capacity, ledgerId, block.Header.Number+1)
+	}
+	ledger.count += count
+}
+
+// IsTxIdIndexComplete returns true when the TX ID index of the Fabric machine holds all the TX IDs
+// of a ledger, so that they do not have to be looked up in the ledger. It is not when the index is
+// disabled, full, or when the Fabric machine has been reset.
+func IsTxIdIndexComplete(ledgerId string) bool {
+	txIdIndex.Lock()
+	defer txIdIndex.Unlock()
+	return !txIdIndex.reset && getLedgerTxIds(ledgerId).count < GetTxIdIndexCapacity()
+}
+
+// InvalidateTxIdIndex records that the TX ID index of the Fabric machine has been emptied by a
+// reset, after which TX IDs are looked up in the ledgers.
+func InvalidateTxIdIndex() {
+	txIdIndex.Lock()
+	defer txIdIndex.Unlock()
+	if GetTxIdIndexBits() > 0 && !txIdIndex.reset {
+		logger.Warning("TX ID index of the Fabric machine has been reset, duplicate TX IDs are looked up in the ledgers")
+	}
+	txIdIndex.reset = true
+}
+
+// SetTxIdLookup sets the function that tells whether a TX ID is in a ledger.
+func SetTxIdLookup(ledgerId string, lookup func(txId string) (bool, error)) {
+	txIdIndex.Lock()
+	defer txIdIndex.Unlock()
+	getLedgerTxIds(ledgerId).lookup = lookup
+}
+
+// TxIdExists returns true when a transaction of a ledger has the given TX ID, confirming a
+// duplicate TX ID reported by the Fabric machine.
+func TxIdExists(ledgerId string, txId string) (bool, error) {
+	txIdIndex.Lock()
+	lookup := getLedgerTxIds(ledgerId).lookup
+	txIdIndex.Unlock()
+	if lookup == nil {
+		return false, fmt.Errorf("No ledger %s to look up TX ID %s", ledgerId, txId)
+	}
+	return lookup(txId)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmapi
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric/fabricmachine/testutil"
+)
+
+// initTestTxIdIndex starts with the TX IDs of no ledger and a TX ID index of 4 TX IDs.
+func initTestTxIdIndex(t *testing.T) {
+	saved := fmConfig
+	t.Cleanup(func() {
+		fmConfig = saved
+		txIdIndex.ledgers = make(map[string]*ledgerTxIds)
+		txIdIndex.reset = false
+	})
+	fmConfig.txIdIndexBits = 2
+	txIdIndex.ledgers = make(map[string]*ledgerTxIds)
+	txIdIndex.reset = false
+}
+
+// txIdBlock returns a block with the given number of transactions.
+func txIdBlock(number uint64, txs int) *common.Block {
+	var envelopes []*common.Envelope
+	for i := 0; i < txs; i++ {
+		envelopes = append(envelopes, testutil.NewEnvelope(&testutil.Tx{TxId: fmt.Sprintf("tx%d-%d", number, i), Chaincode: "mycc"}))
+	}
+	return testutil.NewBlock(number, nil, envelopes...)
+}
+
+func TestTxIdIndexComplete(t *testing.T) {
+	initTestTxIdIndex(t)
+
+	CountTxIds("ch1", txIdBlock(1, 3))
+	if !IsTxIdIndexComplete("ch1") {
+		t.Error("TX ID index holding 3 TX IDs out of 4 is not complete")
+	}
+	CountTxIds("ch1", txIdBlock(2, 1))
+	if IsTxIdIndexComplete("ch1") {
+		t.Error("full TX ID index is complete")
+	}
+	// TX IDs are counted by ledger.
+	CountTxIds("ch2", txIdBlock(1, 1))
+	if !IsTxIdIndexComplete("ch2") {
+		t.Error("TX IDs of another ledger counted")
+	}
+
+	// The TX ID index is emptied by a reset, and only seeded again by orderers.
+	InvalidateTxIdIndex()
+	if IsTxIdIndexComplete("ch2") {
+		t.Error("TX ID index complete after a reset")
+	}
+
+	fmConfig.txIdIndexBits = 0
+	txIdIndex.reset = false
+	if IsTxIdIndexComplete("ch3") {
+		t.Error("disabled TX ID index is complete")
+	}
+}
+
+func TestTxIdExists(t *testing.T) {
+	initTestTxIdIndex(t)
+	SetTxIdLookup("ch1", func(txId string) (bool, error) { return txId == "tx1", nil })
+	SetTxIdLookup("ch2", func(txId string) (bool, error) { return txId == "tx2", nil })
+
+	if exists, err := TxIdExists("ch1", "tx1"); err != nil || !exists {
+		t.Errorf("tx1 in ch1: got %t, %v", exists, err)
+	}
+	if exists, err := TxIdExists("ch1", "tx2"); err != nil || exists {
+		t.Errorf("tx2 in ch1: got %t, %v", exists, err)
+	}
+	if _, err := TxIdExists("ch3", "tx1"); err == nil {
+		t.Error("TX ID looked up in an unknown ledger")
+	}
+}
@@ -0,0 +1,354 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package fmaudit validates the blocks of a channel again in software, after the fact, and
+// compares the results with the validation flags stored in the ledger, to check the results of
+// hardware validation.
+//
+// Transactions are validated the way Fabric peers do: creator signature, duplicate TX ID,
+// endorsement policies (chaincode and key-level) and MVCC against a world state rebuilt from the
+// ledger. The world state is rebuilt from the stored flags rather than from the audited ones, so
+// that each divergence points to the transaction validated wrongly rather than cascading to the
+// following transactions.
+package fmaudit
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/hyperledger/fabric/common/channelconfig"
+	fmprotocol "github.com/hyperledger/fabric/fabricmachine/protocol"
+	"github.com/hyperledger/fabric/internal/pkg/txflags"
+	"github.com/pkg/errors"
+)
+
+// Checks that cannot be performed, which make the audit of a transaction inconclusive when the
+// transaction is found valid but stored as invalid.
+const (
+	UncheckedMerkleRangeQuery = "range query summarized as merkle tree"
+	UncheckedLegacyChaincode  = "chaincode not defined through _lifecycle"
+	UncheckedValidationPlugin = "custom validation plugin"
+	UncheckedCollectionPolicy = "collection endorsement policy"
+)
+
+// Divergence is a transaction whose stored validation code does not match the audited one
+type Divergence struct {
+	Block   uint64
+	Tx      int
+	TxId    string
+	Stored  peer.TxValidationCode
+	Audited peer.TxValidationCode
+	Reason  string
+
+	// Checks that could not be performed, when the transaction is found valid
+	Unchecked []string
+}
+
+// Inconclusive returns true when the transaction is found valid but some checks could not be
+// performed, so that the stored code may still be right
+func (d Divergence) Inconclusive() bool {
+	return d.Audited == peer.TxValidationCode_VALID && len(d.Unchecked) > 0
+}
+
+func (d Divergence) String() string {
+	s := fmt.Sprintf("block %d tx%d (%s): stored %s, audited %s", d.Block, d.Tx, d.TxId, d.Stored, d.Audited)
+	if d.Reason != "" {
+		s += ": " + d.Reason
+	}
+	if d.Inconclusive() {
+		s += fmt.Sprintf(" (inconclusive, unchecked: %v)", d.Unchecked)
+	}
+	return s
+}
+
+// Report summarizes an audit
+type Report struct {
+	Blocks int
+	Txs    int
+
+	// Transactions whose validity does not match, conclusively or not
+	Divergences []Divergence
+
+	// Transactions whose validity matches but whose validation codes differ, as when hardware
+	// reports all invalid transactions as MVCC conflicts
+	CodeMismatches int
+
+	// Number of transactions with each check that could not be performed
+	Unchecked map[string]int
+}
+
+// Auditor validates the blocks of a channel, which must be given in order starting from the
+// genesis block
+type Auditor struct {
+	cryptoProvider bccsp.BCCSP
+	channelId      string
+	bundle         *channelconfig.Bundle
+	state          *worldState
+	txIds          map[string]bool
+	next           uint64
+	report         Report
+}
+
+// NewAuditor returns an auditor for a channel, using cryptoProvider to verify signatures
+func NewAuditor(cryptoProvider bccsp.BCCSP) *Auditor {
+	return &Auditor{
+		cryptoProvider: cryptoProvider,
+		state:          newWorldState(),
+		txIds:          make(map[string]bool),
+		report:         Report{Unchecked: make(map[string]int)},
+	}
+}
+
+// Report returns the results of the blocks audited so far
+func (a *Auditor) Report() *Report {
+	return &a.report
+}
+
+// nsRWSet is the read-write set of a transaction in a namespace
+type nsRWSet struct {
+	namespace   string
+	kv          *kvrwset.KVRWSet
+	collections []collHashedRWSet
+}
+
+// collHashedRWSet is the hashed read-write set of a transaction in a private data collection
+type collHashedRWSet struct {
+	name   string
+	hashed *kvrwset.HashedRWSet
+}
+
+// txResult is the outcome of the validation of a transaction
+type txResult struct {
+	txId      string
+	code      peer.TxValidationCode
+	reason    string
+	unchecked []string
+	rwsets    []nsRWSet
+}
+
+func invalid(code peer.TxValidationCode, format string, args ...interface{}) txResult {
+	return txResult{code: code, reason: fmt.Sprintf(format, args...)}
+}
+
+// AuditBlock validates the transactions of a block and returns the ones whose validity does not
+// match the stored flags
+func (a *Auditor) AuditBlock(block *cb.Block) ([]Divergence, error) {
+	if block.Header == nil || block.Data == nil {
+		return nil, errors.New("block without header or data")
+	}
+	number := block.Header.Number
+	if number != a.next {
+		return nil, errors.Errorf("expected block %d but got block %d", a.next, number)
+	}
+	metadata := block.GetMetadata().GetMetadata()
+	if len(metadata) <= int(cb.BlockMetadataIndex_TRANSACTIONS_FILTER) {
+		return nil, errors.Errorf("block %d has no transaction flags", number)
+	}
+	stored := txflags.ValidationFlags(metadata[cb.BlockMetadataIndex_TRANSACTIONS_FILTER])
+	if len(stored) != len(block.Data.Data) {
+		return nil, errors.Errorf("block %d has %d transaction flags for %d transactions", number, len(stored), len(block.Data.Data))
+	}
+
+	// The channel config of a config block only applies to the following blocks, except for the
+	// genesis block which defines the channel.
+	if number == 0 {
+		if err := a.updateConfig(block); err != nil {
+			return nil, err
+		}
+	}
+	if a.bundle == nil {
+		return nil, errors.New("channel config is not known")
+	}
+
+	var divergences []Divergence
+	batch := newUpdateBatch()
+	for i := range block.Data.Data {
+		result := a.validateTransaction(block.Data.Data[i], batch)
+		if stored.IsValid(i) {
+			batch.addTransaction(a.state, result.rwsets, version{number, uint64(i)})
+		}
+		for _, unchecked := range result.unchecked {
+			a.report.Unchecked[unchecked]++
+		}
+		a.report.Txs++
+
+		if (result.code == peer.TxValidationCode_VALID) != stored.IsValid(i) {
+			divergences = append(divergences, Divergence{
+				Block:     number,
+				Tx:        i,
+				TxId:      result.txId,
+				Stored:    stored.Flag(i),
+				Audited:   result.code,
+				Reason:    result.reason,
+				Unchecked: result.unchecked,
+			})
+		} else if result.code != stored.Flag(i) {
+			a.report.CodeMismatches++
+		}
+	}
+	a.state.commit(batch)
+
+	if number > 0 {
+		if config, err := fmprotocol.IsConfigBlock(block); err != nil {
+			return nil, errors.WithMessagef(err, "cannot read block %d", number)
+		} else if config {
+			if err := a.updateConfig(block); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	a.report.Blocks++
+	a.report.Divergences = append(a.report.Divergences, divergences...)
+	a.next++
+	return divergences, nil
+}
+
+// updateConfig reads the channel config of a config block
+func (a *Auditor) updateConfig(block *cb.Block) error {
+	envelope, err := fmprotocol.ExtractEnvelope(block, 0)
+	if err != nil {
+		return errors.WithMessagef(err, "cannot read config block %d", block.Header.Number)
+	}
+	payload, err := fmprotocol.UnmarshalPayload(envelope.Payload)
+	if err != nil || payload.Header == nil {
+		return errors.Errorf("cannot read payload of config block %d", block.Header.Number)
+	}
+	chdr, err := fmprotocol.UnmarshalChannelHeader(payload.Header.ChannelHeader)
+	if err != nil {
+		return errors.WithMessagef(err, "cannot read channel header of config block %d", block.Header.Number)
+	}
+	configEnvelope, err := fmprotocol.UnmarshalConfigEnvelope(payload.Data)
+	if err != nil {
+		return errors.WithMessagef(err, "cannot read config block %d", block.Header.Number)
+	}
+	bundle, err := channelconfig.NewBundle(chdr.ChannelId, configEnvelope.Config, a.cryptoProvider)
+	if err != nil {
+		return errors.WithMessagef(err, "invalid channel config in block %d", block.Header.Number)
+	}
+	a.channelId = chdr.ChannelId
+	a.bundle = bundle
+	return nil
+}
+
+// validateTransaction validates a transaction in the order Fabric peers do, so that the code of
+// the first failing check is returned
+func (a *Auditor) validateTransaction(data []byte, batch *updateBatch) txResult {
+	envelope, err := fmprotocol.GetEnvelopeFromBlock(data)
+	if err != nil {
+		return invalid(peer.TxValidationCode_INVALID_OTHER_REASON, "%s", err)
+	}
+	payload, err := fmprotocol.UnmarshalPayload(envelope.Payload)
+	if err != nil || payload.Header == nil {
+		return invalid(peer.TxValidationCode_BAD_PAYLOAD, "cannot read payload")
+	}
+	chdr, err := fmprotocol.UnmarshalChannelHeader(payload.Header.ChannelHeader)
+	if err != nil {
+		return invalid(peer.TxValidationCode_BAD_CHANNEL_HEADER, "%s", err)
+	}
+
+	result := a.validatePayload(envelope, payload, chdr, batch)
+	result.txId = chdr.TxId
+	if chdr.TxId != "" {
+		a.txIds[chdr.TxId] = true
+	}
+	return result
+}
+
+// validatePayload validates a transaction given its decoded envelope and channel header
+func (a *Auditor) validatePayload(envelope *cb.Envelope, payload *cb.Payload, chdr *cb.ChannelHeader, batch *updateBatch) txResult {
+	switch cb.HeaderType(chdr.Type) {
+	case cb.HeaderType_CONFIG:
+		return txResult{code: peer.TxValidationCode_VALID}
+	case cb.HeaderType_ENDORSER_TRANSACTION:
+	default:
+		return invalid(peer.TxValidationCode_UNKNOWN_TX_TYPE, "transaction type %d", chdr.Type)
+	}
+	if chdr.ChannelId != a.channelId {
+		return invalid(peer.TxValidationCode_BAD_CHANNEL_HEADER, "transaction of channel %s", chdr.ChannelId)
+	}
+
+	shdr, err := fmprotocol.UnmarshalSignatureHeader(payload.Header.SignatureHeader)
+	if err != nil {
+		return invalid(peer.TxValidationCode_BAD_COMMON_HEADER, "%s", err)
+	}
+	if err := a.validateCreator(shdr.Creator, envelope.Payload, envelope.Signature); err != nil {
+		return invalid(peer.TxValidationCode_BAD_CREATOR_SIGNATURE, "%s", err)
+	}
+
+	tx, err := fmprotocol.UnmarshalTransaction(payload.Data)
+	if err != nil {
+		return invalid(peer.TxValidationCode_BAD_PAYLOAD, "%s", err)
+	}
+	if len(tx.Actions) != 1 {
+		return invalid(peer.TxValidationCode_BAD_PAYLOAD, "%d actions, only one action per transaction is supported", len(tx.Actions))
+	}
+	actionPayload, err := fmprotocol.UnmarshalChaincodeActionPayload(tx.Actions[0].Payload)
+	if err != nil || actionPayload.Action == nil {
+		return invalid(peer.TxValidationCode_BAD_PAYLOAD, "cannot read chaincode action payload")
+	}
+	responsePayload, err := fmprotocol.UnmarshalProposalResponsePayload(actionPayload.Action.ProposalResponsePayload)
+	if err != nil {
+		return invalid(peer.TxValidationCode_BAD_RESPONSE_PAYLOAD, "%s", err)
+	}
+	action, err := fmprotocol.UnmarshalChaincodeAction(responsePayload.Extension)
+	if err != nil {
+		return invalid(peer.TxValidationCode_BAD_RESPONSE_PAYLOAD, "%s", err)
+	}
+	rwsets, err := unmarshalRWSets(action.Results)
+	if err != nil {
+		return invalid(peer.TxValidationCode_BAD_RWSET, "%s", err)
+	}
+
+	if a.txIds[chdr.TxId] {
+		return txResult{code: peer.TxValidationCode_DUPLICATE_TXID, reason: "TX ID already in the ledger", rwsets: rwsets}
+	}
+
+	hdrExt, err := fmprotocol.UnmarshalChaincodeHeaderExtension(chdr.Extension)
+	if err != nil || hdrExt.ChaincodeId == nil {
+		return txResult{code: peer.TxValidationCode_INVALID_OTHER_REASON, reason: "missing chaincode id", rwsets: rwsets}
+	}
+	code, reason, unchecked := a.validateEndorsements(hdrExt.ChaincodeId.Name, rwsets, actionPayload.Action)
+	if code != peer.TxValidationCode_VALID {
+		return txResult{code: code, reason: reason, rwsets: rwsets}
+	}
+
+	code, readUnchecked := validateReads(a.state, batch, rwsets)
+	if code != peer.TxValidationCode_VALID {
+		return txResult{code: code, reason: "read set does not match the world state", rwsets: rwsets}
+	}
+	return txResult{code: peer.TxValidationCode_VALID, unchecked: append(unchecked, readUnchecked...), rwsets: rwsets}
+}
+
+// unmarshalRWSets unmarshals the read-write sets of a transaction
+func unmarshalRWSets(data []byte) ([]nsRWSet, error) {
+	txRWSet := &rwset.TxReadWriteSet{}
+	if err := proto.Unmarshal(data, txRWSet); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling TxReadWriteSet")
+	}
+	rwsets := make([]nsRWSet, 0, len(txRWSet.NsRwset))
+	for _, ns := range txRWSet.NsRwset {
+		kv := &kvrwset.KVRWSet{}
+		if err := proto.Unmarshal(ns.Rwset, kv); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshaling KVRWSet of %s", ns.Namespace)
+		}
+		rwset := nsRWSet{namespace: ns.Namespace, kv: kv}
+		for _, coll := range ns.CollectionHashedRwset {
+			hashed := &kvrwset.HashedRWSet{}
+			if err := proto.Unmarshal(coll.HashedRwset, hashed); err != nil {
+				return nil, errors.Wrapf(err, "error unmarshaling HashedRWSet of %s/%s", ns.Namespace, coll.CollectionName)
+			}
+			rwset.collections = append(rwset.collections, collHashedRWSet{coll.CollectionName, hashed})
+		}
+		rwsets = append(rwsets, rwset)
+	}
+	return rwsets, nil
+}
@@ -0,0 +1,175 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmaudit
+
+import (
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric/common/cauthdsl"
+	"github.com/hyperledger/fabric/common/policies"
+	fmapi "github.com/hyperledger/fabric/fabricmachine/api"
+	"github.com/hyperledger/fabric/protoutil"
+	"github.com/pkg/errors"
+)
+
+// Policy that transactions of _lifecycle itself have to satisfy, hard-coded in Fabric codebase
+// (core/chaincode/lifecycle).
+const lifecycleEndorsementPolicy = "/Channel/Application/LifecycleEndorsement"
+
+// The only validation plugin whose policies are evaluated.
+const defaultValidationPlugin = "vscc"
+
+// errUnchecked tells that a policy cannot be evaluated, the message says why
+type errUnchecked string
+
+func (e errUnchecked) Error() string {
+	return string(e)
+}
+
+// validateCreator checks the creator identity of a transaction and its signature over the payload
+func (a *Auditor) validateCreator(creator []byte, payload []byte, signature []byte) error {
+	identity, err := a.bundle.MSPManager().DeserializeIdentity(creator)
+	if err != nil {
+		return errors.WithMessage(err, "cannot deserialize creator")
+	}
+	if err := identity.Validate(); err != nil {
+		return errors.WithMessage(err, "invalid creator")
+	}
+	if err := identity.Verify(payload, signature); err != nil {
+		return errors.WithMessage(err, "invalid creator signature")
+	}
+	return nil
+}
+
+// validateEndorsements evaluates the endorsement policies a transaction has to satisfy: the
+// key-level policies of the keys it writes that have one, and the policies of the chaincodes whose
+// namespaces it writes, or of the chaincode it invokes when it writes nothing. It returns the
+// validation code, the reason of failures and the policies that cannot be evaluated.
+func (a *Auditor) validateEndorsements(chaincode string, rwsets []nsRWSet, action *peer.ChaincodeEndorsedAction) (peer.TxValidationCode, string, []string) {
+	signatures := make([]*protoutil.SignedData, 0, len(action.Endorsements))
+	for _, endorsement := range action.Endorsements {
+		data := make([]byte, 0, len(action.ProposalResponsePayload)+len(endorsement.Endorser))
+		data = append(data, action.ProposalResponsePayload...)
+		data = append(data, endorsement.Endorser...)
+		signatures = append(signatures, &protoutil.SignedData{
+			Data:      data,
+			Identity:  endorsement.Endorser,
+			Signature: endorsement.Signature,
+		})
+	}
+
+	// namespaces whose chaincode policy applies, and key-level policies
+	namespaces := make(map[string]bool)
+	var keyPolicies [][]byte
+	var unchecked []string
+	for _, ns := range rwsets {
+		keys := make([]string, 0, len(ns.kv.Writes)+len(ns.kv.MetadataWrites))
+		for _, write := range ns.kv.Writes {
+			keys = append(keys, write.Key)
+		}
+		for _, metadataWrite := range ns.kv.MetadataWrites {
+			keys = append(keys, metadataWrite.Key)
+		}
+		for _, key := range keys {
+			if value := a.state.get(ns.namespace, key); value != nil && value.validationParameter != nil {
+				keyPolicies = append(keyPolicies, value.validationParameter)
+			} else {
+				namespaces[ns.namespace] = true
+			}
+		}
+		for _, coll := range ns.collections {
+			if len(coll.hashed.HashedWrites) > 0 || len(coll.hashed.MetadataWrites) > 0 {
+				namespaces[ns.namespace] = true
+				unchecked = append(unchecked, UncheckedCollectionPolicy)
+			}
+		}
+	}
+	if len(namespaces) == 0 && len(keyPolicies) == 0 {
+		namespaces[chaincode] = true
+	}
+
+	for _, rule := range keyPolicies {
+		policy, _, err := cauthdsl.NewPolicyProvider(a.bundle.MSPManager()).NewPolicy(rule)
+		if err != nil {
+			return peer.TxValidationCode_ENDORSEMENT_POLICY_FAILURE, "invalid key-level endorsement policy: " + err.Error(), nil
+		}
+		if err := policy.EvaluateSignedData(signatures); err != nil {
+			return peer.TxValidationCode_ENDORSEMENT_POLICY_FAILURE, "key-level endorsement policy not satisfied: " + err.Error(), nil
+		}
+	}
+
+	names := make([]string, 0, len(namespaces))
+	for namespace := range namespaces {
+		names = append(names, namespace)
+	}
+	sort.Strings(names)
+	for _, namespace := range names {
+		policy, err := a.chaincodePolicy(namespace)
+		if unc, ok := err.(errUnchecked); ok {
+			unchecked = append(unchecked, string(unc))
+			continue
+		}
+		if err != nil {
+			return peer.TxValidationCode_ENDORSEMENT_POLICY_FAILURE, err.Error(), nil
+		}
+		if err := policy.EvaluateSignedData(signatures); err != nil {
+			return peer.TxValidationCode_ENDORSEMENT_POLICY_FAILURE, "endorsement policy of " + namespace + " not satisfied: " + err.Error(), nil
+		}
+	}
+	return peer.TxValidationCode_VALID, "", unchecked
+}
+
+// chaincodePolicy returns the endorsement policy of a chaincode as defined in the world state
+func (a *Auditor) chaincodePolicy(namespace string) (policies.Policy, error) {
+	if namespace == lifecycleNamespace {
+		return a.channelPolicy(lifecycleEndorsementPolicy)
+	}
+
+	value := a.state.get(lifecycleNamespace, fmapi.ValidationInfoKey(namespace))
+	if value == nil {
+		return nil, errUnchecked(UncheckedLegacyChaincode)
+	}
+	info, err := fmapi.UnmarshalValidationInfo(value.value)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "invalid definition of chaincode %s", namespace)
+	}
+	if info.ValidationPlugin != defaultValidationPlugin {
+		return nil, errUnchecked(UncheckedValidationPlugin)
+	}
+
+	applicationPolicy := &peer.ApplicationPolicy{}
+	if err := proto.Unmarshal(info.ValidationParameter, applicationPolicy); err != nil {
+		return nil, errors.Wrapf(err, "invalid endorsement policy of chaincode %s", namespace)
+	}
+	switch t := applicationPolicy.Type.(type) {
+	case *peer.ApplicationPolicy_SignaturePolicy:
+		rule, err := proto.Marshal(t.SignaturePolicy)
+		if err != nil {
+			return nil, err
+		}
+		policy, _, err := cauthdsl.NewPolicyProvider(a.bundle.MSPManager()).NewPolicy(rule)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid endorsement policy of chaincode %s", namespace)
+		}
+		return policy, nil
+	case *peer.ApplicationPolicy_ChannelConfigPolicyReference:
+		return a.channelPolicy(t.ChannelConfigPolicyReference)
+	default:
+		return nil, errors.Errorf("unknown endorsement policy type %T of chaincode %s", applicationPolicy.Type, namespace)
+	}
+}
+
+// channelPolicy returns a policy of the channel config
+func (a *Auditor) channelPolicy(path string) (policies.Policy, error) {
+	policy, ok := a.bundle.PolicyManager().GetPolicy(path)
+	if !ok {
+		return nil, errors.Errorf("channel policy %s not found", path)
+	}
+	return policy, nil
+}
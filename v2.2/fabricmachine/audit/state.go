@@ -0,0 +1,238 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmaudit
+
+import (
+	"sort"
+
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// Namespace whose values are kept in the rebuilt state, since chaincode definitions are read from
+// it. Other values are not needed to check read sets.
+const lifecycleNamespace = "_lifecycle"
+
+// version of a key, the block and transaction that last wrote it
+type version struct {
+	blockNum uint64
+	txNum    uint64
+}
+
+// stateValue is the committed state of a key
+type stateValue struct {
+	version version
+	value   []byte
+
+	// Key-level endorsement policy (marshaled SignaturePolicyEnvelope), nil when the key has none
+	validationParameter []byte
+}
+
+// worldState is the state rebuilt from the ledger, public keys by namespace and key, and private
+// key hashes by namespace, collection and key hash
+type worldState struct {
+	public map[string]map[string]*stateValue
+	hashed map[string]map[string]*stateValue
+}
+
+func newWorldState() *worldState {
+	return &worldState{
+		public: make(map[string]map[string]*stateValue),
+		hashed: make(map[string]map[string]*stateValue),
+	}
+}
+
+// collectionKey identifies a collection of a namespace in hashed state maps
+func collectionKey(namespace string, collection string) string {
+	return namespace + "$" + collection
+}
+
+func (s *worldState) get(namespace string, key string) *stateValue {
+	return s.public[namespace][key]
+}
+
+func (s *worldState) getHashed(namespace string, collection string, keyHash []byte) *stateValue {
+	return s.hashed[collectionKey(namespace, collection)][string(keyHash)]
+}
+
+// updateBatch holds the writes of the valid transactions of the block being audited. They are
+// committed to the world state at the end of the block, like Fabric does. A nil value in the maps
+// is a deletion.
+type updateBatch struct {
+	public map[string]map[string]*stateValue
+	hashed map[string]map[string]*stateValue
+}
+
+func newUpdateBatch() *updateBatch {
+	return &updateBatch{
+		public: make(map[string]map[string]*stateValue),
+		hashed: make(map[string]map[string]*stateValue),
+	}
+}
+
+func (b *updateBatch) exists(namespace string, key string) bool {
+	_, prs := b.public[namespace][key]
+	return prs
+}
+
+func (b *updateBatch) existsHashed(namespace string, collection string, keyHash []byte) bool {
+	_, prs := b.hashed[collectionKey(namespace, collection)][string(keyHash)]
+	return prs
+}
+
+func put(m map[string]map[string]*stateValue, namespace string, key string, value *stateValue) {
+	if m[namespace] == nil {
+		m[namespace] = make(map[string]*stateValue)
+	}
+	m[namespace][key] = value
+}
+
+// addTransaction adds the writes of a valid transaction to the batch
+func (b *updateBatch) addTransaction(state *worldState, rwsets []nsRWSet, v version) {
+	for _, ns := range rwsets {
+		for _, write := range ns.kv.Writes {
+			if write.IsDelete {
+				put(b.public, ns.namespace, write.Key, nil)
+				continue
+			}
+			value := &stateValue{version: v}
+			if current := b.current(state, ns.namespace, write.Key); current != nil {
+				value.validationParameter = current.validationParameter
+			}
+			if ns.namespace == lifecycleNamespace {
+				value.value = write.Value
+			}
+			put(b.public, ns.namespace, write.Key, value)
+		}
+		for _, metadataWrite := range ns.kv.MetadataWrites {
+			current := b.current(state, ns.namespace, metadataWrite.Key)
+			if current == nil {
+				continue
+			}
+			value := *current
+			value.version = v
+			value.validationParameter = nil
+			for _, entry := range metadataWrite.Entries {
+				if entry.Name == peer.MetaDataKeys_VALIDATION_PARAMETER.String() {
+					value.validationParameter = entry.Value
+				}
+			}
+			put(b.public, ns.namespace, metadataWrite.Key, &value)
+		}
+		for _, coll := range ns.collections {
+			for _, write := range coll.hashed.HashedWrites {
+				var value *stateValue
+				if !write.IsDelete {
+					value = &stateValue{version: v}
+				}
+				put(b.hashed, collectionKey(ns.namespace, coll.name), string(write.KeyHash), value)
+			}
+		}
+	}
+}
+
+// current returns the value of a key as of the last write of the batch
+func (b *updateBatch) current(state *worldState, namespace string, key string) *stateValue {
+	if value, prs := b.public[namespace][key]; prs {
+		return value
+	}
+	return state.get(namespace, key)
+}
+
+// commit applies the batch to the world state
+func (s *worldState) commit(b *updateBatch) {
+	apply := func(state map[string]map[string]*stateValue, updates map[string]map[string]*stateValue) {
+		for namespace, values := range updates {
+			for key, value := range values {
+				if value == nil {
+					delete(state[namespace], key)
+					continue
+				}
+				put(state, namespace, key, value)
+			}
+		}
+	}
+	apply(s.public, b.public)
+	apply(s.hashed, b.hashed)
+}
+
+// readVersionMatches returns true when a key read at readVersion is still at that version
+func readVersionMatches(value *stateValue, readVersion *kvrwset.Version) bool {
+	if value == nil {
+		return readVersion == nil
+	}
+	return readVersion != nil && readVersion.BlockNum == value.version.blockNum && readVersion.TxNum == value.version.txNum
+}
+
+// validateReads checks the read set of a transaction against the world state and the writes of
+// the earlier valid transactions of the block, the way Fabric's MVCC validation does. It returns
+// the validation code, and the checks that cannot be performed.
+func validateReads(state *worldState, batch *updateBatch, rwsets []nsRWSet) (peer.TxValidationCode, []string) {
+	var unchecked []string
+	for _, ns := range rwsets {
+		for _, read := range ns.kv.Reads {
+			if batch.exists(ns.namespace, read.Key) || !readVersionMatches(state.get(ns.namespace, read.Key), read.Version) {
+				return peer.TxValidationCode_MVCC_READ_CONFLICT, nil
+			}
+		}
+		for _, rqi := range ns.kv.RangeQueriesInfo {
+			if rqi.GetRawReads() == nil {
+				unchecked = append(unchecked, UncheckedMerkleRangeQuery)
+				continue
+			}
+			if !validateRangeQuery(state, batch, ns.namespace, rqi) {
+				return peer.TxValidationCode_PHANTOM_READ_CONFLICT, nil
+			}
+		}
+		for _, coll := range ns.collections {
+			for _, read := range coll.hashed.HashedReads {
+				if batch.existsHashed(ns.namespace, coll.name, read.KeyHash) ||
+					!readVersionMatches(state.getHashed(ns.namespace, coll.name, read.KeyHash), read.Version) {
+					return peer.TxValidationCode_MVCC_READ_CONFLICT, nil
+				}
+			}
+		}
+	}
+	return peer.TxValidationCode_VALID, unchecked
+}
+
+// validateRangeQuery executes a range query again over the world state, and returns true when it
+// returns the same keys at the same versions as when the transaction was simulated. Any key of
+// the range written by an earlier transaction of the block is a conflict.
+func validateRangeQuery(state *worldState, batch *updateBatch, namespace string, rqi *kvrwset.RangeQueryInfo) bool {
+	inRange := func(key string) bool {
+		return key >= rqi.StartKey && (rqi.EndKey == "" || key < rqi.EndKey)
+	}
+	keySet := make(map[string]bool)
+	for key := range state.public[namespace] {
+		if inRange(key) {
+			keySet[key] = true
+		}
+	}
+	for key := range batch.public[namespace] {
+		if inRange(key) {
+			keySet[key] = true
+		}
+	}
+	keys := make([]string, 0, len(keySet))
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	reads := rqi.GetRawReads().KvReads
+	for i, key := range keys {
+		if i == len(reads) {
+			// more results than the simulation got, which only matters when it read all of them
+			return !rqi.ItrExhausted
+		}
+		if key != reads[i].Key || batch.exists(namespace, key) || !readVersionMatches(state.get(namespace, key), reads[i].Version) {
+			return false
+		}
+	}
+	return len(keys) == len(reads)
+}
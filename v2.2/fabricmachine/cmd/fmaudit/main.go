@@ -0,0 +1,125 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// fmaudit validates the blocks of a channel again in software and reports the transactions whose
+// stored validation flags do not match, to prove after the fact that the results committed by
+// hardware peers are correct.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/hyperledger/fabric/bccsp/factory"
+	"github.com/hyperledger/fabric/common/ledger/blkstorage"
+	"github.com/hyperledger/fabric/common/metrics/disabled"
+	fmaudit "github.com/hyperledger/fabric/fabricmachine/audit"
+)
+
+const usage = `Usage: fmaudit -blockstore <dir> -channel <channel> [options]
+
+The block store directory is the one holding the chains directory, e.g.
+/var/hyperledger/production/ledgersData/chains for peers. The block store index may be updated
+when it is opened, so run fmaudit on a copy of the ledger or with the peer stopped.
+
+Blocks are always validated from the genesis block, since the world state is rebuilt from them,
+and divergences are reported from the -from block on. Divergences are inconclusive when the
+transaction is found valid but some of its checks cannot be performed.
+
+Options:
+`
+
+func main() {
+	blockStore := flag.String("blockstore", "", "block store directory")
+	channel := flag.String("channel", "", "channel to audit")
+	from := flag.Uint64("from", 0, "first block whose divergences are reported")
+	to := flag.Uint64("to", 0, "last block to audit, the last block of the ledger by default")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *blockStore == "" || *channel == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	provider, err := blkstorage.NewProvider(
+		blkstorage.NewConf(*blockStore, -1),
+		&blkstorage.IndexConfig{AttrsToIndex: []blkstorage.IndexableAttr{blkstorage.IndexableAttrBlockNum}},
+		&disabled.Provider{},
+	)
+	if err != nil {
+		fatalf("cannot open block store %s: %s", *blockStore, err)
+	}
+	defer provider.Close()
+	if exists, err := provider.Exists(*channel); err != nil || !exists {
+		fatalf("no ledger for channel %s in %s", *channel, *blockStore)
+	}
+	store, err := provider.Open(*channel)
+	if err != nil {
+		fatalf("cannot open ledger of channel %s: %s", *channel, err)
+	}
+	defer store.Shutdown()
+
+	info, err := store.GetBlockchainInfo()
+	if err != nil {
+		fatalf("cannot read ledger of channel %s: %s", *channel, err)
+	}
+	if *to == 0 || *to >= info.Height {
+		*to = info.Height - 1
+	}
+
+	auditor := fmaudit.NewAuditor(factory.GetDefault())
+	conclusive, inconclusive := 0, 0
+	for number := uint64(0); number <= *to; number++ {
+		block, err := store.RetrieveBlockByNumber(number)
+		if err != nil {
+			fatalf("cannot read block %d: %s", number, err)
+		}
+		divergences, err := auditor.AuditBlock(block)
+		if err != nil {
+			fatalf("cannot audit block %d: %s", number, err)
+		}
+		if number < *from {
+			continue
+		}
+		for _, d := range divergences {
+			fmt.Println(d)
+			if d.Inconclusive() {
+				inconclusive++
+			} else {
+				conclusive++
+			}
+		}
+	}
+
+	report := auditor.Report()
+	fmt.Printf("Audited %d block(s), %d transaction(s) of channel %s\n", report.Blocks, report.Txs, *channel)
+	fmt.Printf("Divergences from block %d: %d, and %d inconclusive\n", *from, conclusive, inconclusive)
+	fmt.Printf("Matching validity with a different code: %d\n", report.CodeMismatches)
+	if len(report.Unchecked) > 0 {
+		reasons := make([]string, 0, len(report.Unchecked))
+		for reason := range report.Unchecked {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		fmt.Println("Checks not performed:")
+		for _, reason := range reasons {
+			fmt.Printf("  %s: %d transaction(s)\n", reason, report.Unchecked[reason])
+		}
+	}
+	if conclusive > 0 {
+		os.Exit(1)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "fmaudit: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,316 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// fmbench replays the blocks of an existing peer or orderer ledger to a hardware peer, reads the
+// results back from the Fabric machine and compares them with the validation flags stored in the
+// ledger, to benchmark hardware builds with recorded traffic.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric/common/ledger/blkstorage"
+	"github.com/hyperledger/fabric/common/metrics/disabled"
+	fmapi "github.com/hyperledger/fabric/fabricmachine/api"
+	fmprotocol "github.com/hyperledger/fabric/fabricmachine/protocol"
+	"github.com/hyperledger/fabric/internal/pkg/txflags"
+	"github.com/spf13/viper"
+)
+
+const usage = `Usage: fmbench -blockstore <dir> -channel <channel> [options]
+
+The block store directory is the one holding the chains directory, e.g.
+/var/hyperledger/production/ledgersData/chains for peers and /var/hyperledger/production/orderer for
+orderers. The block store index may be updated when it is opened, so run fmbench on a copy of the
+ledger or with the node stopped.
+
+Options:
+`
+
+// Most mismatching transactions listed in the report
+const maxReportedMismatches = 20
+
+// sentBlock is a block sent to the hardware peer, waiting for its results, or a block skipped
+// because hardware peers do not validate it
+type sentBlock struct {
+	block       *cb.Block
+	softwareTxs []bool
+	sent        time.Time
+	skipped     bool
+}
+
+// benchResults accumulates the results of the blocks read back from the Fabric machine
+type benchResults struct {
+	blocks         int
+	txs            int
+	skipped        int
+	hwLatencies    []time.Duration
+	e2eLatencies   []time.Duration
+	invalidBlocks  int
+	numTxsMismatch int
+	flagMismatches int
+	mismatches     []string
+}
+
+func main() {
+	configFile := flag.String("config", os.Getenv("CORE_FABRIC_HW_CONFIG_FILE"), "Fabric machine config file")
+	blockStore := flag.String("blockstore", "", "block store directory")
+	channel := flag.String("channel", "", "channel whose blocks are replayed")
+	from := flag.Uint64("from", 1, "first block to replay")
+	to := flag.Uint64("to", 0, "last block to replay, the last block of the ledger by default")
+	rate := flag.Float64("rate", 0, "blocks sent per second, as fast as the hardware peer returns results when 0")
+	window := flag.Int("window", 4, "most blocks sent ahead of their results")
+	timeout := flag.Duration("timeout", 10*time.Second, "how long to wait for the results of a block")
+	address := flag.String("address", "", "address of the hardware peer, overrides the config file")
+	pcieResource := flag.String("pcie", "", "PCIe resource file of the FPGA card, overrides the config file")
+	reset := flag.Bool("reset", false, "reset the Fabric machine before replaying")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *configFile == "" || *blockStore == "" || *channel == "" || *window < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	v := viper.New()
+	v.Set("fabric.hw.config.file", *configFile)
+	if err := fmapi.InitConfig(v); err != nil {
+		fatalf("%s", err)
+	}
+	if err := fmprotocol.InitConfig(); err != nil {
+		fatalf("%s", err)
+	}
+	if *address == "" {
+		*address = fmapi.GetHardwareAddress()
+	}
+	if *pcieResource == "" {
+		*pcieResource = fmapi.GetPcieResourceFile()
+	}
+
+	provider, err := blkstorage.NewProvider(
+		blkstorage.NewConf(*blockStore, -1),
+		&blkstorage.IndexConfig{AttrsToIndex: []blkstorage.IndexableAttr{blkstorage.IndexableAttrBlockNum}},
+		&disabled.Provider{},
+	)
+	if err != nil {
+		fatalf("cannot open block store %s: %s", *blockStore, err)
+	}
+	defer provider.Close()
+	if exists, err := provider.Exists(*channel); err != nil || !exists {
+		fatalf("no ledger for channel %s in %s", *channel, *blockStore)
+	}
+	store, err := provider.Open(*channel)
+	if err != nil {
+		fatalf("cannot open ledger of channel %s: %s", *channel, err)
+	}
+	defer store.Shutdown()
+
+	info, err := store.GetBlockchainInfo()
+	if err != nil {
+		fatalf("cannot read ledger of channel %s: %s", *channel, err)
+	}
+	if *to == 0 || *to >= info.Height {
+		*to = info.Height - 1
+	}
+	if *from == 0 || *from > *to {
+		fatalf("invalid block range %d-%d, the ledger has blocks up to %d", *from, *to, info.Height-1)
+	}
+
+	fm, err := fmapi.OpenFabricMachine(*pcieResource)
+	if err != nil {
+		fatalf("cannot open Fabric machine: %s", err)
+	}
+	defer fm.Close()
+	if *reset {
+		if err := fm.Reset(); err != nil {
+			fatalf("cannot reset Fabric machine: %s", err)
+		}
+	}
+
+	getBlock := func(number uint64) *cb.Block {
+		block, err := store.RetrieveBlockByNumber(number)
+		if err != nil {
+			return nil
+		}
+		return block
+	}
+
+	if err := fmprotocol.StartReplay(*address); err != nil {
+		fatalf("%s", err)
+	}
+	fmt.Printf("Replaying blocks %d-%d of channel %s to %s\n", *from, *to, *channel, *address)
+	start := time.Now()
+	results, err := replay(fm, getBlock, *from, *to, *rate, *window, *timeout)
+	elapsed := time.Since(start)
+	results.report(elapsed)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	if results.invalidBlocks > 0 || results.numTxsMismatch > 0 || results.flagMismatches > 0 {
+		os.Exit(1)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "fmbench: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// replay sends blocks from..to at the given rate, at most window blocks ahead of their results,
+// and collects the results
+func replay(fm *fmapi.FabricMachine, getBlock fmprotocol.BlockGetter, from uint64, to uint64, rate float64, window int,
+	timeout time.Duration) (*benchResults, error) {
+	results := &benchResults{}
+	pending := make(chan sentBlock, window)
+	sendErr := make(chan error, 1)
+
+	go func() {
+		defer close(pending)
+		var interval time.Duration
+		if rate > 0 {
+			interval = time.Duration(float64(time.Second) / rate)
+		}
+		next := time.Now()
+		for number := from; number <= to; number++ {
+			block := getBlock(number)
+			if block == nil {
+				sendErr <- fmt.Errorf("cannot read block %d", number)
+				return
+			}
+			if interval > 0 {
+				time.Sleep(time.Until(next))
+				next = next.Add(interval)
+			}
+			sent := time.Now()
+			softwareTxs, err := fmprotocol.ReplayBlock(block, getBlock)
+			if err == fmprotocol.ErrBlockNotSupported || err == fmprotocol.ErrConfigBlock {
+				pending <- sentBlock{block: block, skipped: true}
+				continue
+			}
+			if err != nil {
+				sendErr <- fmt.Errorf("cannot send block %d: %s", number, err)
+				return
+			}
+			pending <- sentBlock{block: block, softwareTxs: softwareTxs, sent: sent}
+		}
+	}()
+
+	for p := range pending {
+		if p.skipped {
+			results.skipped++
+			continue
+		}
+		data, err := waitBlockData(fm, p.block.Header.Number, timeout)
+		if err != nil {
+			return results, err
+		}
+		results.add(p, data, time.Since(p.sent))
+	}
+	select {
+	case err := <-sendErr:
+		return results, err
+	default:
+		return results, nil
+	}
+}
+
+// waitBlockData reads the results of a block from the Fabric machine, waiting for them until
+// timeout
+func waitBlockData(fm *fmapi.FabricMachine, number uint64, timeout time.Duration) (*fmapi.BlockData, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		data, err := fm.PeekResultWindow()
+		if err != nil {
+			return nil, err
+		}
+		if data.Num == number {
+			return fm.ReadResultWindow()
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("no results for block %d after %s, Fabric machine has block %d", number, timeout, data.Num)
+		}
+		time.Sleep(50 * time.Microsecond)
+	}
+}
+
+// add compares the results of a block with the validation flags stored in the ledger. Transactions
+// validated in software are not compared, and hardware peers only report whether transactions are
+// valid, so only validity is compared.
+func (r *benchResults) add(p sentBlock, data *fmapi.BlockData, e2eLatency time.Duration) {
+	number := p.block.Header.Number
+	numTxs := len(p.block.Data.Data)
+	r.blocks++
+	r.txs += numTxs
+	r.hwLatencies = append(r.hwLatencies, data.Latency)
+	r.e2eLatencies = append(r.e2eLatencies, e2eLatency)
+
+	if !data.Valid {
+		r.invalidBlocks++
+		r.mismatch("block %d: hardware reports an invalid block", number)
+	}
+	if int(data.NumTxs) != numTxs {
+		r.numTxsMismatch++
+		r.mismatch("block %d: hardware reports %d tx(s), the block has %d", number, data.NumTxs, numTxs)
+		return
+	}
+
+	metadata := p.block.GetMetadata().GetMetadata()
+	if len(metadata) <= int(cb.BlockMetadataIndex_TRANSACTIONS_FILTER) {
+		return
+	}
+	expected := txflags.ValidationFlags(metadata[cb.BlockMetadataIndex_TRANSACTIONS_FILTER])
+	if len(expected) != numTxs {
+		return
+	}
+	for i := 0; i < numTxs; i++ {
+		if i < len(p.softwareTxs) && p.softwareTxs[i] {
+			continue
+		}
+		if expected.IsValid(i) != data.TxsVldFlags.IsValid(i) {
+			r.flagMismatches++
+			r.mismatch("block %d tx%d: ledger %s, hardware %s", number, i, expected.Flag(i), data.TxsVldFlags.Flag(i))
+		}
+	}
+}
+
+func (r *benchResults) mismatch(format string, args ...interface{}) {
+	if len(r.mismatches) < maxReportedMismatches {
+		r.mismatches = append(r.mismatches, fmt.Sprintf(format, args...))
+	}
+}
+
+// report prints throughput, latency percentiles and mismatches
+func (r *benchResults) report(elapsed time.Duration) {
+	fmt.Printf("Blocks: %d validated, %d skipped (config blocks)\n", r.blocks, r.skipped)
+	fmt.Printf("Transactions: %d\n", r.txs)
+	if r.blocks > 0 {
+		seconds := elapsed.Seconds()
+		fmt.Printf("Throughput: %.1f blocks/s, %.1f tx/s over %s\n", float64(r.blocks)/seconds, float64(r.txs)/seconds, elapsed.Round(time.Millisecond))
+		fmt.Printf("Hardware latency:   %s\n", percentiles(r.hwLatencies))
+		fmt.Printf("End-to-end latency: %s\n", percentiles(r.e2eLatencies))
+	}
+	fmt.Printf("Mismatches: %d invalid block(s), %d tx count(s), %d tx flag(s)\n", r.invalidBlocks, r.numTxsMismatch, r.flagMismatches)
+	for _, m := range r.mismatches {
+		fmt.Printf("  %s\n", m)
+	}
+}
+
+// percentiles formats the 50th, 90th and 99th percentiles and the maximum of latencies
+func percentiles(latencies []time.Duration) string {
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))]
+	}
+	return fmt.Sprintf("p50=%s p90=%s p99=%s max=%s", at(0.50), at(0.90), at(0.99), sorted[len(sorted)-1])
+}
@@ -0,0 +1,387 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// fmctl inspects and operates a Fabric machine: registers, results, certificate cache and blocks
+// sent to the hardware peer.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	fmapi "github.com/hyperledger/fabric/fabricmachine/api"
+	fmprotocol "github.com/hyperledger/fabric/fabricmachine/protocol"
+	"github.com/spf13/viper"
+)
+
+const usage = `Usage: fmctl [-config <file>] [-pcie <resource file>] [-address <address>] <command> [arguments]
+
+Commands:
+  reg read <offset>              read a register
+  reg write <offset> <value>     write a register
+  version                        show the OpenNIC and Fabric machine build versions
+  status                         show the block in the result window
+  result [-raw]                  decode the result window (releases the next block)
+  reset                          reset the Fabric machine (restart orderers to seed its TX ID index)
+  certs list                     list the certificates of the certificate cache file
+  certs push                     install the certificates of the certificate cache file
+  send <block file>              send a block (common.Block protobuf) to the hardware peer
+  watch [-interval <d>] [-consume [-from <n>]]
+                                 show results as blocks are validated
+
+The result window holds the results of one block at a time. Reading all of it releases the next
+block, so result and watch -consume must not be used while a peer reads results.
+
+Options:
+`
+
+// options common to all commands
+var (
+	configFile   string
+	pcieResource string
+	address      string
+)
+
+func main() {
+	flag.StringVar(&configFile, "config", os.Getenv("CORE_FABRIC_HW_CONFIG_FILE"), "Fabric machine config file")
+	flag.StringVar(&pcieResource, "pcie", "", "PCIe resource file of the FPGA card, overrides the config file")
+	flag.StringVar(&address, "address", "", "address of the hardware peer, overrides the config file")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "fmctl %s: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+// run runs a command
+func run(command string, args []string) error {
+	if err := initConfig(); err != nil {
+		return err
+	}
+
+	switch command {
+	case "reg":
+		return registerCommand(args)
+	case "version":
+		return versionCommand()
+	case "status":
+		return statusCommand()
+	case "result":
+		return resultCommand(args)
+	case "reset":
+		return resetCommand()
+	case "certs":
+		return certsCommand(args)
+	case "send":
+		return sendCommand(args)
+	case "watch":
+		return watchCommand(args)
+	}
+	flag.Usage()
+	os.Exit(2)
+	return nil
+}
+
+// initConfig reads the Fabric machine config file when there is one
+func initConfig() error {
+	if configFile == "" {
+		return nil
+	}
+	v := viper.New()
+	v.Set("fabric.hw.config.file", configFile)
+	if err := fmapi.InitConfig(v); err != nil {
+		return err
+	}
+	return fmprotocol.InitConfig()
+}
+
+// openFabricMachine opens the configured FPGA card without resetting it
+func openFabricMachine() (*fmapi.FabricMachine, error) {
+	resource := pcieResource
+	if resource == "" {
+		resource = fmapi.GetPcieResourceFile()
+	}
+	if resource == "" {
+		return nil, fmt.Errorf("no PCIe resource file, set -pcie or -config")
+	}
+	return fmapi.OpenFabricMachine(resource)
+}
+
+// hardwareAddress returns the configured hardware peer address
+func hardwareAddress() (string, error) {
+	if address != "" {
+		return address, nil
+	}
+	if addr := fmapi.GetHardwareAddress(); addr != "" {
+		return addr, nil
+	}
+	return "", fmt.Errorf("no hardware peer address, set -address or -config")
+}
+
+// parseUint32 parses a register offset or value, in decimal or with a 0x prefix
+func parseUint32(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %s", s)
+	}
+	return uint32(v), nil
+}
+
+func registerCommand(args []string) error {
+	if len(args) < 2 || (args[0] == "write" && len(args) != 3) || (args[0] == "read" && len(args) != 2) {
+		return fmt.Errorf("expected read <offset> or write <offset> <value>")
+	}
+	offset, err := parseUint32(args[1])
+	if err != nil {
+		return err
+	}
+	fm, err := openFabricMachine()
+	if err != nil {
+		return err
+	}
+	defer fm.Close()
+
+	switch args[0] {
+	case "read":
+		value, err := fm.ReadRegister(offset)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%#08x: %#08x\n", offset, value)
+		return nil
+	case "write":
+		value, err := parseUint32(args[2])
+		if err != nil {
+			return err
+		}
+		return fm.WriteRegister(offset, value)
+	}
+	return fmt.Errorf("unknown register operation %s", args[0])
+}
+
+func versionCommand() error {
+	fm, err := openFabricMachine()
+	if err != nil {
+		return err
+	}
+	defer fm.Close()
+
+	shellVersion, fmVersion, err := fm.Versions()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("OpenNIC build version:        %#x\n", shellVersion)
+	fmt.Printf("Fabric machine build version: %#x\n", fmVersion)
+	return nil
+}
+
+func statusCommand() error {
+	fm, err := openFabricMachine()
+	if err != nil {
+		return err
+	}
+	defer fm.Close()
+
+	shellVersion, fmVersion, err := fm.Versions()
+	if err != nil {
+		return err
+	}
+	data, err := fm.PeekResultWindow()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("OpenNIC build version:        %#x\n", shellVersion)
+	fmt.Printf("Fabric machine build version: %#x\n", fmVersion)
+	fmt.Printf("Result window:                block %d, %d tx(s), valid=%t\n", data.Num, data.NumTxs, data.Valid)
+	return nil
+}
+
+func resultCommand(args []string) error {
+	flags := flag.NewFlagSet("result", flag.ExitOnError)
+	raw := flags.Bool("raw", false, "also show the raw registers")
+	flags.Parse(args)
+
+	fm, err := openFabricMachine()
+	if err != nil {
+		return err
+	}
+	defer fm.Close()
+
+	data, err := fm.ReadResultWindow()
+	if err != nil {
+		return err
+	}
+	printBlockData(data)
+	if *raw {
+		fmt.Printf("Registers: %s\n", fm.ResultRegisters())
+	}
+	return nil
+}
+
+// printBlockData prints the results of a block, one line per transaction
+func printBlockData(data *fmapi.BlockData) {
+	fmt.Printf("Block %d: %d tx(s), valid=%t, latency=%s\n", data.Num, data.NumTxs, data.Valid, data.Latency)
+	if fmapi.IsResultDataHashEnabled() || data.Attestation != nil {
+		fmt.Printf("  data hash: %016x\n", data.DataHash)
+	}
+	if a := data.Attestation; a != nil {
+		fmt.Printf("  signature: %s key %d %x\n", a.Algorithm, a.KeyId, a.Signature)
+	}
+	for i := 0; i < int(data.NumTxs) && i < len(data.TxsVldFlags); i++ {
+		fmt.Printf("  tx%d: %s\n", i, data.TxsVldFlags.Flag(i))
+	}
+}
+
+func resetCommand() error {
+	fm, err := openFabricMachine()
+	if err != nil {
+		return err
+	}
+	defer fm.Close()
+	return fm.Reset()
+}
+
+func certsCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected list or push")
+	}
+	switch args[0] {
+	case "list":
+		path := fmapi.GetCertificateCacheFile()
+		if path == "" {
+			return fmt.Errorf("no certificate cache file configured")
+		}
+		certificates, err := fmprotocol.ReadCertificateCacheFile(path)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tMSP ID\tROLE\tSOURCE\tEXPIRES\tSUBJECT")
+		for _, c := range certificates {
+			source := "block"
+			if c.FromConfig {
+				source = "config"
+			}
+			fmt.Fprintf(w, "%#04x\t%s\t%s\t%s\t%s\t%s\n", c.Id, c.MspId, c.Role, source, c.NotAfter.Format(time.RFC3339), c.Subject)
+		}
+		return w.Flush()
+	case "push":
+		addr, err := hardwareAddress()
+		if err != nil {
+			return err
+		}
+		if fmapi.GetCertificateCacheFile() == "" {
+			return fmt.Errorf("no certificate cache file configured")
+		}
+		installed, err := fmprotocol.PushCertificateCache(addr)
+		fmt.Printf("Installed %d certificate(s) in %s\n", installed, addr)
+		return err
+	}
+	return fmt.Errorf("unknown certificate operation %s", args[0])
+}
+
+func sendCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a block file")
+	}
+	addr, err := hardwareAddress()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	block := &cb.Block{}
+	if err := proto.Unmarshal(data, block); err != nil {
+		return fmt.Errorf("%s is not a block: %s", args[0], err)
+	}
+	if block.Header == nil {
+		return fmt.Errorf("%s has no block header", args[0])
+	}
+
+	// Refer to the certificates the orderer installed, so that the hardware peer resolves them
+	if fmapi.GetCertificateCacheFile() != "" {
+		if err := fmprotocol.LoadCertificateCache(addr); err != nil {
+			return err
+		}
+	}
+	if err := fmprotocol.SendBlock(addr, block, nil); err != nil {
+		return err
+	}
+	fmt.Printf("Sent block %d (%d tx(s)) to %s\n", block.Header.Number, len(block.GetData().GetData()), addr)
+	return nil
+}
+
+func watchCommand(args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	interval := flags.Duration("interval", 100*time.Millisecond, "polling interval")
+	consume := flags.Bool("consume", false, "read the whole result window of each block, releasing the next block")
+	from := flags.Int64("from", -1, "first block to read with -consume, the block in the result window by default")
+	flags.Parse(args)
+
+	fm, err := openFabricMachine()
+	if err != nil {
+		return err
+	}
+	defer fm.Close()
+
+	current, err := fm.PeekResultWindow()
+	if err != nil {
+		return err
+	}
+
+	if *consume {
+		next := current.Num
+		if *from >= 0 {
+			next = uint64(*from)
+		}
+		for {
+			data, err := fm.PeekResultWindow()
+			if err != nil {
+				return err
+			}
+			if data.Num != next || (next == 0 && !data.Valid) { // Block0 must always be valid.
+				time.Sleep(*interval)
+				continue
+			}
+			if data, err = fm.ReadResultWindow(); err != nil {
+				return err
+			}
+			printBlockData(data)
+			next++
+		}
+	}
+
+	fmt.Printf("Block %d: %d tx(s), valid=%t\n", current.Num, current.NumTxs, current.Valid)
+	for {
+		time.Sleep(*interval)
+		data, err := fm.PeekResultWindow()
+		if err != nil {
+			return err
+		}
+		if data.Num != current.Num || data.NumTxs != current.NumTxs || data.Valid != current.Valid {
+			fmt.Printf("Block %d: %d tx(s), valid=%t\n", data.Num, data.NumTxs, data.Valid)
+			current = data
+		}
+	}
+}
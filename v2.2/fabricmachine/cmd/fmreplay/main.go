@@ -0,0 +1,77 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// fmreplay resends the packets of a capture written by the orderer (hardware.protocol.captureFile)
+// to a hardware peer, at the original timing or faster.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	fmprotocol "github.com/hyperledger/fabric/fabricmachine/protocol"
+)
+
+func main() {
+	address := flag.String("address", "", "address of the hardware peer (host:port, or socket path for the unix transport)")
+	transport := flag.String("transport", fmprotocol.BCM_TRANSPORT_UDP, "transport: udp, tcp or unix")
+	sourceInterface := flag.String("sourceInterface", "", "network interface UDP packets are sent from")
+	dscp := flag.Int("dscp", 0, "DSCP value of UDP packets")
+	speed := flag.Float64("speed", 1, "timing acceleration: 1 replays at the original timing, 2 twice as fast, 0 without delays")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -address <address> [options] <capture file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *address == "" || flag.NArg() != 1 || *speed < 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := replay(flag.Arg(0), *address, *transport, *sourceInterface, *dscp, *speed); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// replay sends the packets of a capture, spacing them by their capture time intervals divided by
+// speed
+func replay(path string, address string, transport string, sourceInterface string, dscp int, speed float64) error {
+	packets, err := fmprotocol.ReadCapture(path)
+	if err != nil {
+		return err
+	}
+	if len(packets) == 0 {
+		return fmt.Errorf("%s holds no packets", path)
+	}
+
+	conn, err := fmprotocol.DialTransport(transport, address, sourceInterface, dscp)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	var bytes int
+	for i, packet := range packets {
+		if speed > 0 {
+			offset := time.Duration(float64(packet.Time.Sub(packets[0].Time)) / speed)
+			if wait := time.Until(start.Add(offset)); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		if err := conn.Send(packet.Payload); err != nil {
+			return fmt.Errorf("cannot send packet %d: %s", i, err)
+		}
+		bytes += len(packet.Payload)
+	}
+
+	elapsed := time.Since(start)
+	fmt.Printf("Sent %d packets (%d bytes) to %s in %s\n", len(packets), bytes, address, elapsed)
+	return nil
+}
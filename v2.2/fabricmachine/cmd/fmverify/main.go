@@ -0,0 +1,273 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// fmverify creates the keys Fabric machines sign block results with, and checks the signatures
+// that hardware peers store in the metadata of the blocks of a channel, to prove that validation
+// flags come from a Fabric machine.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric/common/ledger/blkstorage"
+	"github.com/hyperledger/fabric/common/metrics/disabled"
+	fmapi "github.com/hyperledger/fabric/fabricmachine/api"
+	"github.com/hyperledger/fabric/internal/pkg/txflags"
+)
+
+const usage = `Usage: fmverify <command> [options]
+
+Commands:
+  keygen -algorithm <algorithm> -id <id> -out <prefix>
+        create a result signature key. For ed25519, <prefix>.key holds the private key (seed)
+        the Fabric machine is provisioned with, and <prefix>.pub the public key for peers and
+        auditors. For hmac-sha256, <prefix>.key holds the device key, which peers need as well.
+        Keys are added to the files when they exist.
+  verify -blockstore <dir> -channel <channel> -keys <key file> [-from <n>] [-to <n>] [-require]
+        check the result signatures stored in the blocks of a channel. The block store directory
+        is the one holding the chains directory, e.g. /var/hyperledger/production/ledgersData/chains
+        for peers. The block store index may be updated when it is opened, so run fmverify on a
+        copy of the ledger or with the peer stopped.
+
+Only ed25519 signatures prove that validation flags come from a Fabric machine. Peers hold the
+device key of hmac-sha256 signatures, which only protect results from corruption between the
+Fabric machine and the peer, so blocks signed with hmac-sha256 are reported as not proven.
+
+Valid txs whose validation flag is not signed were validated in software by the peer, e.g.
+because their chaincode is configured to be validated in software. Signed valid txs that are
+invalid in the ledger were invalidated by the peer, e.g. because of conflicts with other txs of
+the block.
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch flag.Arg(0) {
+	case "keygen":
+		err = keygenCommand(flag.Args()[1:])
+	case "verify":
+		err = verifyCommand(flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fmverify %s: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func keygenCommand(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	algorithm := flags.String("algorithm", fmapi.ResultSignatureEd25519, "either ed25519 or hmac-sha256")
+	id := flags.Uint("id", 1, "key id, greater than the ones of the keys being replaced")
+	out := flags.String("out", "", "prefix of the key files")
+	flags.Parse(args)
+	if *out == "" || *id > 255 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	switch *algorithm {
+	case fmapi.ResultSignatureEd25519:
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		if err := addKey(*out+".key", uint8(*id), private.Seed(), 0600); err != nil {
+			return err
+		}
+		if err := addKey(*out+".pub", uint8(*id), public, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Created Ed25519 key %d in %s.key and %s.pub\n", *id, *out, *out)
+	case fmapi.ResultSignatureHmacSha256:
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if err := addKey(*out+".key", uint8(*id), key, 0600); err != nil {
+			return err
+		}
+		fmt.Printf("Created HMAC-SHA256 key %d in %s.key\n", *id, *out)
+	default:
+		return fmt.Errorf("unknown algorithm %s", *algorithm)
+	}
+	return nil
+}
+
+// addKey adds a key to a key file, creating the file when it does not exist
+func addKey(path string, id uint8, key []byte, perm os.FileMode) error {
+	var file fmapi.ResultKeyFile
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("cannot parse %s: %s", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, k := range file.Keys {
+		if k.Id == id {
+			return fmt.Errorf("%s already has key %d", path, id)
+		}
+	}
+	file.Keys = append(file.Keys, fmapi.ResultKey{Id: id, Key: hex.EncodeToString(key)})
+
+	data, err := json.MarshalIndent(&file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), perm)
+}
+
+// counts of the verify command
+type verifyCounts struct {
+	blocks      int
+	signed      int
+	unsigned    int
+	unproven    int // signed with hmac-sha256
+	failed      int
+	unsignedTxs int // valid in the ledger, not signed valid
+	peerInvalid int // signed valid, invalid in the ledger
+}
+
+func verifyCommand(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	blockStore := flags.String("blockstore", "", "block store directory")
+	channel := flags.String("channel", "", "channel to verify")
+	keyFile := flags.String("keys", "", "ed25519 public key file, as configured on peers")
+	from := flags.Uint64("from", 0, "first block to verify")
+	to := flags.Uint64("to", 0, "last block to verify, the last block of the ledger by default")
+	require := flags.Bool("require", false, "fail on blocks without ed25519 result signature")
+	flags.Parse(args)
+	if *blockStore == "" || *channel == "" || *keyFile == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	keys, err := fmapi.ReadResultKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	provider, err := blkstorage.NewProvider(
+		blkstorage.NewConf(*blockStore, -1),
+		&blkstorage.IndexConfig{AttrsToIndex: []blkstorage.IndexableAttr{blkstorage.IndexableAttrBlockNum}},
+		&disabled.Provider{},
+	)
+	if err != nil {
+		return fmt.Errorf("cannot open block store %s: %s", *blockStore, err)
+	}
+	defer provider.Close()
+	if exists, err := provider.Exists(*channel); err != nil || !exists {
+		return fmt.Errorf("no ledger for channel %s in %s", *channel, *blockStore)
+	}
+	store, err := provider.Open(*channel)
+	if err != nil {
+		return fmt.Errorf("cannot open ledger of channel %s: %s", *channel, err)
+	}
+	defer store.Shutdown()
+
+	info, err := store.GetBlockchainInfo()
+	if err != nil {
+		return fmt.Errorf("cannot read ledger of channel %s: %s", *channel, err)
+	}
+	if *to == 0 || *to >= info.Height {
+		*to = info.Height - 1
+	}
+
+	var counts verifyCounts
+	for number := *from; number <= *to; number++ {
+		block, err := store.RetrieveBlockByNumber(number)
+		if err != nil {
+			return fmt.Errorf("cannot read block %d: %s", number, err)
+		}
+		counts.blocks++
+		verifyBlock(block, keys, &counts)
+	}
+
+	fmt.Printf("Verified %d block(s) of channel %s\n", counts.blocks, *channel)
+	fmt.Printf("Signed: %d, failed: %d, unsigned: %d, not proven (hmac-sha256): %d\n", counts.signed, counts.failed, counts.unsigned, counts.unproven)
+	fmt.Printf("Valid txs not signed valid (validated in software): %d\n", counts.unsignedTxs)
+	fmt.Printf("Signed valid txs invalidated by the peer: %d\n", counts.peerInvalid)
+	if counts.failed > 0 || (*require && counts.unsigned+counts.unproven > 0) {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// verifyBlock checks the result signature of a block against the block and its validation flags
+func verifyBlock(block *cb.Block, keys map[uint8][]byte, counts *verifyCounts) {
+	number := block.Header.Number
+	attestation, err := fmapi.GetResultAttestation(block)
+	if err != nil {
+		fmt.Printf("Block %d: %s\n", number, err)
+		counts.failed++
+		return
+	}
+	if attestation == nil {
+		counts.unsigned++
+		return
+	}
+	if attestation.Algorithm != fmapi.ResultSignatureEd25519 {
+		fmt.Printf("Block %d: signed with %s, which does not prove that validation flags come from a Fabric machine\n", number, attestation.Algorithm)
+		counts.unproven++
+		return
+	}
+
+	var data [][]byte
+	if block.Data != nil {
+		data = block.Data.Data
+	}
+	switch {
+	case attestation.BlockNum != number:
+		err = fmt.Errorf("signed for block %d", attestation.BlockNum)
+	case int(attestation.NumTxs) != len(data):
+		err = fmt.Errorf("signed for %d transaction(s) but block has %d", attestation.NumTxs, len(data))
+	case attestation.DataHash != fmapi.BlockDataHash(data):
+		err = fmt.Errorf("signed data hash %016x does not match block data hash %016x", attestation.DataHash, fmapi.BlockDataHash(data))
+	default:
+		err = attestation.Verify(keys)
+	}
+	if err != nil {
+		fmt.Printf("Block %d: %s\n", number, err)
+		counts.failed++
+		return
+	}
+	counts.signed++
+
+	metadata := block.Metadata.GetMetadata()
+	if len(metadata) <= int(cb.BlockMetadataIndex_TRANSACTIONS_FILTER) {
+		return
+	}
+	flags := txflags.ValidationFlags(metadata[cb.BlockMetadataIndex_TRANSACTIONS_FILTER])
+	for i := 0; i < len(flags) && i < len(data); i++ {
+		valid := flags.Flag(i) == peer.TxValidationCode_VALID
+		if valid && !attestation.IsValid(i) {
+			fmt.Printf("Block %d tx%d: valid in the ledger, not signed valid\n", number, i)
+			counts.unsignedTxs++
+		} else if !valid && attestation.IsValid(i) {
+			counts.peerInvalid++
+		}
+	}
+}
@@ -0,0 +1,372 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// decoder.go parses blockchain machine protocol packets sent by orderers back into structured
+// values, and reassembles the blocks they carry, as a hardware peer sees them.
+package fmdecoder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric/fabricmachine/protocol"
+	"github.com/pkg/errors"
+)
+
+// TransportHeader is the transport header of a blockchain machine protocol packet.
+type TransportHeader struct {
+	Sequence      uint16
+	Control       byte
+	MsgType       byte
+	AnnotationNum int
+}
+
+// Annotation locates data in the payload of a message (pointer), or refers to data cached in the
+// hardware peer (locator), in which case Desc is the cache id.
+type Annotation struct {
+	DataType byte // without the locator bit
+	Locator  bool
+	Offset   uint16
+	Desc     uint16
+}
+
+// Message is a decoded blockchain machine protocol packet.
+type Message struct {
+	Header      TransportHeader
+	Annotations []Annotation
+	Payload     []byte
+}
+
+// DecodePacket parses a packet, without its authentication trailer.
+func DecodePacket(packet []byte) (*Message, error) {
+	if len(packet) < fmprotocol.BCM_TRANSPORT_HEADER_SIZE {
+		return nil, errors.Errorf("packet too short: %d bytes", len(packet))
+	}
+	m := &Message{
+		Header: TransportHeader{
+			Sequence:      binary.BigEndian.Uint16(packet[0:2]),
+			Control:       packet[2] >> 4,
+			MsgType:       packet[2] & 0x0F,
+			AnnotationNum: int(packet[3]),
+		},
+	}
+
+	pos := fmprotocol.BCM_TRANSPORT_HEADER_SIZE
+	end := pos + m.Header.AnnotationNum*fmprotocol.ANNOTATION_SIZE
+	if end > len(packet) {
+		return nil, errors.Errorf("packet %d too short for %d annotation(s)", m.Header.Sequence, m.Header.AnnotationNum)
+	}
+	for ; pos < end; pos += fmprotocol.ANNOTATION_SIZE {
+		m.Annotations = append(m.Annotations, Annotation{
+			DataType: packet[pos] & fmprotocol.ANNOTATION_DATA_TYPE_MASK,
+			Locator:  packet[pos]&fmprotocol.ANNOTATION_TYPE_MASK == fmprotocol.ANNOTATION_TYPE_LOCATOR,
+			Offset:   binary.BigEndian.Uint16(packet[pos+1 : pos+3]),
+			Desc:     binary.BigEndian.Uint16(packet[pos+3 : pos+5]),
+		})
+	}
+	m.Payload = packet[end:]
+	return m, nil
+}
+
+// Find returns the first annotation of a data type.
+func (m *Message) Find(dataType byte) (Annotation, bool) {
+	for _, a := range m.Annotations {
+		if a.DataType == dataType {
+			return a, true
+		}
+	}
+	return Annotation{}, false
+}
+
+// Data returns the payload data a pointer annotation refers to.
+func (m *Message) Data(a Annotation) ([]byte, error) {
+	if a.Locator {
+		return nil, errors.Errorf("annotation 0x%x is a locator", a.DataType)
+	}
+	if int(a.Offset)+int(a.Desc) > len(m.Payload) {
+		return nil, errors.Errorf("annotation 0x%x at %d+%d overruns payload of %d bytes", a.DataType, a.Offset, a.Desc, len(m.Payload))
+	}
+	return m.Payload[a.Offset : a.Offset+a.Desc], nil
+}
+
+var msgTypeNames = map[byte]string{
+	fmprotocol.BCM_MSG_TYPE_CACHE_UPDATE:       "cache update",
+	fmprotocol.BCM_MSG_TYPE_BLOCK_HEADER:       "block header",
+	fmprotocol.BCM_MSG_TYPE_TRANSACTION:        "transaction",
+	fmprotocol.BCM_MSG_TYPE_BLOCK_METADATA:     "block metadata",
+	fmprotocol.BCM_MSG_TYPE_CAPABILITY:         "capability",
+	fmprotocol.BCM_MSG_TYPE_ENDORSEMENT_POLICY: "endorsement policy",
+	fmprotocol.BCM_MSG_TYPE_TXID_SEED:          "tx id seed",
+	fmprotocol.BCM_MSG_TYPE_ACK:                "ack",
+}
+
+var dataTypeNames = map[byte]string{
+	fmprotocol.ANNOTATION_DATA_TYPE_BLOCKHEADER:        "block header",
+	fmprotocol.ANNOTATION_DATA_TYPE_TRANSACTION:        "transactions",
+	fmprotocol.ANNOTATION_DATA_TYPE_BLOCKMETADATA:      "block metadata",
+	fmprotocol.ANNOTATION_DATA_TYPE_BLOCK_ID:           "block id",
+	fmprotocol.ANNOTATION_DATA_TYPE_TX_START:           "tx start",
+	fmprotocol.ANNOTATION_DATA_TYPE_CHANNEL_NAME:       "channel name",
+	fmprotocol.ANNOTATION_DATA_TYPE_TX_ID:              "tx id",
+	fmprotocol.ANNOTATION_DATA_TYPE_CHAINCODE_NAME:     "chaincode name",
+	fmprotocol.ANNOTATION_DATA_TYPE_CREATER_CA:         "creator identity",
+	fmprotocol.ANNOTATION_DATA_TYPE_TX_ACTION:          "tx action",
+	fmprotocol.ANNOTATION_DATA_TYPE_TX_CA:              "tx action identity",
+	fmprotocol.ANNOTATION_DATA_TYPE_CONTRACT_NAME:      "contract name",
+	fmprotocol.ANNOTATION_DATA_TYPE_CONTRACT_INPUT:     "contract input",
+	fmprotocol.ANNOTATION_DATA_TYPE_ENDORSER_ACTION:    "endorser action",
+	fmprotocol.ANNOTATION_DATA_TYPE_RW_SET:             "read/write set",
+	fmprotocol.ANNOTATION_DATA_TYPE_ENDORSER:           "endorsements",
+	fmprotocol.ANNOTATION_DATA_TYPE_ENDORSER_CA:        "endorser identity",
+	fmprotocol.ANNOTATION_DATA_TYPE_ENDORSER_SIG:       "endorser signature",
+	fmprotocol.ANNOTATION_DATA_TYPE_TX_SIG:             "tx signature",
+	fmprotocol.ANNOTATION_DATA_TYPE_RANGE_QUERY:        "range query",
+	fmprotocol.ANNOTATION_DATA_TYPE_RANGE_QUERY_HASHES: "range query hashes",
+	fmprotocol.ANNOTATION_DATA_TYPE_COLLECTION_NAME:    "collection name",
+	fmprotocol.ANNOTATION_DATA_TYPE_COLLECTION_RW_SET:  "collection read/write set",
+	fmprotocol.ANNOTATION_DATA_TYPE_ORDERER_CA:         "orderer identity",
+	fmprotocol.ANNOTATION_DATA_TYPE_ORDERER_SIG:        "orderer signature",
+	fmprotocol.ANNOTATION_DATA_TYPE_CACHE_DATA:         "cache data",
+	fmprotocol.ANNOTATION_DATA_TYPE_CACHE_NAME:         "cache name",
+	fmprotocol.ANNOTATION_DATA_TYPE_CACHE_CA:           "cache certificate",
+	fmprotocol.ANNOTATION_DATA_TYPE_CACHE_SERIAL:       "revoked serial",
+	fmprotocol.ANNOTATION_DATA_TYPE_CACHE_ISSUER:       "revoked serial issuer",
+	fmprotocol.ANNOTATION_DATA_TYPE_TXID_SEED:          "tx id seed",
+	fmprotocol.ANNOTATION_DATA_TYPE_POLICY_CHAINCODE:   "policy chaincode",
+	fmprotocol.ANNOTATION_DATA_TYPE_POLICY_RULE:        "policy rule",
+	fmprotocol.ANNOTATION_DATA_TYPE_POLICY_COMMIT:      "policy commit",
+}
+
+// MsgTypeName returns the name of a message type.
+func MsgTypeName(msgType byte) string {
+	if name, ok := msgTypeNames[msgType]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(0x%x)", msgType)
+}
+
+// DataTypeName returns the name of an annotation data type.
+func DataTypeName(dataType byte) string {
+	if name, ok := dataTypeNames[dataType]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(0x%x)", dataType)
+}
+
+// String dissects a message, one annotation per line.
+func (m *Message) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#%d %s control=0x%x annotations=%d payload=%dB",
+		m.Header.Sequence, MsgTypeName(m.Header.MsgType), m.Header.Control, m.Header.AnnotationNum, len(m.Payload))
+	for _, a := range m.Annotations {
+		if a.Locator {
+			fmt.Fprintf(&b, "\n  locator 0x%02x %-26s at %d, cache id %d", a.DataType, DataTypeName(a.DataType), a.Offset, a.Desc)
+		} else {
+			fmt.Fprintf(&b, "\n  pointer 0x%02x %-26s at %d, %d", a.DataType, DataTypeName(a.DataType), a.Offset, a.Desc)
+		}
+	}
+	return b.String()
+}
+
+// Decoder decodes the packets sent by an orderer to a hardware peer, in order. It keeps the
+// certificate cache up to date from cache update messages, to restore the identities that
+// locators replace, and reassembles blocks.
+type Decoder struct {
+	verifier     *fmprotocol.BcmVerifier
+	certificates map[uint16][]byte
+
+	// block being reassembled
+	blockData      []byte
+	transactions   int
+	blockNumber    uint64
+	inBlock        bool
+	receivedTxs    int
+	transactionMsg []*Message
+}
+
+// NewDecoder creates a decoder. Packets are authenticated with verifier, unless nil.
+func NewDecoder(verifier *fmprotocol.BcmVerifier) *Decoder {
+	return &Decoder{
+		verifier:     verifier,
+		certificates: make(map[uint16][]byte),
+	}
+}
+
+// Certificate returns the serialized identity cached with an id.
+func (d *Decoder) Certificate(id uint16) ([]byte, bool) {
+	cert, ok := d.certificates[id]
+	return cert, ok
+}
+
+// Decode parses a packet and applies it: cache update messages update the certificate cache, and
+// block messages are reassembled. It returns the message, and the block when the packet completes
+// one. Transactions of the block are also returned as messages by Transactions.
+func (d *Decoder) Decode(packet []byte) (*Message, *cb.Block, error) {
+	if d.verifier != nil {
+		var err error
+		if packet, err = d.verifier.Verify(packet); err != nil {
+			return nil, nil, err
+		}
+	}
+	m, err := DecodePacket(packet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch m.Header.MsgType {
+	case fmprotocol.BCM_MSG_TYPE_CACHE_UPDATE:
+		return m, nil, d.applyCacheUpdate(m)
+	case fmprotocol.BCM_MSG_TYPE_BLOCK_HEADER:
+		return m, nil, d.startBlock(m)
+	case fmprotocol.BCM_MSG_TYPE_TRANSACTION:
+		return m, nil, d.addTransaction(m)
+	case fmprotocol.BCM_MSG_TYPE_BLOCK_METADATA:
+		block, err := d.endBlock(m)
+		return m, block, err
+	}
+	return m, nil, nil
+}
+
+// Transactions returns the transaction messages of the last block.
+func (d *Decoder) Transactions() []*Message {
+	return d.transactionMsg
+}
+
+// applyCacheUpdate updates the certificate cache
+func (d *Decoder) applyCacheUpdate(m *Message) error {
+	if len(m.Annotations) == 0 {
+		return errors.New("cache update without annotations")
+	}
+	id := m.Annotations[0].Offset
+	switch m.Header.Control {
+	case fmprotocol.BCM_CACHE_OP_ADD, fmprotocol.BCM_CACHE_OP_UPDATE:
+		if int(m.Annotations[0].Desc) != len(m.Payload) {
+			return errors.Errorf("cache update %d of %d bytes, expected %d", id, len(m.Payload), m.Annotations[0].Desc)
+		}
+		d.certificates[id] = append([]byte(nil), m.Payload...)
+	case fmprotocol.BCM_CACHE_OP_REMOVE:
+		delete(d.certificates, id)
+	case fmprotocol.BCM_CACHE_OP_REVOKE, fmprotocol.BCM_CACHE_OP_UNREVOKE:
+		// Revoked certificates are removed by the orderer afterwards, and cached again when
+		// reinstated.
+	default:
+		return errors.Errorf("unknown cache operation %d", m.Header.Control)
+	}
+	return nil
+}
+
+// startBlock starts reassembling a block from its header message
+func (d *Decoder) startBlock(m *Message) error {
+	d.inBlock = false
+	transactions, ok := m.Find(fmprotocol.ANNOTATION_DATA_TYPE_TRANSACTION)
+	if !ok {
+		return errors.New("block header without transaction count")
+	}
+	header, ok := m.Find(fmprotocol.ANNOTATION_DATA_TYPE_BLOCKHEADER)
+	if !ok {
+		return errors.New("block header without header annotation")
+	}
+	data, err := m.Data(header)
+	if err != nil {
+		return err
+	}
+
+	d.blockData = append(d.blockData[:0], data...)
+	d.transactions = int(transactions.Offset)
+	d.receivedTxs = 0
+	d.transactionMsg = nil
+	d.inBlock = true
+	d.blockNumber = 0
+	if id, ok := m.Find(fmprotocol.ANNOTATION_DATA_TYPE_BLOCK_ID); ok {
+		number, err := m.Data(id)
+		if err != nil {
+			return err
+		}
+		d.blockNumber, _ = proto.DecodeVarint(number)
+	}
+	return nil
+}
+
+// addTransaction adds a transaction to the block being reassembled
+func (d *Decoder) addTransaction(m *Message) error {
+	if !d.inBlock {
+		return errors.New("transaction outside of a block")
+	}
+	if d.receivedTxs == d.transactions {
+		d.inBlock = false
+		return errors.Errorf("block %d has more than %d transaction(s)", d.blockNumber, d.transactions)
+	}
+	data, err := d.RestorePayload(m)
+	if err != nil {
+		d.inBlock = false
+		return errors.WithMessagef(err, "cannot restore block %d tx%d", d.blockNumber, d.receivedTxs)
+	}
+	d.blockData = append(d.blockData, data...)
+	d.receivedTxs++
+	d.transactionMsg = append(d.transactionMsg, m)
+	return nil
+}
+
+// endBlock completes the block being reassembled with its metadata message
+func (d *Decoder) endBlock(m *Message) (*cb.Block, error) {
+	if !d.inBlock {
+		return nil, errors.New("block metadata outside of a block")
+	}
+	d.inBlock = false
+	if d.receivedTxs != d.transactions {
+		return nil, errors.Errorf("block %d has %d transaction(s), expected %d", d.blockNumber, d.receivedTxs, d.transactions)
+	}
+	data, err := d.RestorePayload(m)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot restore block %d metadata", d.blockNumber)
+	}
+	d.blockData = append(d.blockData, data...)
+
+	block := &cb.Block{}
+	if err := proto.Unmarshal(d.blockData, block); err != nil {
+		return nil, errors.Wrapf(err, "cannot unmarshal block %d", d.blockNumber)
+	}
+	if block.Header.GetNumber() != d.blockNumber {
+		return nil, errors.Errorf("block id %d does not match block number %d", d.blockNumber, block.Header.GetNumber())
+	}
+	return block, nil
+}
+
+// RestorePayload returns the payload of a message with the identities its locators refer to put
+// back in place, as they were before the orderer removed them.
+func (d *Decoder) RestorePayload(m *Message) ([]byte, error) {
+	var locators []Annotation
+	for _, a := range m.Annotations {
+		if a.Locator {
+			locators = append(locators, a)
+		}
+	}
+	if len(locators) == 0 {
+		return m.Payload, nil
+	}
+	sort.SliceStable(locators, func(i, j int) bool { return locators[i].Offset < locators[j].Offset })
+
+	payload := make([]byte, 0, len(m.Payload))
+	start := 0
+	for _, a := range locators {
+		if int(a.Offset) < start || int(a.Offset) > len(m.Payload) {
+			return nil, errors.Errorf("locator 0x%x at %d out of payload of %d bytes", a.DataType, a.Offset, len(m.Payload))
+		}
+		cert, ok := d.certificates[a.Desc]
+		if !ok {
+			return nil, errors.Errorf("locator 0x%x refers to uncached certificate %d", a.DataType, a.Desc)
+		}
+		payload = append(payload, m.Payload[start:a.Offset]...)
+		payload = append(payload, cert...)
+		start = int(a.Offset)
+	}
+	payload = append(payload, m.Payload[start:]...)
+	return payload, nil
+}
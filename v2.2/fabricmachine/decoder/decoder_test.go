@@ -0,0 +1,216 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmdecoder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	fmapi "github.com/hyperledger/fabric/fabricmachine/api"
+	"github.com/hyperledger/fabric/fabricmachine/protocol"
+	"github.com/hyperledger/fabric/fabricmachine/testutil"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// testConfig is the Fabric machine configuration of the tests. Certificate cache updates are not
+// acknowledged, since the fake transport never responds.
+const testConfig = `
+hardware:
+  protocol:
+    address: decoder
+    orderers: [orderer.example.com]
+    certificateMiss: install
+    certificateAckTimeout: 0s
+    sendBatchSize: 64
+    capabilities:
+      certificateCacheSize: 64
+      certificateIdRoleBits: 2
+      certificateIdOrgBits: 4
+      maxIdentitySize: 2048
+      maxEndorsers: 4
+      maxTransactionSize: 65535
+`
+
+// initTestConfig initializes the Fabric machine configuration and protocol from testConfig.
+func initTestConfig(t *testing.T) {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "fabric_machine.yaml")
+	if err := ioutil.WriteFile(configFile, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	v.Set("fabric.hw.config.file", configFile)
+	if err := fmapi.InitConfig(v); err != nil {
+		t.Fatal(err)
+	}
+	if err := fmprotocol.InitConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeTransport records the packets sent to the hardware peer instead of sending them.
+type fakeTransport struct {
+	sync.Mutex
+	packets [][]byte
+}
+
+func (t *fakeTransport) Send(packet []byte) error {
+	t.Lock()
+	defer t.Unlock()
+	t.packets = append(t.packets, append([]byte{}, packet...))
+	return nil
+}
+
+func (t *fakeTransport) SendBatch(packets [][]byte) (int, error) {
+	for _, packet := range packets {
+		t.Send(packet)
+	}
+	return len(packets), nil
+}
+
+func (t *fakeTransport) Receive(buff []byte, deadline time.Time) (int, error) {
+	return 0, errors.New("no packet")
+}
+
+func (t *fakeTransport) Close() error {
+	return nil
+}
+
+// sent returns the packets sent so far and forgets about them.
+func (t *fakeTransport) sent() [][]byte {
+	t.Lock()
+	defer t.Unlock()
+	packets := t.packets
+	t.packets = nil
+	return packets
+}
+
+// decode decodes packets in order, and returns the last block they carry.
+func decode(t *testing.T, d *Decoder, packets [][]byte) *cb.Block {
+	t.Helper()
+	var block *cb.Block
+	for _, packet := range packets {
+		m, b, err := d.Decode(packet)
+		if err != nil {
+			t.Fatalf("cannot decode packet: %s", err)
+		}
+		t.Log(m)
+		if b != nil {
+			block = b
+		}
+	}
+	if block == nil {
+		t.Fatal("no block decoded")
+	}
+	return block
+}
+
+// annotationData returns the data a transaction annotation refers to, restoring the identities
+// of locators from the certificate cache.
+func annotationData(t *testing.T, d *Decoder, m *Message, dataType byte) []byte {
+	t.Helper()
+	a, ok := m.Find(dataType)
+	if !ok {
+		t.Fatalf("transaction %d without %s annotation", m.Header.Sequence, DataTypeName(dataType))
+	}
+	if a.Locator {
+		identity, ok := d.Certificate(a.Desc)
+		if !ok {
+			t.Fatalf("%s locator refers to uncached certificate %d", DataTypeName(dataType), a.Desc)
+		}
+		return identity
+	}
+	data, err := m.Data(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeBlock(t *testing.T) {
+	initTestConfig(t)
+	transport := &fakeTransport{}
+	fmprotocol.OpenBcmSession("decoder", transport)
+	if err := fmprotocol.StartReplay("decoder"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate of the first transaction is installed in the certificate cache, and replaced
+	// by a locator. Certificate chains cannot be cached, so the second transaction carries its
+	// creator inline.
+	client := testutil.Identity("Org1MSP", testutil.NewCertificate("client"))
+	chain := testutil.Identity("Org1MSP", append(testutil.NewCertificate("user"), testutil.NewCertificate("ca")...))
+	endorser := testutil.Identity("Org2MSP", testutil.NewCertificate("peer0"))
+	txs := []*testutil.Tx{
+		{TxId: "tx1", Chaincode: "mycc", Args: []string{"put", "a"}, Creator: client, Endorsers: [][]byte{endorser}},
+		{TxId: "tx2", Chaincode: "mycc", Args: []string{"put", "b"}, Creator: chain, Endorsers: [][]byte{endorser}},
+	}
+	var envelopes []*cb.Envelope
+	for _, tx := range txs {
+		envelopes = append(envelopes, testutil.NewEnvelope(tx))
+	}
+	orderer := testutil.Identity("OrdererMSP", testutil.NewCertificate("orderer"))
+	config := testutil.NewConfigBlock(0, orderer, "OrdererMSP", "Org1MSP", "Org2MSP")
+	block := testutil.NewBlock(1, orderer, envelopes...)
+
+	getBlock := func(number uint64) *cb.Block {
+		if number == 0 {
+			return config
+		}
+		return nil
+	}
+	if _, err := fmprotocol.ReplayBlock(block, getBlock); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDecoder(nil)
+	check := func(t *testing.T, decoded *cb.Block) {
+		if !proto.Equal(decoded, block) {
+			t.Fatal("decoded block does not match the block sent")
+		}
+		transactions := d.Transactions()
+		if len(transactions) != len(txs) {
+			t.Fatalf("%d transaction message(s) instead of %d", len(transactions), len(txs))
+		}
+		for i, m := range transactions {
+			if txId := annotationData(t, d, m, fmprotocol.ANNOTATION_DATA_TYPE_TX_ID); string(txId) != txs[i].TxId {
+				t.Errorf("tx%d: TX ID %s instead of %s", i, txId, txs[i].TxId)
+			}
+			if name := annotationData(t, d, m, fmprotocol.ANNOTATION_DATA_TYPE_CHAINCODE_NAME); string(name) != txs[i].Chaincode {
+				t.Errorf("tx%d: chaincode %s instead of %s", i, name, txs[i].Chaincode)
+			}
+			if creator := annotationData(t, d, m, fmprotocol.ANNOTATION_DATA_TYPE_CREATER_CA); !bytes.Equal(creator, txs[i].Creator) {
+				t.Errorf("tx%d: creator %x instead of %x", i, creator, txs[i].Creator)
+			}
+			if endorser := annotationData(t, d, m, fmprotocol.ANNOTATION_DATA_TYPE_ENDORSER_CA); !bytes.Equal(endorser, txs[i].Endorsers[0]) {
+				t.Errorf("tx%d: endorser %x instead of %x", i, endorser, txs[i].Endorsers[0])
+			}
+		}
+		if creator, _ := transactions[0].Find(fmprotocol.ANNOTATION_DATA_TYPE_CREATER_CA); !creator.Locator {
+			t.Error("cached creator sent inline")
+		}
+		if creator, _ := transactions[1].Find(fmprotocol.ANNOTATION_DATA_TYPE_CREATER_CA); creator.Locator {
+			t.Error("certificate chain replaced by a locator")
+		}
+	}
+
+	t.Run("SendBlock", func(t *testing.T) {
+		check(t, decode(t, d, transport.sent()))
+	})
+	t.Run("SendBlockBytes", func(t *testing.T) {
+		if err := fmprotocol.SendBlockBytes("decoder", testutil.Marshal(block), 1, nil); err != nil {
+			t.Fatal(err)
+		}
+		check(t, decode(t, d, transport.sent()))
+	})
+}
@@ -61,6 +61,9 @@ func (pcie *PCIeMemMap) ReadAt(offset uint32) (uint32, error) {
 	if pcie.memMap == nil {
 		return 0, fmt.Errorf("Memory map doesn't exist for %v", pcie.resourceFile)
 	}
+	if offset%4 != 0 || uint64(offset)+4 > uint64(len(pcie.memMap)) {
+		return 0, fmt.Errorf("Invalid register offset %#x for %v", offset, pcie.resourceFile)
+	}
 
 	addr := (*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(&pcie.memMap[0])) + uintptr(offset)))
 	val := *addr
@@ -72,6 +75,9 @@ func (pcie *PCIeMemMap) WriteAt(offset, data uint32) error {
 	if pcie.memMap == nil {
 		return fmt.Errorf("Memory map doesn't exist for %v", pcie.resourceFile)
 	}
+	if offset%4 != 0 || uint64(offset)+4 > uint64(len(pcie.memMap)) {
+		return fmt.Errorf("Invalid register offset %#x for %v", offset, pcie.resourceFile)
+	}
 
 	*(*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(&pcie.memMap[0])) + uintptr(offset))) = data
 	return nil
@@ -0,0 +1,108 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CachedCertificate describes a certificate of the certificate cache file
+type CachedCertificate struct {
+	Id         int
+	MspId      string
+	Role       string
+	FromConfig bool
+	Subject    string
+	NotAfter   time.Time
+}
+
+// ReadCertificateCacheFile returns the certificates of a certificate cache file, which holds the
+// certificates the orderer installed in the hardware peer, ordered by id
+func ReadCertificateCacheFile(path string) ([]CachedCertificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var persisted persistedCertificateCache
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse certificate cache file %s", path)
+	}
+
+	roles := persisted.Roles
+	if len(roles) == 0 {
+		roles = defaultIdentityRoles
+	}
+	certificates := make([]CachedCertificate, 0, len(persisted.Certificates))
+	for _, c := range persisted.Certificates {
+		certificate := CachedCertificate{Id: c.Id, MspId: c.MspId, Role: "unknown", FromConfig: c.FromConfig}
+		if c.Role >= 0 && c.Role < len(roles) {
+			certificate.Role = roles[c.Role]
+		}
+		if block, _ := pem.Decode(c.Cert); block != nil {
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				certificate.Subject = cert.Subject.String()
+				certificate.NotAfter = cert.NotAfter
+			}
+		}
+		certificates = append(certificates, certificate)
+	}
+	sort.Slice(certificates, func(i, j int) bool { return certificates[i].Id < certificates[j].Id })
+	return certificates, nil
+}
+
+// LoadCertificateCache restores the certificate cache from the configured certificate cache file,
+// after asking the hardware peer at addr for its capabilities, so that blocks sent outside of the
+// orderer refer to the certificates the hardware peer holds. It fails when the hardware peer
+// cannot validate transactions within the configured limits.
+func LoadCertificateCache(addr string) error {
+	if err := negotiateCapabilities(addr); err != nil {
+		return err
+	}
+	initCertificateCache()
+	loadCertificateCache()
+	return nil
+}
+
+// PushCertificateCache installs the certificates of the configured certificate cache file in the
+// hardware peer at addr, as the orderer does at startup. It returns how many certificates were
+// installed.
+func PushCertificateCache(addr string) (int, error) {
+	if err := LoadCertificateCache(addr); err != nil {
+		return 0, err
+	}
+	if len(CertificateIdCache) == 0 {
+		return 0, errors.New("no certificate to push")
+	}
+
+	ids := make([]int, 0, len(CertificateIdCache))
+	for id := range CertificateIdCache {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	installed := 0
+	var failed []int
+	for _, id := range ids {
+		if err := sendCertificateCacheUpdate(addr, BCM_CACHE_OP_UPDATE, CertificateIdCache[id]); err != nil {
+			logger.Warningf("Cannot install certificate with id=%d: %s", id, err)
+			failed = append(failed, id)
+			continue
+		}
+		installed++
+	}
+	if len(failed) > 0 {
+		return installed, errors.Errorf("cannot install certificates with ids %v", failed)
+	}
+	return installed, nil
+}
@@ -7,11 +7,13 @@ SPDX-License-Identifier: Apache-2.0
 package fmprotocol
 
 import (
-	"bytes"
 	"encoding/binary"
-)
+	"math/big"
+	"sort"
 
-const MAX_ENDORSER_NUM int = 8
+	"github.com/hyperledger/fabric/fabricmachine/api"
+	"github.com/pkg/errors"
+)
 
 type AnnotationPointer struct {
 	dataType uint8
@@ -62,6 +64,10 @@ const ANNOTATION_DATA_TYPE_ENDORSER byte = 0x2b
 const ANNOTATION_DATA_TYPE_ENDORSER_CA byte = 0x2c
 const ANNOTATION_DATA_TYPE_ENDORSER_SIG byte = 0x2d
 const ANNOTATION_DATA_TYPE_TX_SIG byte = 0x2e
+const ANNOTATION_DATA_TYPE_RANGE_QUERY byte = 0x2f
+const ANNOTATION_DATA_TYPE_RANGE_QUERY_HASHES byte = 0x30
+const ANNOTATION_DATA_TYPE_COLLECTION_NAME byte = 0x31
+const ANNOTATION_DATA_TYPE_COLLECTION_RW_SET byte = 0x32
 
 // annotations for block metata
 const ANNOTATION_DATA_TYPE_ORDERER_CA byte = 0x40
@@ -71,6 +77,16 @@ const ANNOTATION_DATA_TYPE_ORDERER_SIG byte = 0x41
 const ANNOTATION_DATA_TYPE_CACHE_DATA byte = 0x01
 const ANNOTATION_DATA_TYPE_CACHE_NAME byte = 0x02
 const ANNOTATION_DATA_TYPE_CACHE_CA byte = 0x03
+const ANNOTATION_DATA_TYPE_CACHE_SERIAL byte = 0x04
+const ANNOTATION_DATA_TYPE_CACHE_ISSUER byte = 0x05
+
+// annotations for TX ID index seed message
+const ANNOTATION_DATA_TYPE_TXID_SEED byte = 0x60
+
+// annotations for endorsement policy message
+const ANNOTATION_DATA_TYPE_POLICY_CHAINCODE byte = 0x50
+const ANNOTATION_DATA_TYPE_POLICY_RULE byte = 0x51
+const ANNOTATION_DATA_TYPE_POLICY_COMMIT byte = 0x52
 
 type AnnotationInfo struct {
 	annotationType byte
@@ -92,7 +108,7 @@ var blockTransactionAnnotationInfoList []AnnotationInfo = []AnnotationInfo{
 	// transaction start
 	{ANNOTATION_TYPE_POINTER | ANNOTATION_DATA_TYPE_TX_START, []int{1, 2}},
 	// transaction id
-	// {ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_TX_ID, []int{1, 1, 1, 1, 5}}, //not required by hw accelerator
+	{ANNOTATION_TYPE_POINTER | ANNOTATION_DATA_TYPE_TX_ID, []int{1, 1, 1, 1, 5}},
 	// Chaincode name
 	{ANNOTATION_TYPE_POINTER | ANNOTATION_DATA_TYPE_CHAINCODE_NAME, []int{1, 1, 1, 1, 7, 2, 2}},
 	// Creater CA/identity
@@ -101,12 +117,18 @@ var blockTransactionAnnotationInfoList []AnnotationInfo = []AnnotationInfo{
 	{ANNOTATION_TYPE_POINTER | ANNOTATION_DATA_TYPE_TX_ACTION, []int{1, 1, 2, 1}},
 	// TX CA/identity
 	{ANNOTATION_TYPE_LOCATOR | ANNOTATION_DATA_TYPE_TX_CA, []int{1, 1, 2, 1, 1, 1}},
-	// TODO: smart contract name
-	// TODO: smart contract input
+	// Smart contract name (first argument of the chaincode input)
+	{ANNOTATION_TYPE_POINTER | ANNOTATION_DATA_TYPE_CONTRACT_NAME, []int{1, 1, 2, 1, 2, 1, 1, 1, 3, 1}},
+	// Smart contract input (chaincode input with all arguments)
+	{ANNOTATION_TYPE_POINTER | ANNOTATION_DATA_TYPE_CONTRACT_INPUT, []int{1, 1, 2, 1, 2, 1, 1, 1, 3}},
 	// Endorser action
 	{ANNOTATION_TYPE_POINTER | ANNOTATION_DATA_TYPE_ENDORSER_ACTION, []int{1, 1, 2, 1, 2, 1}},
 	// Read/Write set
 	{ANNOTATION_TYPE_POINTER | ANNOTATION_DATA_TYPE_RW_SET, []int{1, 1, 2, 1, 2, 2, 1, 2, 1}},
+	// Range query info and merkle summary list (within the read/write set)
+	{ANNOTATION_TYPE_POINTER | ANNOTATION_DATA_TYPE_RANGE_QUERY, []int{1, 1, 2, 1, 2, 2, 1, 2, 1}},
+	// Private data collection name and hashed read/write set list (within the read/write set)
+	{ANNOTATION_TYPE_POINTER | ANNOTATION_DATA_TYPE_COLLECTION_NAME, []int{1, 1, 2, 1, 2, 2, 1, 2, 1}},
 	// Endorser
 	{ANNOTATION_TYPE_POINTER | ANNOTATION_DATA_TYPE_ENDORSER, []int{1, 1, 2, 1, 2, 2, 2}},
 	// Endorser CA/identity list
@@ -132,10 +154,24 @@ var blockCacheUpdateAnnotationInfoList []AnnotationInfo = []AnnotationInfo{
 }
 
 var BlockHeaderAnnotationNumber int = len(blockHeaderAnnotationInfoList)
-var BlockTransactionAnnotationNumber int = len(blockTransactionAnnotationInfoList) - 1 + MAX_ENDORSER_NUM
+var BlockTransactionAnnotationNumber int = fixedAnnotationNumber(blockTransactionAnnotationInfoList)
 var BlockMetadataAnnotationNumber int = len(blockMetadataAnnotationInfoList)
 var CacheUpdateAnnotationNumber int = len(blockCacheUpdateAnnotationInfoList)
 
+// fixedAnnotationNumber returns the number of transaction annotations that are always present.
+// Transactions also carry one endorser CA/identity annotation per endorsement, and two annotations
+// per range query and per private data collection.
+func fixedAnnotationNumber(list []AnnotationInfo) (num int) {
+	for _, annotationInfo := range list {
+		switch annotationInfo.annotationType & ANNOTATION_DATA_TYPE_MASK {
+		case ANNOTATION_DATA_TYPE_ENDORSER_CA, ANNOTATION_DATA_TYPE_RANGE_QUERY, ANNOTATION_DATA_TYPE_COLLECTION_NAME:
+		default:
+			num++
+		}
+	}
+	return num
+}
+
 func makeAnnotation(dataType uint8, offset uint16, desc uint16) (annotation Annotation) {
 	annotation = Annotation{dataType, offset, desc}
 	return annotation
@@ -164,18 +200,30 @@ func setAnnotationOffset(annotation *Annotation, offset uint16) {
 	annotation.offset = offset
 }
 
-// annotationListToBytes serializes annotations to big endian
-func annotationListToBytes(annotation []Annotation) (data []byte) {
-	buf := &bytes.Buffer{}
+func setAnnotationDataType(annotation *Annotation, dataType uint8) {
+	annotation.dataType = dataType
+}
+
+// Size of a serialized annotation in bytes
+const ANNOTATION_SIZE int = 5
+
+// appendAnnotationBytes appends annotations serialized to big endian to dst
+func appendAnnotationBytes(dst []byte, annotation []Annotation) []byte {
 	for i := 0; i < len(annotation); i++ {
-		binary.Write(buf, binary.BigEndian, annotation[i])
+		dst = append(dst, annotation[i].dataType, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(dst[len(dst)-4:], annotation[i].offset)
+		binary.BigEndian.PutUint16(dst[len(dst)-2:], annotation[i].desc)
 	}
-	data = buf.Bytes()
-	return data
+	return dst
+}
+
+// annotationListToBytes serializes annotations to big endian
+func annotationListToBytes(annotation []Annotation) (data []byte) {
+	return appendAnnotationBytes(make([]byte, 0, len(annotation)*ANNOTATION_SIZE), annotation)
 }
 
 // generateBlockAnnotation generates annotation list for block header message
-func generateBlockAnnotation(hdr_pos int, hdr_len int, transaction_len_list []int, data []byte) (ret []Annotation) {
+func generateBlockAnnotation(hdr_pos int, hdr_len int, transaction_len_list []int, data []byte) (ret []Annotation, err error) {
 	ret = make([]Annotation, BlockHeaderAnnotationNumber)
 
 	for i, annotationInfo := range blockHeaderAnnotationInfoList {
@@ -187,131 +235,387 @@ func generateBlockAnnotation(hdr_pos int, hdr_len int, transaction_len_list []in
 		case ANNOTATION_DATA_TYPE_BLOCKMETADATA:
 			ret[i] = makeAnnotation(annotationInfo.annotationType, 1, 0)
 		case ANNOTATION_DATA_TYPE_BLOCK_ID:
-			pos := 0
-			length := 0
-			// block ID : varint
-			_, length, pos = protoGetFieldLength(data, pos)
-			pos, length = protoGetFieldPos(data, 0, length, []int{1})
-			length = 1
-			pos = pos + 1
-			pos_temp := pos
-			for pos_temp < 64 {
-				if (data[pos_temp] & 0x80) != 0x80 {
-					break
-				}
-				pos_temp = pos_temp + 1
-				length = length + 1
+			// block ID : varint in the block header, omitted for block 0
+			pos, length, err := protoGetFieldPos(data, hdr_pos, hdr_len, []int{1, 1})
+			if err != nil {
+				return nil, errors.WithMessage(err, "cannot read block number")
+			}
+			if pos < 0 {
+				pos = hdr_pos
+				length = 0
 			}
-			ret[i] = makeAnnotation(annotationInfo.annotationType, uint16(pos), uint16(length))
+			ret[i] = makeAnnotation(annotationInfo.annotationType, uint16(pos-hdr_pos), uint16(length))
 		}
 	}
-	return ret
+	return ret, nil
 }
 
-// generateTransactionAnnotation generates annotation list for transaction
-func generateTransactionAnnotation(transaction_pos int, transaction_len int, data []byte) (ret []Annotation) {
-	ret = make([]Annotation, BlockTransactionAnnotationNumber)
+// generateTransactionAnnotation generates annotation list and control flags for transaction.
+// The endorser annotation carries the number of endorsements, followed by one endorser CA/identity
+// annotation per endorsement. Transactions with more endorsements than the hardware peer can check
+// are annotated without endorsements and flagged with BCM_CTRL_SOFTWARE_ENDORSEMENT, so that their
+// endorsements are checked in software instead. Range queries and private data collections are
+// annotated right after the read/write set. Invocations of read-only functions without writes are
+// flagged with BCM_CTRL_READ_ONLY. Missing optional fields (e.g. chaincode input without arguments,
+// or empty read/write set) are annotated with empty pointers.
+func generateTransactionAnnotation(transaction_pos int, transaction_len int, data []byte) (ret []Annotation, control byte, err error) {
+	ret = make([]Annotation, 0, BlockTransactionAnnotationNumber)
 	pos := transaction_pos
 	length := 0
-	endorser_end := 0
-
-	i := 0
+	endorser_index := -1
+	chaincode := ""
+	function := ""
+	writes := false
 
 	for _, annotationInfo := range blockTransactionAnnotationInfoList {
-		switch annotationInfo.annotationType & ANNOTATION_DATA_TYPE_MASK {
+		dataType := annotationInfo.annotationType & ANNOTATION_DATA_TYPE_MASK
+		switch dataType {
 		case ANNOTATION_DATA_TYPE_ENDORSER:
-			pos, length = protoGetFieldPos(data, transaction_pos, transaction_len, annotationInfo.path[:len(annotationInfo.path)-1])
-			endorser_end = pos + length
-
-			pos, length = protoGetFieldPos(data, transaction_pos, transaction_len, annotationInfo.path)
-			ret[i] = makeAnnotation(annotationInfo.annotationType, uint16(pos-transaction_pos-3), uint16(length)) // move annotation back to endorser start point (1B type, 2B length)
-			i++
+			// point to the first endorsement, including its key
+			fieldStart := 0
+			fieldStart, pos, length, err = protoGetFieldStart(data, transaction_pos, transaction_len, annotationInfo.path)
+			if err != nil {
+				return nil, 0, err
+			}
+			if pos < 0 {
+				fieldStart = transaction_pos
+				length = 0
+			}
+			endorser_index = len(ret)
+			ret = append(ret, makeAnnotation(annotationInfo.annotationType, uint16(fieldStart-transaction_pos), uint16(length)))
 		case ANNOTATION_DATA_TYPE_ENDORSER_CA:
-			j := 0
-			pos, length = protoGetFieldPos(data, transaction_pos, transaction_len, annotationInfo.path)
-			for j = 0; j < MAX_ENDORSER_NUM; j++ {
-				_, length, pos = protoGetFieldLength(data, pos)
-				ret[i] = makeAnnotation(annotationInfo.annotationType, uint16(pos-transaction_pos), uint16(length))
-				i++
-				// skip signature
-				pos += length
-				_, length, pos = protoGetFieldLength(data, pos)
-
-				pos += length
-				if pos >= endorser_end {
-					break
-				}
-				_, length, pos = protoGetFieldLength(data, pos)
+			if endorser_index < 0 {
+				return nil, 0, errors.New("endorser CA/identity annotation without endorser annotation")
+			}
+			endorsers, err := generateEndorserAnnotation(annotationInfo, transaction_pos, transaction_len, data)
+			if err != nil {
+				return nil, 0, err
+			}
+			if len(endorsers) > hwCapabilities.maxEndorsers {
+				logger.Debugf("Transaction has %d endorsements, hardware checks at most %d", len(endorsers), hwCapabilities.maxEndorsers)
+				setAnnotationDesc(&(ret[endorser_index]), 0)
+				control |= BCM_CTRL_SOFTWARE_ENDORSEMENT
+				continue
+			}
+			setAnnotationDesc(&(ret[endorser_index]), uint16(len(endorsers)))
+			ret = append(ret, endorsers...)
+		case ANNOTATION_DATA_TYPE_RANGE_QUERY, ANNOTATION_DATA_TYPE_COLLECTION_NAME:
+			pos, length, err = protoGetFieldPos(data, transaction_pos, transaction_len, annotationInfo.path)
+			if err != nil {
+				return nil, 0, err
+			}
+			if pos < 0 {
+				continue
 			}
-			j = j + 1
-			setAnnotationDesc(&(ret[i-j-1]), uint16(j))
-			for ; j < MAX_ENDORSER_NUM; j++ {
-				ret[i] = makeAnnotation(0, 0, 0)
-				i++
+			var annotations []Annotation
+			if dataType == ANNOTATION_DATA_TYPE_RANGE_QUERY {
+				annotations, err = generateRangeQueryAnnotation(transaction_pos, pos, length, data)
+			} else {
+				annotations, err = generateCollectionAnnotation(transaction_pos, pos, length, data)
 			}
+			if err != nil {
+				return nil, 0, err
+			}
+			ret = append(ret, annotations...)
 		default:
-			pos, length = protoGetFieldPos(data, transaction_pos, transaction_len, annotationInfo.path)
-			ret[i] = makeAnnotation(annotationInfo.annotationType, uint16(pos-transaction_pos), uint16(length))
-			i++
+			pos, length, err = protoGetFieldPos(data, transaction_pos, transaction_len, annotationInfo.path)
+			if err != nil {
+				return nil, 0, err
+			}
+			if pos < 0 {
+				if annotationInfo.annotationType&ANNOTATION_TYPE_MASK == ANNOTATION_TYPE_LOCATOR {
+					return nil, 0, errors.Errorf("missing identity of annotation type 0x%x", dataType)
+				}
+				pos = transaction_pos
+				length = 0
+			}
+			switch dataType {
+			case ANNOTATION_DATA_TYPE_CHAINCODE_NAME:
+				chaincode = string(data[pos : pos+length])
+			case ANNOTATION_DATA_TYPE_CONTRACT_NAME:
+				function = string(data[pos : pos+length])
+			case ANNOTATION_DATA_TYPE_RW_SET:
+				if writes, err = rwsetHasWrites(pos, length, data); err != nil {
+					return nil, 0, err
+				}
+			}
+			ret = append(ret, makeAnnotation(annotationInfo.annotationType, uint16(pos-transaction_pos), uint16(length)))
 		}
 	}
 
-	return ret
+	if fmapi.IsReadOnlyFunction(chaincode, function) {
+		if writes {
+			logger.Warningf("Read-only function %s of chaincode %s has writes", function, chaincode)
+		} else {
+			control |= BCM_CTRL_READ_ONLY
+		}
+	}
+	return ret, control, nil
 }
 
-// generateBlockMetaAnnotation generates annotation list for block metadata
-func generateBlockMetaAnnotation(metadata_pos int, metadata_len int, data []byte) (ret []Annotation) {
-	pos := metadata_pos
+// generateEndorserAnnotation generates one endorser CA/identity annotation per endorsement of a
+// transaction. The annotation path leads to the endorsements of the endorsed action.
+func generateEndorserAnnotation(annotationInfo AnnotationInfo, transaction_pos int, transaction_len int, data []byte) (ret []Annotation, err error) {
+	path := annotationInfo.path
+	if len(path) == 0 {
+		return nil, errors.New("empty endorser CA/identity annotation path")
+	}
+	action_pos, action_len, err := protoGetFieldPos(data, transaction_pos, transaction_len, path[:len(path)-1])
+	if err != nil || action_pos < 0 {
+		return nil, err
+	}
+
+	field := 0
+	length := 0
+	for pos := action_pos; pos < action_pos+action_len; pos += length {
+		field, length, pos, err = protoGetFieldLength(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		if field != path[len(path)-1] {
+			continue
+		}
+		// endorser: field == 1
+		endorser_pos, endorser_len, err := protoSearchFieldPos(data, pos, length, 1)
+		if err != nil {
+			return nil, err
+		}
+		if endorser_pos < 0 {
+			return nil, errors.Errorf("missing endorser identity at %d", pos-transaction_pos)
+		}
+		ret = append(ret, makeAnnotation(annotationInfo.annotationType, uint16(endorser_pos-transaction_pos), uint16(endorser_len)))
+	}
+	return ret, nil
+}
+
+// rwsetHasWrites returns true when a transaction read/write set (rwset.TxReadWriteSet) writes
+// keys, key metadata or private data
+func rwsetHasWrites(rwset_pos int, rwset_len int, data []byte) (bool, error) {
+	field := 0
 	length := 0
+	var err error
+	for pos := rwset_pos; pos < rwset_pos+rwset_len; pos += length {
+		// namespace read/write set: field == 2
+		field, length, pos, err = protoGetFieldLength(data, pos)
+		if err != nil {
+			return false, err
+		}
+		if field != 2 {
+			continue
+		}
+		// collection hashed read/write sets: field == 3
+		coll_pos, _, err := protoSearchFieldPos(data, pos, length, 3)
+		if err != nil || coll_pos >= 0 {
+			return coll_pos >= 0, err
+		}
+		// key/value read/write set: field == 2, writes: field == 3, metadata writes: field == 4
+		kv_pos, kv_len, err := protoSearchFieldPos(data, pos, length, 2)
+		if err != nil {
+			return false, err
+		}
+		if kv_pos < 0 {
+			continue
+		}
+		for _, kv_field := range []int{3, 4} {
+			write_pos, _, err := protoSearchFieldPos(data, kv_pos, kv_len, kv_field)
+			if err != nil || write_pos >= 0 {
+				return write_pos >= 0, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// generateSoftwareTransactionAnnotation generates annotation list for transaction validated in
+// software, which only locates the transaction id so that the hardware peer adds it to its TX ID
+// index
+func generateSoftwareTransactionAnnotation(transaction_pos int, transaction_len int, data []byte) (ret []Annotation, err error) {
+	for _, annotationInfo := range blockTransactionAnnotationInfoList {
+		if annotationInfo.annotationType&ANNOTATION_DATA_TYPE_MASK != ANNOTATION_DATA_TYPE_TX_ID {
+			continue
+		}
+		pos, length, err := protoGetFieldPos(data, transaction_pos, transaction_len, annotationInfo.path)
+		if err != nil || pos < 0 {
+			return nil, err
+		}
+		ret = append(ret, makeAnnotation(annotationInfo.annotationType, uint16(pos-transaction_pos), uint16(length)))
+	}
+	return ret, nil
+}
+
+// generateRangeQueryAnnotation generates two annotations per range query of a transaction
+// read/write set (rwset.TxReadWriteSet): the range query info (kvrwset.RangeQueryInfo), followed by
+// the merkle summary of its reads. The merkle summary annotation is empty when the range query
+// carries its raw reads instead.
+func generateRangeQueryAnnotation(transaction_pos int, rwset_pos int, rwset_len int, data []byte) (ret []Annotation, err error) {
+	field := 0
+	length := 0
+	for pos := rwset_pos; pos < rwset_pos+rwset_len; pos += length {
+		// namespace read/write set: field == 2
+		field, length, pos, err = protoGetFieldLength(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		if field != 2 {
+			continue
+		}
+
+		// key/value read/write set: field == 2, range queries: field == 2
+		kv_pos, kv_len, err := protoSearchFieldPos(data, pos, length, 2)
+		if err != nil {
+			return nil, err
+		}
+		kv_length := 0
+		for kv := kv_pos; kv_pos >= 0 && kv < kv_pos+kv_len; kv += kv_length {
+			field, kv_length, kv, err = protoGetFieldLength(data, kv)
+			if err != nil {
+				return nil, err
+			}
+			if field != 2 {
+				continue
+			}
+			ret = append(ret, makeAnnotation(ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_RANGE_QUERY, uint16(kv-transaction_pos), uint16(kv_length)))
+
+			// merkle summary of the reads: field == 5
+			hashes_pos, hashes_len, err := protoSearchFieldPos(data, kv, kv_length, 5)
+			if err != nil {
+				return nil, err
+			}
+			if hashes_pos < 0 {
+				hashes_pos = kv
+				hashes_len = 0
+			}
+			ret = append(ret, makeAnnotation(ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_RANGE_QUERY_HASHES, uint16(hashes_pos-transaction_pos), uint16(hashes_len)))
+		}
+	}
+	return ret, nil
+}
+
+// generateCollectionAnnotation generates two annotations per private data collection of a
+// transaction read/write set (rwset.TxReadWriteSet): the collection name, followed by the hashed
+// read/write set of the collection (kvrwset.HashedRWSet), which is empty when the collection has
+// neither hashed reads nor hashed writes.
+func generateCollectionAnnotation(transaction_pos int, rwset_pos int, rwset_len int, data []byte) (ret []Annotation, err error) {
+	field := 0
+	length := 0
+	for pos := rwset_pos; pos < rwset_pos+rwset_len; pos += length {
+		// namespace read/write set: field == 2
+		field, length, pos, err = protoGetFieldLength(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		if field != 2 {
+			continue
+		}
+
+		// collection hashed read/write sets: field == 3
+		ns_length := 0
+		for ns := pos; ns < pos+length; ns += ns_length {
+			field, ns_length, ns, err = protoGetFieldLength(data, ns)
+			if err != nil {
+				return nil, err
+			}
+			if field != 3 {
+				continue
+			}
+			// collection name: field == 1, hashed read/write set: field == 2
+			name_pos, name_len, err := protoSearchFieldPos(data, ns, ns_length, 1)
+			if err != nil {
+				return nil, err
+			}
+			if name_pos < 0 {
+				return nil, errors.Errorf("missing collection name at %d", ns-transaction_pos)
+			}
+			hashed_pos, hashed_len, err := protoSearchFieldPos(data, ns, ns_length, 2)
+			if err != nil {
+				return nil, err
+			}
+			if hashed_pos < 0 {
+				hashed_pos = ns
+				hashed_len = 0
+			}
+			ret = append(ret, makeAnnotation(ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_COLLECTION_NAME, uint16(name_pos-transaction_pos), uint16(name_len)))
+			ret = append(ret, makeAnnotation(ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_COLLECTION_RW_SET, uint16(hashed_pos-transaction_pos), uint16(hashed_len)))
+		}
+	}
+	return ret, nil
+}
+
+// generateBlockMetaAnnotation generates annotation list for block metadata
+func generateBlockMetaAnnotation(metadata_pos int, metadata_len int, data []byte) (ret []Annotation, err error) {
 	ret = make([]Annotation, BlockMetadataAnnotationNumber)
 
 	for i, annotationInfo := range blockMetadataAnnotationInfoList {
 		switch annotationInfo.annotationType & ANNOTATION_DATA_TYPE_MASK {
 		default:
-			pos, length = protoGetFieldPos(data, metadata_pos, metadata_len, annotationInfo.path)
+			pos, length, err := protoGetFieldPos(data, metadata_pos, metadata_len, annotationInfo.path)
+			if err != nil {
+				return nil, err
+			}
+			if pos < 0 {
+				return nil, errors.Errorf("missing block metadata of annotation type 0x%x", annotationInfo.annotationType&ANNOTATION_DATA_TYPE_MASK)
+			}
 			ret[i] = makeAnnotation(annotationInfo.annotationType, uint16(pos-metadata_pos), uint16(length))
 		}
 	}
 
-	return ret
+	return ret, nil
 }
 
-// adjustDataBasedOnLocator removes cached data based on ID number in locators
+// adjustDataBasedOnLocator removes cached data based on ID number in locators.
+// Data that is not cached in hardware is kept inline, and its locator is turned into a pointer.
+// Annotation offsets are moved back by the size of the data removed before them.
 func adjustDataBasedOnLocator(data []byte, pos int, length int, annotation []Annotation) (payload []byte) {
-	// Keep original position/length
-	start := pos
-	end := pos + length
-	// removed bytes
-	removedBytes := 0
+	type removedData struct {
+		offset int
+		size   int
+	}
+	var removed []removedData
+
 	// search Locator
-	var ret []byte
 	for i := 0; i < len(annotation); i++ {
 		atype := getAnnotationDataType(annotation[i])
-		if atype == 0 {
+		if atype == 0 || atype&ANNOTATION_TYPE_MASK != ANNOTATION_TYPE_LOCATOR {
 			continue
-		} else if atype&ANNOTATION_TYPE_MASK == ANNOTATION_TYPE_LOCATOR {
-			id := getCertificateId(data[pos+int(getAnnotationOffset(annotation[i])) : pos+int(getAnnotationOffset(annotation[i])+getAnnotationDesc(annotation[i]))])
-			end = pos + int(getAnnotationOffset(annotation[i]))
-			ret = append(ret, data[start:end]...)
-			start = end + int(getAnnotationDesc(annotation[i]))
-			end = start
-
-			correctedOffset := int(getAnnotationOffset(annotation[i])) - removedBytes
-			setAnnotationOffset(&(annotation[i]), uint16(correctedOffset))
-			removedBytes += int(getAnnotationDesc(annotation[i]))
-			// FIXME: work around
-			// setAnnotationDesc(&(annotation[i]), uint16(id))
-			setAnnotationDesc(&(annotation[i]), uint16(id))
-		} else {
-			correctedOffset := int(getAnnotationOffset(annotation[i])) - removedBytes
-			setAnnotationOffset(&(annotation[i]), uint16(correctedOffset))
 		}
+
+		offset := int(getAnnotationOffset(annotation[i]))
+		size := int(getAnnotationDesc(annotation[i]))
+		id := getCertificateId(data[pos+offset : pos+offset+size])
+		if id < 0 {
+			logger.Debugf("Identity at offset %d is not cached, sending it inline", offset)
+			setAnnotationDataType(&(annotation[i]), ANNOTATION_TYPE_POINTER|(atype&ANNOTATION_DATA_TYPE_MASK))
+			continue
+		}
+
+		removed = append(removed, removedData{offset, size})
+		touchCertificate(id)
+		setAnnotationDesc(&(annotation[i]), uint16(id))
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i].offset < removed[j].offset })
+
+	payload = make([]byte, 0, length)
+	start := 0
+	for _, r := range removed {
+		payload = append(payload, data[pos+start:pos+r.offset]...)
+		start = r.offset + r.size
 	}
-	end = pos + length
-	if start != end {
-		ret = append(ret, data[start:end]...)
+	payload = append(payload, data[pos+start:pos+length]...)
+
+	for i := 0; i < len(annotation); i++ {
+		if getAnnotationDataType(annotation[i]) == 0 {
+			continue
+		}
+		offset := int(getAnnotationOffset(annotation[i]))
+		correctedOffset := offset
+		for _, r := range removed {
+			if r.offset+r.size <= offset {
+				correctedOffset -= r.size
+			}
+		}
+		setAnnotationOffset(&(annotation[i]), uint16(correctedOffset))
 	}
-	return ret
+	return payload
 }
 
 // getAnnotationActiveSize returns active annotation size
@@ -327,30 +631,88 @@ func getAnnotationActiveSize(annotation []Annotation) (ret int) {
 	return ret
 }
 
-// generateCertificateUpdateAnnotation generates annotation list for certificate cache update message
-func generateCertificateUpdateAnnotation(id int, name string, ca []byte) (payload []byte, annotations []Annotation) {
-	// 0a len name
-	// 12 len ca
-	payload = make([]byte, 0)
-	payload = append(payload, uint8(0x0a))
-	payload = append(payload, uint8(len(name)))
-	payload = append(payload, []byte(name)...)
-
-	payload = append(payload, uint8(0x12))
-	payload = append(payload, uint8((len(ca)&0x7F)|0x80))
-	payload = append(payload, uint8(len(ca)>>7))
-	payload = append(payload, ca...)
+// generateCertificateUpdateAnnotation generates annotation list for certificate cache update message.
+// The payload is the serialized identity (msp.SerializedIdentity), exactly as it appears in
+// transactions.
+func generateCertificateUpdateAnnotation(id int, name string, ca []byte) (payload []byte, annotations []Annotation, err error) {
+	payload = serializeCertificate(name, ca)
+	namePos, nameLen, err := protoGetFieldPos(payload, 0, len(payload), []int{1})
+	if err != nil {
+		return nil, nil, err
+	}
+	caPos, caLen, err := protoGetFieldPos(payload, 0, len(payload), []int{2})
+	if err != nil {
+		return nil, nil, err
+	}
+	if namePos < 0 || caPos < 0 {
+		return nil, nil, errors.Errorf("incomplete certificate cache entry %d", id)
+	}
 
 	annotations = make([]Annotation, CacheUpdateAnnotationNumber)
-	for i, annotationInfo := range blockHeaderAnnotationInfoList {
+	for i, annotationInfo := range blockCacheUpdateAnnotationInfoList {
 		switch annotationInfo.annotationType & ANNOTATION_DATA_TYPE_MASK {
 		case ANNOTATION_DATA_TYPE_CACHE_DATA:
-			annotations[i] = makeAnnotation(annotationInfo.annotationType, uint16(id), uint16(len(name)+len(ca)+5))
+			annotations[i] = makeAnnotation(annotationInfo.annotationType, uint16(id), uint16(len(payload)))
 		case ANNOTATION_DATA_TYPE_CACHE_NAME:
-			annotations[i] = makeAnnotation(annotationInfo.annotationType, uint16(2), uint16(len(name)))
+			annotations[i] = makeAnnotation(annotationInfo.annotationType, uint16(namePos), uint16(nameLen))
 		case ANNOTATION_DATA_TYPE_CACHE_CA:
-			annotations[i] = makeAnnotation(annotationInfo.annotationType, uint16(5+len(name)), uint16(len(ca)))
+			annotations[i] = makeAnnotation(annotationInfo.annotationType, uint16(caPos), uint16(caLen))
 		}
 	}
+	return payload, annotations, nil
+}
+
+// generateCertificateRemoveAnnotation generates annotation list for certificate cache remove message
+func generateCertificateRemoveAnnotation(id int) (annotations []Annotation) {
+	annotationInfo := blockCacheUpdateAnnotationInfoList[0]
+	annotations = []Annotation{makeAnnotation(annotationInfo.annotationType, uint16(id), 0)}
+	return annotations
+}
+
+// generateCertificateRevokeAnnotation generates payload and annotation list for certificate
+// revocation message. The payload is the big-endian serial number of the revoked certificate,
+// followed by the SHA-256 hash of its DER encoded issuer name.
+func generateCertificateRevokeAnnotation(id int, issuerHash []byte, serial *big.Int) (payload []byte, annotations []Annotation) {
+	payload = append(serial.Bytes(), issuerHash...)
+	serialLen := len(payload) - len(issuerHash)
+	annotationInfo := blockCacheUpdateAnnotationInfoList[0]
+	annotations = []Annotation{
+		makeAnnotation(annotationInfo.annotationType, uint16(id), 0),
+		makeAnnotation(ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_CACHE_SERIAL, 0, uint16(serialLen)),
+		makeAnnotation(ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_CACHE_ISSUER, uint16(serialLen), uint16(len(issuerHash))),
+	}
+	return payload, annotations
+}
+
+// generateEndorsementPolicyAnnotation generates payload and annotation list for endorsement policy
+// message. The payload holds the chaincode name, the compiled policy and, for policies defined by
+// a transaction, the big-endian block number (8B) and transaction index (2B) of that transaction.
+func generateEndorsementPolicyAnnotation(policy endorsementPolicy) (payload []byte, annotations []Annotation) {
+	payload = append(payload, policy.chaincode...)
+	annotations = append(annotations, makeAnnotation(ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_POLICY_CHAINCODE,
+		0, uint16(len(policy.chaincode))))
+	annotations = append(annotations, makeAnnotation(ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_POLICY_RULE,
+		uint16(len(payload)), uint16(len(policy.rule))))
+	payload = append(payload, policy.rule...)
+
+	if policy.conditional {
+		commit := make([]byte, 10)
+		binary.BigEndian.PutUint64(commit[0:8], policy.blockNumber)
+		binary.BigEndian.PutUint16(commit[8:10], uint16(policy.txIndex))
+		annotations = append(annotations, makeAnnotation(ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_POLICY_COMMIT,
+			uint16(len(payload)), uint16(len(commit))))
+		payload = append(payload, commit...)
+	}
+	return payload, annotations
+}
+
+// generateTxIdSeedAnnotation generates payload and annotation list for TX ID index seed message.
+// The payload holds the TX IDs back to back.
+func generateTxIdSeedAnnotation(txIds []string) (payload []byte, annotations []Annotation) {
+	for _, txId := range txIds {
+		annotations = append(annotations, makeAnnotation(ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_TXID_SEED,
+			uint16(len(payload)), uint16(len(txId))))
+		payload = append(payload, txId...)
+	}
 	return payload, annotations
 }
@@ -0,0 +1,282 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric/fabricmachine/testutil"
+)
+
+// privateDataEnvelopes returns one transaction per entry of collections, writing the given private
+// data collections.
+func privateDataEnvelopes(collections ...[]string) []*common.Envelope {
+	creator := testutil.Identity("Org1MSP", testutil.NewCertificate("client"))
+	endorser := testutil.Identity("Org1MSP", testutil.NewCertificate("peer0"))
+	var envelopes []*common.Envelope
+	for i := range collections {
+		envelopes = append(envelopes, testutil.NewEnvelope(&testutil.Tx{
+			TxId:        fmt.Sprintf("tx%d", i),
+			Chaincode:   "mycc",
+			Args:        []string{"put", "key", "value"},
+			Creator:     creator,
+			Endorsers:   [][]byte{endorser},
+			Collections: collections[i],
+		}))
+	}
+	return envelopes
+}
+
+func TestClassifyPrivateDataTransactions(t *testing.T) {
+	initTestConfig(t)
+
+	// maxCollections is 1
+	envelopes := privateDataEnvelopes(nil, []string{"collectionA"}, []string{"collectionA", "collectionB", "collectionC"})
+	block := testutil.NewBlock(1, testutil.Identity("OrdererMSP", testutil.NewCertificate("orderer")), envelopes...)
+	softwareTxs := classifyTransactions(block)
+	want := []bool{false, false, true}
+	for i := range want {
+		if softwareTxs[i] != want[i] {
+			t.Errorf("tx%d: got software validation %v, want %v", i, softwareTxs[i], want[i])
+		}
+	}
+}
+
+func TestCollectionAnnotation(t *testing.T) {
+	initTestConfig(t)
+
+	tests := [][]string{
+		nil,
+		{"collectionA"},
+		{"collectionA", "collectionB", "collectionC"},
+	}
+	for i, env := range privateDataEnvelopes(tests...) {
+		collections := tests[i]
+		annotations, _, transaction := transactionAnnotations(t, env)
+
+		var found []Annotation
+		for _, annotation := range annotations {
+			switch getAnnotationDataType(annotation) & ANNOTATION_DATA_TYPE_MASK {
+			case ANNOTATION_DATA_TYPE_COLLECTION_NAME, ANNOTATION_DATA_TYPE_COLLECTION_RW_SET:
+				found = append(found, annotation)
+			}
+		}
+		if len(found) != 2*len(collections) {
+			t.Fatalf("%d collection(s): got %d collection annotations, want %d", len(collections), len(found), 2*len(collections))
+		}
+		if len(annotations) != BlockTransactionAnnotationNumber+1+len(found) {
+			t.Errorf("%d collection(s): got %d annotations, want %d", len(collections), len(annotations), BlockTransactionAnnotationNumber+1+len(found))
+		}
+
+		for j, collection := range collections {
+			name, hashed := found[2*j], found[2*j+1]
+			if getAnnotationDataType(name) != ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_COLLECTION_NAME ||
+				getAnnotationDataType(hashed) != ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_COLLECTION_RW_SET {
+				t.Fatalf("collection %s: got annotation types 0x%x, 0x%x", collection, getAnnotationDataType(name), getAnnotationDataType(hashed))
+			}
+			got := annotatedBytes(transaction, name)
+			if string(got) != collection {
+				t.Errorf("collection %s: name annotation points to %q", collection, got)
+			}
+			hashedRWSet := &kvrwset.HashedRWSet{}
+			if err := proto.Unmarshal(annotatedBytes(transaction, hashed), hashedRWSet); err != nil {
+				t.Fatalf("collection %s: %s", collection, err)
+			}
+			if len(hashedRWSet.HashedWrites) != 1 || !bytes.Equal(hashedRWSet.HashedWrites[0].KeyHash, []byte(collection+" key hash")) {
+				t.Errorf("collection %s: hashed read/write set annotation points to %v", collection, hashedRWSet)
+			}
+		}
+	}
+}
+
+// annotatedBytes returns the bytes of a transaction a pointer annotation points to
+func annotatedBytes(transaction []byte, annotation Annotation) []byte {
+	offset := int(getAnnotationOffset(annotation))
+	return transaction[offset : offset+int(getAnnotationDesc(annotation))]
+}
+
+// transactionAnnotations returns the annotations and control flags of a transaction along with the
+// annotated transaction.
+func transactionAnnotations(t *testing.T, env *common.Envelope) ([]Annotation, byte, []byte) {
+	t.Helper()
+	// Transactions start with their key in the block data, and annotation offsets are relative to
+	// it rather than to the beginning of the block.
+	transaction, err := proto.Marshal(&common.BlockData{Data: [][]byte{testutil.Marshal(env)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := []byte("block prefix")
+	data := append(append([]byte{}, prefix...), transaction...)
+	annotations, control, err := generateTransactionAnnotation(len(prefix), len(transaction), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return annotations, control, transaction
+}
+
+func TestRangeQueryAnnotation(t *testing.T) {
+	initTestConfig(t)
+	creator := testutil.Identity("Org1MSP", testutil.NewCertificate("client"))
+	endorser := testutil.Identity("Org1MSP", testutil.NewCertificate("peer0"))
+
+	tests := []struct {
+		name         string
+		rangeQueries int
+		hashes       bool
+	}{
+		{"no range query", 0, false},
+		{"raw reads", 2, false},
+		{"merkle summary", 2, true},
+	}
+	for _, test := range tests {
+		annotations, _, transaction := transactionAnnotations(t, testutil.NewEnvelope(&testutil.Tx{
+			TxId:             "tx",
+			Chaincode:        "mycc",
+			Args:             []string{"scan", "key0", "key2"},
+			Creator:          creator,
+			Endorsers:        [][]byte{endorser},
+			RangeQueries:     test.rangeQueries,
+			RangeQueryHashes: test.hashes,
+		}))
+
+		var found []Annotation
+		for _, annotation := range annotations {
+			switch getAnnotationDataType(annotation) & ANNOTATION_DATA_TYPE_MASK {
+			case ANNOTATION_DATA_TYPE_RANGE_QUERY, ANNOTATION_DATA_TYPE_RANGE_QUERY_HASHES:
+				found = append(found, annotation)
+			}
+		}
+		if len(found) != 2*test.rangeQueries {
+			t.Fatalf("%s: got %d range query annotations, want %d", test.name, len(found), 2*test.rangeQueries)
+		}
+
+		for i := 0; i < test.rangeQueries; i++ {
+			info, hashes := found[2*i], found[2*i+1]
+			if getAnnotationDataType(info) != ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_RANGE_QUERY ||
+				getAnnotationDataType(hashes) != ANNOTATION_TYPE_POINTER|ANNOTATION_DATA_TYPE_RANGE_QUERY_HASHES {
+				t.Fatalf("%s: range query %d: got annotation types 0x%x, 0x%x", test.name, i, getAnnotationDataType(info), getAnnotationDataType(hashes))
+			}
+			rqi := &kvrwset.RangeQueryInfo{}
+			if err := proto.Unmarshal(annotatedBytes(transaction, info), rqi); err != nil {
+				t.Fatalf("%s: range query %d: %s", test.name, i, err)
+			}
+			if rqi.StartKey != fmt.Sprintf("key%d", i) {
+				t.Errorf("%s: range query %d: info annotation points to %v", test.name, i, rqi)
+			}
+
+			// The merkle summary annotation is empty for raw reads.
+			if !test.hashes {
+				if getAnnotationDesc(hashes) != 0 {
+					t.Errorf("%s: range query %d: merkle summary annotation of raw reads has %d bytes", test.name, i, getAnnotationDesc(hashes))
+				}
+				continue
+			}
+			summary := &kvrwset.QueryReadsMerkleSummary{}
+			if err := proto.Unmarshal(annotatedBytes(transaction, hashes), summary); err != nil {
+				t.Fatalf("%s: range query %d: %s", test.name, i, err)
+			}
+			if len(summary.MaxLevelHashes) != 1 || string(summary.MaxLevelHashes[0]) != fmt.Sprintf("key%d reads hash", i) {
+				t.Errorf("%s: range query %d: merkle summary annotation points to %v", test.name, i, summary)
+			}
+		}
+	}
+}
+
+func TestContractAnnotation(t *testing.T) {
+	initTestConfigFile(t, testConfig+"Chaincodes:\n- name: mycc\n  readOnlyFunctions: [query]\n")
+	creator := testutil.Identity("Org1MSP", testutil.NewCertificate("client"))
+	endorser := testutil.Identity("Org1MSP", testutil.NewCertificate("peer0"))
+	write := map[string][]*kvrwset.KVWrite{"mycc": {{Key: "key", Value: []byte("value")}}}
+
+	tests := []struct {
+		name     string
+		args     []string
+		writes   map[string][]*kvrwset.KVWrite
+		readOnly bool
+	}{
+		{"read-only function", []string{"query", "key"}, nil, true},
+		// Read-only functions are trusted only as long as they do not write.
+		{"read-only function with writes", []string{"query", "key"}, write, false},
+		{"other function", []string{"put", "key", "value"}, write, false},
+		{"no arguments", nil, nil, false},
+	}
+	for _, test := range tests {
+		annotations, control, transaction := transactionAnnotations(t, testutil.NewEnvelope(&testutil.Tx{
+			TxId:      "tx",
+			Chaincode: "mycc",
+			Args:      test.args,
+			Creator:   creator,
+			Endorsers: [][]byte{endorser},
+			Writes:    test.writes,
+		}))
+		if readOnly := control&BCM_CTRL_READ_ONLY != 0; readOnly != test.readOnly {
+			t.Errorf("%s: read-only flag is %t, want %t", test.name, readOnly, test.readOnly)
+		}
+
+		for _, annotation := range annotations {
+			switch getAnnotationDataType(annotation) & ANNOTATION_DATA_TYPE_MASK {
+			case ANNOTATION_DATA_TYPE_CONTRACT_NAME:
+				want := ""
+				if len(test.args) > 0 {
+					want = test.args[0]
+				}
+				if got := string(annotatedBytes(transaction, annotation)); got != want {
+					t.Errorf("%s: contract name annotation points to %q, want %q", test.name, got, want)
+				}
+			case ANNOTATION_DATA_TYPE_CONTRACT_INPUT:
+				input := &peer.ChaincodeInput{}
+				if err := proto.Unmarshal(annotatedBytes(transaction, annotation), input); err != nil {
+					t.Fatalf("%s: %s", test.name, err)
+				}
+				if len(input.Args) != len(test.args) {
+					t.Errorf("%s: contract input annotation points to %v", test.name, input)
+				}
+			}
+		}
+	}
+}
+
+func TestClassifySoftwareChaincodes(t *testing.T) {
+	initTestConfigFile(t, testConfig+`
+Chaincodes:
+- name: swcc
+  validation: software
+- name: hwcc
+  validation: hardware
+`)
+	creator := testutil.Identity("Org1MSP", testutil.NewCertificate("client"))
+	endorser := testutil.Identity("Org1MSP", testutil.NewCertificate("peer0"))
+	var envelopes []*common.Envelope
+	for _, chaincode := range []string{"swcc", "hwcc", "othercc"} {
+		envelopes = append(envelopes, testutil.NewEnvelope(&testutil.Tx{
+			TxId:      chaincode,
+			Chaincode: chaincode,
+			Args:      []string{"put", "key", "value"},
+			Creator:   creator,
+			Endorsers: [][]byte{endorser},
+		}))
+	}
+	block := testutil.NewBlock(1, testutil.Identity("OrdererMSP", testutil.NewCertificate("orderer")), envelopes...)
+
+	// Chaincodes are validated in hardware unless configured otherwise, one transaction at a time.
+	softwareTxs := classifyTransactions(block)
+	want := []bool{true, false, false}
+	for i := range want {
+		if softwareTxs[i] != want[i] {
+			t.Errorf("tx%d: got software validation %v, want %v", i, softwareTxs[i], want[i])
+		}
+	}
+	if !CheckMessageData(block) {
+		t.Error("block with a chaincode validated in software not supported")
+	}
+}
@@ -0,0 +1,378 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hyperledger/fabric/fabricmachine/api"
+	"github.com/pkg/errors"
+)
+
+// message authentication algorithms
+const BCM_AUTH_NONE string = "none"
+const BCM_AUTH_HMAC_SHA256 string = "hmac-sha256"
+const BCM_AUTH_AES_GMAC string = "aes-gmac"
+
+// Authenticated packets end with a trailer: key id (1B), session id (8B), epoch (2B) and tag (16B).
+// The tag covers the whole packet up to the tag, and the session id, epoch and sequence number of
+// the transport header form a 112-bit packet number that never repeats for a given key.
+const BCM_AUTH_TAG_SIZE int = 16
+const BCM_AUTH_TRAILER_SIZE int = 1 + 8 + 2 + BCM_AUTH_TAG_SIZE
+
+// Number of packets older than the most recent one that a verifier still accepts, when they arrive
+// out of order.
+const bcmReplayWindowSize = 64
+
+// bcmAuthKeyFile is the format of the authentication key file
+type bcmAuthKeyFile struct {
+	Keys []struct {
+		Id  uint8  `json:"id"`
+		Key string `json:"key"` // hex
+	} `json:"keys"`
+}
+
+// bcmAuthKeySet computes authentication tags with a set of keys, indexed by key id
+type bcmAuthKeySet struct {
+	algorithm string
+	hmacKeys  map[uint8][]byte
+	gmacKeys  map[uint8]cipher.AEAD
+	active    uint8
+}
+
+// newBcmAuthKeySet creates a key set for an algorithm. The key with the highest id is used to
+// authenticate packets.
+func newBcmAuthKeySet(algorithm string, keys map[uint8][]byte) (*bcmAuthKeySet, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no authentication key")
+	}
+	ks := &bcmAuthKeySet{algorithm: algorithm}
+	switch algorithm {
+	case BCM_AUTH_HMAC_SHA256:
+		ks.hmacKeys = make(map[uint8][]byte)
+	case BCM_AUTH_AES_GMAC:
+		ks.gmacKeys = make(map[uint8]cipher.AEAD)
+	default:
+		return nil, errors.Errorf("unknown authentication algorithm %s", algorithm)
+	}
+
+	for id, key := range keys {
+		if len(key) < 16 {
+			return nil, errors.Errorf("authentication key %d is shorter than 16 bytes", id)
+		}
+		if ks.hmacKeys != nil {
+			ks.hmacKeys[id] = key
+		} else {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid authentication key %d", id)
+			}
+			gcm, err := cipher.NewGCM(block)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid authentication key %d", id)
+			}
+			ks.gmacKeys[id] = gcm
+		}
+		if id > ks.active {
+			ks.active = id
+		}
+	}
+	return ks, nil
+}
+
+// tag computes the authentication tag of data with a key. nonce is the session id followed by the
+// packet counter (epoch and sequence number), which GMAC needs unique per key.
+func (ks *bcmAuthKeySet) tag(id uint8, nonce []byte, data []byte) ([]byte, bool) {
+	if ks.hmacKeys != nil {
+		key, ok := ks.hmacKeys[id]
+		if !ok {
+			return nil, false
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return mac.Sum(nil)[:BCM_AUTH_TAG_SIZE], true
+	}
+	gcm, ok := ks.gmacKeys[id]
+	if !ok {
+		return nil, false
+	}
+	return gcm.Seal(nil, nonce, nil, data), true
+}
+
+// bcmAuthNonce returns the nonce of a packet
+func bcmAuthNonce(sessionId uint64, epoch uint16, sequence uint16) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[0:8], sessionId)
+	binary.BigEndian.PutUint16(nonce[8:10], epoch)
+	binary.BigEndian.PutUint16(nonce[10:12], sequence)
+	return nonce
+}
+
+// readBcmAuthKeys reads authentication keys from a key file
+func readBcmAuthKeys(path string) (map[uint8][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file bcmAuthKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse authentication key file %s", path)
+	}
+	keys := make(map[uint8][]byte)
+	for _, k := range file.Keys {
+		if _, ok := keys[k.Id]; ok {
+			return nil, errors.Errorf("duplicate authentication key %d in %s", k.Id, path)
+		}
+		key, err := hex.DecodeString(k.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid authentication key %d in %s", k.Id, path)
+		}
+		keys[k.Id] = key
+	}
+	return keys, nil
+}
+
+// bcmAuth keeps the keys used to authenticate the packets sent to hardware peers. Keys are rotated
+// by adding a key with a higher id to the key file: the orderer switches to it once it notices that
+// the file changed. Older keys can be removed from the file once hardware peers accept the new one.
+var bcmAuth struct {
+	sync.Mutex
+	required    bool
+	keys        *bcmAuthKeySet
+	keyFile     string
+	sessionFile string
+	modTime     time.Time
+}
+
+// loadAuthenticationKeys reads the authentication keys from the configured key file, when
+// authentication is enabled. Nothing is sent to hardware peers until the keys can be read then.
+func loadAuthenticationKeys() {
+	algorithm := fmapi.GetAuthenticationAlgorithm()
+	bcmAuth.Lock()
+	bcmAuth.required = algorithm != "" && algorithm != BCM_AUTH_NONE
+	bcmAuth.keys = nil
+	bcmAuth.keyFile = ""
+	bcmAuth.sessionFile = ""
+	if bcmAuth.required {
+		bcmAuth.keyFile = fmapi.GetAuthenticationKeyFile()
+		bcmAuth.sessionFile = fmapi.GetAuthenticationSessionFile()
+	}
+	bcmAuth.Unlock()
+	if err := reloadAuthenticationKeys(); err != nil {
+		// Sending unauthenticated packets would have them dropped by the hardware peer anyway.
+		logger.Errorf("Cannot load authentication keys, packets will not be sent until they are: %s", err)
+	}
+}
+
+// reloadAuthenticationKeys reads the authentication keys again when the key file has changed
+func reloadAuthenticationKeys() error {
+	bcmAuth.Lock()
+	defer bcmAuth.Unlock()
+	if bcmAuth.keyFile == "" {
+		if bcmAuth.required {
+			return errors.New("no authentication key file configured")
+		}
+		return nil
+	}
+
+	info, err := os.Stat(bcmAuth.keyFile)
+	if err != nil {
+		return err
+	}
+	if bcmAuth.keys != nil && info.ModTime().Equal(bcmAuth.modTime) {
+		return nil
+	}
+	keys, err := readBcmAuthKeys(bcmAuth.keyFile)
+	if err != nil {
+		return err
+	}
+	ks, err := newBcmAuthKeySet(fmapi.GetAuthenticationAlgorithm(), keys)
+	if err != nil {
+		return err
+	}
+	if bcmAuth.keys == nil || bcmAuth.keys.active != ks.active {
+		logger.Infof("Authenticating packets to hardware peers with %s key %d", ks.algorithm, ks.active)
+	}
+	bcmAuth.keys = ks
+	bcmAuth.modTime = info.ModTime()
+	return nil
+}
+
+// getAuthenticationKeys returns the current authentication keys, nil when authentication is
+// disabled. It fails when authentication is enabled but no key could be read.
+func getAuthenticationKeys() (*bcmAuthKeySet, error) {
+	bcmAuth.Lock()
+	defer bcmAuth.Unlock()
+	if bcmAuth.required && bcmAuth.keys == nil {
+		return nil, errors.Errorf("no authentication key read from %s", bcmAuth.keyFile)
+	}
+	return bcmAuth.keys, nil
+}
+
+// newBcmSessionId returns a session id for the configured session file, see nextBcmSessionId
+func newBcmSessionId() (uint64, error) {
+	bcmAuth.Lock()
+	sessionFile := bcmAuth.sessionFile
+	bcmAuth.Unlock()
+	if sessionFile == "" {
+		return 0, errors.New("no session file to number authenticated sessions")
+	}
+	return nextBcmSessionId(sessionFile)
+}
+
+// nextBcmSessionId returns a session id greater than the one recorded in path, and records it. The
+// session ids of earlier sessions, including the sessions of earlier runs and of other processes
+// sharing path, are smaller, so that their packets cannot be replayed and packet numbers never
+// repeat for a key, even when the clock is set back. Session ids follow the clock otherwise, so
+// that they keep growing when path is lost.
+func nextBcmSessionId(path string) (uint64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot open session file")
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, errors.Wrapf(err, "cannot lock session file %s", path)
+	}
+
+	sessionId := uint64(time.Now().UnixNano())
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot read session file %s", path)
+	}
+	if text := strings.TrimSpace(string(data)); text != "" {
+		last, err := strconv.ParseUint(text, 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid session file %s", path)
+		}
+		if last == math.MaxUint64 {
+			return 0, errors.Errorf("no session id left after %d in %s", last, path)
+		}
+		if sessionId <= last {
+			sessionId = last + 1
+		}
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return 0, errors.Wrapf(err, "cannot write session file %s", path)
+	}
+	if _, err := f.WriteAt([]byte(strconv.FormatUint(sessionId, 10)+"\n"), 0); err != nil {
+		return 0, errors.Wrapf(err, "cannot write session file %s", path)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, errors.Wrapf(err, "cannot write session file %s", path)
+	}
+	return sessionId, nil
+}
+
+// appendAuthenticationTrailer appends the authentication trailer to a packet
+func appendAuthenticationTrailer(ks *bcmAuthKeySet, session *BcmSession, sequence uint16, packet []byte) []byte {
+	start := len(packet)
+	packet = append(packet, make([]byte, BCM_AUTH_TRAILER_SIZE)...)
+	trailer := packet[start:]
+	trailer[0] = ks.active
+	binary.BigEndian.PutUint64(trailer[1:9], session.sessionId)
+	binary.BigEndian.PutUint16(trailer[9:11], session.epoch)
+	tag, _ := ks.tag(ks.active, bcmAuthNonce(session.sessionId, session.epoch, sequence), packet[:start+11])
+	copy(trailer[11:], tag)
+	return packet
+}
+
+// BcmVerifier checks the authentication trailer of blockchain machine protocol packets and drops
+// replayed packets, as hardware peers do. It is meant for tests and local receivers.
+type BcmVerifier struct {
+	keys      *bcmAuthKeySet
+	started   bool
+	sessionId uint64
+	highest   uint32 // packet counter: epoch and sequence number
+	window    uint64 // packets received among the bcmReplayWindowSize ones up to highest
+}
+
+// NewBcmVerifier creates a verifier accepting packets authenticated with any of the keys, indexed
+// by key id
+func NewBcmVerifier(algorithm string, keys map[uint8][]byte) (*BcmVerifier, error) {
+	ks, err := newBcmAuthKeySet(algorithm, keys)
+	if err != nil {
+		return nil, err
+	}
+	return &BcmVerifier{keys: ks}, nil
+}
+
+// NewBcmVerifierFromKeyFile creates a verifier accepting packets authenticated with any of the
+// keys of an authentication key file
+func NewBcmVerifierFromKeyFile(algorithm string, path string) (*BcmVerifier, error) {
+	keys, err := readBcmAuthKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewBcmVerifier(algorithm, keys)
+}
+
+// Verify checks the authentication trailer of a packet and that the packet was not received
+// before. It returns the packet without its trailer.
+func (v *BcmVerifier) Verify(packet []byte) ([]byte, error) {
+	if len(packet) < BCM_TRANSPORT_HEADER_SIZE+BCM_AUTH_TRAILER_SIZE {
+		return nil, errors.Errorf("packet too short: %d bytes", len(packet))
+	}
+	start := len(packet) - BCM_AUTH_TRAILER_SIZE
+	trailer := packet[start:]
+	id := trailer[0]
+	sessionId := binary.BigEndian.Uint64(trailer[1:9])
+	epoch := binary.BigEndian.Uint16(trailer[9:11])
+	sequence := binary.BigEndian.Uint16(packet[0:2])
+
+	tag, ok := v.keys.tag(id, bcmAuthNonce(sessionId, epoch, sequence), packet[:start+11])
+	if !ok {
+		return nil, errors.Errorf("unknown authentication key %d", id)
+	}
+	if subtle.ConstantTimeCompare(tag, trailer[11:]) != 1 {
+		return nil, errors.New("invalid authentication tag")
+	}
+
+	counter := uint32(epoch)<<16 | uint32(sequence)
+	switch {
+	case !v.started || sessionId > v.sessionId:
+		v.started = true
+		v.sessionId = sessionId
+		v.highest = counter
+		v.window = 1
+	case sessionId < v.sessionId:
+		return nil, errors.Errorf("packet %d of stale session %d", counter, sessionId)
+	case counter > v.highest:
+		if shift := counter - v.highest; shift < bcmReplayWindowSize {
+			v.window = v.window<<shift | 1
+		} else {
+			v.window = 1
+		}
+		v.highest = counter
+	default:
+		age := v.highest - counter
+		if age >= bcmReplayWindowSize {
+			return nil, errors.Errorf("packet %d too old", counter)
+		}
+		if v.window&(1<<age) != 0 {
+			return nil, errors.Errorf("replayed packet %d", counter)
+		}
+		v.window |= 1 << age
+	}
+	return packet[:start], nil
+}
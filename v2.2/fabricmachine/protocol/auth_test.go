@@ -0,0 +1,241 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testAuthKeys returns keys indexed by id
+func testAuthKeys(ids ...uint8) map[uint8][]byte {
+	keys := make(map[uint8][]byte)
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte{id}, 32)
+	}
+	return keys
+}
+
+// testSessionId returns a new session id
+func testSessionId(t *testing.T) uint64 {
+	t.Helper()
+	sessionId, err := nextBcmSessionId(filepath.Join(t.TempDir(), "session"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sessionId
+}
+
+// initTestAuthentication configures authentication with keyFile and loads the keys
+func initTestAuthentication(t *testing.T, keyFile string) {
+	t.Helper()
+	initTestConfigWith(t, fmt.Sprintf("authentication:\n  algorithm: %s\n  keyFile: %s", BCM_AUTH_AES_GMAC, keyFile))
+	loadAuthenticationKeys()
+	t.Cleanup(func() {
+		bcmAuth.Lock()
+		defer bcmAuth.Unlock()
+		bcmAuth.required, bcmAuth.keys, bcmAuth.keyFile, bcmAuth.sessionFile = false, nil, "", ""
+	})
+}
+
+// testAuthPacket returns an authenticated packet with a sequence number and a payload
+func testAuthPacket(t *testing.T, ks *bcmAuthKeySet, session *BcmSession, sequence uint16, payload string) []byte {
+	t.Helper()
+	packet := make([]byte, BCM_TRANSPORT_HEADER_SIZE, BCM_TRANSPORT_HEADER_SIZE+len(payload)+BCM_AUTH_TRAILER_SIZE)
+	binary.BigEndian.PutUint16(packet[0:2], sequence)
+	packet = append(packet, payload...)
+	return appendAuthenticationTrailer(ks, session, sequence, packet)
+}
+
+func TestBcmVerifier(t *testing.T) {
+	for _, algorithm := range []string{BCM_AUTH_HMAC_SHA256, BCM_AUTH_AES_GMAC} {
+		t.Run(algorithm, func(t *testing.T) {
+			ks, err := newBcmAuthKeySet(algorithm, testAuthKeys(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifier, err := NewBcmVerifier(algorithm, testAuthKeys(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			session := &BcmSession{sessionId: testSessionId(t)}
+
+			// accepted, trailer stripped
+			packet := testAuthPacket(t, ks, session, 1, "block")
+			data, err := verifier.Verify(packet)
+			if err != nil {
+				t.Fatalf("packet rejected: %s", err)
+			}
+			if !bytes.Equal(data, packet[:len(packet)-BCM_AUTH_TRAILER_SIZE]) {
+				t.Errorf("verified packet %x instead of %x", data, packet[:len(packet)-BCM_AUTH_TRAILER_SIZE])
+			}
+
+			// replayed sequence
+			if _, err := verifier.Verify(packet); err == nil {
+				t.Error("replayed packet accepted")
+			}
+
+			// tampered payload
+			tampered := testAuthPacket(t, ks, session, 2, "block")
+			tampered[BCM_TRANSPORT_HEADER_SIZE] ^= 1
+			if _, err := verifier.Verify(tampered); err == nil {
+				t.Error("tampered packet accepted")
+			}
+
+			// tampered sequence number
+			tampered = testAuthPacket(t, ks, session, 2, "block")
+			binary.BigEndian.PutUint16(tampered[0:2], 3)
+			if _, err := verifier.Verify(tampered); err == nil {
+				t.Error("packet with tampered sequence number accepted")
+			}
+
+			// out of order within the replay window, once
+			if _, err := verifier.Verify(testAuthPacket(t, ks, session, 5, "block")); err != nil {
+				t.Errorf("packet 5 rejected: %s", err)
+			}
+			packet = testAuthPacket(t, ks, session, 4, "block")
+			if _, err := verifier.Verify(packet); err != nil {
+				t.Errorf("reordered packet 4 rejected: %s", err)
+			}
+			if _, err := verifier.Verify(packet); err == nil {
+				t.Error("replayed reordered packet accepted")
+			}
+
+			// unknown key id
+			other, err := newBcmAuthKeySet(algorithm, testAuthKeys(2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := verifier.Verify(testAuthPacket(t, other, session, 6, "block")); err == nil {
+				t.Error("packet authenticated with unknown key accepted")
+			}
+
+			// stale session
+			stale := &BcmSession{sessionId: session.sessionId - 1}
+			if _, err := verifier.Verify(testAuthPacket(t, ks, stale, 7, "block")); err == nil {
+				t.Error("packet of stale session accepted")
+			}
+		})
+	}
+}
+
+func TestBcmVerifierKeyRotation(t *testing.T) {
+	// the orderer authenticates with the highest key id
+	ks, err := newBcmAuthKeySet(BCM_AUTH_HMAC_SHA256, testAuthKeys(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.active != 2 {
+		t.Fatalf("active key %d instead of 2", ks.active)
+	}
+	session := &BcmSession{sessionId: testSessionId(t)}
+	old, err := NewBcmVerifier(BCM_AUTH_HMAC_SHA256, testAuthKeys(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Verify(testAuthPacket(t, ks, session, 1, "block")); err == nil {
+		t.Error("packet authenticated with key 2 accepted by verifier with key 1 only")
+	}
+	rotated, err := NewBcmVerifier(BCM_AUTH_HMAC_SHA256, testAuthKeys(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotated.Verify(testAuthPacket(t, ks, session, 1, "block")); err != nil {
+		t.Errorf("packet rejected after rotation: %s", err)
+	}
+}
+
+func TestBcmSessionIdPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session")
+	first, err := nextBcmSessionId(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := nextBcmSessionId(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second <= first {
+		t.Errorf("session id %d after %d", second, first)
+	}
+
+	// Session ids keep growing when the clock is set back.
+	last := uint64(time.Now().Add(time.Hour).UnixNano())
+	if err := ioutil.WriteFile(path, []byte(strconv.FormatUint(last, 10)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sessionId, err := nextBcmSessionId(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionId != last+1 {
+		t.Errorf("session id %d after %d", sessionId, last)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nextBcmSessionId(path); err == nil {
+		t.Error("session id returned from an invalid session file")
+	}
+}
+
+func TestAuthenticatedSend(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys.json")
+	keys := testAuthKeys(1)
+	content := fmt.Sprintf(`{"keys": [{"id": 1, "key": "%s"}]}`, hex.EncodeToString(keys[1]))
+	if err := ioutil.WriteFile(keyFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	initTestAuthentication(t, keyFile)
+	transport := newTestSession("authenticated")
+
+	if err := bcmSend("authenticated", BCM_MSG_TYPE_TRANSACTION, 0, nil, 0, []byte("transaction")); err != nil {
+		t.Fatal(err)
+	}
+	packets := transport.sent()
+	if len(packets) != 1 {
+		t.Fatalf("%d packet(s) sent instead of 1", len(packets))
+	}
+	verifier, err := NewBcmVerifier(BCM_AUTH_AES_GMAC, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(packets[0]); err != nil {
+		t.Errorf("packet rejected: %s", err)
+	}
+	data, err := ioutil.ReadFile(keyFile + ".session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%d\n", BcmSessionMap["authenticated"].sessionId); string(data) != want {
+		t.Errorf("session file holds %q instead of %q", data, want)
+	}
+}
+
+func TestSendWithoutAuthenticationKeys(t *testing.T) {
+	initTestAuthentication(t, filepath.Join(t.TempDir(), "missing.json"))
+	transport := newTestSession("unauthenticated")
+
+	if err := bcmSend("unauthenticated", BCM_MSG_TYPE_TRANSACTION, 0, nil, 0, []byte("transaction")); err == nil {
+		t.Error("message sent without the configured authentication keys")
+	}
+	if err := bcmSendBatch("unauthenticated", []bcmMessage{{BCM_MSG_TYPE_TRANSACTION, 0, nil, 0, []byte("transaction")}}); err == nil {
+		t.Error("messages sent without the configured authentication keys")
+	}
+	if packets := transport.sent(); len(packets) != 0 {
+		t.Errorf("%d packet(s) sent", len(packets))
+	}
+}
@@ -7,91 +7,215 @@ SPDX-License-Identifier: Apache-2.0
 package fmprotocol
 
 import (
+	"math/big"
+	"sync"
+
 	"github.com/golang/protobuf/proto"
 	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/pkg/errors"
 )
 
-// SendBlockHeader prepares packet data based on block header and transaction information
-// then send to target addres
-func SendBlockHeader(addr string, data []byte, pos int, length int, transactionLen []int) {
-	annotation := generateBlockAnnotation(pos, length, transactionLen, data)
+// newBcmMessage serializes the annotations of a message, of which annotationNum are active
+func newBcmMessage(msgType byte, control byte, annotation []Annotation, annotationNum int, payload []byte) bcmMessage {
+	return bcmMessage{msgType, control, annotationListToBytes(annotation), annotationNum, payload}
+}
+
+// prepareBlockHeader prepares packet data based on block header and transaction information
+func prepareBlockHeader(data []byte, pos int, length int, transactionLen []int) (bcmMessage, error) {
+	annotation, err := generateBlockAnnotation(pos, length, transactionLen, data)
+	if err != nil {
+		return bcmMessage{}, err
+	}
 	payload := data[pos : pos+length]
-	bcmSend(addr, 0x1, annotationListToBytes(annotation), len(annotation), payload)
+	return newBcmMessage(BCM_MSG_TYPE_BLOCK_HEADER, 0, annotation, len(annotation), payload), nil
 }
 
-// SendTransaction prepares packet data based on transaction and send to target addres
-func SendTransaction(addr string, data []byte, pos int, length int) {
-	annotation := generateTransactionAnnotation(pos, length, data)
+// prepareTransaction prepares packet data based on transaction.
+// Transactions validated in software are sent as they are, so that the hardware peer keeps track
+// of transaction indices and transaction ids.
+func prepareTransaction(data []byte, pos int, length int, softwareValidation bool) (bcmMessage, error) {
+	if softwareValidation {
+		annotation, err := generateSoftwareTransactionAnnotation(pos, length, data)
+		if err != nil {
+			return bcmMessage{}, err
+		}
+		return newBcmMessage(BCM_MSG_TYPE_TRANSACTION, BCM_CTRL_SOFTWARE_VALIDATION, annotation, len(annotation), data[pos:pos+length]), nil
+	}
+
+	annotation, control, err := generateTransactionAnnotation(pos, length, data)
+	if err != nil {
+		return bcmMessage{}, err
+	}
 	payload := adjustDataBasedOnLocator(data, pos, length, annotation)
-	bcmSend(addr, 0x2, annotationListToBytes(annotation), getAnnotationActiveSize(annotation), payload)
+	return newBcmMessage(BCM_MSG_TYPE_TRANSACTION, control, annotation, getAnnotationActiveSize(annotation), payload), nil
 }
 
-// SendBlockMeta prepares packet data based on block metadata and send to target addres
-func SendBlockMeta(addr string, data []byte, pos int, length int) {
-	annotation := generateBlockMetaAnnotation(pos, length, data)
+// prepareBlockMeta prepares packet data based on block metadata
+func prepareBlockMeta(data []byte, pos int, length int) (bcmMessage, error) {
+	annotation, err := generateBlockMetaAnnotation(pos, length, data)
+	if err != nil {
+		return bcmMessage{}, err
+	}
 	payload := adjustDataBasedOnLocator(data, pos, length, annotation)
-	bcmSend(addr, 0x3, annotationListToBytes(annotation), len(annotation), payload)
+	return newBcmMessage(BCM_MSG_TYPE_BLOCK_METADATA, 0, annotation, len(annotation), payload), nil
 }
 
-// SendBlock sends a block to target hardware peer via blockchain machine protocol
-func SendBlock(addr string, block *cb.Block) {
-	data, err := proto.Marshal(block)
-	if err != nil {
-		logger.Errorf("BCM error: block serilization failed: %v", err)
-		return
+// blockBufferPool keeps serialization buffers for reuse, since blocks are serialized once per send
+var blockBufferPool = sync.Pool{
+	New: func() interface{} {
+		return proto.NewBuffer(nil)
+	},
+}
+
+// SendBlock sends a block to target hardware peer via blockchain machine protocol.
+// softwareTxs tells which transactions of the block are validated in software.
+func SendBlock(addr string, block *cb.Block, softwareTxs []bool) error {
+	buf := blockBufferPool.Get().(*proto.Buffer)
+	defer blockBufferPool.Put(buf)
+	buf.Reset()
+	if err := buf.Marshal(block); err != nil {
+		return errors.Wrap(err, "block serialization failed")
 	}
+	return SendBlockBytes(addr, buf.Bytes(), block.Header.GetNumber(), softwareTxs)
+}
 
+// SendBlockBytes sends a block serialized to protobuf (common.Block) to target hardware peer via
+// blockchain machine protocol, without unmarshalling it. number is the block number, for logs.
+// softwareTxs tells which transactions of the block are validated in software.
+// Nothing is sent when the block cannot be parsed, or when one of the transactions that the
+// hardware peer validates cannot be annotated: peers would not know that it is validated in
+// software otherwise. An error is returned as well when only part of the block could be sent.
+func SendBlockBytes(addr string, data []byte, number uint64, softwareTxs []bool) error {
 	// block format: block_header, transaction_1, ..., transaction_N,
 	//   block_metadata
-	pos := 0
-	// block header: fleld == 1, length ~=70
-	field, length, pos := protoGetFieldLength(data, pos)
-	pos += length
-
-	// block data start(envelope): field == 2
-	field, length, pos = protoGetFieldLength(data, pos)
+	// block header: field == 1, block data: field == 2, block metadata: field == 3
+	_, hdrPos, _, err := protoGetFieldStart(data, 0, len(data), []int{1})
+	if err != nil {
+		return errors.WithMessage(err, "cannot read block header")
+	}
+	if hdrPos < 0 {
+		return errors.New("missing block header")
+	}
+	_, dataPos, dataLen, err := protoGetFieldStart(data, 0, len(data), []int{2})
+	if err != nil {
+		return errors.WithMessage(err, "cannot read block data")
+	}
+	metaStart, _, _, err := protoGetFieldStart(data, 0, len(data), []int{3})
+	if err != nil {
+		return errors.WithMessage(err, "cannot read block metadata")
+	}
+	if dataPos < 0 || metaStart < 0 {
+		return errors.New("missing block data or block metadata")
+	}
 
+	// the block header message carries everything up to the transactions
 	BlockHeaderPos := 0
-	BlockHeaderLen := pos - BlockHeaderPos
-	BlockMetaPos := pos + length
+	BlockHeaderLen := dataPos - BlockHeaderPos
+	BlockMetaPos := metaStart
+	BlockMetaLen := len(data) - BlockMetaPos
 
-	// read transactions
+	// read transactions: field == 1
 	var TransactionPosList []int = nil
 	var TransactionLengthList []int = nil
-	for pos < BlockMetaPos {
-		TransactionPosList = append(TransactionPosList, pos)
-		field, length, pos = protoGetFieldLength(data, pos)
-		// field == 1, new transaction, else error ...
+	field, length := 0, 0
+	for pos := dataPos; pos < dataPos+dataLen; pos += length {
+		start := pos
+		field, length, pos, err = protoGetFieldLength(data, pos)
+		if err != nil {
+			return errors.WithMessage(err, "cannot read transaction")
+		}
 		if field != 1 {
-			if len(TransactionPosList) > 0 {
-				TransactionPosList = TransactionPosList[:len(TransactionPosList)-1]
-			}
-		} else {
-			// ERROR!!!
+			return errors.Errorf("unexpected field %d in block data", field)
 		}
-		pos += length
-		TransactionLengthList = append(TransactionLengthList,
-			pos-TransactionPosList[len(TransactionPosList)-1])
+		TransactionPosList = append(TransactionPosList, start)
+		TransactionLengthList = append(TransactionLengthList, pos+length-start)
 	}
 
-	// read metadata
-	field, length, pos = protoGetFieldLength(data, pos)
-	BlockMetaLen := pos + length - BlockMetaPos
+	// prepare all messages before sending any of them
+	header, err := prepareBlockHeader(data, BlockHeaderPos, BlockHeaderLen, TransactionLengthList)
+	if err != nil {
+		return errors.WithMessage(err, "cannot annotate block header")
+	}
+	transactions := make([]bcmMessage, len(TransactionPosList))
+	for i := 0; i < len(TransactionPosList); i++ {
+		softwareValidation := i < len(softwareTxs) && softwareTxs[i]
+		transactions[i], err = prepareTransaction(data, TransactionPosList[i], TransactionLengthList[i], softwareValidation)
+		if err != nil && !softwareValidation {
+			return errors.WithMessagef(err, "cannot annotate tx%d", i)
+		}
+		if err != nil {
+			logger.Warningf("Sending block [%d] tx%d without TX ID: %s", number, i, err)
+			transactions[i] = bcmMessage{BCM_MSG_TYPE_TRANSACTION, BCM_CTRL_SOFTWARE_VALIDATION, nil, 0,
+				data[TransactionPosList[i] : TransactionPosList[i]+TransactionLengthList[i]]}
+		}
+	}
+	metadata, err := prepareBlockMeta(data, BlockMetaPos, BlockMetaLen)
+	if err != nil {
+		return errors.WithMessage(err, "cannot annotate block metadata")
+	}
 
 	// send data
-	logger.Debugf("Send block [%d] header", block.Header.Number)
-	SendBlockHeader(addr, data, BlockHeaderPos, BlockHeaderLen, TransactionLengthList)
-	for i := 0; i < len(TransactionPosList); i++ {
-		logger.Debugf("Send block [%d] tx", block.Header.Number)
-		SendTransaction(addr, data, TransactionPosList[i], TransactionLengthList[i])
+	logger.Debugf("Send block [%d] header, %d tx(s) and metadata", number, len(transactions))
+	messages := make([]bcmMessage, 0, len(transactions)+2)
+	messages = append(messages, header)
+	messages = append(messages, transactions...)
+	messages = append(messages, metadata)
+	if err := bcmSendBatch(addr, messages); err != nil {
+		return errors.WithMessagef(err, "cannot send block [%d]", number)
 	}
-	logger.Debugf("Send block [%d] metadata", block.Header.Number)
-	SendBlockMeta(addr, data, BlockMetaPos, BlockMetaLen)
+	return nil
 }
 
 // sendCertificateCacheUpdate sends certifcate cache update message to target hardware peer
-// via blockchain machine protocol
-func sendCertificateCacheUpdate(addr string, id int, name string, ca []byte) {
-	payload, annotations := generateCertificateUpdateAnnotation(id, name, ca)
-	bcmSend(addr, 0x0, annotationListToBytes(annotations), len(annotations), payload)
+// via blockchain machine protocol. op is one of the BCM_CACHE_OP_* codes; remove messages only
+// carry the cache ID.
+// Add and update messages are acknowledged by the hardware peer when an acknowledgement timeout is
+// configured, so that no transaction refers to a certificate before it is installed.
+func sendCertificateCacheUpdate(addr string, op byte, info CertificateInfo) error {
+	if op == BCM_CACHE_OP_REMOVE {
+		annotations := generateCertificateRemoveAnnotation(info.id)
+		return bcmSend(addr, BCM_MSG_TYPE_CACHE_UPDATE, op, annotationListToBytes(annotations), len(annotations), nil)
+	}
+
+	payload, annotations, err := generateCertificateUpdateAnnotation(info.id, info.name, info.ca)
+	if err != nil {
+		return err
+	}
+	if hwPeer.ackTimeout == 0 {
+		return bcmSend(addr, BCM_MSG_TYPE_CACHE_UPDATE, op, annotationListToBytes(annotations), len(annotations), payload)
+	}
+	return bcmSendWithAck(addr, BCM_MSG_TYPE_CACHE_UPDATE, op, annotationListToBytes(annotations), len(annotations), payload, hwPeer.ackTimeout)
+}
+
+// sendCertificateRevocation sends certificate revocation message to target hardware peer via
+// blockchain machine protocol. op is BCM_CACHE_OP_REVOKE, or BCM_CACHE_OP_UNREVOKE for serials
+// that are no longer revoked. id is the cache ID of the revoked certificate, or
+// CERTIFICATE_ID_NONE when the certificate is not cached, in which case the hardware peer matches
+// inline certificates on both issuer hash and serial.
+func sendCertificateRevocation(addr string, op byte, id int, issuerHash []byte, serial *big.Int) error {
+	payload, annotations := generateCertificateRevokeAnnotation(id, issuerHash, serial)
+	if hwPeer.ackTimeout == 0 {
+		return bcmSend(addr, BCM_MSG_TYPE_CACHE_UPDATE, op, annotationListToBytes(annotations), len(annotations), payload)
+	}
+	return bcmSendWithAck(addr, BCM_MSG_TYPE_CACHE_UPDATE, op, annotationListToBytes(annotations), len(annotations), payload, hwPeer.ackTimeout)
+}
+
+// sendEndorsementPolicy sends endorsement policy message to target hardware peer via blockchain
+// machine protocol
+func sendEndorsementPolicy(addr string, policy endorsementPolicy) error {
+	payload, annotations := generateEndorsementPolicyAnnotation(policy)
+	if hwPeer.ackTimeout == 0 {
+		return bcmSend(addr, BCM_MSG_TYPE_ENDORSEMENT_POLICY, 0, annotationListToBytes(annotations), len(annotations), payload)
+	}
+	return bcmSendWithAck(addr, BCM_MSG_TYPE_ENDORSEMENT_POLICY, 0, annotationListToBytes(annotations), len(annotations), payload, hwPeer.ackTimeout)
+}
+
+// sendTxIdSeed sends TX ID index seed message to target hardware peer via blockchain machine
+// protocol
+func sendTxIdSeed(addr string, txIds []string) error {
+	payload, annotations := generateTxIdSeedAnnotation(txIds)
+	if hwPeer.ackTimeout == 0 {
+		return bcmSend(addr, BCM_MSG_TYPE_TXID_SEED, 0, annotationListToBytes(annotations), len(annotations), payload)
+	}
+	return bcmSendWithAck(addr, BCM_MSG_TYPE_TXID_SEED, 0, annotationListToBytes(annotations), len(annotations), payload, hwPeer.ackTimeout)
 }
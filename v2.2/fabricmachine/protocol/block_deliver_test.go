@@ -0,0 +1,117 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric/fabricmachine/testutil"
+	"github.com/pkg/errors"
+)
+
+func TestSendBlockBytesUnannotatedTransaction(t *testing.T) {
+	initTestConfig(t)
+	transport := newTestSession("unannotated")
+
+	// Transactions without creator cannot be annotated.
+	env := testutil.NewEnvelope(&testutil.Tx{TxId: "tx", Chaincode: "mycc", Args: []string{"put"}})
+	block := testutil.NewBlock(1, testutil.Identity("OrdererMSP", testutil.NewCertificate("orderer")), env)
+	if err := SendBlockBytes("unannotated", testutil.Marshal(block), 1, nil); err == nil {
+		t.Fatal("block sent with a transaction that cannot be annotated")
+	}
+	if packets := transport.sent(); len(packets) != 0 {
+		t.Errorf("%d packet(s) sent", len(packets))
+	}
+
+	// Transactions validated in software are sent anyway.
+	if err := SendBlockBytes("unannotated", testutil.Marshal(block), 1, []bool{true}); err != nil {
+		t.Fatal(err)
+	}
+	if packets := transport.sent(); len(packets) != 3 {
+		t.Errorf("%d packet(s) sent instead of 3", len(packets))
+	}
+}
+
+func TestSendBlockBytesPartialSend(t *testing.T) {
+	initTestConfig(t)
+	transport := newTestSession("partial")
+	transport.failBatches(errors.New("no buffer space available"))
+
+	env := testutil.NewEnvelope(&testutil.Tx{
+		TxId:      "tx",
+		Chaincode: "mycc",
+		Creator:   testutil.Identity("Org1MSP", testutil.NewCertificate("client")),
+		Endorsers: [][]byte{testutil.Identity("Org1MSP", testutil.NewCertificate("peer0"))},
+	})
+	block := testutil.NewBlock(1, testutil.Identity("OrdererMSP", testutil.NewCertificate("orderer")), env)
+	if err := SendBlockBytes("partial", testutil.Marshal(block), 1, nil); err == nil {
+		t.Fatal("block sent in part without error")
+	}
+	if packets := transport.sent(); len(packets) != 1 {
+		t.Errorf("%d packet(s) sent instead of 1", len(packets))
+	}
+}
+
+func FuzzSendBlockBytes(f *testing.F) {
+	block := testBlockBytes()
+	f.Add(block)
+	f.Add(block[:len(block)/2])
+	f.Add([]byte{0x12, 0x02, 0x0a, 0x00})
+	initTestConfig(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		transport := newTestSession("fuzz")
+		if err := SendBlockBytes("fuzz", data, 1, nil); err != nil {
+			if packets := transport.sent(); len(packets) != 0 {
+				t.Fatalf("%d packet(s) sent for a block that failed: %s", len(packets), err)
+			}
+		}
+	})
+}
+
+// BenchmarkSendBlock500 measures sending a block of 500 transactions, serializing it first
+// (marshal) or sending it as it is serialized in the ledger (annotate).
+func BenchmarkSendBlock500(b *testing.B) {
+	initTestConfig(b)
+	newTestSession("benchmark")
+
+	creator := testutil.Identity("Org1MSP", testutil.NewCertificate("client"))
+	endorsers := [][]byte{
+		testutil.Identity("Org1MSP", testutil.NewCertificate("peer0")),
+		testutil.Identity("Org2MSP", testutil.NewCertificate("peer0")),
+	}
+	var envelopes []*common.Envelope
+	for i := 0; i < 500; i++ {
+		envelopes = append(envelopes, testutil.NewEnvelope(&testutil.Tx{
+			TxId:      fmt.Sprintf("%064x", i),
+			Chaincode: "mycc",
+			Args:      []string{"transfer", "a", "b", "10"},
+			Creator:   creator,
+			Endorsers: endorsers,
+		}))
+	}
+	block := testutil.NewBlock(1, testutil.Identity("OrdererMSP", testutil.NewCertificate("orderer")), envelopes...)
+	data := testutil.Marshal(block)
+
+	b.Run("marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := SendBlock("benchmark", block, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("annotate", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := SendBlockBytes("benchmark", data, 1, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
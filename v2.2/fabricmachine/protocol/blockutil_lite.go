@@ -10,6 +10,9 @@ package fmprotocol
 import (
 	"github.com/golang/protobuf/proto"
 	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/msp"
 	"github.com/hyperledger/fabric-protos-go/peer"
 	pb "github.com/hyperledger/fabric-protos-go/peer"
 	"github.com/pkg/errors"
@@ -103,3 +106,240 @@ func IsConfigBlock(block *cb.Block) (bool, error) {
 
 	return (cb.HeaderType(hdr.Type) == cb.HeaderType_CONFIG || cb.HeaderType(hdr.Type) == cb.HeaderType_ORDERER_TRANSACTION), nil
 }
+
+// UnmarshalConfigEnvelope unmarshals bytes to a ConfigEnvelope
+// hyperledger/fabric@v2.0/common/configtx/util.go
+func UnmarshalConfigEnvelope(data []byte) (*cb.ConfigEnvelope, error) {
+	configEnv := &cb.ConfigEnvelope{}
+	err := proto.Unmarshal(data, configEnv)
+	return configEnv, errors.Wrap(err, "error unmarshaling ConfigEnvelope")
+}
+
+// UnmarshalSignatureHeader unmarshals bytes to a SignatureHeader
+// hyperledger/fabric@v2.0/protoutil/unmarshalers.go
+func UnmarshalSignatureHeader(bytes []byte) (*cb.SignatureHeader, error) {
+	sh := &cb.SignatureHeader{}
+	err := proto.Unmarshal(bytes, sh)
+	return sh, errors.Wrap(err, "error unmarshaling SignatureHeader")
+}
+
+// UnmarshalSerializedIdentity unmarshals bytes to a SerializedIdentity
+// hyperledger/fabric@v2.0/protoutil/unmarshalers.go
+func UnmarshalSerializedIdentity(bytes []byte) (*msp.SerializedIdentity, error) {
+	sid := &msp.SerializedIdentity{}
+	err := proto.Unmarshal(bytes, sid)
+	return sid, errors.Wrap(err, "error unmarshaling SerializedIdentity")
+}
+
+// UnmarshalTransaction unmarshals bytes to a Transaction
+// hyperledger/fabric@v2.0/protoutil/unmarshalers.go
+func UnmarshalTransaction(txBytes []byte) (*peer.Transaction, error) {
+	tx := &peer.Transaction{}
+	err := proto.Unmarshal(txBytes, tx)
+	return tx, errors.Wrap(err, "error unmarshaling Transaction")
+}
+
+// UnmarshalChaincodeActionPayload unmarshals bytes to a ChaincodeActionPayload
+// hyperledger/fabric@v2.0/protoutil/unmarshalers.go
+func UnmarshalChaincodeActionPayload(capBytes []byte) (*peer.ChaincodeActionPayload, error) {
+	cap := &peer.ChaincodeActionPayload{}
+	err := proto.Unmarshal(capBytes, cap)
+	return cap, errors.Wrap(err, "error unmarshaling ChaincodeActionPayload")
+}
+
+// GetMetadataFromBlock retrieves metadata at the specified index.
+// hyperledger/fabric@v2.0/protoutil/blockutils.go
+func GetMetadataFromBlock(block *cb.Block, index cb.BlockMetadataIndex) (*cb.Metadata, error) {
+	if block.Metadata == nil {
+		return nil, errors.New("no metadata in block")
+	}
+
+	if len(block.Metadata.Metadata) <= int(index) {
+		return nil, errors.Errorf("no metadata at index [%s]", index)
+	}
+
+	md := &cb.Metadata{}
+	err := proto.Unmarshal(block.Metadata.Metadata[index], md)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error unmarshaling metadata at index [%s]", index)
+	}
+	return md, nil
+}
+
+// GetLastConfigIndexFromBlock retrieves the index of the last config block as
+// encoded in the block metadata
+// hyperledger/fabric@v2.0/protoutil/blockutils.go
+func GetLastConfigIndexFromBlock(block *cb.Block) (uint64, error) {
+	m, err := GetMetadataFromBlock(block, cb.BlockMetadataIndex_SIGNATURES)
+	if err != nil {
+		return 0, errors.WithMessage(err, "failed to retrieve metadata")
+	}
+	// TODO FAB-15864 Remove this fallback when we can stop supporting upgrade from pre-1.4.1 orderer
+	if len(m.Value) == 0 {
+		m, err := GetMetadataFromBlock(block, cb.BlockMetadataIndex_LAST_CONFIG)
+		if err != nil {
+			return 0, errors.WithMessage(err, "failed to retrieve metadata")
+		}
+		lc := &cb.LastConfig{}
+		err = proto.Unmarshal(m.Value, lc)
+		if err != nil {
+			return 0, errors.Wrap(err, "error unmarshaling LastConfig")
+		}
+		return lc.Index, nil
+	}
+
+	obm := &cb.OrdererBlockMetadata{}
+	err = proto.Unmarshal(m.Value, obm)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to unmarshal orderer block metadata")
+	}
+	if obm.LastConfig == nil {
+		return 0, errors.New("missing last config in orderer block metadata")
+	}
+	return obm.LastConfig.Index, nil
+}
+
+// getEndorserTransaction returns the payload and the transaction of an endorser transaction in
+// the given block data entry.
+func getEndorserTransaction(data []byte) (*cb.Payload, *peer.Transaction, error) {
+	envelope, err := GetEnvelopeFromBlock(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err := UnmarshalPayload(envelope.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if payload.Header == nil {
+		return nil, nil, errors.New("missing header in payload")
+	}
+	chdr, err := UnmarshalChannelHeader(payload.Header.ChannelHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cb.HeaderType(chdr.Type) != cb.HeaderType_ENDORSER_TRANSACTION {
+		return nil, nil, errors.Errorf("unsupported header type %d", chdr.Type)
+	}
+	tx, err := UnmarshalTransaction(payload.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return payload, tx, nil
+}
+
+// GetIdentitiesFromTransaction returns the creator and endorser identities of an endorser
+// transaction in the given block data entry.
+func GetIdentitiesFromTransaction(data []byte) ([]*msp.SerializedIdentity, error) {
+	payload, tx, err := getEndorserTransaction(data)
+	if err != nil {
+		return nil, err
+	}
+	shdr, err := UnmarshalSignatureHeader(payload.Header.SignatureHeader)
+	if err != nil {
+		return nil, err
+	}
+	creator, err := UnmarshalSerializedIdentity(shdr.Creator)
+	if err != nil {
+		return nil, err
+	}
+	identities := []*msp.SerializedIdentity{creator}
+
+	for _, action := range tx.Actions {
+		cap, err := UnmarshalChaincodeActionPayload(action.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if cap.Action == nil {
+			continue
+		}
+		for _, endorsement := range cap.Action.Endorsements {
+			endorser, err := UnmarshalSerializedIdentity(endorsement.Endorser)
+			if err != nil {
+				return nil, err
+			}
+			identities = append(identities, endorser)
+		}
+	}
+	return identities, nil
+}
+
+// UnmarshalProposalResponsePayload unmarshals bytes to a ProposalResponsePayload
+// hyperledger/fabric@v2.0/protoutil/unmarshalers.go
+func UnmarshalProposalResponsePayload(prpBytes []byte) (*peer.ProposalResponsePayload, error) {
+	prp := &peer.ProposalResponsePayload{}
+	err := proto.Unmarshal(prpBytes, prp)
+	return prp, errors.Wrap(err, "error unmarshaling ProposalResponsePayload")
+}
+
+// UnmarshalChaincodeAction unmarshals bytes to a ChaincodeAction
+// hyperledger/fabric@v2.0/protoutil/unmarshalers.go
+func UnmarshalChaincodeAction(caBytes []byte) (*peer.ChaincodeAction, error) {
+	chaincodeAction := &peer.ChaincodeAction{}
+	err := proto.Unmarshal(caBytes, chaincodeAction)
+	return chaincodeAction, errors.Wrap(err, "error unmarshaling ChaincodeAction")
+}
+
+// GetNamespaceWritesFromTransaction returns the public writes of an endorser transaction in the
+// given block data entry to the given namespace.
+func GetNamespaceWritesFromTransaction(data []byte, namespace string) ([]*kvrwset.KVWrite, error) {
+	_, tx, err := getEndorserTransaction(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var writes []*kvrwset.KVWrite
+	for _, action := range tx.Actions {
+		cap, err := UnmarshalChaincodeActionPayload(action.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if cap.Action == nil {
+			continue
+		}
+		prp, err := UnmarshalProposalResponsePayload(cap.Action.ProposalResponsePayload)
+		if err != nil {
+			return nil, err
+		}
+		chaincodeAction, err := UnmarshalChaincodeAction(prp.Extension)
+		if err != nil {
+			return nil, err
+		}
+		txRWSet := &rwset.TxReadWriteSet{}
+		if err := proto.Unmarshal(chaincodeAction.Results, txRWSet); err != nil {
+			return nil, errors.Wrap(err, "error unmarshaling TxReadWriteSet")
+		}
+		for _, nsRWSet := range txRWSet.NsRwset {
+			if nsRWSet.Namespace != namespace {
+				continue
+			}
+			kvRWSet := &kvrwset.KVRWSet{}
+			if err := proto.Unmarshal(nsRWSet.Rwset, kvRWSet); err != nil {
+				return nil, errors.Wrap(err, "error unmarshaling KVRWSet")
+			}
+			writes = append(writes, kvRWSet.Writes...)
+		}
+	}
+	return writes, nil
+}
+
+// GetBlockSignerIdentities returns the identities that signed the given block.
+func GetBlockSignerIdentities(block *cb.Block) ([]*msp.SerializedIdentity, error) {
+	m, err := GetMetadataFromBlock(block, cb.BlockMetadataIndex_SIGNATURES)
+	if err != nil {
+		return nil, err
+	}
+
+	var identities []*msp.SerializedIdentity
+	for _, signature := range m.Signatures {
+		shdr, err := UnmarshalSignatureHeader(signature.SignatureHeader)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := UnmarshalSerializedIdentity(shdr.Creator)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, signer)
+	}
+	return identities, nil
+}
@@ -0,0 +1,216 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/hyperledger/fabric/fabricmachine/api"
+	"github.com/pkg/errors"
+)
+
+// capability codes reported by the hardware peer
+const CAPABILITY_CERTIFICATE_CACHE_SIZE byte = 0x01
+const CAPABILITY_CERTIFICATE_ID_ROLE_BITS byte = 0x02
+const CAPABILITY_CERTIFICATE_ID_ORG_BITS byte = 0x03
+const CAPABILITY_MAX_IDENTITY_SIZE byte = 0x04
+const CAPABILITY_MAX_ENDORSERS byte = 0x05
+const CAPABILITY_MAX_TRANSACTION_SIZE byte = 0x06
+const CAPABILITY_MAX_RANGE_QUERIES byte = 0x07
+const CAPABILITY_MAX_COLLECTIONS byte = 0x08
+const CAPABILITY_TXID_INDEX_BITS byte = 0x09
+
+// Size of a capability entry: 1B code, 2B value
+const CAPABILITY_ENTRY_SIZE int = 3
+
+// Certificate ids are carried in 16-bit annotation descriptors.
+const CERTIFICATE_ID_BITS int = 16
+
+const capabilityRequestTimeout = 500 * time.Millisecond
+
+// HardwareCapabilities keeps the limits of the hardware peer that the orderer has to respect
+// while encoding blocks.
+type HardwareCapabilities struct {
+	// Number of certificates the hardware certificate cache can hold.
+	certificateCacheSize int
+
+	// Bit layout of certificate ids, from least to most significant bits: role, organization
+	// and user. User bits are the remaining bits of the id.
+	certificateIdRoleBits int
+	certificateIdOrgBits  int
+
+	// Largest serialized identity (in bytes) that fits in a certificate cache entry.
+	maxIdentitySize int
+
+	// Most endorsements of a transaction the hardware peer can check. Endorsements of transactions
+	// with more endorsements are checked in software.
+	maxEndorsers int
+
+	// Largest transaction (in bytes) the hardware peer can validate. Larger transactions are
+	// validated in software.
+	maxTransactionSize int
+
+	// Most range queries of a transaction the hardware peer can check for phantom reads. Range
+	// queries are not supported when zero. Transactions with more range queries are validated in
+	// software.
+	maxRangeQueries int
+
+	// Most private data collections of a transaction whose hashed read/write sets the hardware
+	// peer can check. Private data is not supported when zero. Transactions using more
+	// collections are validated in software.
+	maxCollections int
+
+	// The TX ID index of the hardware peer holds 2^txIdIndexBits TX IDs. Duplicate TX IDs are
+	// detected in software when zero.
+	txIdIndexBits int
+}
+
+var hwCapabilities HardwareCapabilities
+
+func (c HardwareCapabilities) certificateIdUserBits() int {
+	return CERTIFICATE_ID_BITS - c.certificateIdRoleBits - c.certificateIdOrgBits
+}
+
+// capabilitiesFromConfig returns the capabilities configured for the hardware peer
+func capabilitiesFromConfig() HardwareCapabilities {
+	return HardwareCapabilities{
+		certificateCacheSize:  fmapi.GetCertificateCacheSize(),
+		certificateIdRoleBits: fmapi.GetCertificateIdRoleBits(),
+		certificateIdOrgBits:  fmapi.GetCertificateIdOrgBits(),
+		maxIdentitySize:       fmapi.GetMaxIdentitySize(),
+		maxEndorsers:          fmapi.GetMaxEndorsers(),
+		maxTransactionSize:    fmapi.GetMaxTransactionSize(),
+		maxRangeQueries:       fmapi.GetMaxRangeQueries(),
+		maxCollections:        fmapi.GetMaxCollections(),
+		txIdIndexBits:         fmapi.GetTxIdIndexBits(),
+	}
+}
+
+// parseCapabilities updates capabilities with the entries of a capability response, ignoring
+// unknown capability codes
+func parseCapabilities(data []byte, capabilities *HardwareCapabilities) {
+	for pos := 0; pos+CAPABILITY_ENTRY_SIZE <= len(data); pos += CAPABILITY_ENTRY_SIZE {
+		value := int(binary.BigEndian.Uint16(data[pos+1 : pos+3]))
+		switch data[pos] {
+		case CAPABILITY_CERTIFICATE_CACHE_SIZE:
+			capabilities.certificateCacheSize = value
+		case CAPABILITY_CERTIFICATE_ID_ROLE_BITS:
+			capabilities.certificateIdRoleBits = value
+		case CAPABILITY_CERTIFICATE_ID_ORG_BITS:
+			capabilities.certificateIdOrgBits = value
+		case CAPABILITY_MAX_IDENTITY_SIZE:
+			capabilities.maxIdentitySize = value
+		case CAPABILITY_MAX_ENDORSERS:
+			capabilities.maxEndorsers = value
+		case CAPABILITY_MAX_TRANSACTION_SIZE:
+			capabilities.maxTransactionSize = value
+		case CAPABILITY_MAX_RANGE_QUERIES:
+			capabilities.maxRangeQueries = value
+		case CAPABILITY_MAX_COLLECTIONS:
+			capabilities.maxCollections = value
+		case CAPABILITY_TXID_INDEX_BITS:
+			capabilities.txIdIndexBits = value
+		default:
+			logger.Debugf("Ignoring unknown hardware capability 0x%x", data[pos])
+		}
+	}
+}
+
+// validateCapabilities checks that capabilities describe a usable certificate cache
+func validateCapabilities(capabilities HardwareCapabilities) bool {
+	if capabilities.certificateIdRoleBits < 1 || capabilities.certificateIdOrgBits < 1 ||
+		capabilities.certificateIdUserBits() < 1 {
+		logger.Errorf("Invalid certificate id layout: %d role bit(s), %d org bit(s)",
+			capabilities.certificateIdRoleBits, capabilities.certificateIdOrgBits)
+		return false
+	}
+	if capabilities.certificateCacheSize < 1 {
+		logger.Errorf("Invalid certificate cache size %d", capabilities.certificateCacheSize)
+		return false
+	}
+	if capabilities.maxIdentitySize < 1 {
+		logger.Errorf("Invalid maximum identity size %d", capabilities.maxIdentitySize)
+		return false
+	}
+	// Transaction messages carry one annotation per endorsement and at most 255 annotations.
+	if capabilities.maxEndorsers < 1 || capabilities.maxEndorsers > 0xFF-BlockTransactionAnnotationNumber {
+		logger.Errorf("Invalid maximum number of endorsers %d", capabilities.maxEndorsers)
+		return false
+	}
+	// Each range query and each collection take two more annotations.
+	if capabilities.maxRangeQueries < 0 || capabilities.maxCollections < 0 ||
+		capabilities.maxEndorsers+2*capabilities.maxRangeQueries+2*capabilities.maxCollections > 0xFF-BlockTransactionAnnotationNumber {
+		logger.Errorf("Invalid maximum number of range queries %d or collections %d",
+			capabilities.maxRangeQueries, capabilities.maxCollections)
+		return false
+	}
+	if capabilities.txIdIndexBits < 0 || capabilities.txIdIndexBits > 63 {
+		logger.Errorf("Invalid TX ID index size of %d bit(s)", capabilities.txIdIndexBits)
+		return false
+	}
+	// Annotation offsets within transactions are 16-bit.
+	if capabilities.maxTransactionSize < 1 || capabilities.maxTransactionSize > 0xFFFF {
+		logger.Errorf("Invalid maximum transaction size %d", capabilities.maxTransactionSize)
+		return false
+	}
+	return true
+}
+
+// negotiateCapabilities asks the hardware peer for its capabilities, falling back to the
+// configured ones when the hardware peer does not respond. Peers decide which transactions to
+// validate in software based on the configured limits, so it fails when the hardware peer cannot
+// validate transactions within these limits; such a hardware peer must not be sent blocks.
+func negotiateCapabilities(addr string) error {
+	capabilities := capabilitiesFromConfig()
+	response, err := bcmRequest(addr, BCM_MSG_TYPE_CAPABILITY, 0, nil, 0, nil, BCM_MSG_TYPE_CAPABILITY, capabilityRequestTimeout)
+	if err != nil {
+		logger.Warningf("Using configured hardware capabilities: %s", err)
+	} else {
+		parseCapabilities(response, &capabilities)
+	}
+
+	if !validateCapabilities(capabilities) {
+		logger.Warning("Using configured hardware capabilities")
+		capabilities = capabilitiesFromConfig()
+	}
+
+	if capabilities.maxEndorsers < fmapi.GetMaxEndorsers() {
+		return errors.Errorf("hardware peer checks at most %d endorsements but %d are configured, set maxEndorsers to %d on all nodes",
+			capabilities.maxEndorsers, fmapi.GetMaxEndorsers(), capabilities.maxEndorsers)
+	}
+	if capabilities.maxTransactionSize < fmapi.GetMaxTransactionSize() {
+		return errors.Errorf("hardware peer validates transactions of at most %d bytes but %d are configured, set maxTransactionSize to %d on all nodes",
+			capabilities.maxTransactionSize, fmapi.GetMaxTransactionSize(), capabilities.maxTransactionSize)
+	}
+	if capabilities.maxRangeQueries < fmapi.GetMaxRangeQueries() {
+		return errors.Errorf("hardware peer checks at most %d range queries but %d are configured, set maxRangeQueries to %d on all nodes",
+			capabilities.maxRangeQueries, fmapi.GetMaxRangeQueries(), capabilities.maxRangeQueries)
+	}
+	if capabilities.maxCollections < fmapi.GetMaxCollections() {
+		return errors.Errorf("hardware peer checks at most %d collections but %d are configured, set maxCollections to %d on all nodes",
+			capabilities.maxCollections, fmapi.GetMaxCollections(), capabilities.maxCollections)
+	}
+	// Peers skip the ledger lookup of TX IDs based on the configured index size, so a smaller
+	// index would let duplicate TX IDs through.
+	if capabilities.txIdIndexBits < fmapi.GetTxIdIndexBits() {
+		return errors.Errorf("hardware peer TX ID index has %d bit(s) but %d are configured, set txIdIndexBits to %d on all nodes",
+			capabilities.txIdIndexBits, fmapi.GetTxIdIndexBits(), capabilities.txIdIndexBits)
+	}
+	// The orderer checks the same number of endorsements, and seeds the same number of TX IDs, as
+	// peers expect, even when the hardware peer can handle more.
+	capabilities.maxEndorsers = fmapi.GetMaxEndorsers()
+	capabilities.txIdIndexBits = fmapi.GetTxIdIndexBits()
+
+	hwCapabilities = capabilities
+	logger.Infof("Hardware capabilities: certificate cache size=%d, certificate id bits (role/org/user)=%d/%d/%d, max identity size=%d, max endorsers=%d, max transaction size=%d, max range queries=%d, max collections=%d, TX ID index bits=%d",
+		hwCapabilities.certificateCacheSize, hwCapabilities.certificateIdRoleBits,
+		hwCapabilities.certificateIdOrgBits, hwCapabilities.certificateIdUserBits(), hwCapabilities.maxIdentitySize,
+		hwCapabilities.maxEndorsers, hwCapabilities.maxTransactionSize, hwCapabilities.maxRangeQueries,
+		hwCapabilities.maxCollections, hwCapabilities.txIdIndexBits)
+	return nil
+}
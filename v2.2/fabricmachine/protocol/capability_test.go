@@ -0,0 +1,171 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric/fabricmachine/testutil"
+	"google.golang.org/grpc/metadata"
+)
+
+// capabilityTransport answers capability requests with the given capabilities.
+type capabilityTransport struct {
+	fakeTransport
+	capabilities map[byte]int
+}
+
+func (t *capabilityTransport) Receive(buff []byte, deadline time.Time) (int, error) {
+	packets := t.sent()
+	if len(packets) == 0 {
+		return t.fakeTransport.Receive(buff, deadline)
+	}
+	request, err := bytesToTransportHeader(packets[len(packets)-1])
+	if err != nil {
+		return 0, err
+	}
+	response := transportHeaderToBytes(BcmTransportHeader{request.sequence, BCM_MSG_TYPE_CAPABILITY, 0})
+	for code, value := range t.capabilities {
+		entry := make([]byte, CAPABILITY_ENTRY_SIZE)
+		entry[0] = code
+		binary.BigEndian.PutUint16(entry[1:], uint16(value))
+		response = append(response, entry...)
+	}
+	return copy(buff, response), nil
+}
+
+// hardwareCapabilities returns the capabilities of a hardware peer matching testConfig, with
+// the given overrides.
+func hardwareCapabilities(overrides map[byte]int) map[byte]int {
+	capabilities := map[byte]int{
+		CAPABILITY_CERTIFICATE_CACHE_SIZE:   128,
+		CAPABILITY_CERTIFICATE_ID_ROLE_BITS: 3,
+		CAPABILITY_CERTIFICATE_ID_ORG_BITS:  5,
+		CAPABILITY_MAX_IDENTITY_SIZE:        1024,
+		CAPABILITY_MAX_ENDORSERS:            8,
+		CAPABILITY_MAX_TRANSACTION_SIZE:     65535,
+		CAPABILITY_MAX_RANGE_QUERIES:        2,
+		CAPABILITY_MAX_COLLECTIONS:          1,
+	}
+	for code, value := range overrides {
+		capabilities[code] = value
+	}
+	return capabilities
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	initTestConfig(t)
+	OpenBcmSession(testHardwareAddress, &capabilityTransport{capabilities: hardwareCapabilities(nil)})
+	if err := negotiateCapabilities(testHardwareAddress); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hardware peer decides the certificate cache, but endorsements are checked within the
+	// configured limit that peers route transactions by.
+	want := HardwareCapabilities{
+		certificateCacheSize:  128,
+		certificateIdRoleBits: 3,
+		certificateIdOrgBits:  5,
+		maxIdentitySize:       1024,
+		maxEndorsers:          4,
+		maxTransactionSize:    65535,
+		maxRangeQueries:       2,
+		maxCollections:        1,
+	}
+	if hwCapabilities != want {
+		t.Errorf("negotiated %+v, want %+v", hwCapabilities, want)
+	}
+}
+
+func TestNegotiateCapabilitiesMismatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		capability byte
+		value      int
+	}{
+		{"max endorsers", CAPABILITY_MAX_ENDORSERS, 2},
+		{"max transaction size", CAPABILITY_MAX_TRANSACTION_SIZE, 4096},
+		{"max range queries", CAPABILITY_MAX_RANGE_QUERIES, 1},
+		{"max collections", CAPABILITY_MAX_COLLECTIONS, 0},
+	}
+	for _, test := range tests {
+		initTestConfig(t)
+		configured := hwCapabilities
+		OpenBcmSession(testHardwareAddress, &capabilityTransport{
+			capabilities: hardwareCapabilities(map[byte]int{test.capability: test.value}),
+		})
+		if err := negotiateCapabilities(testHardwareAddress); err == nil {
+			t.Errorf("%s: hardware peer below the configured limit accepted", test.name)
+		}
+		if hwCapabilities != configured {
+			t.Errorf("%s: capabilities changed to %+v", test.name, hwCapabilities)
+		}
+	}
+}
+
+func TestNegotiateCapabilitiesTxIdIndex(t *testing.T) {
+	initTestConfigWith(t, "  txIdIndexBits: 16")
+	configured := hwCapabilities
+	OpenBcmSession(testHardwareAddress, &capabilityTransport{
+		capabilities: hardwareCapabilities(map[byte]int{CAPABILITY_TXID_INDEX_BITS: 12}),
+	})
+	if err := negotiateCapabilities(testHardwareAddress); err == nil {
+		t.Error("hardware peer with a smaller TX ID index accepted")
+	}
+	if hwCapabilities != configured {
+		t.Errorf("capabilities changed to %+v", hwCapabilities)
+	}
+
+	// Peers expect the configured index size, the orderer seeds as many TX IDs.
+	OpenBcmSession(testHardwareAddress, &capabilityTransport{
+		capabilities: hardwareCapabilities(map[byte]int{CAPABILITY_TXID_INDEX_BITS: 20}),
+	})
+	if err := negotiateCapabilities(testHardwareAddress); err != nil {
+		t.Fatal(err)
+	}
+	if hwCapabilities.txIdIndexBits != 16 {
+		t.Errorf("got TX ID index of %d bit(s), want 16", hwCapabilities.txIdIndexBits)
+	}
+}
+
+func TestNegotiateCapabilitiesInvalid(t *testing.T) {
+	initTestConfig(t)
+	configured := hwCapabilities
+	OpenBcmSession(testHardwareAddress, &capabilityTransport{
+		capabilities: hardwareCapabilities(map[byte]int{CAPABILITY_CERTIFICATE_ID_ROLE_BITS: 0}),
+	})
+	if err := negotiateCapabilities(testHardwareAddress); err != nil {
+		t.Fatal(err)
+	}
+	if hwCapabilities != configured {
+		t.Errorf("invalid capabilities not replaced by the configured ones: %+v", hwCapabilities)
+	}
+}
+
+func TestSendToHardwareRefused(t *testing.T) {
+	initTestConfigWith(t, "orderers: [orderer0]")
+	transport := &capabilityTransport{capabilities: hardwareCapabilities(map[byte]int{CAPABILITY_MAX_ENDORSERS: 2})}
+	OpenBcmSession(testHardwareAddress, transport)
+	hwPeer.address = testHardwareAddress
+	hwPeer.blockToSend = 1
+	hwPeer.initDone = false
+	defer func() { hwPeer.initDone, hwPeer.isOrderer, hwPeer.refused = false, false, nil }()
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(":authority", "orderer0:7050"))
+	block := testutil.NewBlock(1, nil, testutil.NewEnvelope(&testutil.Tx{TxId: "tx", Chaincode: "mycc"}))
+	SendToHardware(ctx, block, func(uint64) *cb.Block { return nil }, nil)
+	if hwPeer.refused == nil {
+		t.Fatal("hardware peer below the configured limit accepted")
+	}
+	if packets := transport.sent(); len(packets) != 0 {
+		t.Errorf("sent %d packet(s) to the refused hardware peer", len(packets))
+	}
+}
@@ -0,0 +1,370 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Captures hold raw IP packets (LINKTYPE_RAW), with synthetic IP and UDP headers around the
+// blockchain machine protocol packets.
+const pcapLinkTypeRaw = 101
+const pcapMagic = 0xa1b2c3d4
+const pcapngBlockSHB = 0x0a0d0d0a
+const pcapngBlockIDB = 0x00000001
+const pcapngBlockEPB = 0x00000006
+const pcapngByteOrderMagic = 0x1a2b3c4d
+
+// Source address and port of the synthetic headers
+var captureSourceIP = net.IPv4(127, 0, 0, 1)
+
+const captureSourcePort = 49655
+
+// CapturedPacket is a blockchain machine protocol packet read from a capture
+type CapturedPacket struct {
+	Time    time.Time
+	Payload []byte
+}
+
+// captureWriter writes packets to a pcap file, or to a pcapng file when its name ends with
+// .pcapng
+type captureWriter struct {
+	sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	pcapng bool
+}
+
+// newCaptureWriter creates a capture file
+func newCaptureWriter(path string) (*captureWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &captureWriter{file: file, w: bufio.NewWriter(file), pcapng: strings.HasSuffix(path, ".pcapng")}
+	if c.pcapng {
+		// section header block, then interface description block
+		shb := make([]byte, 28)
+		binary.LittleEndian.PutUint32(shb[0:4], pcapngBlockSHB)
+		binary.LittleEndian.PutUint32(shb[4:8], 28)
+		binary.LittleEndian.PutUint32(shb[8:12], pcapngByteOrderMagic)
+		binary.LittleEndian.PutUint16(shb[12:14], 1)
+		binary.LittleEndian.PutUint64(shb[16:24], 0xFFFFFFFFFFFFFFFF) // unknown section length
+		binary.LittleEndian.PutUint32(shb[24:28], 28)
+		idb := make([]byte, 20)
+		binary.LittleEndian.PutUint32(idb[0:4], pcapngBlockIDB)
+		binary.LittleEndian.PutUint32(idb[4:8], 20)
+		binary.LittleEndian.PutUint16(idb[8:10], pcapLinkTypeRaw)
+		binary.LittleEndian.PutUint32(idb[12:16], 0xFFFF) // snap length
+		binary.LittleEndian.PutUint32(idb[16:20], 20)
+		c.w.Write(shb)
+		c.w.Write(idb)
+	} else {
+		hdr := make([]byte, 24)
+		binary.LittleEndian.PutUint32(hdr[0:4], pcapMagic)
+		binary.LittleEndian.PutUint16(hdr[4:6], 2)
+		binary.LittleEndian.PutUint16(hdr[6:8], 4)
+		binary.LittleEndian.PutUint32(hdr[16:20], 0xFFFF) // snap length
+		binary.LittleEndian.PutUint32(hdr[20:24], pcapLinkTypeRaw)
+		c.w.Write(hdr)
+	}
+	if err := c.w.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// write records a packet sent to addr at time t
+func (c *captureWriter) write(t time.Time, addr string, packet []byte) error {
+	frame := synthesizeUdpFrame(addr, packet)
+
+	c.Lock()
+	defer c.Unlock()
+	if c.pcapng {
+		// enhanced packet block, timestamps in microseconds
+		padded := (len(frame) + 3) &^ 3
+		total := 32 + padded
+		hdr := make([]byte, 28)
+		binary.LittleEndian.PutUint32(hdr[0:4], pcapngBlockEPB)
+		binary.LittleEndian.PutUint32(hdr[4:8], uint32(total))
+		us := uint64(t.UnixNano() / 1000)
+		binary.LittleEndian.PutUint32(hdr[12:16], uint32(us>>32))
+		binary.LittleEndian.PutUint32(hdr[16:20], uint32(us))
+		binary.LittleEndian.PutUint32(hdr[20:24], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(hdr[24:28], uint32(len(frame)))
+		trailer := make([]byte, padded-len(frame)+4)
+		binary.LittleEndian.PutUint32(trailer[len(trailer)-4:], uint32(total))
+		c.w.Write(hdr)
+		c.w.Write(frame)
+		c.w.Write(trailer)
+	} else {
+		hdr := make([]byte, 16)
+		binary.LittleEndian.PutUint32(hdr[0:4], uint32(t.Unix()))
+		binary.LittleEndian.PutUint32(hdr[4:8], uint32(t.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(frame)))
+		c.w.Write(hdr)
+		c.w.Write(frame)
+	}
+	return c.w.Flush()
+}
+
+func (c *captureWriter) close() error {
+	c.Lock()
+	defer c.Unlock()
+	c.w.Flush()
+	return c.file.Close()
+}
+
+// synthesizeUdpFrame wraps a packet in IPv4 or IPv6 and UDP headers, towards addr when it is an
+// IP address and port, and towards the loopback address otherwise
+func synthesizeUdpFrame(addr string, packet []byte) []byte {
+	dstIP := net.IPv4(127, 0, 0, 1)
+	dstPort := 0
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			dstIP = ip
+		}
+		dstPort, _ = strconv.Atoi(port)
+	}
+
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:2], captureSourcePort)
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(packet)))
+
+	var frame []byte
+	if ip4 := dstIP.To4(); ip4 != nil {
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+8+len(packet)))
+		ip[8] = 64 // TTL
+		ip[9] = 17 // UDP
+		copy(ip[12:16], captureSourceIP.To4())
+		copy(ip[16:20], ip4)
+		binary.BigEndian.PutUint16(ip[10:12], ipv4Checksum(ip))
+		frame = append(ip, udp...)
+	} else {
+		ip := make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:6], uint16(8+len(packet)))
+		ip[6] = 17 // UDP
+		ip[7] = 64 // hop limit
+		copy(ip[8:24], net.IPv6loopback)
+		copy(ip[24:40], dstIP.To16())
+		frame = append(ip, udp...)
+	}
+	// UDP checksums are optional over IPv4 and left out, since captures are not meant for the wire
+	return append(frame, packet...)
+}
+
+// ipv4Checksum computes the checksum of an IPv4 header
+func ipv4Checksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i : i+2]))
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return ^uint16(sum)
+}
+
+// ReadCapture reads the UDP payloads of a pcap or pcapng capture of raw IP packets, such as the
+// ones the orderer writes
+func ReadCapture(path string) ([]CapturedPacket, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, errors.Wrapf(err, "cannot read %s", path)
+	}
+	switch binary.LittleEndian.Uint32(magic) {
+	case pcapMagic:
+		return readPcap(r)
+	case pcapngBlockSHB:
+		return readPcapng(r)
+	}
+	return nil, errors.Errorf("%s is not a little-endian pcap or pcapng file", path)
+}
+
+// readPcap reads the packets of a pcap file, after its magic number
+func readPcap(r io.Reader) ([]CapturedPacket, error) {
+	hdr := make([]byte, 20)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if linkType := binary.LittleEndian.Uint32(hdr[16:20]); linkType != pcapLinkTypeRaw {
+		return nil, errors.Errorf("unsupported link type %d", linkType)
+	}
+
+	var packets []CapturedPacket
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, record); err == io.EOF {
+			return packets, nil
+		} else if err != nil {
+			return nil, err
+		}
+		t := time.Unix(int64(binary.LittleEndian.Uint32(record[0:4])), int64(binary.LittleEndian.Uint32(record[4:8]))*1000)
+		frame := make([]byte, binary.LittleEndian.Uint32(record[8:12]))
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, err
+		}
+		if payload := udpPayload(frame); payload != nil {
+			packets = append(packets, CapturedPacket{t, payload})
+		}
+	}
+}
+
+// readPcapng reads the packets of a single section pcapng file, after its first block type
+func readPcapng(r io.Reader) ([]CapturedPacket, error) {
+	var packets []CapturedPacket
+	first := true
+	for {
+		var blockType uint32 = pcapngBlockSHB
+		if !first {
+			hdr := make([]byte, 4)
+			if _, err := io.ReadFull(r, hdr); err == io.EOF {
+				return packets, nil
+			} else if err != nil {
+				return nil, err
+			}
+			blockType = binary.LittleEndian.Uint32(hdr)
+		}
+		first = false
+
+		lengthBytes := make([]byte, 4)
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return nil, err
+		}
+		length := binary.LittleEndian.Uint32(lengthBytes)
+		if length < 12 || length%4 != 0 {
+			return nil, errors.Errorf("invalid pcapng block length %d", length)
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+
+		switch blockType {
+		case pcapngBlockSHB:
+			if binary.LittleEndian.Uint32(body[0:4]) != pcapngByteOrderMagic {
+				return nil, errors.New("unsupported big-endian pcapng section")
+			}
+		case pcapngBlockIDB:
+			if linkType := binary.LittleEndian.Uint16(body[0:2]); linkType != pcapLinkTypeRaw {
+				return nil, errors.Errorf("unsupported link type %d", linkType)
+			}
+		case pcapngBlockEPB:
+			if len(body) < 24 {
+				return nil, errors.New("truncated enhanced packet block")
+			}
+			us := uint64(binary.LittleEndian.Uint32(body[4:8]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:12]))
+			captured := binary.LittleEndian.Uint32(body[12:16])
+			if int(captured) > len(body)-24 {
+				return nil, errors.New("truncated enhanced packet block")
+			}
+			t := time.Unix(0, int64(us)*1000)
+			if payload := udpPayload(body[20 : 20+captured]); payload != nil {
+				packets = append(packets, CapturedPacket{t, append([]byte(nil), payload...)})
+			}
+		}
+	}
+}
+
+// udpPayload returns the payload of a raw IPv4 or IPv6 UDP packet, nil for other packets
+func udpPayload(frame []byte) []byte {
+	if len(frame) < 1 {
+		return nil
+	}
+	var offset int
+	switch frame[0] >> 4 {
+	case 4:
+		if len(frame) < 20 || frame[9] != 17 {
+			return nil
+		}
+		offset = int(frame[0]&0x0F) * 4
+	case 6:
+		if len(frame) < 40 || frame[6] != 17 {
+			return nil
+		}
+		offset = 40
+	default:
+		return nil
+	}
+	if len(frame) < offset+8 {
+		return nil
+	}
+	return frame[offset+8:]
+}
+
+// captureTransport mirrors the packets sent through a transport to a capture file
+type captureTransport struct {
+	Transport
+	addr    string
+	capture *captureWriter
+}
+
+func (t *captureTransport) Send(packet []byte) error {
+	if err := t.Transport.Send(packet); err != nil {
+		return err
+	}
+	t.record(packet)
+	return nil
+}
+
+func (t *captureTransport) SendBatch(packets [][]byte) (int, error) {
+	n, err := t.Transport.SendBatch(packets)
+	for _, packet := range packets[:n] {
+		t.record(packet)
+	}
+	return n, err
+}
+
+func (t *captureTransport) record(packet []byte) {
+	if err := t.capture.write(time.Now(), t.addr, packet); err != nil {
+		logger.Warningf("Cannot capture packet to %s: %s", t.addr, err)
+	}
+}
+
+// bcmCapture is the capture file all sessions mirror their packets to, nil when capture is disabled
+var bcmCapture *captureWriter
+var bcmCaptureOnce sync.Once
+
+// getCaptureWriter opens the configured capture file the first time it is called
+func getCaptureWriter(path string) *captureWriter {
+	bcmCaptureOnce.Do(func() {
+		if path == "" {
+			return
+		}
+		c, err := newCaptureWriter(path)
+		if err != nil {
+			logger.Errorf("Cannot create capture file %s: %s", path, err)
+			return
+		}
+		logger.Infof("Capturing packets to hardware peers to %s", path)
+		bcmCapture = c
+	})
+	return bcmCapture
+}
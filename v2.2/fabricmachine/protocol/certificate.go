@@ -7,48 +7,123 @@ SPDX-License-Identifier: Apache-2.0
 package fmprotocol
 
 import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"io/ioutil"
+	"os"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric/fabricmachine/api"
+	"github.com/pkg/errors"
+)
+
+// Identity roles known to the hardware. Role ids are assigned in the order below starting from 0,
+// followed by custom roles (organizational units in the MSP configuration) in the order they are
+// discovered.
+const (
+	ROLE_ADMIN int = iota
+	ROLE_ORDERER
+	ROLE_PEER
+	ROLE_CLIENT
 )
 
+var defaultIdentityRoles = []string{"admin", "orderer", "peer", "client"}
+
+var identityRoles []string
+
 type CertificateInfo struct {
 	id            int
 	name          string
 	ca            []byte
 	identity_data []byte
+
+	// Organization and role the id was generated from.
+	orgId int
+	role  int
+
+	// True when the certificate comes from the channel MSP configuration (e.g. an admin
+	// certificate), false when it was learned from a block.
+	fromConfig bool
+
+	// Last block that referred to the certificate, used to evict the least recently used
+	// certificates when the hardware certificate cache is full.
+	lastUsed uint64
 }
 
 var CertificateCache map[string]CertificateInfo
 var CertificateIdCache map[int]CertificateInfo
 
+// Organization ids keyed by MSP ID. Ids are assigned in the order the MSPs are discovered and are
+// never reused, so that ids stay stable when organizations are removed from the channel.
+var certificateOrgIds map[string]int
+
+// Latest MSP configuration of each organization in the channel, keyed by MSP ID.
+var mspConfigs map[string]*msp.FabricMSPConfig
+
+// Block currently being prepared for sending, used to track when certificates were last used.
+var certificateClock uint64
+
+// generateId packs user, organization and role into a cache ID according to the certificate id
+// layout of the hardware peer
 func generateId(userId int, orgId int, role int) (id int) {
-	id = role + (orgId << 4) + (userId << 8)
+	roleBits := hwCapabilities.certificateIdRoleBits
+	orgBits := hwCapabilities.certificateIdOrgBits
+	id = role + (orgId << uint(roleBits)) + (userId << uint(roleBits+orgBits))
 	return id
 }
 
+// generateOrgId returns the organization and role part of a cache ID
 func generateOrgId(data int) (id uint16) {
-	id = (uint16)(data & 0x0FF)
+	mask := (1 << uint(hwCapabilities.certificateIdRoleBits+hwCapabilities.certificateIdOrgBits)) - 1
+	id = (uint16)(data & mask)
 	return id
 }
 
 func initCertificateCache() {
 	CertificateCache = make(map[string]CertificateInfo)
 	CertificateIdCache = make(map[int]CertificateInfo)
+	certificateOrgIds = make(map[string]int)
+	mspConfigs = make(map[string]*msp.FabricMSPConfig)
+	mspRevokedSerials = make(map[string]map[string]revokedCertificate)
+	identityRoles = append([]string{}, defaultIdentityRoles...)
 }
 
-// serializeCertificate generates serialized identity data based on certificate name and certificate data
+// serializeCertificate generates serialized identity data based on certificate name and certificate data.
+// It marshals msp.SerializedIdentity the same way Fabric does, so that the result matches the
+// creator and endorser identities in transactions byte-for-byte.
 func serializeCertificate(name string, ca []byte) (id_data []byte) {
-	id_data = make([]byte, 0)
-	id_data = append(id_data, uint8(0x0a))
-	id_data = append(id_data, uint8(len(name)))
-	id_data = append(id_data, []byte(name)...)
-
-	id_data = append(id_data, uint8(0x12))
-	id_data = append(id_data, uint8((len(ca)&0x7F)|0x80))
-	id_data = append(id_data, uint8(len(ca)>>7))
-	id_data = append(id_data, ca...)
+	id_data, err := proto.Marshal(&msp.SerializedIdentity{Mspid: name, IdBytes: ca})
+	if err != nil {
+		logger.Errorf("cannot serialize %s identity: %v", name, err.Error())
+		return nil
+	}
 	return id_data
 }
 
+// validateCertificate checks that the hardware peer can hold a certificate in its cache.
+// It returns an error describing why the certificate cannot be cached otherwise.
+func validateCertificate(name string, ca []byte) error {
+	if size := len(serializeCertificate(name, ca)); size > hwCapabilities.maxIdentitySize {
+		return errors.Errorf("%s identity of %d bytes exceeds maximum identity size of %d bytes",
+			name, size, hwCapabilities.maxIdentitySize)
+	}
+
+	block, rest := pem.Decode(ca)
+	if block == nil {
+		return errors.Errorf("%s identity is not a PEM encoded certificate", name)
+	}
+	if next, _ := pem.Decode(rest); next != nil {
+		return errors.Errorf("%s identity is a certificate chain, which is not supported by hardware", name)
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return errors.Wrapf(err, "%s identity is not a valid x509 certificate", name)
+	}
+	return nil
+}
+
 // getCertificateId gets cache ID number of a certificate
 func getCertificateId(identity_data []byte) (id int) {
 	k := string(identity_data)
@@ -79,12 +154,13 @@ func insertCertificate(id int, name string, ca []byte) (res int) {
 
 	sk := serializeCertificate(name, ca)
 	k := getCertificateId(sk)
-	if k > 0 {
+	if k >= 0 {
 		return -1 // ca existed
 	}
 
-	CertificateCache[string(sk)] = CertificateInfo{id, name, ca, sk}
-	CertificateIdCache[id] = CertificateInfo{id, name, ca, sk}
+	info := CertificateInfo{id: id, name: name, ca: ca, identity_data: sk}
+	CertificateCache[string(sk)] = info
+	CertificateIdCache[id] = info
 	return 0
 }
 
@@ -95,35 +171,376 @@ func removeCertificateFromCache(id int) {
 	delete(CertificateCache, k)
 }
 
-// getCertificateIdWithRuntimeUpdate finds or creates a cache entry based on certificate data and return the cache ID
-func getCertificateIdWithRuntimeUpdate(ca []byte) (id int) {
-	k := string(ca)
-	v, prs := CertificateCache[k]
+// getOrgId returns the organization id of an MSP, assigning a new one if the MSP is not known yet
+func getOrgId(mspId string) (orgId int) {
+	orgId, prs := certificateOrgIds[mspId]
+	if !prs {
+		orgId = len(certificateOrgIds)
+		certificateOrgIds[mspId] = orgId
+	}
+	return orgId
+}
 
-	if prs == false {
-		insertCertificate(len(CertificateCache), "test-"+string(len(CertificateCache)), ca)
-		v, prs = CertificateCache[k]
-		logger.Warningf("Certificate not found, insert runtime: id=%d", v.id)
+// getRoleId returns the id of a role, assigning a new one if the role is not known yet
+func getRoleId(name string) (role int) {
+	for role, r := range identityRoles {
+		if r == name {
+			return role
+		}
 	}
-	return v.id
+	identityRoles = append(identityRoles, name)
+	return len(identityRoles) - 1
 }
 
-// installCertificateFile add a certificate file to certificate cache
-func installCertificateFile(path string, id int, name string) (ret int) {
-	data, err := ioutil.ReadFile(path)
+// getIdentityRole classifies a certificate into one of the identity roles based on the MSP
+// configuration of its organization (explicit admins list, NodeOUs and organizational units)
+func getIdentityRole(mspId string, ca []byte) (role int) {
+	conf := mspConfigs[mspId]
+	if conf == nil {
+		return ROLE_CLIENT
+	}
+	for _, admin := range conf.Admins {
+		if bytes.Equal(admin, ca) {
+			return ROLE_ADMIN
+		}
+	}
+
+	block, _ := pem.Decode(ca)
+	if block == nil {
+		return ROLE_CLIENT
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
-		logger.Errorf("cannot read from %v:%v", path, err.Error())
+		return ROLE_CLIENT
+	}
+
+	nodeOUs := conf.FabricNodeOus
+	if nodeOUs != nil && nodeOUs.Enable {
+		for _, ou := range cert.Subject.OrganizationalUnit {
+			switch ou {
+			case nodeOUs.AdminOuIdentifier.GetOrganizationalUnitIdentifier():
+				return ROLE_ADMIN
+			case nodeOUs.OrdererOuIdentifier.GetOrganizationalUnitIdentifier():
+				return ROLE_ORDERER
+			case nodeOUs.PeerOuIdentifier.GetOrganizationalUnitIdentifier():
+				return ROLE_PEER
+			case nodeOUs.ClientOuIdentifier.GetOrganizationalUnitIdentifier():
+				return ROLE_CLIENT
+			}
+		}
+	}
+
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		for _, ouIdentifier := range conf.OrganizationalUnitIdentifiers {
+			if ou == ouIdentifier.OrganizationalUnitIdentifier {
+				return getRoleId(ou)
+			}
+		}
+	}
+	return ROLE_CLIENT
+}
+
+// allocateCertificateId returns the first free cache ID for an organization and role, or -1 when
+// all user ids of the organization and role are in use
+func allocateCertificateId(orgId int, role int) (id int) {
+	for userId := 0; userId < (1 << uint(hwCapabilities.certificateIdUserBits())); userId++ {
+		id = generateId(userId, orgId, role)
+		if _, prs := CertificateIdCache[id]; !prs {
+			return id
+		}
+	}
+	return -1
+}
+
+// findEvictableCertificate returns the least recently used certificate that is not used by the
+// block being sent and did not come from the MSP configuration, or -1 if there is none.
+// Only certificates of the given organization and role are considered when role >= 0.
+func findEvictableCertificate(orgId int, role int) (id int) {
+	id = -1
+	for _, info := range CertificateIdCache {
+		if info.fromConfig || info.lastUsed >= certificateClock {
+			continue
+		}
+		if role >= 0 && (info.orgId != orgId || info.role != role) {
+			continue
+		}
+		if id < 0 || info.lastUsed < CertificateIdCache[id].lastUsed {
+			id = info.id
+		}
+	}
+	return id
+}
+
+// touchCertificate marks a certificate as used by the block being sent
+func touchCertificate(id int) {
+	info, prs := CertificateIdCache[id]
+	if !prs {
+		return
+	}
+	info.lastUsed = certificateClock
+	CertificateIdCache[id] = info
+	CertificateCache[string(info.identity_data)] = info
+}
+
+// addCertificate assigns a cache ID to a certificate, inserts it into the certificate cache and
+// installs it in the hardware peer.
+// When the hardware certificate cache is full, or all ids of the organization and role are in use,
+// the least recently used certificate is evicted and its slot is reused.
+func addCertificate(addr string, name string, ca []byte, fromConfig bool) (id int) {
+	if err := validateCertificate(name, ca); err != nil {
+		if fromConfig {
+			logger.Errorf("Configuration error: %s", err)
+		} else {
+			logger.Warningf("Not caching certificate: %s", err)
+		}
+		return -1
+	}
+	if isCertificateRevoked(name, ca) {
+		logger.Debugf("Not caching revoked %s certificate, sending it inline", name)
 		return -1
 	}
-	logger.Infof("certificate read from %s done. size = %d", path, len(data))
 
-	ret = insertCertificate(id, name, data)
-	return ret
+	orgId := getOrgId(name)
+	role := getIdentityRole(name, ca)
+	if orgId >= (1<<uint(hwCapabilities.certificateIdOrgBits)) || role >= (1<<uint(hwCapabilities.certificateIdRoleBits)) {
+		logger.Errorf("Certificate id layout cannot hold %s %s identities (org id %d, role id %d)",
+			name, identityRoles[role], orgId, role)
+		return -1
+	}
+
+	op := BCM_CACHE_OP_ADD
+	if len(CertificateIdCache) >= hwCapabilities.certificateCacheSize {
+		evicted := findEvictableCertificate(orgId, -1)
+		if evicted < 0 {
+			logger.Errorf("Certificate cache is full, cannot add %s %s certificate", name, identityRoles[role])
+			return -1
+		}
+		deleteCertificate(addr, evicted)
+	}
+	id = allocateCertificateId(orgId, role)
+	if id < 0 {
+		id = findEvictableCertificate(orgId, role)
+		if id < 0 {
+			logger.Errorf("No free certificate id for %s %s identities", name, identityRoles[role])
+			return -1
+		}
+		// Overwrite the evicted certificate in place.
+		evicted := CertificateIdCache[id]
+		logger.Infof("Evicting %s %s certificate with id=%d", evicted.name, identityRoles[evicted.role], id)
+		removeCertificateFromCache(id)
+		op = BCM_CACHE_OP_UPDATE
+	}
+	if insertCertificate(id, name, ca) != 0 {
+		return -1
+	}
+
+	info := CertificateIdCache[id]
+	info.orgId = orgId
+	info.role = role
+	info.fromConfig = fromConfig
+	info.lastUsed = certificateClock
+	CertificateIdCache[id] = info
+	CertificateCache[string(info.identity_data)] = info
+
+	logger.Infof("Adding %s %s certificate with id=%d", name, identityRoles[role], id)
+	if err := sendCertificateCacheUpdate(addr, op, info); err != nil {
+		// The hardware peer may or may not have installed the certificate, so drop it on both
+		// sides. Transactions referring to it will carry the identity inline instead.
+		logger.Warningf("Cannot install %s certificate with id=%d: %s", name, id, err)
+		deleteCertificate(addr, id)
+		return -1
+	}
+	return id
+}
+
+// deleteCertificate removes a certificate from the certificate cache and from the hardware peer
+func deleteCertificate(addr string, id int) {
+	info, prs := CertificateIdCache[id]
+	if !prs {
+		return
+	}
+	logger.Infof("Removing %s %s certificate with id=%d", info.name, identityRoles[info.role], id)
+	removeCertificateFromCache(id)
+	if err := sendCertificateCacheUpdate(addr, BCM_CACHE_OP_REMOVE, info); err != nil {
+		// The hardware peer keeps the certificate until its ID is used for another one.
+		logger.Warningf("Cannot remove %s certificate with id=%d from hardware peer: %s", info.name, id, err)
+	}
+}
+
+// learnCertificate makes sure that a serialized identity seen in a block is cached, adding it when
+// it is not known yet. Returns true when a new certificate has been added.
+func learnCertificate(addr string, identity *msp.SerializedIdentity) (added bool) {
+	if id := getCertificateId(serializeCertificate(identity.Mspid, identity.IdBytes)); id >= 0 {
+		touchCertificate(id)
+		return false
+	}
+	if !hwPeer.installCertificates {
+		return false
+	}
+	if _, prs := mspConfigs[identity.Mspid]; !prs {
+		logger.Warningf("Identity of unknown MSP %s is not cached", identity.Mspid)
+		return false
+	}
+	return addCertificate(addr, identity.Mspid, identity.IdBytes, false) >= 0
+}
+
+// updateCertificatesFromMSPConfigs applies a new set of channel MSP configurations to the
+// certificate cache, and sends incremental updates for the changes (including revocations) to the
+// hardware peer
+func updateCertificatesFromMSPConfigs(addr string, configs map[string]*msp.FabricMSPConfig) {
+	mspConfigs = configs
+	updateRevocations(addr, configs)
+
+	cached := make([]CertificateInfo, 0, len(CertificateIdCache))
+	for _, info := range CertificateIdCache {
+		cached = append(cached, info)
+	}
+	for _, info := range cached {
+		conf, prs := configs[info.name]
+		if !prs {
+			// The organization has been removed from the channel.
+			deleteCertificate(addr, info.id)
+			continue
+		}
+
+		isAdmin := false
+		for _, admin := range conf.Admins {
+			if bytes.Equal(admin, info.ca) {
+				isAdmin = true
+				break
+			}
+		}
+		if info.fromConfig && !isAdmin {
+			// The admin certificate has been removed from the MSP configuration.
+			deleteCertificate(addr, info.id)
+			continue
+		}
+
+		if role := getIdentityRole(info.name, info.ca); role != info.role {
+			// The identity has changed its role (e.g. NodeOUs were enabled), so it needs a new id.
+			deleteCertificate(addr, info.id)
+			addCertificate(addr, info.name, info.ca, isAdmin)
+		}
+	}
+
+	for name, conf := range configs {
+		getOrgId(name)
+		for _, admin := range conf.Admins {
+			if id := getCertificateId(serializeCertificate(name, admin)); id >= 0 {
+				info := CertificateIdCache[id]
+				info.fromConfig = true
+				CertificateIdCache[id] = info
+				CertificateCache[string(info.identity_data)] = info
+				continue
+			}
+			addCertificate(addr, name, admin, true)
+		}
+	}
+
+	saveCertificateCache()
 }
 
 // updateRemoteCertificateCache updates the remote peer with latest cache data
 func updateRemoteCertificateCache(addr string) {
-	for _, v := range CertificateCache {
-		sendCertificateCacheUpdate(addr, v.id, v.name, v.ca)
+	removed := false
+	for _, v := range CertificateIdCache {
+		if err := sendCertificateCacheUpdate(addr, BCM_CACHE_OP_UPDATE, v); err != nil {
+			logger.Warningf("Cannot sync %s certificate with id=%d: %s", v.name, v.id, err)
+			removeCertificateFromCache(v.id)
+			removed = true
+		}
+	}
+	if removed {
+		saveCertificateCache()
+	}
+}
+
+// Format of the certificate cache file which persists id assignment across orderer restarts.
+type persistedCertificate struct {
+	Id         int    `json:"id"`
+	MspId      string `json:"mspid"`
+	Role       int    `json:"role"`
+	Cert       []byte `json:"cert"`
+	FromConfig bool   `json:"from_config"`
+}
+
+type persistedCertificateCache struct {
+	RoleBits     int                    `json:"role_bits"`
+	OrgBits      int                    `json:"org_bits"`
+	Roles        []string               `json:"roles"`
+	OrgIds       map[string]int         `json:"org_ids"`
+	Certificates []persistedCertificate `json:"certificates"`
+}
+
+// loadCertificateCache restores the certificate cache from the certificate cache file
+func loadCertificateCache() {
+	path := fmapi.GetCertificateCacheFile()
+	if path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Errorf("cannot read from %v:%v", path, err.Error())
+		}
+		return
+	}
+
+	var persisted persistedCertificateCache
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		logger.Errorf("cannot parse certificate cache file %v:%v", path, err.Error())
+		return
+	}
+
+	if persisted.RoleBits != hwCapabilities.certificateIdRoleBits || persisted.OrgBits != hwCapabilities.certificateIdOrgBits {
+		logger.Warningf("Certificate id layout has changed, discarding certificate ids in %s", path)
+		return
+	}
+	if len(persisted.Roles) > 0 {
+		identityRoles = persisted.Roles
+	}
+	for name, orgId := range persisted.OrgIds {
+		certificateOrgIds[name] = orgId
+	}
+	for _, c := range persisted.Certificates {
+		if insertCertificate(c.Id, c.MspId, c.Cert) != 0 {
+			logger.Warningf("Skipping duplicate certificate with id=%d in %s", c.Id, path)
+			continue
+		}
+		info := CertificateIdCache[c.Id]
+		info.orgId = certificateOrgIds[c.MspId]
+		info.role = c.Role
+		info.fromConfig = c.FromConfig
+		CertificateIdCache[c.Id] = info
+		CertificateCache[string(info.identity_data)] = info
+	}
+	logger.Infof("Loaded %d certificate(s) from %s", len(CertificateIdCache), path)
+}
+
+// saveCertificateCache writes the certificate cache to the certificate cache file
+func saveCertificateCache() {
+	path := fmapi.GetCertificateCacheFile()
+	if path == "" {
+		return
+	}
+
+	persisted := persistedCertificateCache{
+		RoleBits: hwCapabilities.certificateIdRoleBits,
+		OrgBits:  hwCapabilities.certificateIdOrgBits,
+		Roles:    identityRoles,
+		OrgIds:   certificateOrgIds,
+	}
+	for _, info := range CertificateIdCache {
+		persisted.Certificates = append(persisted.Certificates,
+			persistedCertificate{info.id, info.name, info.role, info.ca, info.fromConfig})
+	}
+	data, err := json.MarshalIndent(persisted, "", "  ")
+	if err != nil {
+		logger.Errorf("cannot serialize certificate cache: %v", err.Error())
+		return
+	}
+
+	if err := fmapi.WriteFile(path, data); err != nil {
+		logger.Errorf("%s", err)
 	}
 }
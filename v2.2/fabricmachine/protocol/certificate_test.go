@@ -0,0 +1,445 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric/fabricmachine/testutil"
+)
+
+const testHardwareAddress = "127.0.0.1:7100"
+
+// initTestCertificateCache starts with an empty certificate cache that installs the certificates
+// it learns, and returns the transport recording the cache updates.
+func initTestCertificateCache(t *testing.T) *fakeTransport {
+	t.Helper()
+	initTestConfig(t)
+	initCertificateCache()
+	hwPeer.address = testHardwareAddress
+	hwPeer.installCertificates = true
+	hwPeer.ackTimeout = 0
+	certificateClock = 0
+	return newTestSession(testHardwareAddress)
+}
+
+// cacheUpdate is a certificate cache update message sent to the hardware peer.
+type cacheUpdate struct {
+	op byte
+	id int
+}
+
+// cacheUpdates returns the certificate cache update messages among packets
+func cacheUpdates(t *testing.T, packets [][]byte) (updates []cacheUpdate) {
+	t.Helper()
+	for _, packet := range packets {
+		hdr, err := bytesToTransportHeader(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.ctrl_type&0x0F != BCM_MSG_TYPE_CACHE_UPDATE {
+			continue
+		}
+		// The first annotation carries the cache ID in its offset field.
+		id := binary.BigEndian.Uint16(packet[BCM_TRANSPORT_HEADER_SIZE+1:])
+		updates = append(updates, cacheUpdate{(hdr.ctrl_type >> 4) &^ BCM_CTRL_ACK_REQUEST, int(id)})
+	}
+	return updates
+}
+
+// cachedCertificate returns the cache entry of an identity, failing the test when it is not cached
+func cachedCertificate(t *testing.T, mspId string, certificate []byte) CertificateInfo {
+	t.Helper()
+	id := getCertificateId(serializeCertificate(mspId, certificate))
+	if id < 0 {
+		t.Fatalf("%s certificate is not cached", mspId)
+	}
+	return CertificateIdCache[id]
+}
+
+func TestCertificateCacheFromMSPConfigs(t *testing.T) {
+	transport := initTestCertificateCache(t)
+
+	admin1 := testutil.NewCertificate("admin1")
+	admin2 := testutil.NewCertificate("admin2")
+	updateCertificatesFromMSPConfigs(testHardwareAddress, map[string]*msp.FabricMSPConfig{
+		"Org1MSP": {Name: "Org1MSP", Admins: [][]byte{admin1}},
+		"Org2MSP": {Name: "Org2MSP", Admins: [][]byte{admin2}},
+	})
+	info1 := cachedCertificate(t, "Org1MSP", admin1)
+	info2 := cachedCertificate(t, "Org2MSP", admin2)
+	for _, info := range []CertificateInfo{info1, info2} {
+		if !info.fromConfig || info.role != ROLE_ADMIN {
+			t.Errorf("%s admin: got fromConfig %v and role %d, want true and %d", info.name, info.fromConfig, info.role, ROLE_ADMIN)
+		}
+	}
+	if info1.orgId == info2.orgId {
+		t.Errorf("Org1MSP and Org2MSP share org id %d", info1.orgId)
+	}
+	updates := cacheUpdates(t, transport.sent())
+	if len(updates) != 2 || updates[0].op != BCM_CACHE_OP_ADD || updates[1].op != BCM_CACHE_OP_ADD {
+		t.Fatalf("got cache updates %v, want 2 additions", updates)
+	}
+
+	// Org2MSP leaves the channel and Org1MSP replaces its admin.
+	admin3 := testutil.NewCertificate("admin3")
+	updateCertificatesFromMSPConfigs(testHardwareAddress, map[string]*msp.FabricMSPConfig{
+		"Org1MSP": {Name: "Org1MSP", Admins: [][]byte{admin3}},
+	})
+	if len(CertificateIdCache) != 1 {
+		t.Fatalf("got %d cached certificates, want 1", len(CertificateIdCache))
+	}
+	info3 := cachedCertificate(t, "Org1MSP", admin3)
+	if info3.orgId != info1.orgId {
+		t.Errorf("Org1MSP org id changed from %d to %d", info1.orgId, info3.orgId)
+	}
+	removed := map[int]bool{}
+	added := 0
+	for _, update := range cacheUpdates(t, transport.sent()) {
+		switch update.op {
+		case BCM_CACHE_OP_REMOVE:
+			removed[update.id] = true
+		case BCM_CACHE_OP_ADD:
+			added++
+		}
+	}
+	if !removed[info1.id] || !removed[info2.id] || added != 1 {
+		t.Errorf("got removals %v and %d addition(s), want removal of ids %d and %d and 1 addition", removed, added, info1.id, info2.id)
+	}
+}
+
+func TestCertificateCacheFromBlock(t *testing.T) {
+	transport := initTestCertificateCache(t)
+	updateCertificatesFromMSPConfigs(testHardwareAddress, map[string]*msp.FabricMSPConfig{
+		"OrdererMSP": {Name: "OrdererMSP"},
+		"Org1MSP":    {Name: "Org1MSP"},
+	})
+
+	orderer := testutil.NewCertificate("orderer")
+	client := testutil.NewCertificate("client")
+	peer0 := testutil.NewCertificate("peer0")
+	unknown := testutil.NewCertificate("unknown")
+	rangeClient := testutil.NewCertificate("range client")
+	block := testutil.NewBlock(1, testutil.Identity("OrdererMSP", orderer),
+		testutil.NewEnvelope(&testutil.Tx{
+			TxId:      "tx0",
+			Chaincode: "mycc",
+			Creator:   testutil.Identity("Org1MSP", client),
+			Endorsers: [][]byte{testutil.Identity("Org1MSP", peer0), testutil.Identity("Org3MSP", unknown)},
+		}),
+		// maxRangeQueries is 2, so the transaction is validated in software.
+		testutil.NewEnvelope(&testutil.Tx{
+			TxId:         "tx1",
+			Chaincode:    "mycc",
+			Creator:      testutil.Identity("Org1MSP", rangeClient),
+			Endorsers:    [][]byte{testutil.Identity("Org1MSP", peer0)},
+			RangeQueries: 3,
+		}),
+	)
+	learnCertificatesFromBlock(block, classifyTransactions(block))
+
+	for _, identity := range []struct {
+		mspId       string
+		certificate []byte
+	}{{"OrdererMSP", orderer}, {"Org1MSP", client}, {"Org1MSP", peer0}} {
+		info := cachedCertificate(t, identity.mspId, identity.certificate)
+		if info.fromConfig || info.lastUsed != 1 {
+			t.Errorf("%s certificate: got fromConfig %v and last use %d, want false and 1", identity.mspId, info.fromConfig, info.lastUsed)
+		}
+	}
+	if getCertificateId(serializeCertificate("Org3MSP", unknown)) >= 0 {
+		t.Error("identity of an MSP outside of the channel is cached")
+	}
+	if getCertificateId(serializeCertificate("Org1MSP", rangeClient)) >= 0 {
+		t.Error("creator of a transaction validated in software is cached")
+	}
+	if updates := cacheUpdates(t, transport.sent()); len(updates) != 3 {
+		t.Errorf("got cache updates %v, want 3 additions", updates)
+	}
+
+	// Identities already cached are not sent again.
+	learnCertificatesFromBlock(testutil.NewBlock(2, testutil.Identity("OrdererMSP", orderer)), nil)
+	if updates := cacheUpdates(t, transport.sent()); len(updates) != 0 {
+		t.Errorf("got cache updates %v for cached identities", updates)
+	}
+	if info := cachedCertificate(t, "OrdererMSP", orderer); info.lastUsed != 2 {
+		t.Errorf("orderer certificate: got last use %d, want 2", info.lastUsed)
+	}
+}
+
+// creatorAnnotation returns the creator identity annotation of a transaction message
+func creatorAnnotation(t *testing.T, m bcmMessage) Annotation {
+	t.Helper()
+	for i := 0; i < len(m.annotationData); i += ANNOTATION_SIZE {
+		annotation := makeAnnotation(m.annotationData[i],
+			binary.BigEndian.Uint16(m.annotationData[i+1:]), binary.BigEndian.Uint16(m.annotationData[i+3:]))
+		if getAnnotationDataType(annotation)&ANNOTATION_DATA_TYPE_MASK == ANNOTATION_DATA_TYPE_CREATER_CA {
+			return annotation
+		}
+	}
+	t.Fatal("missing creator annotation")
+	return Annotation{}
+}
+
+func TestCertificateMiss(t *testing.T) {
+	for _, install := range []bool{false, true} {
+		transport := initTestCertificateCache(t)
+		hwPeer.installCertificates = install
+		updateCertificatesFromMSPConfigs(testHardwareAddress, map[string]*msp.FabricMSPConfig{"Org1MSP": {Name: "Org1MSP"}})
+
+		creator := testutil.Identity("Org1MSP", testutil.NewCertificate("client"))
+		env := testutil.NewEnvelope(&testutil.Tx{TxId: "tx0", Chaincode: "mycc", Creator: creator})
+		block := testutil.NewBlock(1, nil, env)
+		learnCertificatesFromBlock(block, classifyTransactions(block))
+		updates := cacheUpdates(t, transport.sent())
+
+		// Transactions start with their key in the block data.
+		transaction := testutil.Marshal(&common.BlockData{Data: [][]byte{testutil.Marshal(env)}})
+		m, err := prepareTransaction(transaction, 0, len(transaction), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		annotation := creatorAnnotation(t, m)
+		if !install {
+			// The identity is sent inline, and the creator locator is turned into a pointer to it.
+			if len(updates) != 0 || len(CertificateIdCache) != 0 {
+				t.Errorf("inline: got cache updates %v and %d cached certificate(s)", updates, len(CertificateIdCache))
+			}
+			if getAnnotationDataType(annotation)&ANNOTATION_TYPE_MASK != ANNOTATION_TYPE_POINTER {
+				t.Fatalf("inline: got creator annotation type 0x%x, want a pointer", getAnnotationDataType(annotation))
+			}
+			if got := annotatedBytes(m.payload, annotation); string(got) != string(creator) {
+				t.Errorf("inline: creator annotation points to %q", got)
+			}
+			continue
+		}
+
+		// The identity is installed before the block refers to it by its cache ID.
+		id := getCertificateId(creator)
+		if len(updates) != 1 || updates[0] != (cacheUpdate{BCM_CACHE_OP_ADD, id}) || id < 0 {
+			t.Fatalf("install: got cache updates %v, want addition of id %d", updates, id)
+		}
+		if getAnnotationDataType(annotation)&ANNOTATION_TYPE_MASK != ANNOTATION_TYPE_LOCATOR || int(getAnnotationDesc(annotation)) != id {
+			t.Errorf("install: got creator annotation %+v, want locator of id %d", annotation, id)
+		}
+		if bytes.Contains(m.payload, creator) {
+			t.Error("install: creator identity is sent along with its cache ID")
+		}
+	}
+}
+
+func TestCertificateInstallNotAcknowledged(t *testing.T) {
+	transport := initTestCertificateCache(t)
+	hwPeer.ackTimeout = 10 * time.Millisecond
+	defer func() { hwPeer.ackTimeout = 0 }()
+	mspConfigs = map[string]*msp.FabricMSPConfig{"Org1MSP": {Name: "Org1MSP"}}
+
+	if learnCertificate(testHardwareAddress, &msp.SerializedIdentity{Mspid: "Org1MSP", IdBytes: testutil.NewCertificate("client")}) {
+		t.Error("certificate added without acknowledgement")
+	}
+	if len(CertificateIdCache) != 0 {
+		t.Errorf("got %d cached certificate(s), want none", len(CertificateIdCache))
+	}
+	// The hardware peer may have installed the certificate, so it is removed again.
+	updates := cacheUpdates(t, transport.sent())
+	if len(updates) != 2 || updates[0].op != BCM_CACHE_OP_ADD || updates[1] != (cacheUpdate{BCM_CACHE_OP_REMOVE, updates[0].id}) {
+		t.Errorf("got cache updates %v, want an addition then its removal", updates)
+	}
+}
+
+func TestCertificateIdLayout(t *testing.T) {
+	initTestCertificateCache(t)
+
+	// 2 role bits, 4 org bits and 10 user bits
+	id := generateId(3, 2, ROLE_PEER)
+	if id != ROLE_PEER|2<<2|3<<6 {
+		t.Errorf("got id 0x%x for user 3 of org 2 with role %d", id, ROLE_PEER)
+	}
+	if orgId := generateOrgId(id); int(orgId) != ROLE_PEER|2<<2 {
+		t.Errorf("got organization and role 0x%x of id 0x%x", orgId, id)
+	}
+
+	mspConfigs = map[string]*msp.FabricMSPConfig{"Org1MSP": {Name: "Org1MSP"}, "Org2MSP": {Name: "Org2MSP"}}
+	for i, mspId := range []string{"Org1MSP", "Org2MSP", "Org1MSP"} {
+		id := addCertificate(testHardwareAddress, mspId, testutil.NewCertificate("client"), false)
+		orgId := certificateOrgIds[mspId]
+		if id != generateId(i/2, orgId, ROLE_CLIENT) {
+			t.Errorf("certificate %d of %s: got id 0x%x, want user %d of org %d", i, mspId, id, i/2, orgId)
+		}
+	}
+
+	// Organizations beyond the layout cannot be cached.
+	for i := 0; i < 16; i++ {
+		getOrgId(fmt.Sprintf("Org%dMSP", i+3))
+	}
+	mspConfigs["Org18MSP"] = &msp.FabricMSPConfig{Name: "Org18MSP"}
+	if id := addCertificate(testHardwareAddress, "Org18MSP", testutil.NewCertificate("client"), false); id >= 0 {
+		t.Errorf("certificate of org id %d cached with id 0x%x", certificateOrgIds["Org18MSP"], id)
+	}
+}
+
+func TestCertificateEviction(t *testing.T) {
+	transport := initTestCertificateCache(t)
+	hwCapabilities.certificateCacheSize = 3
+	admin := testutil.NewCertificate("admin")
+	updateCertificatesFromMSPConfigs(testHardwareAddress, map[string]*msp.FabricMSPConfig{
+		"Org1MSP": {Name: "Org1MSP", Admins: [][]byte{admin}},
+	})
+
+	// The cache is full after the certificates of blocks 1 and 2, the one of block 1 is the least
+	// recently used even though it is older than the admin certificate.
+	var ids []int
+	for block := uint64(1); block <= 3; block++ {
+		certificateClock = block
+		ids = append(ids, addCertificate(testHardwareAddress, "Org1MSP", testutil.NewCertificate("client"), false))
+	}
+	if len(CertificateIdCache) != 3 {
+		t.Fatalf("got %d cached certificates, want 3", len(CertificateIdCache))
+	}
+	if _, prs := CertificateIdCache[ids[1]]; !prs {
+		t.Error("certificate of block 2 evicted")
+	}
+	if ids[2] != ids[0] {
+		t.Errorf("certificate of block 3 got id %d, want id %d of the evicted certificate", ids[2], ids[0])
+	}
+	cachedCertificate(t, "Org1MSP", admin)
+	updates := cacheUpdates(t, transport.sent())
+	want := []cacheUpdate{{BCM_CACHE_OP_REMOVE, ids[0]}, {BCM_CACHE_OP_ADD, ids[2]}}
+	if len(updates) < 2 || updates[len(updates)-2] != want[0] || updates[len(updates)-1] != want[1] {
+		t.Errorf("got cache updates %v, want %v last", updates, want)
+	}
+
+	// Certificates used by the block being sent are not evicted.
+	certificateClock = 4
+	touchCertificate(ids[1])
+	touchCertificate(ids[2])
+	if id := addCertificate(testHardwareAddress, "Org1MSP", testutil.NewCertificate("client"), false); id >= 0 {
+		t.Errorf("certificate cached with id %d in a cache full of certificates in use", id)
+	}
+}
+
+func TestCertificateEvictionWithinRole(t *testing.T) {
+	transport := initTestCertificateCache(t)
+	// One user bit leaves room for two clients per organization.
+	hwCapabilities.certificateIdOrgBits = CERTIFICATE_ID_BITS - hwCapabilities.certificateIdRoleBits - 1
+	mspConfigs = map[string]*msp.FabricMSPConfig{"Org1MSP": {Name: "Org1MSP"}}
+
+	var ids []int
+	for block := uint64(1); block <= 3; block++ {
+		certificateClock = block
+		ids = append(ids, addCertificate(testHardwareAddress, "Org1MSP", testutil.NewCertificate("client"), false))
+	}
+	if ids[2] != ids[0] || ids[1] == ids[0] {
+		t.Fatalf("got ids %v, want the third client to reuse the id of the first", ids)
+	}
+	if len(CertificateIdCache) != 2 {
+		t.Errorf("got %d cached certificates, want 2", len(CertificateIdCache))
+	}
+	// The evicted certificate is overwritten in place.
+	if updates := cacheUpdates(t, transport.sent()); updates[len(updates)-1] != (cacheUpdate{BCM_CACHE_OP_UPDATE, ids[0]}) {
+		t.Errorf("got cache updates %v, want an update of id %d last", updates, ids[0])
+	}
+}
+
+func TestSerializeCertificate(t *testing.T) {
+	certificate := testutil.NewCertificate("client")
+	serialized := serializeCertificate("Org1MSP", certificate)
+	// Identities are cached exactly as they appear in transactions.
+	if !bytes.Equal(serialized, testutil.Identity("Org1MSP", certificate)) {
+		t.Error("serialized identity differs from the one in transactions")
+	}
+	identity := &msp.SerializedIdentity{}
+	if err := proto.Unmarshal(serialized, identity); err != nil {
+		t.Fatal(err)
+	}
+	if identity.Mspid != "Org1MSP" || !bytes.Equal(identity.IdBytes, certificate) {
+		t.Errorf("got identity %s %q", identity.Mspid, identity.IdBytes)
+	}
+
+	// The cache update message carries the serialized identity, and points to its fields.
+	payload, annotations, err := generateCertificateUpdateAnnotation(5, "Org1MSP", certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, serialized) {
+		t.Error("cache update payload differs from the serialized identity")
+	}
+	for _, annotation := range annotations {
+		switch getAnnotationDataType(annotation) & ANNOTATION_DATA_TYPE_MASK {
+		case ANNOTATION_DATA_TYPE_CACHE_NAME:
+			if got := annotatedBytes(payload, annotation); string(got) != "Org1MSP" {
+				t.Errorf("name annotation points to %q", got)
+			}
+		case ANNOTATION_DATA_TYPE_CACHE_CA:
+			if got := annotatedBytes(payload, annotation); !bytes.Equal(got, certificate) {
+				t.Errorf("certificate annotation points to %q", got)
+			}
+		}
+	}
+}
+
+func TestCertificateCachePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "certificates.json")
+	initTestCertificateCache(t)
+	initTestConfigWith(t, "certificateCacheFile: "+path)
+
+	admin := testutil.NewCertificate("admin")
+	updateCertificatesFromMSPConfigs(testHardwareAddress, map[string]*msp.FabricMSPConfig{
+		"Org1MSP": {Name: "Org1MSP", Admins: [][]byte{admin}},
+		"Org2MSP": {Name: "Org2MSP"},
+	})
+	client := testutil.NewCertificate("client")
+	learnCertificatesFromBlock(testutil.NewBlock(1, nil, testutil.NewEnvelope(&testutil.Tx{
+		TxId:      "tx0",
+		Chaincode: "mycc",
+		Creator:   testutil.Identity("Org2MSP", client),
+	})), []bool{false})
+	saved := CertificateIdCache
+	orgIds := certificateOrgIds
+
+	// A restarted orderer assigns the same ids.
+	initCertificateCache()
+	loadCertificateCache()
+	if len(CertificateIdCache) != len(saved) {
+		t.Fatalf("loaded %d certificate(s), want %d", len(CertificateIdCache), len(saved))
+	}
+	for id, want := range saved {
+		got, prs := CertificateIdCache[id]
+		if !prs {
+			t.Errorf("certificate with id %d not loaded", id)
+			continue
+		}
+		if !bytes.Equal(got.identity_data, want.identity_data) || got.orgId != want.orgId || got.role != want.role || got.fromConfig != want.fromConfig {
+			t.Errorf("certificate with id %d: got %s org %d role %d fromConfig %v, want %s org %d role %d fromConfig %v", id,
+				got.name, got.orgId, got.role, got.fromConfig, want.name, want.orgId, want.role, want.fromConfig)
+		}
+		if getCertificateId(want.identity_data) != id {
+			t.Errorf("serialized identity of certificate with id %d not loaded", id)
+		}
+	}
+	for mspId, orgId := range orgIds {
+		if certificateOrgIds[mspId] != orgId {
+			t.Errorf("%s: got org id %d, want %d", mspId, certificateOrgIds[mspId], orgId)
+		}
+	}
+
+	// Ids are discarded when the hardware peer lays them out differently.
+	hwCapabilities.certificateIdOrgBits++
+	initCertificateCache()
+	loadCertificateCache()
+	if len(CertificateIdCache) != 0 {
+		t.Errorf("loaded %d certificate(s) with a different id layout", len(CertificateIdCache))
+	}
+}
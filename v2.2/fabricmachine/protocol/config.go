@@ -6,54 +6,166 @@ SPDX-License-Identifier: Apache-2.0
 package fmprotocol
 
 import (
-	"github.com/spf13/viper"
+	"github.com/golang/protobuf/proto"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric/fabricmachine/api"
+	"github.com/pkg/errors"
 )
 
-// Orgnization in config file
-type Organization struct {
-	Name  string
-	Certs []struct {
-		Role string
-		Cert string
+// Channel config groups that contain organizations, and the config value keeping the MSP of
+// an organization. These are hard-coded in Fabric codebase (common/channelconfig).
+var channelConfigOrgGroups = []string{"Application", "Orderer"}
+
+const channelConfigMSPKey = "MSP"
+
+// Type of Fabric (x.509 based) MSPs in msp.MSPConfig. Idemix MSPs are not supported by hardware.
+const fabricMSPType int32 = 0
+
+// getConfigFromConfigBlock extracts the channel config from a config block
+func getConfigFromConfigBlock(block *cb.Block) (*cb.Config, error) {
+	envelope, err := ExtractEnvelope(block, 0)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := UnmarshalPayload(envelope.Payload)
+	if err != nil {
+		return nil, err
+	}
+	configEnvelope, err := UnmarshalConfigEnvelope(payload.Data)
+	if err != nil {
+		return nil, err
+	}
+	if configEnvelope.Config == nil || configEnvelope.Config.ChannelGroup == nil {
+		return nil, errors.New("missing channel group in config")
+	}
+	return configEnvelope.Config, nil
+}
+
+// getMSPConfigsFromConfig extracts the MSP configuration of all the organizations in the channel
+// from a channel config
+func getMSPConfigsFromConfig(config *cb.Config) (map[string]*msp.FabricMSPConfig, error) {
+	configs := make(map[string]*msp.FabricMSPConfig)
+	for _, groupName := range channelConfigOrgGroups {
+		group, prs := config.ChannelGroup.Groups[groupName]
+		if !prs {
+			continue
+		}
+		for orgName, org := range group.Groups {
+			value, prs := org.Values[channelConfigMSPKey]
+			if !prs {
+				logger.Warningf("Missing MSP in %s organization %s", groupName, orgName)
+				continue
+			}
+			mspConfig := &msp.MSPConfig{}
+			if err := proto.Unmarshal(value.Value, mspConfig); err != nil {
+				return nil, errors.Wrapf(err, "error unmarshaling MSPConfig of %s", orgName)
+			}
+			if mspConfig.Type != fabricMSPType {
+				logger.Warningf("Skipping MSP of organization %s with unsupported type %d", orgName, mspConfig.Type)
+				continue
+			}
+			fabricMSPConfig := &msp.FabricMSPConfig{}
+			if err := proto.Unmarshal(mspConfig.Config, fabricMSPConfig); err != nil {
+				return nil, errors.Wrapf(err, "error unmarshaling FabricMSPConfig of %s", orgName)
+			}
+			configs[fabricMSPConfig.Name] = fabricMSPConfig
+		}
 	}
+	return configs, nil
 }
 
-// loadIdentityTable read certificates from config file and write to certificate table
-func loadIdentityTable(roles []string, organizations []Organization) (errno int) {
-	errno = 0
-	role_to_id := make(map[string]int)
-	for role_id, role := range roles {
-		role_to_id[role] = role_id
+// updateChannelConfig makes sure that the certificate cache and the endorsement policies reflect
+// the latest channel config as of the provided block, fetching the config block referenced by the
+// block when needed
+func updateChannelConfig(block *cb.Block, getBlock BlockGetter) error {
+	configIndex, err := GetLastConfigIndexFromBlock(block)
+	if err != nil {
+		return err
+	}
+	if hwPeer.configLoaded && configIndex == hwPeer.configBlock {
+		return nil
 	}
 
-	for org_id, organization := range organizations {
-		user_id_record := [4]int{0, 0, 0, 0}
-		for _, cer := range organization.Certs {
-			role_id := role_to_id[cer.Role]
-			org_name := organization.Name
-			user_id := user_id_record[role_id]
-			cer_path := cer.Cert
-			installCertificateFile(cer_path, generateId(user_id, org_id, role_id), org_name)
-			user_id_record[role_id]++
+	configBlock := block
+	if configIndex != block.Header.Number {
+		configBlock = getBlock(configIndex)
+		if configBlock == nil {
+			return errors.Errorf("cannot retrieve config block %d", configIndex)
 		}
 	}
-	return errno
+
+	config, err := getConfigFromConfigBlock(configBlock)
+	if err != nil {
+		return errors.WithMessagef(err, "cannot read config block %d", configIndex)
+	}
+	configs, err := getMSPConfigsFromConfig(config)
+	if err != nil {
+		return errors.WithMessagef(err, "cannot read MSPs from config block %d", configIndex)
+	}
+	logger.Infof("Updating certificates from config block %d with %d MSP(s) ...", configIndex, len(configs))
+	updateCertificatesFromMSPConfigs(hwPeer.address, configs)
+	logger.Infof("Updating endorsement policies from config block %d ...", configIndex)
+	fmapi.SetChannelConfig(config)
+	updateEndorsementPoliciesFromConfig(hwPeer.address, config)
+
+	hwPeer.configBlock = configIndex
+	hwPeer.configLoaded = true
+	return nil
 }
 
-// readConfig reads config file and call related functions
-func readConfig() {
-	viper.SetConfigName("fabric_machine")                 // name of config file (without extension)
-	viper.SetConfigType("yaml")                           // REQUIRED if the config file does not have the extension in the name
-	viper.AddConfigPath("/etc/hyperledger/fabricmachine") // path to look for the config file in
-	err := viper.ReadInConfig()                           // Find and read the config file
-	if err != nil {                                       // Handle errors reading the config file
-		logger.Errorf("Fatal error config file: %s \n", err)
-		return
+// learnCertificatesFromBlock caches the creator and endorser identities of all transactions in a
+// block that are validated by hardware as well as the block signers, so that they can be replaced
+// by their cache IDs when the block is sent
+func learnCertificatesFromBlock(block *cb.Block, softwareTxs []bool) {
+	certificateClock = block.Header.Number
+	identities, err := GetBlockSignerIdentities(block)
+	if err != nil {
+		logger.Debugf("Cannot get signers of block [%d]: %s", block.Header.Number, err)
+	}
+	for i := range block.Data.Data {
+		if softwareTxs[i] {
+			continue
+		}
+		txIdentities, err := GetIdentitiesFromTransaction(block.Data.Data[i])
+		if err != nil {
+			logger.Debugf("Cannot get identities of block [%d] tx%d: %s", block.Header.Number, i, err)
+			continue
+		}
+		identities = append(identities, txIdentities...)
 	}
 
-	roles := viper.GetStringSlice("Roles")
-	organizations := make([]Organization, 0)
-	viper.UnmarshalKey("Organizations", &organizations)
+	// Mark all cached identities of the block as used first, so that none of them is evicted to
+	// make room for the new ones.
+	for _, identity := range identities {
+		if id := getCertificateId(serializeCertificate(identity.Mspid, identity.IdBytes)); id >= 0 {
+			touchCertificate(id)
+		}
+	}
+	added := false
+	for _, identity := range identities {
+		if learnCertificate(hwPeer.address, identity) {
+			added = true
+		}
+	}
+	if added {
+		saveCertificateCache()
+	}
+}
 
-	loadIdentityTable(roles, organizations)
+// classifyTransactions tells which transactions of a block are validated in software, following
+// the same rules as the peers
+func classifyTransactions(block *cb.Block) (softwareTxs []bool) {
+	softwareTxs = make([]bool, len(block.Data.Data))
+	for i := range block.Data.Data {
+		envelope, err := GetEnvelopeFromBlock(block.Data.Data[i])
+		if err != nil {
+			continue
+		}
+		if reason := fmapi.GetSoftwareValidationReason(envelope); reason != "" {
+			logger.Debugf("Block [%d] tx%d is validated in software: %s", block.Header.Number, i, reason)
+			softwareTxs[i] = true
+		}
+	}
+	return softwareTxs
 }
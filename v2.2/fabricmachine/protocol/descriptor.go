@@ -0,0 +1,273 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/golang/protobuf/descriptor"
+	"github.com/golang/protobuf/proto"
+	protobuf "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/hyperledger/fabric/fabricmachine/api"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Version of the annotation descriptor format supported by this orderer.
+const ANNOTATION_DESCRIPTOR_VERSION int = 1
+
+// Messages where annotation paths start: transactions are located from their entry in the block
+// data, and block metadata from its field in the block.
+const transactionRootMessage = "common.BlockData"
+const metadataRootMessage = "common.Block"
+
+// annotationDescriptor describes the annotations of transaction and block metadata messages.
+// Annotation paths are lists of proto field names, each optionally followed by the message type
+// carried by the field in parentheses, e.g. payload(common.Payload). The type is required to go
+// through bytes fields holding serialized messages.
+type annotationDescriptor struct {
+	Version     int                         `mapstructure:"version"`
+	Transaction []annotationEntryDescriptor `mapstructure:"transaction"`
+	Metadata    []annotationEntryDescriptor `mapstructure:"metadata"`
+}
+
+type annotationEntryDescriptor struct {
+	Type int      `mapstructure:"type"`
+	Kind string   `mapstructure:"kind"`
+	Path []string `mapstructure:"path"`
+}
+
+var pathElementRegexp = regexp.MustCompile(`^(\w+)(?:\(([\w.]+)\))?$`)
+
+// getMessageDescriptor returns the descriptor of a registered proto message, e.g. common.Envelope
+func getMessageDescriptor(name string) (*protobuf.DescriptorProto, error) {
+	t := proto.MessageType(name)
+	if t == nil {
+		return nil, errors.Errorf("unknown message %s", name)
+	}
+	msg, ok := reflect.New(t.Elem()).Interface().(descriptor.Message)
+	if !ok {
+		return nil, errors.Errorf("no descriptor for message %s", name)
+	}
+	_, md := descriptor.ForMessage(msg)
+	return md, nil
+}
+
+// resolveAnnotationPath turns a path of field names into a path of field numbers, starting from
+// the root message
+func resolveAnnotationPath(root string, names []string) ([]int, error) {
+	path := make([]int, 0, len(names))
+	message := root
+	for i, element := range names {
+		match := pathElementRegexp.FindStringSubmatch(element)
+		if match == nil {
+			return nil, errors.Errorf("invalid path element %s", element)
+		}
+		if message == "" {
+			return nil, errors.Errorf("missing message type of %s", names[i-1])
+		}
+		md, err := getMessageDescriptor(message)
+		if err != nil {
+			return nil, err
+		}
+
+		var field *protobuf.FieldDescriptorProto
+		for _, f := range md.Field {
+			if f.GetName() == match[1] {
+				field = f
+				break
+			}
+		}
+		if field == nil {
+			return nil, errors.Errorf("message %s has no field %s", message, match[1])
+		}
+		path = append(path, int(field.GetNumber()))
+
+		switch field.GetType() {
+		case protobuf.FieldDescriptorProto_TYPE_MESSAGE:
+			message = strings.TrimPrefix(field.GetTypeName(), ".")
+			if match[2] != "" && match[2] != message {
+				return nil, errors.Errorf("field %s of %s is a %s, not a %s", match[1], md.GetName(), message, match[2])
+			}
+		case protobuf.FieldDescriptorProto_TYPE_BYTES:
+			message = match[2]
+		default:
+			if match[2] != "" {
+				return nil, errors.Errorf("field %s of %s is not a message", match[1], md.GetName())
+			}
+			message = ""
+		}
+	}
+	return path, nil
+}
+
+// resolveAnnotationList validates annotation definitions and resolves their paths
+func resolveAnnotationList(root string, entries []annotationEntryDescriptor) ([]AnnotationInfo, error) {
+	var list []AnnotationInfo
+	seen := make(map[byte]bool)
+	for _, entry := range entries {
+		if entry.Type < 0 || entry.Type > int(ANNOTATION_DATA_TYPE_MASK) {
+			return nil, errors.Errorf("invalid annotation type 0x%x", entry.Type)
+		}
+		dataType := byte(entry.Type)
+		if seen[dataType] {
+			return nil, errors.Errorf("duplicate annotation type 0x%x", dataType)
+		}
+		seen[dataType] = true
+		if dataType == ANNOTATION_DATA_TYPE_ENDORSER_CA && !seen[ANNOTATION_DATA_TYPE_ENDORSER] {
+			return nil, errors.New("endorser CA/identity annotation must follow endorser annotation")
+		}
+
+		var annotationType byte
+		switch entry.Kind {
+		case "pointer":
+			annotationType = ANNOTATION_TYPE_POINTER | dataType
+		case "locator":
+			annotationType = ANNOTATION_TYPE_LOCATOR | dataType
+		default:
+			return nil, errors.Errorf("invalid kind %s of annotation type 0x%x", entry.Kind, dataType)
+		}
+
+		path, err := resolveAnnotationPath(root, entry.Path)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid path of annotation type 0x%x", dataType)
+		}
+		list = append(list, AnnotationInfo{annotationType, path})
+	}
+	return list, nil
+}
+
+// fieldPath returns the path of field names of prefix followed by names
+func fieldPath(prefix []string, names ...string) []string {
+	return append(append([]string{}, prefix...), names...)
+}
+
+// Field names leading from common.BlockData to the fields of endorser transactions shared by
+// several built-in annotations.
+var (
+	builtinActionPath = []string{"data(common.Envelope)", "payload(common.Payload)", "data(protos.Transaction)", "actions"}
+	builtinRWSetPath  = fieldPath(builtinActionPath, "payload(protos.ChaincodeActionPayload)", "action",
+		"proposal_response_payload(protos.ProposalResponsePayload)", "extension(protos.ChaincodeAction)", "results")
+	builtinEndorsementsPath = fieldPath(builtinActionPath, "payload(protos.ChaincodeActionPayload)", "action", "endorsements")
+	builtinInputPath        = fieldPath(builtinActionPath, "payload(protos.ChaincodeActionPayload)",
+		"chaincode_proposal_payload(protos.ChaincodeProposalPayload)", "input(protos.ChaincodeInvocationSpec)", "chaincode_spec", "input")
+)
+
+// builtinAnnotationDescriptor describes the built-in transaction and block metadata annotations by
+// field names, like annotations_v2.2.yaml, so that their field numbers can be checked against the
+// proto definitions Fabric is built with.
+var builtinAnnotationDescriptor = annotationDescriptor{
+	Version: ANNOTATION_DESCRIPTOR_VERSION,
+	Transaction: []annotationEntryDescriptor{
+		{int(ANNOTATION_DATA_TYPE_TX_START), "pointer", []string{"data(common.Envelope)", "signature"}},
+		{int(ANNOTATION_DATA_TYPE_TX_ID), "pointer", []string{"data(common.Envelope)", "payload(common.Payload)", "header",
+			"channel_header(common.ChannelHeader)", "tx_id"}},
+		{int(ANNOTATION_DATA_TYPE_CHAINCODE_NAME), "pointer", []string{"data(common.Envelope)", "payload(common.Payload)", "header",
+			"channel_header(common.ChannelHeader)", "extension(protos.ChaincodeHeaderExtension)", "chaincode_id", "name"}},
+		{int(ANNOTATION_DATA_TYPE_CREATER_CA), "locator", []string{"data(common.Envelope)", "payload(common.Payload)", "header",
+			"signature_header(common.SignatureHeader)", "creator"}},
+		{int(ANNOTATION_DATA_TYPE_TX_ACTION), "pointer", builtinActionPath},
+		{int(ANNOTATION_DATA_TYPE_TX_CA), "locator", fieldPath(builtinActionPath, "header(common.SignatureHeader)", "creator")},
+		{int(ANNOTATION_DATA_TYPE_CONTRACT_NAME), "pointer", fieldPath(builtinInputPath, "args")},
+		{int(ANNOTATION_DATA_TYPE_CONTRACT_INPUT), "pointer", builtinInputPath},
+		{int(ANNOTATION_DATA_TYPE_ENDORSER_ACTION), "pointer", append(append([]string{}, builtinActionPath...),
+			"payload(protos.ChaincodeActionPayload)", "chaincode_proposal_payload")},
+		{int(ANNOTATION_DATA_TYPE_RW_SET), "pointer", builtinRWSetPath},
+		{int(ANNOTATION_DATA_TYPE_RANGE_QUERY), "pointer", builtinRWSetPath},
+		{int(ANNOTATION_DATA_TYPE_COLLECTION_NAME), "pointer", builtinRWSetPath},
+		{int(ANNOTATION_DATA_TYPE_ENDORSER), "pointer", builtinEndorsementsPath},
+		{int(ANNOTATION_DATA_TYPE_ENDORSER_CA), "locator", builtinEndorsementsPath},
+		{int(ANNOTATION_DATA_TYPE_TX_SIG), "pointer", []string{"data(common.Envelope)", "signature"}},
+	},
+	Metadata: []annotationEntryDescriptor{
+		{int(ANNOTATION_DATA_TYPE_ORDERER_CA), "locator", []string{"metadata", "metadata(common.Metadata)", "signatures",
+			"signature_header(common.SignatureHeader)", "creator"}},
+		{int(ANNOTATION_DATA_TYPE_ORDERER_SIG), "pointer", []string{"metadata", "metadata(common.Metadata)", "signatures", "signature"}},
+	},
+}
+
+// checkBuiltinAnnotations resolves the field names of the built-in annotations and checks that
+// they lead to the same field numbers as the built-in annotation paths
+func checkBuiltinAnnotations() error {
+	transactionList, err := resolveAnnotationList(transactionRootMessage, builtinAnnotationDescriptor.Transaction)
+	if err != nil {
+		return errors.WithMessage(err, "invalid built-in transaction annotations")
+	}
+	if err := compareAnnotationLists(transactionList, blockTransactionAnnotationInfoList); err != nil {
+		return errors.WithMessage(err, "built-in transaction annotations do not match the proto definitions")
+	}
+	metadataList, err := resolveAnnotationList(metadataRootMessage, builtinAnnotationDescriptor.Metadata)
+	if err != nil {
+		return errors.WithMessage(err, "invalid built-in block metadata annotations")
+	}
+	if err := compareAnnotationLists(metadataList, blockMetadataAnnotationInfoList); err != nil {
+		return errors.WithMessage(err, "built-in block metadata annotations do not match the proto definitions")
+	}
+	return nil
+}
+
+// compareAnnotationLists checks that annotation lists have the same annotations with the same paths
+func compareAnnotationLists(resolved []AnnotationInfo, builtin []AnnotationInfo) error {
+	if len(resolved) != len(builtin) {
+		return errors.Errorf("%d annotation(s) instead of %d", len(builtin), len(resolved))
+	}
+	for i := range resolved {
+		if resolved[i].annotationType != builtin[i].annotationType {
+			return errors.Errorf("annotation %d has type 0x%x instead of 0x%x", i, builtin[i].annotationType, resolved[i].annotationType)
+		}
+		if !reflect.DeepEqual(resolved[i].path, builtin[i].path) {
+			return errors.Errorf("annotation type 0x%x has path %v instead of %v", builtin[i].annotationType&ANNOTATION_DATA_TYPE_MASK,
+				builtin[i].path, resolved[i].path)
+		}
+	}
+	return nil
+}
+
+// loadAnnotationDescriptor replaces the built-in transaction and block metadata annotations with
+// the ones of the configured annotation descriptor
+func loadAnnotationDescriptor() {
+	file := fmapi.GetAnnotationDescriptorFile()
+	if file == "" {
+		return
+	}
+
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		logger.Errorf("Using built-in annotations, cannot read annotation descriptor %s: %s", file, err)
+		return
+	}
+	var desc annotationDescriptor
+	if err := v.Unmarshal(&desc); err != nil {
+		logger.Errorf("Using built-in annotations, cannot parse annotation descriptor %s: %s", file, err)
+		return
+	}
+	if desc.Version != ANNOTATION_DESCRIPTOR_VERSION {
+		logger.Errorf("Using built-in annotations, unsupported annotation descriptor version %d", desc.Version)
+		return
+	}
+
+	transactionList, err := resolveAnnotationList(transactionRootMessage, desc.Transaction)
+	if err != nil {
+		logger.Errorf("Using built-in annotations, invalid transaction annotations in %s: %s", file, err)
+		return
+	}
+	metadataList, err := resolveAnnotationList(metadataRootMessage, desc.Metadata)
+	if err != nil {
+		logger.Errorf("Using built-in annotations, invalid block metadata annotations in %s: %s", file, err)
+		return
+	}
+
+	blockTransactionAnnotationInfoList = transactionList
+	blockMetadataAnnotationInfoList = metadataList
+	BlockTransactionAnnotationNumber = fixedAnnotationNumber(blockTransactionAnnotationInfoList)
+	BlockMetadataAnnotationNumber = len(blockMetadataAnnotationInfoList)
+	logger.Infof("Loaded %d transaction and %d block metadata annotation(s) from %s",
+		len(transactionList), len(metadataList), file)
+}
@@ -0,0 +1,63 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestBuiltinAnnotations(t *testing.T) {
+	if err := checkBuiltinAnnotations(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuiltinAnnotationMismatch(t *testing.T) {
+	saved := blockTransactionAnnotationInfoList
+	defer func() { blockTransactionAnnotationInfoList = saved }()
+
+	// TX ID path leading to the epoch of the channel header instead of its TX ID
+	blockTransactionAnnotationInfoList = append([]AnnotationInfo{}, saved...)
+	for i, annotationInfo := range blockTransactionAnnotationInfoList {
+		if annotationInfo.annotationType&ANNOTATION_DATA_TYPE_MASK == ANNOTATION_DATA_TYPE_TX_ID {
+			blockTransactionAnnotationInfoList[i].path = []int{1, 1, 1, 1, 6}
+		}
+	}
+	if err := checkBuiltinAnnotations(); err == nil {
+		t.Fatal("mismatching TX ID path accepted")
+	}
+}
+
+// TestAnnotationDescriptorFile checks that the annotation descriptor shipped with the configuration
+// describes the built-in annotations.
+func TestAnnotationDescriptorFile(t *testing.T) {
+	v := viper.New()
+	v.SetConfigFile("../config/annotations_v2.2.yaml")
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	var desc annotationDescriptor
+	if err := v.Unmarshal(&desc); err != nil {
+		t.Fatal(err)
+	}
+	transactionList, err := resolveAnnotationList(transactionRootMessage, desc.Transaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compareAnnotationLists(transactionList, blockTransactionAnnotationInfoList); err != nil {
+		t.Errorf("transaction annotations: %s", err)
+	}
+	metadataList, err := resolveAnnotationList(metadataRootMessage, desc.Metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compareAnnotationLists(metadataList, blockMetadataAnnotationInfoList); err != nil {
+		t.Errorf("block metadata annotations: %s", err)
+	}
+}
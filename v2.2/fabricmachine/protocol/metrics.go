@@ -0,0 +1,126 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"sync"
+
+	"github.com/hyperledger/fabric/common/metrics"
+	"github.com/hyperledger/fabric/common/metrics/disabled"
+)
+
+var (
+	revokedCertificates = metrics.CounterOpts{
+		Namespace:    "fabricmachine",
+		Subsystem:    "certificate_cache",
+		Name:         "revoked_certificates",
+		Help:         "The number of cached identities that were invalidated because they were revoked.",
+		StatsdFormat: "%{#fqname}",
+	}
+	revokedSerials = metrics.GaugeOpts{
+		Namespace:    "fabricmachine",
+		Subsystem:    "certificate_cache",
+		Name:         "revoked_serials",
+		Help:         "The number of revoked certificate serial numbers in the channel MSP configuration.",
+		StatsdFormat: "%{#fqname}",
+	}
+	sentPackets = metrics.CounterOpts{
+		Namespace:    "fabricmachine",
+		Subsystem:    "transport",
+		Name:         "sent_packets",
+		Help:         "The number of packets sent to a hardware peer.",
+		LabelNames:   []string{"address"},
+		StatsdFormat: "%{#fqname}.%{address}",
+	}
+	sentBytes = metrics.CounterOpts{
+		Namespace:    "fabricmachine",
+		Subsystem:    "transport",
+		Name:         "sent_bytes",
+		Help:         "The number of bytes sent to a hardware peer.",
+		LabelNames:   []string{"address"},
+		StatsdFormat: "%{#fqname}.%{address}",
+	}
+	blockSendBytesPerSecond = metrics.GaugeOpts{
+		Namespace:    "fabricmachine",
+		Subsystem:    "transport",
+		Name:         "block_send_bytes_per_second",
+		Help:         "The throughput in bytes per second achieved when sending the last block to a hardware peer.",
+		LabelNames:   []string{"address"},
+		StatsdFormat: "%{#fqname}.%{address}",
+	}
+	blockSendPacketsPerSecond = metrics.GaugeOpts{
+		Namespace:    "fabricmachine",
+		Subsystem:    "transport",
+		Name:         "block_send_packets_per_second",
+		Help:         "The throughput in packets per second achieved when sending the last block to a hardware peer.",
+		LabelNames:   []string{"address"},
+		StatsdFormat: "%{#fqname}.%{address}",
+	}
+	blockSendFailures = metrics.CounterOpts{
+		Namespace:    "fabricmachine",
+		Subsystem:    "protocol",
+		Name:         "block_send_failures",
+		Help:         "The number of attempts to send a block to a hardware peer that failed.",
+		LabelNames:   []string{"address"},
+		StatsdFormat: "%{#fqname}.%{address}",
+	}
+	pendingBlocks = metrics.GaugeOpts{
+		Namespace:    "fabricmachine",
+		Subsystem:    "protocol",
+		Name:         "pending_blocks",
+		Help:         "The number of blocks delivered by the orderer but not sent to a hardware peer yet, which grows while sending fails.",
+		LabelNames:   []string{"address"},
+		StatsdFormat: "%{#fqname}.%{address}",
+	}
+	skippedBlocks = metrics.CounterOpts{
+		Namespace:    "fabricmachine",
+		Subsystem:    "protocol",
+		Name:         "skipped_blocks",
+		Help:         "The number of ill-formed blocks not sent to a hardware peer, which peers validate in software.",
+		LabelNames:   []string{"address"},
+		StatsdFormat: "%{#fqname}.%{address}",
+	}
+)
+
+// Metrics of the Fabric machine protocol.
+type Metrics struct {
+	RevokedCertificates       metrics.Counter
+	RevokedSerials            metrics.Gauge
+	SentPackets               metrics.Counter
+	SentBytes                 metrics.Counter
+	BlockSendBytesPerSecond   metrics.Gauge
+	BlockSendPacketsPerSecond metrics.Gauge
+	BlockSendFailures         metrics.Counter
+	PendingBlocks             metrics.Gauge
+	SkippedBlocks             metrics.Counter
+}
+
+func NewMetrics(p metrics.Provider) *Metrics {
+	return &Metrics{
+		RevokedCertificates:       p.NewCounter(revokedCertificates),
+		RevokedSerials:            p.NewGauge(revokedSerials),
+		SentPackets:               p.NewCounter(sentPackets),
+		SentBytes:                 p.NewCounter(sentBytes),
+		BlockSendBytesPerSecond:   p.NewGauge(blockSendBytesPerSecond),
+		BlockSendPacketsPerSecond: p.NewGauge(blockSendPacketsPerSecond),
+		BlockSendFailures:         p.NewCounter(blockSendFailures),
+		PendingBlocks:             p.NewGauge(pendingBlocks),
+		SkippedBlocks:             p.NewCounter(skippedBlocks),
+	}
+}
+
+// Metrics are disabled until InitMetrics is called.
+var hwMetrics = NewMetrics(&disabled.Provider{})
+var hwMetricsOnce sync.Once
+
+// InitMetrics reports the Fabric machine protocol metrics to the provided metrics provider.
+// Only the first call has an effect, since metrics cannot be registered more than once.
+func InitMetrics(p metrics.Provider) {
+	hwMetricsOnce.Do(func() {
+		hwMetrics = NewMetrics(p)
+	})
+}
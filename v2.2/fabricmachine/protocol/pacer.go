@@ -0,0 +1,114 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"time"
+)
+
+// Longest burst the pacer lets through at full rate after being idle.
+const pacerBurstDuration = 10 * time.Millisecond
+
+// tokenBucket paces packets to a rate in bytes per second and in packets per second. A rate of 0
+// is unlimited. Buckets start full, and hold at most pacerBurstDuration worth of tokens, but always
+// enough for one jumbo frame.
+type tokenBucket struct {
+	bytesPerSecond   float64
+	packetsPerSecond float64
+	maxBytes         float64
+	maxPackets       float64
+	bytes            float64
+	packets          float64
+	last             time.Time
+}
+
+// newTokenBucket creates a pacer, or returns nil when both rates are unlimited
+func newTokenBucket(bytesPerSecond int, packetsPerSecond int) *tokenBucket {
+	if bytesPerSecond <= 0 && packetsPerSecond <= 0 {
+		return nil
+	}
+	tb := &tokenBucket{
+		bytesPerSecond:   float64(bytesPerSecond),
+		packetsPerSecond: float64(packetsPerSecond),
+		last:             time.Now(),
+	}
+	tb.maxBytes = tb.bytesPerSecond * pacerBurstDuration.Seconds()
+	if tb.maxBytes < float64(BCM_MAX_PACKET_SIZE) {
+		tb.maxBytes = float64(BCM_MAX_PACKET_SIZE)
+	}
+	tb.maxPackets = tb.packetsPerSecond * pacerBurstDuration.Seconds()
+	if tb.maxPackets < 1 {
+		tb.maxPackets = 1
+	}
+	tb.bytes = tb.maxBytes
+	tb.packets = tb.maxPackets
+	return tb
+}
+
+// refill adds the tokens earned since the last refill
+func (tb *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(tb.last).Seconds()
+	tb.last = now
+	tb.bytes += elapsed * tb.bytesPerSecond
+	if tb.bytes > tb.maxBytes {
+		tb.bytes = tb.maxBytes
+	}
+	tb.packets += elapsed * tb.packetsPerSecond
+	if tb.packets > tb.maxPackets {
+		tb.packets = tb.maxPackets
+	}
+}
+
+// admit returns how many of the given packets can be sent right away, at least one when none can
+// be sent now, after sleeping until the rates allow it. Tokens are only consumed by charge, once
+// the packets have been sent.
+func (tb *tokenBucket) admit(sizes []int) int {
+	if tb == nil {
+		return len(sizes)
+	}
+	tb.refill(time.Now())
+
+	// wait for the first packet
+	var wait float64
+	if tb.bytesPerSecond > 0 && tb.bytes < float64(sizes[0]) {
+		wait = (float64(sizes[0]) - tb.bytes) / tb.bytesPerSecond
+	}
+	if tb.packetsPerSecond > 0 && tb.packets < 1 {
+		if w := (1 - tb.packets) / tb.packetsPerSecond; w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		time.Sleep(time.Duration(wait * float64(time.Second)))
+		tb.refill(time.Now())
+	}
+
+	// the first packet always goes, even when it overdraws the bucket by rounding
+	n := 1
+	bytes := tb.bytes - float64(sizes[0])
+	packets := tb.packets - 1
+	for n < len(sizes) {
+		if (tb.bytesPerSecond > 0 && bytes < float64(sizes[n])) || (tb.packetsPerSecond > 0 && packets < 1) {
+			break
+		}
+		bytes -= float64(sizes[n])
+		packets--
+		n++
+	}
+	return n
+}
+
+// charge consumes the tokens of sent packets
+func (tb *tokenBucket) charge(sizes []int) {
+	if tb == nil {
+		return
+	}
+	for _, size := range sizes {
+		tb.bytes -= float64(size)
+		tb.packets--
+	}
+}
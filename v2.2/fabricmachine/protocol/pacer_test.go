@@ -0,0 +1,57 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"testing"
+)
+
+func TestTokenBucketAdmitCharge(t *testing.T) {
+	// 10 packets per burst
+	tb := newTokenBucket(0, 1000)
+	sizes := []int{100, 100, 100, 100, 100, 100, 100, 100, 100, 100, 100, 100}
+	if n := tb.admit(sizes[:5]); n != 5 {
+		t.Fatalf("admitted %d packet(s) instead of 5", n)
+	}
+	if n := tb.admit(sizes); n != 10 {
+		t.Fatalf("admitted %d packet(s) before charging instead of 10", n)
+	}
+	tb.charge(sizes[:2])
+	if n := tb.admit(sizes); n != 8 {
+		t.Fatalf("admitted %d packet(s) after charging 2 instead of 8", n)
+	}
+}
+
+// partialTransport sends one packet per batch.
+type partialTransport struct {
+	fakeTransport
+}
+
+func (t *partialTransport) SendBatch(packets [][]byte) (int, error) {
+	return t.fakeTransport.SendBatch(packets[:1])
+}
+
+func TestSendBatchChargesSentPackets(t *testing.T) {
+	initTestConfig(t)
+	transport := &partialTransport{}
+	session := &BcmSession{addr: "partial", conn: transport, pacer: newTokenBucket(0, 1000)}
+
+	messages := make([]bcmMessage, 5)
+	for i := range messages {
+		messages[i] = bcmMessage{BCM_MSG_TYPE_TRANSACTION, 0, nil, 0, []byte("transaction")}
+	}
+	if err := bcmSessionSendBatch(session, messages); err != nil {
+		t.Fatal(err)
+	}
+	if packets := transport.sent(); len(packets) != 5 {
+		t.Fatalf("sent %d packet(s) instead of 5", len(packets))
+	}
+	// The bucket holds 10 packets and refills by one packet per millisecond.
+	if session.pacer.packets < 4.9 || session.pacer.packets > 6 {
+		t.Errorf("%.2f packet token(s) left instead of 5", session.pacer.packets)
+	}
+}
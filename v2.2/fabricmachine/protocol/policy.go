@@ -0,0 +1,261 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric/fabricmachine/api"
+	"github.com/pkg/errors"
+)
+
+// role id of principals satisfied by any identity of the organization
+const POLICY_ROLE_MEMBER byte = 0xFF
+
+// Policy that transactions of _lifecycle itself have to satisfy.
+const lifecycleEndorsementPolicy = "/Channel/Application/LifecycleEndorsement"
+
+type endorsementPolicy struct {
+	chaincode string
+
+	// Marshaled peer.ApplicationPolicy of the chaincode definition.
+	applicationPolicy []byte
+
+	// Policies defined by a transaction only apply when the hardware peer validates that
+	// transaction, starting from the block after it.
+	conditional bool
+	blockNumber uint64
+	txIndex     int
+
+	// Compiled policy as sent to the hardware peer.
+	rule []byte
+}
+
+// Endorsement policies of the chaincodes defined through _lifecycle, keyed by chaincode name.
+var chaincodePolicies map[string]*endorsementPolicy
+
+// Latest channel config, used to resolve policies referring to channel config policies.
+var channelConfig *cb.Config
+
+func initEndorsementPolicies() {
+	chaincodePolicies = make(map[string]*endorsementPolicy)
+	channelConfig = nil
+}
+
+// compilePrincipal compiles the role of an MSP into a signed by node, mapping MSPs to certificate
+// cache organization ids and MSP roles to identity roles
+func compilePrincipal(mspId string, mspRole msp.MSPRole_MSPRoleType) ([]byte, error) {
+	if _, prs := mspConfigs[mspId]; !prs {
+		// Identities of MSPs that are not part of the channel can never satisfy the principal.
+		logger.Warningf("Policy refers to unknown MSP %s", mspId)
+		return fmapi.PolicyNeverSatisfied, nil
+	}
+	orgId := getOrgId(mspId)
+	if orgId >= (1 << uint(hwCapabilities.certificateIdOrgBits)) {
+		return nil, errors.Errorf("certificate id layout cannot hold %s org id %d", mspId, orgId)
+	}
+
+	var role byte
+	switch mspRole {
+	case msp.MSPRole_MEMBER:
+		role = POLICY_ROLE_MEMBER
+	case msp.MSPRole_ADMIN:
+		role = byte(ROLE_ADMIN)
+	case msp.MSPRole_ORDERER:
+		role = byte(ROLE_ORDERER)
+	case msp.MSPRole_PEER:
+		role = byte(ROLE_PEER)
+	case msp.MSPRole_CLIENT:
+		role = byte(ROLE_CLIENT)
+	default:
+		return nil, errors.Errorf("MSP role %s is not supported by hardware", mspRole)
+	}
+	return []byte{fmapi.PolicyNodeSignedBy, byte(orgId), role}, nil
+}
+
+// installEndorsementPolicy compiles an endorsement policy and sends it to the hardware peer.
+// Returns false when the policy cannot be enforced by hardware, in which case a policy that is
+// never satisfied is installed instead, so that the previous policy of the chaincode no longer
+// applies. Orderers and peers validate the transactions of chaincodes whose policy fails
+// fmapi.CheckEndorsementPolicy in software; other compile errors (e.g. too many organizations for
+// the certificate id layout) are configuration errors that invalidate the chaincode transactions.
+func installEndorsementPolicy(addr string, policy *endorsementPolicy) bool {
+	rule, err := fmapi.CompileEndorsementPolicy(policy.applicationPolicy, channelConfig, compilePrincipal)
+	if checkErr := fmapi.CheckEndorsementPolicy(policy.applicationPolicy, channelConfig); checkErr != nil {
+		logger.Warningf("Endorsement policy of chaincode %s is enforced in software: %s", policy.chaincode, checkErr)
+		uninstallEndorsementPolicy(addr, policy.chaincode)
+		return false
+	} else if err != nil {
+		logger.Errorf("Cannot compile endorsement policy of chaincode %s, its transactions are invalidated: %s", policy.chaincode, err)
+		uninstallEndorsementPolicy(addr, policy.chaincode)
+		return false
+	}
+	policy.rule = rule
+
+	if err := sendEndorsementPolicy(addr, *policy); err != nil {
+		logger.Warningf("Cannot install endorsement policy of chaincode %s: %s", policy.chaincode, err)
+		return false
+	}
+	return true
+}
+
+// uninstallEndorsementPolicy replaces the endorsement policy of a chaincode on the hardware peer
+// with a policy that is never satisfied.
+func uninstallEndorsementPolicy(addr string, chaincode string) {
+	policy := endorsementPolicy{chaincode: chaincode, rule: fmapi.PolicyNeverSatisfied}
+	if err := sendEndorsementPolicy(addr, policy); err != nil {
+		logger.Warningf("Cannot uninstall endorsement policy of chaincode %s: %s", chaincode, err)
+	}
+}
+
+// updateEndorsementPoliciesFromConfig sends the endorsement policy of _lifecycle and the policies
+// of all known chaincodes to the hardware peer again, since policies referring to channel config
+// policies (e.g. /Channel/Application/Endorsement) and organization ids may have changed
+func updateEndorsementPoliciesFromConfig(addr string, config *cb.Config) {
+	channelConfig = config
+	if _, prs := config.ChannelGroup.Groups["Application"]; !prs {
+		return
+	}
+
+	lifecyclePolicy, err := proto.Marshal(&peer.ApplicationPolicy{
+		Type: &peer.ApplicationPolicy_ChannelConfigPolicyReference{
+			ChannelConfigPolicyReference: lifecycleEndorsementPolicy,
+		},
+	})
+	if err != nil {
+		logger.Errorf("cannot serialize %s endorsement policy: %v", fmapi.LifecycleNamespace, err.Error())
+	} else {
+		installEndorsementPolicy(addr, &endorsementPolicy{chaincode: fmapi.LifecycleNamespace, applicationPolicy: lifecyclePolicy})
+	}
+
+	var names []string
+	for name := range chaincodePolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		installEndorsementPolicy(addr, chaincodePolicies[name])
+	}
+}
+
+// updateEndorsementPoliciesFromBlock sends the endorsement policies of the chaincode definitions
+// committed by _lifecycle transactions in a block to the hardware peer. Each policy only applies
+// if the hardware peer finds the transaction that defines it valid.
+func updateEndorsementPoliciesFromBlock(addr string, block *cb.Block) {
+	changed := false
+	for i := range block.Data.Data {
+		writes, err := GetNamespaceWritesFromTransaction(block.Data.Data[i], fmapi.LifecycleNamespace)
+		if err != nil {
+			logger.Debugf("Cannot get %s writes of block [%d] tx%d: %s", fmapi.LifecycleNamespace, block.Header.Number, i, err)
+			continue
+		}
+		for _, write := range writes {
+			name, ok := fmapi.GetValidationInfoChaincode(write.Key)
+			if !ok || write.IsDelete {
+				continue
+			}
+			info, err := fmapi.UnmarshalValidationInfo(write.Value)
+			if err != nil {
+				logger.Warningf("Cannot read validation info of chaincode %s in block [%d] tx%d: %s", name, block.Header.Number, i, err)
+				continue
+			}
+			if info.ValidationPlugin != fmapi.DefaultValidationPlugin {
+				logger.Warningf("Chaincode %s uses validation plugin %s, which is not supported by hardware", name, info.ValidationPlugin)
+				if _, prs := chaincodePolicies[name]; prs {
+					delete(chaincodePolicies, name)
+					changed = true
+				}
+				uninstallEndorsementPolicy(addr, name)
+				continue
+			}
+
+			policy := &endorsementPolicy{
+				chaincode:         name,
+				applicationPolicy: info.ValidationParameter,
+				conditional:       true,
+				blockNumber:       block.Header.Number,
+				txIndex:           i,
+			}
+			logger.Infof("Updating endorsement policy of chaincode %s from block [%d] tx%d", name, block.Header.Number, i)
+			chaincodePolicies[name] = policy
+			changed = true
+			installEndorsementPolicy(addr, policy)
+		}
+	}
+	if changed {
+		saveEndorsementPolicies()
+	}
+}
+
+// Format of the endorsement policy file which persists chaincode policies across orderer restarts.
+type persistedEndorsementPolicy struct {
+	Chaincode         string `json:"chaincode"`
+	ApplicationPolicy []byte `json:"application_policy"`
+	Conditional       bool   `json:"conditional"`
+	BlockNumber       uint64 `json:"block_number"`
+	TxIndex           int    `json:"tx_index"`
+}
+
+// loadEndorsementPolicies restores the chaincode policies from the endorsement policy file. They
+// are sent to the hardware peer once the channel config is known.
+func loadEndorsementPolicies() {
+	path := fmapi.GetEndorsementPolicyFile()
+	if path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Errorf("cannot read from %v:%v", path, err.Error())
+		}
+		return
+	}
+
+	var persisted []persistedEndorsementPolicy
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		logger.Errorf("cannot parse endorsement policy file %v:%v", path, err.Error())
+		return
+	}
+	for _, p := range persisted {
+		chaincodePolicies[p.Chaincode] = &endorsementPolicy{
+			chaincode:         p.Chaincode,
+			applicationPolicy: p.ApplicationPolicy,
+			conditional:       p.Conditional,
+			blockNumber:       p.BlockNumber,
+			txIndex:           p.TxIndex,
+		}
+	}
+	logger.Infof("Loaded %d endorsement policies from %s", len(chaincodePolicies), path)
+}
+
+// saveEndorsementPolicies writes the chaincode policies to the endorsement policy file
+func saveEndorsementPolicies() {
+	path := fmapi.GetEndorsementPolicyFile()
+	if path == "" {
+		return
+	}
+
+	persisted := []persistedEndorsementPolicy{}
+	for _, p := range chaincodePolicies {
+		persisted = append(persisted, persistedEndorsementPolicy{p.chaincode, p.applicationPolicy, p.conditional, p.blockNumber, p.txIndex})
+	}
+	data, err := json.MarshalIndent(persisted, "", "  ")
+	if err != nil {
+		logger.Errorf("cannot serialize endorsement policies: %v", err.Error())
+		return
+	}
+	if err := fmapi.WriteFile(path, data); err != nil {
+		logger.Errorf("%s", err)
+	}
+}
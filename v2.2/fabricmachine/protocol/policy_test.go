@@ -0,0 +1,127 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric/fabricmachine/api"
+	"github.com/hyperledger/fabric/fabricmachine/testutil"
+)
+
+// installedPolicies returns the compiled rules of the endorsement policy messages among packets,
+// keyed by chaincode.
+func installedPolicies(t *testing.T, packets [][]byte) map[string][]byte {
+	t.Helper()
+	rules := make(map[string][]byte)
+	for _, packet := range packets {
+		hdr, err := bytesToTransportHeader(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.ctrl_type&0x0F != BCM_MSG_TYPE_ENDORSEMENT_POLICY {
+			continue
+		}
+		payload := packet[BCM_TRANSPORT_HEADER_SIZE+int(hdr.annotation_size)*ANNOTATION_SIZE:]
+		var chaincode string
+		var rule []byte
+		for i := 0; i < int(hdr.annotation_size); i++ {
+			a := packet[BCM_TRANSPORT_HEADER_SIZE+i*ANNOTATION_SIZE:]
+			data := payload[binary.BigEndian.Uint16(a[1:]):][:binary.BigEndian.Uint16(a[3:])]
+			switch a[0] & ANNOTATION_DATA_TYPE_MASK {
+			case ANNOTATION_DATA_TYPE_POLICY_CHAINCODE:
+				chaincode = string(data)
+			case ANNOTATION_DATA_TYPE_POLICY_RULE:
+				rule = data
+			}
+		}
+		rules[chaincode] = rule
+	}
+	return rules
+}
+
+// testPolicy returns a signature policy satisfied by a signature of the given role of mspId.
+func testPolicy(mspId string, role msp.MSPRole_MSPRoleType) *endorsementPolicy {
+	envelope := &cb.SignaturePolicyEnvelope{
+		Rule: &cb.SignaturePolicy{Type: &cb.SignaturePolicy_SignedBy{SignedBy: 0}},
+		Identities: []*msp.MSPPrincipal{{
+			PrincipalClassification: msp.MSPPrincipal_ROLE,
+			Principal:               testutil.Marshal(&msp.MSPRole{MspIdentifier: mspId, Role: role}),
+		}},
+	}
+	return &endorsementPolicy{
+		chaincode: "mycc",
+		applicationPolicy: testutil.Marshal(&peer.ApplicationPolicy{
+			Type: &peer.ApplicationPolicy_SignaturePolicy{SignaturePolicy: envelope},
+		}),
+	}
+}
+
+// policyReferenceBytes returns an application policy referring to a channel config policy.
+func policyReferenceBytes(reference string) []byte {
+	return testutil.Marshal(&peer.ApplicationPolicy{
+		Type: &peer.ApplicationPolicy_ChannelConfigPolicyReference{ChannelConfigPolicyReference: reference},
+	})
+}
+
+func TestInstallEndorsementPolicy(t *testing.T) {
+	transport := initTestCertificateCache(t)
+	initEndorsementPolicies()
+	updateCertificatesFromMSPConfigs(testHardwareAddress, map[string]*msp.FabricMSPConfig{
+		"Org1MSP": {Name: "Org1MSP"},
+		"Org2MSP": {Name: "Org2MSP"},
+	})
+	transport.sent()
+
+	tests := []struct {
+		name      string
+		policy    *endorsementPolicy
+		installed bool
+		rule      []byte
+	}{
+		{
+			name:      "peer of Org2MSP",
+			policy:    testPolicy("Org2MSP", msp.MSPRole_PEER),
+			installed: true,
+			rule:      []byte{fmapi.PolicyNodeSignedBy, byte(getOrgId("Org2MSP")), byte(ROLE_PEER)},
+		},
+		{
+			name:      "member of Org1MSP",
+			policy:    testPolicy("Org1MSP", msp.MSPRole_MEMBER),
+			installed: true,
+			rule:      []byte{fmapi.PolicyNodeSignedBy, byte(getOrgId("Org1MSP")), POLICY_ROLE_MEMBER},
+		},
+		{
+			// Identities of MSPs outside of the channel never satisfy the policy.
+			name:      "unknown MSP",
+			policy:    testPolicy("Org9MSP", msp.MSPRole_MEMBER),
+			installed: true,
+			rule:      fmapi.PolicyNeverSatisfied,
+		},
+		{
+			// Transactions of the chaincode are validated in software.
+			name:      "channel config not known",
+			policy:    &endorsementPolicy{chaincode: "mycc", applicationPolicy: policyReferenceBytes("/Channel/Application/Endorsement")},
+			installed: false,
+			rule:      fmapi.PolicyNeverSatisfied,
+		},
+	}
+	for _, test := range tests {
+		if installed := installEndorsementPolicy(testHardwareAddress, test.policy); installed != test.installed {
+			t.Errorf("%s: installed is %t, want %t", test.name, installed, test.installed)
+		}
+		rules := installedPolicies(t, transport.sent())
+		if rule, prs := rules["mycc"]; !prs || !bytes.Equal(rule, test.rule) {
+			t.Errorf("%s: installed rule %x, want %x", test.name, rule, test.rule)
+		}
+	}
+}
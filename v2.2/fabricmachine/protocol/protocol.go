@@ -10,10 +10,12 @@ import (
 	"context"
 	"strings"
 	"sync"
+	"time"
 
 	cb "github.com/hyperledger/fabric-protos-go/common"
 	"github.com/hyperledger/fabric/common/flogging"
 	"github.com/hyperledger/fabric/fabricmachine/api"
+	"github.com/pkg/errors"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -30,12 +32,47 @@ type HardwarePeer struct {
 	// True when the current node is considered an orderer node that can send blocks.
 	isOrderer bool
 
+	// Why blocks are not sent to the hardware peer, e.g. it cannot validate transactions within
+	// the limits peers route transactions by.
+	refused error
+
 	// Next block that should be sent.
 	blockToSend uint64
+
+	// True when blockToSend could not be sent, so that it is sent again along with the next block.
+	sendFailed bool
+
+	// True when certificates seen for the first time in a block are installed in the hardware peer
+	// before the block is sent, false when such certificates are sent inline.
+	installCertificates bool
+
+	// How long to wait for the hardware peer to acknowledge a certificate cache update. Updates
+	// are not acknowledged when zero.
+	ackTimeout time.Duration
+
+	// Config block from which the certificate cache was last updated.
+	configLoaded bool
+	configBlock  uint64
+
+	// True once the TX ID index of the hardware peer has been seeded from the ledger.
+	txIdsSeeded bool
 }
 
 var hwPeer HardwarePeer
 
+// BlockGetter retrieves a block from the ledger by its number, returning nil if not found.
+type BlockGetter func(number uint64) *cb.Block
+
+// BlockBytesGetter retrieves a block from the ledger by its number as it is serialized in the
+// ledger, returning nil if not found.
+type BlockBytesGetter func(number uint64) []byte
+
+// BlockBytesReader is implemented by ledgers that return blocks as they are serialized, which saves
+// serializing blocks again to send them to hardware peers.
+type BlockBytesReader interface {
+	RetrieveBlockBytesByNumber(number uint64) ([]byte, error)
+}
+
 // isOrdererNode returns true when the provided node name/id is considered an orderer node that
 // can send blocks to hardware peer.
 func isOrderer(node string) bool {
@@ -51,14 +88,31 @@ func isOrderer(node string) bool {
 	return false
 }
 
-func InitConfig() {
+// InitConfig initializes the Fabric machine protocol from the Fabric machine configuration. It
+// fails when the built-in annotations do not match the proto definitions Fabric is built with.
+func InitConfig() error {
 	if !fmapi.IsEnabled() {
-		return
+		return nil
+	}
+	if err := checkBuiltinAnnotations(); err != nil {
+		return err
 	}
 
 	hwPeer.address = fmapi.GetHardwareAddress()
 	hwPeer.blockToSend = fmapi.GetStartingBlock()
+	switch fmapi.GetCertificateMiss() {
+	case "", "install":
+		hwPeer.installCertificates = true
+	case "inline":
+		hwPeer.installCertificates = false
+	default:
+		logger.Warningf("Unknown certificate miss policy %s, sending certificates inline", fmapi.GetCertificateMiss())
+	}
+	hwPeer.ackTimeout = fmapi.GetCertificateAckTimeout()
+	loadAnnotationDescriptor()
+	loadAuthenticationKeys()
 	logger.Info("Initialized Fabric machine protocol with initial configuration.")
+	return nil
 }
 
 func completeInit(ctx context.Context) {
@@ -73,13 +127,23 @@ func completeInit(ctx context.Context) {
 	thisNode = strings.Split(thisNode, ":")[0]
 	hwPeer.isOrderer = isOrderer(thisNode)
 
-	// Update certificates cache in hardware peer.
+	// Update certificates cache in hardware peer, after finding out how many certificates it can
+	// hold and how their ids are laid out. Certificates assigned before a restart are
+	// restored first so that their ids stay the same, and the rest of the cache is filled from the
+	// channel config and the blocks as they are sent.
 	if hwPeer.isOrderer {
-		logger.Infof("Loading certificates from hardware config file ...")
+		if err := negotiateCapabilities(hwPeer.address); err != nil {
+			logger.Errorf("Not sending blocks to hardware peer %s: %s", hwPeer.address, err)
+			hwPeer.refused = err
+			hwPeer.initDone = true
+			return
+		}
 		initCertificateCache()
-		readConfig()
+		loadCertificateCache()
 		logger.Infof("Syncing certificates with hardware peer ...")
 		updateRemoteCertificateCache(hwPeer.address)
+		initEndorsementPolicies()
+		loadEndorsementPolicies()
 	}
 
 	hwPeer.initDone = true
@@ -92,63 +156,27 @@ func CheckPeerStructure(addr string) (ret bool) {
 	return true
 }
 
-// CheckMessageData checks block message format, return false if the block is not supported
+// CheckMessageData checks block message format, return false if the block is not supported.
+// Peers validate such blocks in software, see fmapi.IsSoftwareValidatedBlock.
 func CheckMessageData(block *cb.Block) (ret bool) {
-	if block.Header.Number == 0 {
-		logger.Warningf("Wrong block number %d", block.Header.Number)
-		return false
-	}
-	config, err := IsConfigBlock(block)
-	if err != nil {
-		logger.Warningf("Cannot check config block: %s", err)
-		return false
-	}
-	if config {
+	if fmapi.IsConfigBlock(block) {
 		logger.Warning("Got a config block")
 		return false
 	}
-	envelope, err := GetEnvelopeFromBlock(block.Data.Data[0])
-	if err != nil {
-		logger.Warningf("Cannot get block.Data.Data[0] envelope: %s", err)
+	if err := fmapi.CheckBlockFormat(block); err != nil {
+		logger.Warningf("%s", err)
 		return false
 	}
-	payload, err := UnmarshalPayload(envelope.Payload)
-	if err != nil {
-		logger.Warningf("Cannot unmarshal envelope payload: %s", err)
-		return false
-	}
-	if payload.Header == nil {
-		logger.Warningf("Missing header in envelope payload")
-		return false
-	}
-	chdr, err := UnmarshalChannelHeader(payload.Header.ChannelHeader)
-	if err != nil {
-		logger.Warningf("Cannot unmarshal channel header: %s", err)
-		return false
-	}
-	if len(chdr.Extension) == 0 {
-		logger.Warningf("Missing extension in channel header")
-		return false
-	}
-	hdrExt, err := UnmarshalChaincodeHeaderExtension(chdr.Extension)
-	if err != nil {
-		logger.Warningf("Cannot unmarshal chaincode header: %s", err)
-		return false
-	}
-	if hdrExt.ChaincodeId == nil {
-		logger.Warningf("Missing chaincode id")
-		return false
-	}
-	// FIXME: quick fix, disable chaincode check.
-	//        should be able to support all chaincode ID
-	//if hdrExt.ChaincodeId.Name != "smallbank" {
-	//	return false
-	//}
+	// Transactions of chaincodes configured for software validation are routed to software one by
+	// one (see classifyTransactions), instead of holding back the whole block.
 	return true
 }
 
-// SendToHardware broadcasts a raw block message to hardware based peers
-func SendToHardware(ctx context.Context, block *cb.Block) {
+// SendToHardware broadcasts a raw block message to hardware based peers.
+// getBlock is used to retrieve the channel's config block when the certificate cache needs to be
+// updated from it. getBlockBytes, which may be nil, is used to send the block as it is serialized
+// in the ledger.
+func SendToHardware(ctx context.Context, block *cb.Block, getBlock BlockGetter, getBlockBytes BlockBytesGetter) {
 	if !fmapi.IsEnabled() {
 		return
 	}
@@ -162,13 +190,15 @@ func SendToHardware(ctx context.Context, block *cb.Block) {
 	}
 
 	// Only orderer will send blocks to hardware peer.
-	if !hwPeer.isOrderer {
+	if !hwPeer.isOrderer || hwPeer.refused != nil {
 		return
 	}
 
-	// Make sure that a block is only sent once.
-	if block.Header.Number != hwPeer.blockToSend {
-		logger.Warningf("Expected to send block %d to hardware peer but received block %d\n", hwPeer.blockToSend, block.Header.Number)
+	// Make sure that a block is only sent once, in order. Blocks that could not be sent are sent
+	// again from the ledger before the next block.
+	number := block.Header.Number
+	if number != hwPeer.blockToSend && !(number > hwPeer.blockToSend && hwPeer.sendFailed) {
+		logger.Warningf("Expected to send block %d to hardware peer but received block %d\n", hwPeer.blockToSend, number)
 		return
 	}
 
@@ -179,18 +209,153 @@ func SendToHardware(ctx context.Context, block *cb.Block) {
 		return
 	}
 
-	// Make sure there are no configuration update blocks, otherwise CheckMessageData() below will
-	// fail and this function will be stuck without sending any blocks.
-	// TODO: Update CheckMessageData to differentiate between normal and configuration update blocks
-	// so that configuration update blocks can be skipped.
+	for hwPeer.blockToSend < number {
+		missed := getBlock(hwPeer.blockToSend)
+		if missed == nil {
+			logger.Errorf("Cannot send block %d to hardware peer again: block not found", hwPeer.blockToSend)
+			break
+		}
+		if err := sendNextBlock(addr, missed, getBlock, getBlockBytes); err != nil {
+			logger.Errorf("%s", err)
+			break
+		}
+	}
+	if hwPeer.blockToSend == number {
+		if err := sendNextBlock(addr, block, getBlock, getBlockBytes); err != nil {
+			logger.Errorf("%s", err)
+		}
+	}
+	hwMetrics.PendingBlocks.With("address", addr).Set(float64(number + 1 - hwPeer.blockToSend))
+}
+
+// sendNextBlock sends the next block to the hardware peer, and moves on to the following block
+// unless sending fails. Config blocks and ill-formed blocks, which peers validate in software, are
+// skipped. It must be called with hwPeer locked.
+func sendNextBlock(addr string, block *cb.Block, getBlock BlockGetter, getBlockBytes BlockBytesGetter) error {
+	if _, err := sendBlockToHardware(addr, block, getBlock, getBlockBytes); err == ErrConfigBlock {
+		// Peers validate config blocks in software, the hardware peer never sees them.
+		logger.Infof("Skipping config block %d, its config has been applied to the hardware peer", block.Header.Number)
+	} else if err == ErrBlockNotSupported {
+		logger.Warningf("Skipping ill-formed block %d, peers validate it in software", block.Header.Number)
+		hwMetrics.SkippedBlocks.With("address", addr).Add(1)
+	} else if err != nil {
+		hwMetrics.BlockSendFailures.With("address", addr).Add(1)
+		hwPeer.sendFailed = true
+		return errors.WithMessagef(err, "cannot send block %d to hardware peer", block.Header.Number)
+	}
+	hwPeer.sendFailed = false
+	hwPeer.blockToSend++
+	return nil
+}
+
+// ErrBlockNotSupported is returned for ill-formed blocks, which are not sent to hardware peers.
+// Peers validate them in software.
+var ErrBlockNotSupported = errors.New("ill-formed block")
+
+// ErrConfigBlock is returned for config blocks, which are not sent to hardware peers since peers
+// validate them in software. Their config is applied to the hardware peer nonetheless.
+var ErrConfigBlock = errors.New("config block")
+
+// sendBlockToHardware keeps the hardware peer at addr in sync with the channel config and the
+// identities and chaincode definitions of the block, then sends the block. It must be called with
+// hwPeer locked. The block is serialized again unless getBlockBytes returns it.
+func sendBlockToHardware(addr string, block *cb.Block, getBlock BlockGetter, getBlockBytes BlockBytesGetter) (softwareTxs []bool, err error) {
+	// Seed the TX ID index of the hardware peer with the transactions already in the ledger.
+	if !hwPeer.txIdsSeeded {
+		seedTxIdIndex(addr, getBlock, block.Header.Number)
+		hwPeer.txIdsSeeded = true
+	}
+
+	// Keep the certificate cache in sync with the MSPs of the channel config.
+	if err := updateChannelConfig(block, getBlock); err != nil {
+		logger.Warningf("Cannot update certificates for block %d: %s", block.Header.Number, err)
+	}
+
+	// Config blocks are skipped once their config has been applied above. Their TX IDs are
+	// indexed nonetheless, like the ones of all the blocks of the ledger.
+	if fmapi.IsConfigBlock(block) {
+		if hwCapabilities.txIdIndexBits > 0 {
+			seedTxIds(addr, fmapi.GetTxIds(block))
+		}
+		return nil, ErrConfigBlock
+	}
 	isBlockData := CheckMessageData(block)
 	if isBlockData == false {
-		logger.Warningf("Received ill-formed block %d\n", block.Header.Number)
-		return
+		// Peers keep track of the TX IDs and chaincode definitions of the blocks they validate
+		// in software as well.
+		if hwCapabilities.txIdIndexBits > 0 {
+			seedTxIds(addr, fmapi.GetTxIds(block))
+		}
+		fmapi.UpdateChaincodeDefinitions(block)
+		updateEndorsementPoliciesFromBlock(addr, block)
+		return nil, ErrBlockNotSupported
+	}
+
+	// Transactions using features that hardware does not support are validated in software.
+	softwareTxs = classifyTransactions(block)
+
+	// Cache identities seen for the first time before the block refers to them.
+	learnCertificatesFromBlock(block, softwareTxs)
+
+	// Pick up rotated authentication keys.
+	if err := reloadAuthenticationKeys(); err != nil {
+		logger.Warningf("Cannot reload authentication keys: %s", err)
 	}
 
 	// Send block.
 	logger.Infof("Sending block %d to hardware peer %s\n", block.Header.Number, addr)
-	SendBlock(addr, block)
-	hwPeer.blockToSend++
+	var data []byte
+	if getBlockBytes != nil {
+		data = getBlockBytes(block.Header.Number)
+	}
+	if data != nil {
+		err = SendBlockBytes(addr, data, block.Header.Number, softwareTxs)
+	} else {
+		err = SendBlock(addr, block, softwareTxs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hwCapabilities.txIdIndexBits > 0 {
+		countTxIds(len(fmapi.GetTxIds(block)))
+	}
+
+	// Chaincode definitions committed by the block apply to the following blocks.
+	fmapi.UpdateChaincodeDefinitions(block)
+	updateEndorsementPoliciesFromBlock(addr, block)
+	return softwareTxs, nil
+}
+
+// StartReplay prepares to send the blocks of an existing ledger to the hardware peer at addr
+// outside of the orderer, e.g. to benchmark hardware peers with recorded traffic. The certificate
+// cache and the endorsement policies start empty, and are filled from the channel config and the
+// blocks as they are sent. The TX ID index is seeded again. It fails when the hardware peer cannot validate transactions within
+// the configured limits.
+func StartReplay(addr string) error {
+	hwPeer.Lock()
+	defer hwPeer.Unlock()
+
+	hwPeer.address = addr
+	if err := negotiateCapabilities(addr); err != nil {
+		return err
+	}
+	initCertificateCache()
+	initEndorsementPolicies()
+	fmapi.ResetChaincodeDefinitions()
+	hwPeer.configLoaded = false
+	hwPeer.txIdsSeeded = false
+	hwPeer.sendFailed = false
+	txIdCount = 0
+	hwPeer.initDone = true
+	return nil
+}
+
+// ReplayBlock sends a block of an existing ledger to the hardware peer set by StartReplay, the way
+// the orderer does, and returns which of its transactions are validated in software. It returns
+// ErrConfigBlock for config blocks and ErrBlockNotSupported for ill-formed blocks, which hardware
+// peers do not validate.
+func ReplayBlock(block *cb.Block, getBlock BlockGetter) ([]bool, error) {
+	hwPeer.Lock()
+	defer hwPeer.Unlock()
+	return sendBlockToHardware(hwPeer.address, block, getBlock, nil)
 }
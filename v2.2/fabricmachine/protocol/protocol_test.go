@@ -0,0 +1,246 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	fmapi "github.com/hyperledger/fabric/fabricmachine/api"
+	"github.com/hyperledger/fabric/fabricmachine/testutil"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/metadata"
+)
+
+// testConfig is the Fabric machine configuration of the tests, which override its capabilities
+// through hwCapabilities where needed.
+const testConfig = `
+hardware:
+  protocol:
+    address: 127.0.0.1:7100
+    sendBatchSize: 64
+    capabilities:
+      certificateCacheSize: 64
+      certificateIdRoleBits: 2
+      certificateIdOrgBits: 4
+      maxIdentitySize: 2048
+      maxEndorsers: 4
+      maxTransactionSize: 65535
+      maxRangeQueries: 2
+      maxCollections: 1
+`
+
+// initTestConfig initializes the Fabric machine configuration and the hardware capabilities from
+// testConfig.
+func initTestConfig(t testing.TB) {
+	t.Helper()
+	initTestConfigWith(t, "")
+}
+
+// initTestConfigWith initializes the Fabric machine configuration and the hardware capabilities
+// from testConfig followed by protocol settings, e.g. "certificateCacheFile: /tmp/cache.json".
+func initTestConfigWith(t testing.TB, protocolSettings string) {
+	t.Helper()
+	config := testConfig
+	for _, setting := range strings.Split(protocolSettings, "\n") {
+		if setting != "" {
+			config += "    " + setting + "\n"
+		}
+	}
+	initTestConfigFile(t, config)
+}
+
+// initTestConfigFile initializes the Fabric machine configuration and the hardware capabilities
+// from the given config file content, e.g. testConfig followed by chaincode settings.
+func initTestConfigFile(t testing.TB, config string) {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "fabric_machine.yaml")
+	if err := ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	v.Set("fabric.hw.config.file", configFile)
+	if err := fmapi.InitConfig(v); err != nil {
+		t.Fatal(err)
+	}
+	hwCapabilities = capabilitiesFromConfig()
+}
+
+// fakeTransport records the packets sent to the hardware peer instead of sending them.
+type fakeTransport struct {
+	sync.Mutex
+	packets [][]byte
+	// When set, batches fail after their first packet.
+	batchFailure error
+}
+
+func (t *fakeTransport) Send(packet []byte) error {
+	t.Lock()
+	defer t.Unlock()
+	t.packets = append(t.packets, append([]byte{}, packet...))
+	return nil
+}
+
+func (t *fakeTransport) SendBatch(packets [][]byte) (int, error) {
+	t.Lock()
+	failure := t.batchFailure
+	t.Unlock()
+	for i, packet := range packets {
+		if failure != nil && i > 0 {
+			return i, failure
+		}
+		t.Send(packet)
+	}
+	return len(packets), nil
+}
+
+// failBatches makes batches fail after their first packet with err, or succeed again when err is
+// nil.
+func (t *fakeTransport) failBatches(err error) {
+	t.Lock()
+	defer t.Unlock()
+	t.batchFailure = err
+}
+
+func (t *fakeTransport) Receive(buff []byte, deadline time.Time) (int, error) {
+	time.Sleep(time.Until(deadline))
+	return 0, errors.New("no packet")
+}
+
+func (t *fakeTransport) Close() error {
+	return nil
+}
+
+// sent returns the packets sent so far and forgets about them.
+func (t *fakeTransport) sent() [][]byte {
+	t.Lock()
+	defer t.Unlock()
+	packets := t.packets
+	t.packets = nil
+	return packets
+}
+
+// newTestSession opens a session to addr whose packets are recorded by the returned transport.
+func newTestSession(addr string) *fakeTransport {
+	transport := &fakeTransport{}
+	OpenBcmSession(addr, transport)
+	return transport
+}
+
+// initTestOrderer sets up the protocol of an orderer sending blocks to a hardware peer matching
+// testConfig from block 1, whose packets are recorded by the returned transport.
+func initTestOrderer(t *testing.T) *capabilityTransport {
+	t.Helper()
+	initTestConfigWith(t, "orderers: [orderer0]")
+	transport := &capabilityTransport{capabilities: hardwareCapabilities(map[byte]int{CAPABILITY_MAX_ENDORSERS: 4})}
+	OpenBcmSession(testHardwareAddress, transport)
+	hwPeer.address = testHardwareAddress
+	hwPeer.blockToSend = 1
+	hwPeer.initDone = false
+	t.Cleanup(func() {
+		hwPeer.initDone, hwPeer.isOrderer, hwPeer.refused, hwPeer.sendFailed = false, false, nil, false
+	})
+	return transport
+}
+
+// sendToHardware sends a block to the hardware peer the way the orderer does, the blocks of the
+// ledger being ledger.
+func sendToHardware(block *cb.Block, ledger map[uint64]*cb.Block) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(":authority", "orderer0:7050"))
+	SendToHardware(ctx, block, func(number uint64) *cb.Block { return ledger[number] }, nil)
+}
+
+// sentBlockHeaders returns how many block header messages are among packets.
+func sentBlockHeaders(t *testing.T, packets [][]byte) (headers int) {
+	t.Helper()
+	for _, packet := range packets {
+		hdr, err := bytesToTransportHeader(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.ctrl_type&0x0F == BCM_MSG_TYPE_BLOCK_HEADER {
+			headers++
+		}
+	}
+	return headers
+}
+
+func TestSendToHardwareSkipsIllFormedBlock(t *testing.T) {
+	transport := initTestOrderer(t)
+	orderer := testutil.Identity("OrdererMSP", testutil.NewCertificate("orderer"))
+
+	// The first transaction of a block must be a chaincode transaction.
+	illFormed := testutil.NewBlock(1, orderer, testutil.NewEnvelope(&testutil.Tx{TxId: "tx1", Chaincode: "mycc"}))
+	illFormed.Data.Data[0] = testutil.Marshal(&cb.Envelope{Payload: testutil.Marshal(&cb.Payload{})})
+	if !fmapi.IsSoftwareValidatedBlock(illFormed) {
+		t.Fatal("ill-formed block validated by hardware on peers")
+	}
+	sendToHardware(illFormed, nil)
+	if headers := sentBlockHeaders(t, transport.sent()); headers != 0 {
+		t.Errorf("sent %d block(s) for an ill-formed block", headers)
+	}
+	if hwPeer.blockToSend != 2 {
+		t.Fatalf("next block to send is %d after an ill-formed block, want 2", hwPeer.blockToSend)
+	}
+
+	block := testutil.NewBlock(2, orderer, testutil.NewEnvelope(&testutil.Tx{
+		TxId:      "tx2",
+		Chaincode: "mycc",
+		Creator:   testutil.Identity("Org1MSP", testutil.NewCertificate("client")),
+		Endorsers: [][]byte{testutil.Identity("Org1MSP", testutil.NewCertificate("peer0"))},
+	}))
+	if fmapi.IsSoftwareValidatedBlock(block) {
+		t.Fatal("block validated in software on peers")
+	}
+	sendToHardware(block, nil)
+	if headers := sentBlockHeaders(t, transport.sent()); headers != 1 {
+		t.Errorf("sent %d block(s), want 1", headers)
+	}
+	if hwPeer.blockToSend != 3 {
+		t.Errorf("next block to send is %d, want 3", hwPeer.blockToSend)
+	}
+}
+
+func TestSendToHardwareResendsFailedBlock(t *testing.T) {
+	transport := initTestOrderer(t)
+	orderer := testutil.Identity("OrdererMSP", testutil.NewCertificate("orderer"))
+	ledger := make(map[uint64]*cb.Block)
+	for number := uint64(1); number <= 2; number++ {
+		ledger[number] = testutil.NewBlock(number, orderer, testutil.NewEnvelope(&testutil.Tx{
+			TxId:      fmt.Sprintf("tx%d", number),
+			Chaincode: "mycc",
+			Creator:   testutil.Identity("Org1MSP", testutil.NewCertificate("client")),
+			Endorsers: [][]byte{testutil.Identity("Org1MSP", testutil.NewCertificate("peer0"))},
+		}))
+	}
+
+	// A block sent in part is not a block sent.
+	transport.failBatches(errors.New("no buffer space available"))
+	sendToHardware(ledger[1], ledger)
+	transport.sent()
+	if hwPeer.blockToSend != 1 || !hwPeer.sendFailed {
+		t.Fatalf("next block to send is %d after a failure, want 1 to be sent again", hwPeer.blockToSend)
+	}
+
+	// The failed block is sent again before the next one.
+	transport.failBatches(nil)
+	sendToHardware(ledger[2], ledger)
+	if headers := sentBlockHeaders(t, transport.sent()); headers != 2 {
+		t.Errorf("sent %d block(s), want 2", headers)
+	}
+	if hwPeer.blockToSend != 3 || hwPeer.sendFailed {
+		t.Errorf("next block to send is %d, want 3", hwPeer.blockToSend)
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+
+	"github.com/hyperledger/fabric-protos-go/msp"
+)
+
+// Cache ID sent with revocations of serials that are not in the certificate cache, so that the
+// hardware peer still rejects such identities when they are sent inline.
+const CERTIFICATE_ID_NONE int = 0xFFFF
+
+// revokedCertificate identifies a revoked certificate
+type revokedCertificate struct {
+	issuer []byte // DER encoded name
+	serial *big.Int
+}
+
+// Revoked certificates of each MSP, keyed by MSP ID and then by issuer and serial number.
+var mspRevokedSerials map[string]map[string]revokedCertificate
+
+// revocationKey identifies a certificate by its issuer (DER encoded name) and serial number
+func revocationKey(issuer []byte, serial *big.Int) string {
+	return string(issuer) + "/" + serial.String()
+}
+
+// tbsCertList is the beginning of the TBSCertList of a CRL (RFC 5280, section 5.1), up to the
+// issuer name, which is kept as it is encoded in the CRL
+type tbsCertList struct {
+	Version   int `asn1:"optional,default:0"`
+	Signature asn1.RawValue
+	Issuer    asn1.RawValue
+}
+
+// getCRLIssuer returns the DER encoded issuer name of a CRL, as it appears in the CRL. Certificates
+// are matched on their issuer name as it appears in them (x509.Certificate.RawIssuer), which only
+// equals the name of a CRL of the same CA byte-for-byte when neither is encoded again: marshaling
+// the parsed name loses its string types.
+func getCRLIssuer(crl *pkix.CertificateList) ([]byte, error) {
+	var tbs tbsCertList
+	if _, err := asn1.Unmarshal(crl.TBSCertList.Raw, &tbs); err != nil {
+		return nil, err
+	}
+	return tbs.Issuer.FullBytes, nil
+}
+
+// getRevokedSerials returns the certificates revoked by the CRLs of an MSP configuration
+func getRevokedSerials(conf *msp.FabricMSPConfig) map[string]revokedCertificate {
+	revoked := make(map[string]revokedCertificate)
+	for _, crlBytes := range conf.RevocationList {
+		// ParseCRL accepts both PEM and DER encoded CRLs.
+		crl, err := x509.ParseCRL(crlBytes)
+		if err != nil {
+			logger.Warningf("Configuration error: cannot parse CRL of %s: %s", conf.Name, err)
+			continue
+		}
+		issuer, err := getCRLIssuer(crl)
+		if err != nil {
+			logger.Warningf("Configuration error: cannot read CRL issuer of %s: %s", conf.Name, err)
+			continue
+		}
+		for _, c := range crl.TBSCertList.RevokedCertificates {
+			revoked[revocationKey(issuer, c.SerialNumber)] = revokedCertificate{issuer: issuer, serial: c.SerialNumber}
+		}
+	}
+	return revoked
+}
+
+// isCertificateRevoked returns true when a certificate has been revoked by its MSP
+func isCertificateRevoked(mspId string, ca []byte) bool {
+	revoked := mspRevokedSerials[mspId]
+	if len(revoked) == 0 {
+		return false
+	}
+	block, _ := pem.Decode(ca)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	_, prs := revoked[revocationKey(cert.RawIssuer, cert.SerialNumber)]
+	return prs
+}
+
+// updateRevocations applies the CRLs of a new set of channel MSP configurations. Cached
+// certificates that have been revoked are invalidated, and every newly revoked serial is sent to
+// the hardware peer along with the hash of its issuer, since serials are only unique per issuer.
+// Revoked certificates are never cached again, so that transactions carry them inline and the
+// hardware peer can reject them. Serials that are no longer revoked by any MSP (e.g. a newer CRL
+// dropped them) are reinstated on the hardware peer, and their certificates are cached again when
+// blocks refer to them.
+func updateRevocations(addr string, configs map[string]*msp.FabricMSPConfig) {
+	previous := mspRevokedSerials
+	mspRevokedSerials = make(map[string]map[string]revokedCertificate)
+	total := 0
+	for name, conf := range configs {
+		mspRevokedSerials[name] = getRevokedSerials(conf)
+		total += len(mspRevokedSerials[name])
+	}
+	hwMetrics.RevokedSerials.Set(float64(total))
+
+	// The hardware peer knows revoked serials by issuer and serial only, and MSPs may share a CA.
+	wasRevoked := make(map[string]bool)
+	for _, revoked := range previous {
+		for key := range revoked {
+			wasRevoked[key] = true
+		}
+	}
+	isRevoked := make(map[string]bool)
+	for _, revoked := range mspRevokedSerials {
+		for key := range revoked {
+			isRevoked[key] = true
+		}
+	}
+
+	// Invalidate cached certificates first, so that their revocation carries their cache ID.
+	revokedIds := make(map[string]int)
+	for _, info := range CertificateIdCache {
+		if !isCertificateRevoked(info.name, info.ca) {
+			continue
+		}
+		block, _ := pem.Decode(info.ca)
+		cert, _ := x509.ParseCertificate(block.Bytes)
+		revokedIds[revocationKey(cert.RawIssuer, cert.SerialNumber)] = info.id
+	}
+
+	sent := make(map[string]bool)
+	for name, revoked := range mspRevokedSerials {
+		for key, cert := range revoked {
+			if wasRevoked[key] || sent[key] {
+				continue
+			}
+			sent[key] = true
+			id, cached := revokedIds[key]
+			if !cached {
+				id = CERTIFICATE_ID_NONE
+			} else {
+				info := CertificateIdCache[id]
+				logger.Infof("Revoking %s %s certificate with id=%d", info.name, identityRoles[info.role], id)
+				removeCertificateFromCache(id)
+				hwMetrics.RevokedCertificates.Add(1)
+			}
+			issuerHash := sha256.Sum256(cert.issuer)
+			if err := sendCertificateRevocation(addr, BCM_CACHE_OP_REVOKE, id, issuerHash[:], cert.serial); err != nil {
+				logger.Warningf("Cannot revoke %s certificate serial %s: %s", name, cert.serial, err)
+			}
+		}
+	}
+
+	for name, revoked := range previous {
+		for key, cert := range revoked {
+			if isRevoked[key] || sent[key] {
+				continue
+			}
+			sent[key] = true
+			logger.Infof("Reinstating %s certificate serial %s", name, cert.serial)
+			issuerHash := sha256.Sum256(cert.issuer)
+			if err := sendCertificateRevocation(addr, BCM_CACHE_OP_UNREVOKE, CERTIFICATE_ID_NONE, issuerHash[:], cert.serial); err != nil {
+				logger.Warningf("Cannot reinstate %s certificate serial %s: %s", name, cert.serial, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-protos-go/msp"
+)
+
+// testCA issues certificates and CRLs. Its name is encoded with UTF8String values, as most CAs
+// do, rather than the PrintableString values Go uses when marshaling a pkix.Name.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, commonName string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := asn1.Marshal(pkix.RDNSequence{
+		{{Type: asn1.ObjectIdentifier{2, 5, 4, 10}, Value: asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte("Org1")}}},
+		{{Type: asn1.ObjectIdentifier{2, 5, 4, 3}, Value: asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte(commonName)}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		RawSubject:            name,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key}
+}
+
+// issue returns a PEM encoded certificate with the given serial number issued by the CA
+func (ca *testCA) issue(t *testing.T, serial int64) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// crl returns a PEM encoded CRL of the CA revoking the given serial numbers
+func (ca *testCA) crl(t *testing.T, number int64, serials ...int64) []byte {
+	t.Helper()
+	template := &x509.RevocationList{Number: big.NewInt(number), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+	for _, serial := range serials {
+		template.RevokedCertificates = append(template.RevokedCertificates,
+			pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+// revocation is a certificate revocation message sent to the hardware peer.
+type revocation struct {
+	op         byte
+	id         int
+	serial     int64
+	issuerHash []byte
+}
+
+// revocations returns the certificate revocation messages among packets
+func revocations(t *testing.T, packets [][]byte) (revoked []revocation) {
+	t.Helper()
+	for _, packet := range packets {
+		hdr, err := bytesToTransportHeader(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		op := hdr.ctrl_type >> 4
+		if hdr.ctrl_type&0x0F != BCM_MSG_TYPE_CACHE_UPDATE || (op != BCM_CACHE_OP_REVOKE && op != BCM_CACHE_OP_UNREVOKE) {
+			continue
+		}
+		payload := packet[BCM_TRANSPORT_HEADER_SIZE+int(hdr.annotation_size)*ANNOTATION_SIZE:]
+		serial := payload[:len(payload)-sha256.Size]
+		revoked = append(revoked, revocation{
+			op:         op,
+			id:         int(packet[BCM_TRANSPORT_HEADER_SIZE+1])<<8 | int(packet[BCM_TRANSPORT_HEADER_SIZE+2]),
+			serial:     new(big.Int).SetBytes(serial).Int64(),
+			issuerHash: payload[len(serial):],
+		})
+	}
+	return revoked
+}
+
+func TestRevokedSerials(t *testing.T) {
+	initTestCertificateCache(t)
+	ca := newTestCA(t, "ca.org1")
+	revoked := ca.issue(t, 100)
+	valid := ca.issue(t, 101)
+	other := newTestCA(t, "ca2.org1").issue(t, 100)
+
+	crl := ca.crl(t, 1, 100)
+	block, _ := pem.Decode(crl)
+	for _, encoding := range []struct {
+		name string
+		crl  []byte
+	}{{"PEM", crl}, {"DER", block.Bytes}} {
+		mspRevokedSerials = map[string]map[string]revokedCertificate{
+			"Org1MSP": getRevokedSerials(&msp.FabricMSPConfig{Name: "Org1MSP", RevocationList: [][]byte{encoding.crl}}),
+		}
+		if !isCertificateRevoked("Org1MSP", revoked) {
+			t.Errorf("%s CRL: revoked certificate is not revoked", encoding.name)
+		}
+		if isCertificateRevoked("Org1MSP", valid) {
+			t.Errorf("%s CRL: certificate with another serial is revoked", encoding.name)
+		}
+		// Serials are only unique per issuer.
+		if isCertificateRevoked("Org1MSP", other) {
+			t.Errorf("%s CRL: certificate of another issuer is revoked", encoding.name)
+		}
+		if isCertificateRevoked("Org2MSP", revoked) {
+			t.Errorf("%s CRL: certificate is revoked by another MSP", encoding.name)
+		}
+	}
+}
+
+func TestUpdateRevocations(t *testing.T) {
+	transport := initTestCertificateCache(t)
+	ca := newTestCA(t, "ca.org1")
+	cached := ca.issue(t, 100)
+	inline := ca.issue(t, 101)
+	block, _ := pem.Decode(cached)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerHash := sha256.Sum256(cert.RawIssuer)
+
+	updateCertificatesFromMSPConfigs(testHardwareAddress, map[string]*msp.FabricMSPConfig{"Org1MSP": {Name: "Org1MSP"}})
+	id := addCertificate(testHardwareAddress, "Org1MSP", cached, false)
+	if id < 0 {
+		t.Fatal("certificate not cached")
+	}
+	transport.sent()
+
+	// The cached certificate is revoked by its cache ID, the other one by issuer and serial only.
+	configs := map[string]*msp.FabricMSPConfig{
+		"Org1MSP": {Name: "Org1MSP", RevocationList: [][]byte{ca.crl(t, 1, 100, 101)}},
+	}
+	updateCertificatesFromMSPConfigs(testHardwareAddress, configs)
+	got := revocations(t, transport.sent())
+	if len(got) != 2 {
+		t.Fatalf("got %d revocation(s), want 2", len(got))
+	}
+	for _, r := range got {
+		want := revocation{BCM_CACHE_OP_REVOKE, id, 100, issuerHash[:]}
+		if r.serial == 101 {
+			want = revocation{BCM_CACHE_OP_REVOKE, CERTIFICATE_ID_NONE, 101, issuerHash[:]}
+		}
+		if r.op != want.op || r.id != want.id || r.serial != want.serial || !bytes.Equal(r.issuerHash, want.issuerHash) {
+			t.Errorf("got revocation %+v, want %+v", r, want)
+		}
+	}
+	if _, prs := CertificateIdCache[id]; prs {
+		t.Error("revoked certificate is still cached")
+	}
+	if addCertificate(testHardwareAddress, "Org1MSP", inline, false) >= 0 {
+		t.Error("revoked certificate cached")
+	}
+
+	// Revocations are only sent once.
+	updateCertificatesFromMSPConfigs(testHardwareAddress, configs)
+	if got := revocations(t, transport.sent()); len(got) != 0 {
+		t.Errorf("got revocations %+v for unchanged CRLs", got)
+	}
+
+	// A newer CRL drops serial 101, which can be cached again.
+	updateCertificatesFromMSPConfigs(testHardwareAddress, map[string]*msp.FabricMSPConfig{
+		"Org1MSP": {Name: "Org1MSP", RevocationList: [][]byte{ca.crl(t, 2, 100)}},
+	})
+	got = revocations(t, transport.sent())
+	want := revocation{BCM_CACHE_OP_UNREVOKE, CERTIFICATE_ID_NONE, 101, issuerHash[:]}
+	if len(got) != 1 || got[0].op != want.op || got[0].id != want.id || got[0].serial != want.serial || !bytes.Equal(got[0].issuerHash, want.issuerHash) {
+		t.Errorf("got revocations %+v, want %+v", got, want)
+	}
+	if addCertificate(testHardwareAddress, "Org1MSP", inline, false) < 0 {
+		t.Error("reinstated certificate not cached")
+	}
+}
@@ -6,61 +6,148 @@ SPDX-License-Identifier: Apache-2.0
 
 package fmprotocol
 
-// getVarint reads a varint value from data position, return the value and next data position
-func getVarint(data []byte, pos int) (val int, off int) {
-	val = 0
-	off = 0
-	for data[pos]&0x80 == 0x80 {
-		val += int(data[pos]&0x7F) << uint(7*off)
-		pos++
-		off++
+import (
+	"github.com/pkg/errors"
+)
+
+// proto wire types
+const PROTO_WIRE_VARINT int = 0
+const PROTO_WIRE_FIXED64 int = 1
+const PROTO_WIRE_BYTES int = 2
+const PROTO_WIRE_START_GROUP int = 3
+const PROTO_WIRE_END_GROUP int = 4
+const PROTO_WIRE_FIXED32 int = 5
+
+// Longest varint encoding (64-bit values)
+const PROTO_MAX_VARINT_SIZE int = 10
+
+// getVarint reads a varint value from data position, return the value and its size in bytes
+func getVarint(data []byte, pos int) (val int, off int, err error) {
+	var v uint64
+	for off = 0; off < PROTO_MAX_VARINT_SIZE; off++ {
+		if pos+off < 0 || pos+off >= len(data) {
+			return 0, 0, errors.Errorf("truncated varint at %d", pos)
+		}
+		b := data[pos+off]
+		v |= uint64(b&0x7F) << uint(7*off)
+		if b&0x80 == 0 {
+			if int(v) < 0 {
+				return 0, 0, errors.Errorf("varint at %d overflows", pos)
+			}
+			return int(v), off + 1, nil
+		}
 	}
-	val += int(data[pos]) << uint(7*off)
-	off++
-	return val, off
+	return 0, 0, errors.Errorf("varint at %d too long", pos)
 }
 
-// protoGetFieldLength reads field ID, field length and field data position
-func protoGetFieldLength(data []byte, pos int) (field int, length int, newPos int) {
-	field, off := getVarint(data, pos)
-	field_type := field & 0x7
-	field = field >> 3
+// protoGetField reads a field key at data position, return the field ID, wire type, field data
+// position and length. The length of varint fields is the size of their encoding.
+func protoGetField(data []byte, pos int) (field int, wireType int, length int, newPos int, err error) {
+	key, off, err := getVarint(data, pos)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	field = key >> 3
+	wireType = key & 0x7
+	if field == 0 {
+		return 0, 0, 0, 0, errors.Errorf("invalid field 0 at %d", pos)
+	}
 	pos += off
 
-	length, off = getVarint(data, pos)
-	if field_type != 0 {
+	switch wireType {
+	case PROTO_WIRE_VARINT:
+		_, length, err = getVarint(data, pos)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+	case PROTO_WIRE_FIXED64:
+		length = 8
+	case PROTO_WIRE_BYTES:
+		length, off, err = getVarint(data, pos)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
 		pos += off
-	} else {
-		length = off
+	case PROTO_WIRE_FIXED32:
+		length = 4
+	default:
+		// groups are deprecated and not used by Fabric protos
+		return 0, 0, 0, 0, errors.Errorf("unsupported wire type %d of field %d at %d", wireType, field, pos)
+	}
+
+	if length > len(data)-pos {
+		return 0, 0, 0, 0, errors.Errorf("truncated field %d at %d: %d bytes past the end", field, pos, length-(len(data)-pos))
 	}
+	return field, wireType, length, pos, nil
+}
 
-	return field, length, pos
+// protoGetFieldLength reads field ID, field length and field data position
+func protoGetFieldLength(data []byte, pos int) (field int, length int, newPos int, err error) {
+	field, _, length, newPos, err = protoGetField(data, pos)
+	return field, length, newPos, err
 }
 
-// protoSearchFieldPos finds first fields data position and length from the starting point
-func protoSearchFieldPos(data []byte, start int, size int, target_field int) (pos int, length int) {
+// protoFindField finds first field from the starting point, return the field start position (its
+// key), wire type, data position and length. Position is -1 when the field is not found.
+func protoFindField(data []byte, start int, size int, target_field int) (fieldStart int, wireType int, pos int, length int, err error) {
+	if start < 0 || size < 0 || size > len(data)-start {
+		return -1, 0, -1, 0, errors.Errorf("invalid range %d+%d of %d bytes", start, size, len(data))
+	}
 	pos = start
 	end := start + size
 	field := 0
 	for pos < end {
-		field, length, pos = protoGetFieldLength(data, pos)
+		fieldStart = pos
+		field, wireType, length, pos, err = protoGetField(data, pos)
+		if err != nil {
+			return -1, 0, -1, 0, err
+		}
+		if pos+length > end {
+			return -1, 0, -1, 0, errors.Errorf("field %d at %d overruns its message", field, fieldStart)
+		}
 		if field == target_field {
-			return pos, length
+			return fieldStart, wireType, pos, length, nil
 		}
 		pos += length
 	}
-	return -1, 0
+	return -1, 0, -1, 0, nil
+}
+
+// protoSearchFieldPos finds first fields data position and length from the starting point.
+// Position is -1 when the field is not found.
+func protoSearchFieldPos(data []byte, start int, size int, target_field int) (pos int, length int, err error) {
+	_, _, pos, length, err = protoFindField(data, start, size, target_field)
+	return pos, length, err
+}
+
+// protoGetFieldPos search field IDs in path recursively, return the last field data position and
+// length. Position is -1 when a field of the path is not found.
+func protoGetFieldPos(data []byte, start int, size int, path []int) (pos int, length int, err error) {
+	_, pos, length, err = protoGetFieldStart(data, start, size, path)
+	return pos, length, err
 }
 
-// protoGetFieldPos search field IDs in path recursively, return the last field data position and length
-func protoGetFieldPos(data []byte, start int, size int, path []int) (pos int, length int) {
+// protoGetFieldStart search field IDs in path recursively, return the last field start position
+// (its key), data position and length. Positions are -1 when a field of the path is not found.
+func protoGetFieldStart(data []byte, start int, size int, path []int) (fieldStart int, pos int, length int, err error) {
+	if start < 0 || size < 0 || size > len(data)-start {
+		return -1, -1, 0, errors.Errorf("invalid range %d+%d of %d bytes", start, size, len(data))
+	}
+	fieldStart = start
 	pos = start
 	length = size
+	wireType := PROTO_WIRE_BYTES
 	for i := 0; i < len(path); i++ {
-		pos, length = protoSearchFieldPos(data, pos, length, path[i])
+		if wireType != PROTO_WIRE_BYTES {
+			return -1, -1, 0, errors.Errorf("field %d of path %v is not a message", path[i-1], path)
+		}
+		fieldStart, wireType, pos, length, err = protoFindField(data, pos, length, path[i])
+		if err != nil {
+			return -1, -1, 0, errors.WithMessagef(err, "cannot read field %d of path %v", path[i], path)
+		}
 		if pos == -1 {
-			return -1, 0
+			return -1, -1, 0, nil
 		}
 	}
-	return pos, length
+	return fieldStart, pos, length, nil
 }
@@ -0,0 +1,62 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/fabricmachine/testutil"
+)
+
+// testBlockBytes returns a serialized block with one endorser transaction, for fuzzing seeds.
+func testBlockBytes() []byte {
+	env := testutil.NewEnvelope(&testutil.Tx{
+		TxId:        "tx",
+		Chaincode:   "mycc",
+		Args:        []string{"put", "key", "value"},
+		Creator:     testutil.Identity("Org1MSP", testutil.NewCertificate("client")),
+		Endorsers:   [][]byte{testutil.Identity("Org1MSP", testutil.NewCertificate("peer0"))},
+		Collections: []string{"collection"},
+	})
+	return testutil.Marshal(testutil.NewBlock(1, testutil.Identity("OrdererMSP", testutil.NewCertificate("orderer")), env))
+}
+
+func FuzzProtoGetField(f *testing.F) {
+	f.Add(testBlockBytes(), 0)
+	f.Add([]byte{0x0a, 0x80}, 0)
+	f.Add([]byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, 0)
+	f.Fuzz(func(t *testing.T, data []byte, pos int) {
+		field, _, length, newPos, err := protoGetField(data, pos)
+		if err != nil {
+			return
+		}
+		if field < 1 || length < 0 || newPos < pos || newPos > len(data) || length > len(data)-newPos {
+			t.Fatalf("field %d at %d of %d bytes: data at %d, %d bytes", field, pos, len(data), newPos, length)
+		}
+	})
+}
+
+func FuzzProtoGetFieldStart(f *testing.F) {
+	block := testBlockBytes()
+	f.Add(block, 0, len(block), []byte{2, 1, 1, 1, 1, 5})
+	f.Add(block, 0, len(block), []byte{3, 1, 2, 1, 1})
+	f.Add(block, 1, len(block)-1, []byte{1})
+	f.Fuzz(func(t *testing.T, data []byte, start int, size int, fields []byte) {
+		path := make([]int, 0, len(fields))
+		for _, field := range fields {
+			path = append(path, int(field%16)+1)
+		}
+		fieldStart, pos, length, err := protoGetFieldStart(data, start, size, path)
+		if err != nil || pos < 0 {
+			return
+		}
+		if fieldStart < start || pos < fieldStart || length < 0 || pos+length > start+size || start+size > len(data) {
+			t.Fatalf("path %v in %d+%d of %d bytes: field at %d, data at %d, %d bytes",
+				path, start, size, len(data), fieldStart, pos, length)
+		}
+	})
+}
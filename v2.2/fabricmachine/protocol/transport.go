@@ -6,21 +6,117 @@ SPDX-License-Identifier: Apache-2.0
 package fmprotocol
 
 import (
-	"bytes"
 	"encoding/binary"
-	"net"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric/fabricmachine/api"
+	"github.com/pkg/errors"
 )
 
+// blockchain machine protocol message types
+const BCM_MSG_TYPE_CACHE_UPDATE byte = 0x0
+const BCM_MSG_TYPE_BLOCK_HEADER byte = 0x1
+const BCM_MSG_TYPE_TRANSACTION byte = 0x2
+const BCM_MSG_TYPE_BLOCK_METADATA byte = 0x3
+const BCM_MSG_TYPE_CAPABILITY byte = 0x4
+const BCM_MSG_TYPE_ENDORSEMENT_POLICY byte = 0x5
+const BCM_MSG_TYPE_TXID_SEED byte = 0x6
+const BCM_MSG_TYPE_ACK byte = 0xF
+
+// control flag requesting the hardware peer to acknowledge a message
+const BCM_CTRL_ACK_REQUEST byte = 0x8
+
+// control flag of transaction messages whose endorsements are checked in software; the hardware
+// peer performs all the other checks
+const BCM_CTRL_SOFTWARE_ENDORSEMENT byte = 0x4
+
+// control flag of transaction messages carrying a transaction validated in software; such
+// messages only have the TX ID annotation, and the hardware peer reports the transaction as
+// invalid without applying its writes
+const BCM_CTRL_SOFTWARE_VALIDATION byte = 0x2
+
+// control flag of transaction messages invoking a function configured as read-only, whose
+// read/write set has no writes; the hardware peer can skip its write pipeline for them
+const BCM_CTRL_READ_ONLY byte = 0x1
+
+// control codes for certificate cache update messages
+const BCM_CACHE_OP_ADD byte = 0x0
+const BCM_CACHE_OP_REMOVE byte = 0x1
+const BCM_CACHE_OP_UPDATE byte = 0x2
+const BCM_CACHE_OP_REVOKE byte = 0x3
+const BCM_CACHE_OP_UNREVOKE byte = 0x4
+
 // BcmSession keeps blockchain machine protocol session information
 type BcmSession struct {
 	addr     string
 	sequence uint16
 	info     uint32
-	udpConn  *net.UDPConn
+	conn     Transport
+	pacer    *tokenBucket
+
+	// authentication of the packets, see appendAuthenticationTrailer; the session id is assigned
+	// when the first authenticated packet is formed, 0 until then
+	sessionId uint64
+	epoch     uint16
+}
+
+// bcmMessage is a blockchain machine protocol message ready to be sent, with its annotations
+// already serialized
+type bcmMessage struct {
+	msgType        byte
+	control        byte
+	annotationData []byte
+	annotationNum  int
+	payload        []byte
+}
+
+// Transport carries blockchain machine protocol packets between the orderer and a hardware peer
+type Transport interface {
+	// Send sends a packet.
+	Send(packet []byte) error
+	// SendBatch sends packets in order, and returns how many of them were sent.
+	SendBatch(packets [][]byte) (int, error)
+	// Receive reads the next packet to buff, waiting until deadline at most.
+	Receive(buff []byte, deadline time.Time) (int, error)
+	Close() error
+}
+
+// transport types
+const BCM_TRANSPORT_UDP string = "udp"
+const BCM_TRANSPORT_TCP string = "tcp"
+const BCM_TRANSPORT_UNIX string = "unix"
+
+// newTransport connects to addr with the configured transport, mirroring packets to the
+// configured capture file
+func newTransport(addr string) (Transport, error) {
+	t, err := DialTransport(fmapi.GetTransportType(), addr, fmapi.GetTransportSourceInterface(), fmapi.GetTransportDscp())
+	if err != nil {
+		return nil, err
+	}
+	if capture := getCaptureWriter(fmapi.GetCaptureFile()); capture != nil {
+		t = &captureTransport{Transport: t, addr: addr, capture: capture}
+	}
+	return t, nil
+}
+
+// DialTransport connects to addr with a transport of the given type. sourceInterface and dscp
+// only apply to UDP.
+func DialTransport(transportType string, addr string, sourceInterface string, dscp int) (Transport, error) {
+	switch transportType {
+	case "", BCM_TRANSPORT_UDP:
+		return newUdpTransport(addr, sourceInterface, dscp)
+	case BCM_TRANSPORT_TCP:
+		return newTcpTransport(addr)
+	case BCM_TRANSPORT_UNIX:
+		return newUnixTransport(addr)
+	default:
+		return nil, errors.Errorf("unknown transport %s", transportType)
+	}
 }
 
 // BcmSessionMap records IP to blockchain machine protocol session relation
-var BcmSessionMap map[string]BcmSession
+var BcmSessionMap map[string]*BcmSession
 
 type BcmTransportHeader struct {
 	sequence        uint16
@@ -28,54 +124,250 @@ type BcmTransportHeader struct {
 	annotation_size uint8
 }
 
+// Size of blockchain machine protocol header in bytes
+const BCM_TRANSPORT_HEADER_SIZE int = 4
+
+// Largest blockchain machine protocol packet in bytes (jumbo frame)
+const BCM_MAX_PACKET_SIZE int = 9000
+
+// bcmPacketPool keeps packet buffers for reuse, so that sending a block does not allocate one
+// buffer per message
+var bcmPacketPool = sync.Pool{
+	New: func() interface{} {
+		buff := make([]byte, BCM_MAX_PACKET_SIZE)
+		return &buff
+	},
+}
+
+// putTransportHeader formats blockchain machine protocol header to binary in data
+func putTransportHeader(data []byte, hdr BcmTransportHeader) {
+	binary.BigEndian.PutUint16(data[0:2], hdr.sequence)
+	data[2] = hdr.ctrl_type
+	data[3] = hdr.annotation_size
+}
+
 // transportHeaderToBytes formats blockchain machine protocol header to binary
 func transportHeaderToBytes(hdr BcmTransportHeader) (data []byte) {
-	buf := &bytes.Buffer{}
-	binary.Write(buf, binary.BigEndian, hdr)
-	data = buf.Bytes()
+	data = make([]byte, BCM_TRANSPORT_HEADER_SIZE)
+	putTransportHeader(data, hdr)
 	return data
 }
 
-// bcmSessionFindOrCreate searches session map for IP, creates a new session if not existed
-func bcmSessionFindOrCreate(addr string) (session BcmSession) {
-	if BcmSessionMap == nil {
-		BcmSessionMap = make(map[string]BcmSession)
+// bytesToTransportHeader parses blockchain machine protocol header from binary
+func bytesToTransportHeader(data []byte) (hdr BcmTransportHeader, err error) {
+	if len(data) < BCM_TRANSPORT_HEADER_SIZE {
+		return hdr, errors.Errorf("header too short: %d bytes", len(data))
 	}
-	if BcmSessionMap[addr].addr != addr {
-		udpAddr, _ := net.ResolveUDPAddr("udp4", addr)
-		udpConn, err := net.DialUDP("udp", nil, udpAddr)
+	hdr = BcmTransportHeader{binary.BigEndian.Uint16(data[0:2]), data[2], data[3]}
+	return hdr, nil
+}
+
+// bcmSessionFindOrCreate searches session map for IP, creates a new session if not existed
+func bcmSessionFindOrCreate(addr string) (session *BcmSession) {
+	if BcmSessionMap[addr] == nil {
+		conn, err := newTransport(addr)
 		if err != nil {
-			return
+			logger.Errorf("cannot connect to %v:%v", addr, err.Error())
+			return nil
 		}
-		BcmSessionMap[addr] = BcmSession{addr, 0, 0, udpConn}
+		OpenBcmSession(addr, conn)
 	}
 	return BcmSessionMap[addr]
 }
 
+// OpenBcmSession opens a session to addr over conn instead of the configured transport, e.g. to
+// record the packets sent to addr. It replaces the current session to addr, if any.
+func OpenBcmSession(addr string, conn Transport) {
+	if BcmSessionMap == nil {
+		BcmSessionMap = make(map[string]*BcmSession)
+	}
+	BcmSessionMap[addr] = &BcmSession{
+		addr:  addr,
+		conn:  conn,
+		pacer: newTokenBucket(fmapi.GetPacingBytesPerSecond(), fmapi.GetPacingPacketsPerSecond()),
+	}
+}
+
+// bcmSessionPacket forms a packet from blockchain machine protocol message in buff when it is large
+// enough, and assigns the next sequence number of the session to it. Packets are authenticated
+// when authentication is configured, and cannot be formed when authentication keys or a session id
+// are missing then.
+func bcmSessionPacket(session *BcmSession, m bcmMessage, buff []byte) ([]byte, error) {
+	bcmHeader := BcmTransportHeader{session.sequence, uint8(byte(m.control<<4) | m.msgType), uint8(m.annotationNum)}
+	keys, err := getAuthenticationKeys()
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil && session.sessionId == 0 {
+		if session.sessionId, err = newBcmSessionId(); err != nil {
+			return nil, err
+		}
+	}
+
+	size := BCM_TRANSPORT_HEADER_SIZE + len(m.annotationData) + len(m.payload)
+	if keys != nil {
+		size += BCM_AUTH_TRAILER_SIZE
+	}
+	if size > cap(buff) {
+		logger.Errorf("error: UDP too large: %d bytes", size)
+		buff = make([]byte, 0, size)
+	}
+	buff = buff[:BCM_TRANSPORT_HEADER_SIZE]
+	putTransportHeader(buff, bcmHeader)
+	buff = append(buff, m.annotationData...)
+	buff = append(buff, m.payload...)
+	if keys != nil {
+		buff = appendAuthenticationTrailer(keys, session, bcmHeader.sequence, buff)
+	}
+
+	// Sequence numbers wrap around, the epoch keeps packet numbers unique within the session.
+	session.sequence++
+	if session.sequence == 0 {
+		session.epoch++
+		if session.epoch == 0 {
+			session.sessionId = 0
+		}
+	}
+	return buff, nil
+}
+
 // bcmSessionSend forms a packet from blockchain machine protocol message and send out via protocol session
-func bcmSessionSend(session BcmSession, msgType byte, annotation_data []byte, annotation_num int, payload []byte) {
-	control := 0
+func bcmSessionSend(session *BcmSession, msgType byte, control byte, annotation_data []byte, annotation_num int, payload []byte) error {
+	pooled := bcmPacketPool.Get().(*[]byte)
+	defer bcmPacketPool.Put(pooled)
+	buff, err := bcmSessionPacket(session, bcmMessage{msgType, control, annotation_data, annotation_num, payload}, *pooled)
+	if err != nil {
+		return errors.WithMessagef(err, "cannot send message to %s", session.addr)
+	}
 
-	bcmHeader := BcmTransportHeader{session.sequence, uint8(byte(control<<4) | msgType), uint8(annotation_num)}
-	var buff []byte
-	buff = append(buff, transportHeaderToBytes(bcmHeader)...)
-	buff = append(buff, annotation_data...)
-	buff = append(buff, payload...)
+	session.pacer.admit([]int{len(buff)})
+	if err := session.conn.Send(buff); err != nil {
+		return errors.Wrapf(err, "cannot send message to %s", session.addr)
+	}
+	session.pacer.charge([]int{len(buff)})
+	hwMetrics.SentPackets.With("address", session.addr).Add(1)
+	hwMetrics.SentBytes.With("address", session.addr).Add(float64(len(buff)))
+	logger.Debugf("send ok: %d %d %d", len(annotation_data), len(payload), len(buff))
+	return nil
+}
+
+// bcmSessionSendBatch forms packets from blockchain machine protocol messages and sends them out
+// via protocol session, several packets per system call and at the pace of the session. It reports
+// the achieved throughput. It stops at the first packet that cannot be sent, whose error it
+// returns: the hardware peer only gets part of the messages then.
+func bcmSessionSendBatch(session *BcmSession, messages []bcmMessage) (err error) {
+	batchSize := fmapi.GetSendBatchSize()
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	pooled := make([]*[]byte, len(messages))
+	packets := make([][]byte, len(messages))
+	sizes := make([]int, len(messages))
+	defer func() {
+		for _, buff := range pooled {
+			if buff != nil {
+				bcmPacketPool.Put(buff)
+			}
+		}
+	}()
+	for i, m := range messages {
+		pooled[i] = bcmPacketPool.Get().(*[]byte)
+		if packets[i], err = bcmSessionPacket(session, m, *pooled[i]); err != nil {
+			return errors.WithMessagef(err, "cannot send %d packet(s) to %s", len(messages), session.addr)
+		}
+		sizes[i] = len(packets[i])
+	}
+
+	start := time.Now()
+	sentPackets := 0
+	sentBytes := 0
+	for sentPackets < len(packets) {
+		end := sentPackets + batchSize
+		if end > len(packets) {
+			end = len(packets)
+		}
+		end = sentPackets + session.pacer.admit(sizes[sentPackets:end])
+
+		// Only the packets actually sent are charged, the pacer does not hold back the next
+		// attempt for packets that were not.
+		var n int
+		n, err = session.conn.SendBatch(packets[sentPackets:end])
+		session.pacer.charge(sizes[sentPackets : sentPackets+n])
+		if err != nil {
+			err = errors.Wrapf(err, "cannot send %d packet(s) to %s", len(packets)-sentPackets-n, session.addr)
+			break
+		}
+		for _, size := range sizes[sentPackets : sentPackets+n] {
+			sentBytes += size
+		}
+		sentPackets += n
+	}
 
-	length, err := session.udpConn.Write(buff)
+	hwMetrics.SentPackets.With("address", session.addr).Add(float64(sentPackets))
+	hwMetrics.SentBytes.With("address", session.addr).Add(float64(sentBytes))
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 && sentPackets > 0 {
+		hwMetrics.BlockSendBytesPerSecond.With("address", session.addr).Set(float64(sentBytes) / elapsed)
+		hwMetrics.BlockSendPacketsPerSecond.With("address", session.addr).Set(float64(sentPackets) / elapsed)
+	}
 	if err != nil {
-		return
+		return err
 	}
+	logger.Debugf("send ok: %d packet(s), %d byte(s)", sentPackets, sentBytes)
+	return nil
+}
 
-	if length > 9000 {
-		logger.Errorf("error: UDP too large")
-	} else {
-		logger.Debugf("send ok: ", len(annotation_data), len(payload), length)
+// bcmSendBatch sends blockchain machine protocol messages to destination IP address, in order
+func bcmSendBatch(addr string, messages []bcmMessage) error {
+	session := bcmSessionFindOrCreate(addr)
+	if session == nil {
+		return errors.Errorf("no session to %s", addr)
 	}
+	return bcmSessionSendBatch(session, messages)
 }
 
 // bcmSend sends a blockchain machine protocol message to destination IP address
-func bcmSend(addr string, msgType byte, annotation_data []byte, annotation_num int, payload []byte) {
+func bcmSend(addr string, msgType byte, control byte, annotation_data []byte, annotation_num int, payload []byte) error {
 	session := bcmSessionFindOrCreate(addr)
-	bcmSessionSend(session, msgType, annotation_data, annotation_num, payload)
+	if session == nil {
+		return errors.Errorf("no session to %s", addr)
+	}
+	return bcmSessionSend(session, msgType, control, annotation_data, annotation_num, payload)
+}
+
+// bcmSendWithAck sends a blockchain machine protocol message to destination IP address, and waits
+// until the hardware peer acknowledges it by echoing the message sequence number
+func bcmSendWithAck(addr string, msgType byte, control byte, annotation_data []byte, annotation_num int, payload []byte, timeout time.Duration) error {
+	_, err := bcmRequest(addr, msgType, control|BCM_CTRL_ACK_REQUEST, annotation_data, annotation_num, payload, BCM_MSG_TYPE_ACK, timeout)
+	return err
+}
+
+// bcmRequest sends a blockchain machine protocol message to destination IP address, and waits for
+// a response of the given type with the same sequence number. It returns the response payload.
+func bcmRequest(addr string, msgType byte, control byte, annotation_data []byte, annotation_num int, payload []byte, responseType byte, timeout time.Duration) (response []byte, err error) {
+	session := bcmSessionFindOrCreate(addr)
+	if session == nil {
+		return nil, errors.Errorf("no session to %s", addr)
+	}
+	sequence := session.sequence
+	if err := bcmSessionSend(session, msgType, control, annotation_data, annotation_num, payload); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	buff := make([]byte, BCM_MAX_PACKET_SIZE)
+	for {
+		length, err := session.conn.Receive(buff, deadline)
+		if err != nil {
+			return nil, errors.Wrapf(err, "no response for message %d from %s", sequence, addr)
+		}
+		hdr, err := bytesToTransportHeader(buff[:length])
+		if err != nil {
+			continue
+		}
+		// Skip stale responses to earlier messages.
+		if hdr.ctrl_type&0x0F == responseType && hdr.sequence == sequence {
+			return buff[BCM_TRANSPORT_HEADER_SIZE:length], nil
+		}
+	}
 }
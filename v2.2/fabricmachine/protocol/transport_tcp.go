@@ -0,0 +1,116 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Size of the length prefix of packets sent over stream transports
+const BCM_FRAME_HEADER_SIZE int = 4
+
+// tcpTransport sends packets over a TCP connection, each packet preceded by its length (32-bit
+// big endian). The connection is established again on the next send after a failure.
+type tcpTransport struct {
+	addr string
+	conn net.Conn
+}
+
+// newTcpTransport connects to addr (host:port)
+func newTcpTransport(addr string) (*tcpTransport, error) {
+	t := &tcpTransport{addr: addr}
+	if err := t.connect(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// connect connects to the receiver when not connected
+func (t *tcpTransport) connect() error {
+	if t.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", t.addr, 5*time.Second)
+	if err != nil {
+		return errors.Wrapf(err, "cannot connect to %s", t.addr)
+	}
+	t.conn = conn
+	return nil
+}
+
+// reset closes the connection after a failure, so that the next send connects again
+func (t *tcpTransport) reset() {
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// frameHeader returns the length prefix of a packet
+func frameHeader(packet []byte) []byte {
+	hdr := make([]byte, BCM_FRAME_HEADER_SIZE)
+	binary.BigEndian.PutUint32(hdr, uint32(len(packet)))
+	return hdr
+}
+
+func (t *tcpTransport) Send(packet []byte) error {
+	_, err := t.SendBatch([][]byte{packet})
+	return err
+}
+
+// SendBatch writes the packets with a single system call (writev). It returns 0 or all of them,
+// since the receiver cannot tell how many complete packets it got before a failure anyway.
+func (t *tcpTransport) SendBatch(packets [][]byte) (int, error) {
+	if err := t.connect(); err != nil {
+		return 0, err
+	}
+	buffers := make(net.Buffers, 0, 2*len(packets))
+	for _, packet := range packets {
+		buffers = append(buffers, frameHeader(packet), packet)
+	}
+	if _, err := buffers.WriteTo(t.conn); err != nil {
+		t.reset()
+		return 0, err
+	}
+	return len(packets), nil
+}
+
+// Receive reads the next packet. The connection is reset when a packet is only partly received
+// before the deadline, since the stream cannot be resynchronized.
+func (t *tcpTransport) Receive(buff []byte, deadline time.Time) (int, error) {
+	if err := t.connect(); err != nil {
+		return 0, err
+	}
+	if err := t.conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	hdr := make([]byte, BCM_FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(t.conn, hdr); err != nil {
+		t.reset()
+		return 0, err
+	}
+	length := int(binary.BigEndian.Uint32(hdr))
+	if length > len(buff) {
+		t.reset()
+		return 0, errors.Errorf("packet of %d bytes from %s too large", length, t.addr)
+	}
+	if _, err := io.ReadFull(t.conn, buff[:length]); err != nil {
+		t.reset()
+		return 0, err
+	}
+	return length, nil
+}
+
+func (t *tcpTransport) Close() error {
+	t.reset()
+	return nil
+}
@@ -0,0 +1,209 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPackets are sent over each transport, one by one and as a batch
+var testPackets = [][]byte{[]byte("header"), []byte("transaction"), []byte("metadata")}
+
+// sendTestPackets sends testPackets over a transport, the first one alone and the others as a
+// batch
+func sendTestPackets(t *testing.T, transport Transport) {
+	t.Helper()
+	if err := transport.Send(testPackets[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := transport.SendBatch(testPackets[1:]); err != nil || n != len(testPackets)-1 {
+		t.Fatalf("sent %d packet(s) instead of %d: %v", n, len(testPackets)-1, err)
+	}
+}
+
+// checkTestPackets checks that received are testPackets
+func checkTestPackets(t *testing.T, received [][]byte) {
+	t.Helper()
+	if len(received) != len(testPackets) {
+		t.Fatalf("received %d packet(s) instead of %d", len(received), len(testPackets))
+	}
+	for i, packet := range received {
+		if !bytes.Equal(packet, testPackets[i]) {
+			t.Errorf("received packet %d %q instead of %q", i, packet, testPackets[i])
+		}
+	}
+}
+
+// checkResponse has the receiver respond with a packet and checks that the transport receives it
+func checkResponse(t *testing.T, transport Transport, respond func([]byte) error) {
+	t.Helper()
+	if err := respond([]byte("ack")); err != nil {
+		t.Fatal(err)
+	}
+	buff := make([]byte, BCM_MAX_PACKET_SIZE)
+	n, err := transport.Receive(buff, time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buff[:n]) != "ack" {
+		t.Errorf("received response %q instead of ack", buff[:n])
+	}
+}
+
+// receivePackets reads n datagrams from conn
+func receivePackets(t *testing.T, conn net.PacketConn, n int) (packets [][]byte, from net.Addr) {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buff := make([]byte, BCM_MAX_PACKET_SIZE)
+	for i := 0; i < n; i++ {
+		length, addr, err := conn.ReadFrom(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, append([]byte{}, buff[:length]...))
+		from = addr
+	}
+	return packets, from
+}
+
+func TestUdpTransport(t *testing.T) {
+	for _, network := range []string{"udp4", "udp6"} {
+		t.Run(network, func(t *testing.T) {
+			host := "127.0.0.1"
+			if network == "udp6" {
+				host = "[::1]"
+			}
+			receiver, err := net.ListenPacket(network, host+":0")
+			if err != nil {
+				t.Skipf("no %s loopback: %s", network, err)
+			}
+			defer receiver.Close()
+
+			transport, err := DialTransport(BCM_TRANSPORT_UDP, receiver.LocalAddr().String(), "", 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer transport.Close()
+
+			sendTestPackets(t, transport)
+			packets, from := receivePackets(t, receiver, len(testPackets))
+			checkTestPackets(t, packets)
+			checkResponse(t, transport, func(packet []byte) error {
+				_, err := receiver.WriteTo(packet, from)
+				return err
+			})
+		})
+	}
+}
+
+func TestUnixTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receiver.sock")
+	receiver, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	transport, err := DialTransport(BCM_TRANSPORT_UNIX, path, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	sendTestPackets(t, transport)
+	packets, from := receivePackets(t, receiver, len(testPackets))
+	checkTestPackets(t, packets)
+	checkResponse(t, transport, func(packet []byte) error {
+		_, err := receiver.WriteTo(packet, from)
+		return err
+	})
+}
+
+// readFrame reads a length-prefixed packet from a stream
+func readFrame(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, BCM_FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, binary.BigEndian.Uint32(hdr))
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+func TestTcpTransport(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	transport, err := DialTransport(BCM_TRANSPORT_TCP, listener.Addr().String(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sendTestPackets(t, transport)
+	var packets [][]byte
+	for range testPackets {
+		packet, err := readFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+	}
+	checkTestPackets(t, packets)
+	checkResponse(t, transport, func(packet []byte) error {
+		_, err := conn.Write(append(frameHeader(packet), packet...))
+		return err
+	})
+
+	// A response that does not fit is dropped along with the connection, since the stream cannot
+	// be resynchronized. The next send connects again.
+	if _, err := conn.Write(frameHeader(make([]byte, BCM_MAX_PACKET_SIZE+1))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.Receive(make([]byte, BCM_MAX_PACKET_SIZE), time.Now().Add(5*time.Second)); err == nil {
+		t.Fatal("oversized response received")
+	}
+	if err := transport.Send(testPackets[0]); err != nil {
+		t.Fatal(err)
+	}
+	reconnected, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reconnected.Close()
+	packet, err := readFrame(reconnected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet, testPackets[0]) {
+		t.Errorf("received packet %q instead of %q after reconnecting", packet, testPackets[0])
+	}
+}
+
+func TestDialUnknownTransport(t *testing.T) {
+	if _, err := DialTransport("sctp", "127.0.0.1:7100", "", 0); err == nil {
+		t.Error("unknown transport dialed")
+	}
+}
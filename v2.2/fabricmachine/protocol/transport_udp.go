@@ -0,0 +1,122 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// udpTransport sends packets as UDP datagrams over IPv4 or IPv6, several datagrams per system call
+// (sendmmsg) when batching
+type udpTransport struct {
+	conn     *net.UDPConn
+	ipv4Conn *ipv4.PacketConn
+	ipv6Conn *ipv6.PacketConn
+}
+
+// newUdpTransport connects to addr (host:port, with IPv6 hosts in brackets). Packets are sent from
+// the address of sourceInterface when set, and marked with dscp.
+func newUdpTransport(addr string, sourceInterface string, dscp int) (*udpTransport, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot resolve %s", addr)
+	}
+	isIpv4 := udpAddr.IP.To4() != nil
+
+	var localAddr *net.UDPAddr
+	if sourceInterface != "" {
+		ip, err := getInterfaceAddress(sourceInterface, isIpv4)
+		if err != nil {
+			return nil, err
+		}
+		localAddr = &net.UDPAddr{IP: ip}
+	}
+
+	conn, err := net.DialUDP("udp", localAddr, udpAddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot connect to %s", addr)
+	}
+
+	t := &udpTransport{conn: conn}
+	if isIpv4 {
+		t.ipv4Conn = ipv4.NewPacketConn(conn)
+		if dscp != 0 {
+			err = ipv4.NewConn(conn).SetTOS(dscp << 2)
+		}
+	} else {
+		t.ipv6Conn = ipv6.NewPacketConn(conn)
+		if dscp != 0 {
+			err = ipv6.NewConn(conn).SetTrafficClass(dscp << 2)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "cannot set DSCP %d", dscp)
+	}
+	return t, nil
+}
+
+// getInterfaceAddress returns the first IPv4 or IPv6 address of a network interface
+func getInterfaceAddress(name string, ipv4 bool) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot find interface %s", name)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get addresses of interface %s", name)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if (ipNet.IP.To4() != nil) == ipv4 {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, errors.Errorf("interface %s has no address of the destination family", name)
+}
+
+func (t *udpTransport) Send(packet []byte) error {
+	_, err := t.conn.Write(packet)
+	return err
+}
+
+func (t *udpTransport) SendBatch(packets [][]byte) (int, error) {
+	if len(packets) == 1 {
+		if err := t.Send(packets[0]); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+	// ipv4.Message and ipv6.Message are the same type
+	messages := make([]ipv4.Message, len(packets))
+	for i, packet := range packets {
+		messages[i].Buffers = [][]byte{packet}
+	}
+	if t.ipv4Conn != nil {
+		return t.ipv4Conn.WriteBatch(messages, 0)
+	}
+	return t.ipv6Conn.WriteBatch(messages, 0)
+}
+
+func (t *udpTransport) Receive(buff []byte, deadline time.Time) (int, error) {
+	if err := t.conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	return t.conn.Read(buff)
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
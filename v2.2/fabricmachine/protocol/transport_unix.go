@@ -0,0 +1,58 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// unixTransport sends packets as datagrams over a Unix socket, for receivers running on the same
+// host. The sending socket is bound to an abstract address so that the receiver can respond.
+type unixTransport struct {
+	conn *net.UnixConn
+}
+
+// newUnixTransport connects to the Unix datagram socket at path
+func newUnixTransport(path string) (*unixTransport, error) {
+	remoteAddr := &net.UnixAddr{Name: path, Net: "unixgram"}
+	localAddr := &net.UnixAddr{Name: fmt.Sprintf("@fabricmachine-%d-%d", os.Getpid(), time.Now().UnixNano()), Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", localAddr, remoteAddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot connect to %s", path)
+	}
+	return &unixTransport{conn: conn}, nil
+}
+
+func (t *unixTransport) Send(packet []byte) error {
+	_, err := t.conn.Write(packet)
+	return err
+}
+
+func (t *unixTransport) SendBatch(packets [][]byte) (int, error) {
+	for i, packet := range packets {
+		if err := t.Send(packet); err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
+
+func (t *unixTransport) Receive(buff []byte, deadline time.Time) (int, error) {
+	if err := t.conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	return t.conn.Read(buff)
+}
+
+func (t *unixTransport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,88 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	fmapi "github.com/hyperledger/fabric/fabricmachine/api"
+)
+
+// Most TX IDs sent in a TX ID index seed message, one annotation per TX ID. Seed messages are also
+// limited to one packet, see txIdSeedBatchLength.
+const txIdSeedBatchSize int = 0xFF
+
+// Number of TX IDs the TX ID index of the hardware peer is expected to hold, seeded from the
+// ledger and then learned from the blocks sent to it.
+var txIdCount uint64
+
+// txIdIndexCapacity returns how many TX IDs the TX ID index of the hardware peer holds
+func txIdIndexCapacity() uint64 {
+	return uint64(1) << uint(hwCapabilities.txIdIndexBits)
+}
+
+// countTxIds keeps track of how many TX IDs the hardware peer indexes, and reports when its TX ID
+// index cannot hold all of them anymore, since duplicates of the TX IDs it drops go undetected.
+// Peers look TX IDs up in the ledger from then on.
+func countTxIds(count int) {
+	capacity := txIdIndexCapacity()
+	if txIdCount < capacity && txIdCount+uint64(count) >= capacity {
+		logger.Warningf("TX ID index of the hardware peer is full with %d TX IDs, peers look duplicate TX IDs up in the ledger from now on",
+			capacity)
+	}
+	txIdCount += uint64(count)
+}
+
+// seedTxIdIndex sends the TX IDs of the blocks of the ledger below height to the hardware peer,
+// so that it can detect transactions that reuse them. Transactions of the blocks sent afterwards
+// are indexed by the hardware peer from their TX ID annotation.
+// Seeding reads the ledger from its first block until the index is full, since peers look TX IDs
+// up in the ledger once it is, so it takes longer as the ledger grows up to the index capacity.
+func seedTxIdIndex(addr string, getBlock BlockGetter, height uint64) {
+	if hwCapabilities.txIdIndexBits == 0 {
+		return
+	}
+
+	logger.Infof("Seeding TX ID index of hardware peer with %d block(s) ...", height)
+	for number := uint64(0); number < height && txIdCount < txIdIndexCapacity(); number++ {
+		block := getBlock(number)
+		if block == nil {
+			logger.Warningf("Cannot seed TX ID index with block %d: block not found", number)
+			continue
+		}
+		seedTxIds(addr, fmapi.GetTxIds(block))
+		if number%10000 == 0 && number > 0 {
+			logger.Infof("Seeded TX ID index of hardware peer with %d block(s)", number)
+		}
+	}
+	logger.Infof("Seeded TX ID index of hardware peer with %d TX ID(s)", txIdCount)
+}
+
+// seedTxIds sends TX IDs to the TX ID index of the hardware peer, in as many messages as needed
+func seedTxIds(addr string, txIds []string) {
+	for len(txIds) > 0 {
+		n := txIdSeedBatchLength(txIds)
+		if err := sendTxIdSeed(addr, txIds[:n]); err != nil {
+			logger.Warningf("Cannot seed TX ID index: %s", err)
+		}
+		countTxIds(n)
+		txIds = txIds[n:]
+	}
+}
+
+// txIdSeedBatchLength returns how many of the first TX IDs fit in one TX ID index seed message, at
+// least one
+func txIdSeedBatchLength(txIds []string) int {
+	size := BCM_TRANSPORT_HEADER_SIZE + BCM_AUTH_TRAILER_SIZE
+	n := 0
+	for n < len(txIds) && n < txIdSeedBatchSize {
+		size += ANNOTATION_SIZE + len(txIds[n])
+		if size > BCM_MAX_PACKET_SIZE && n > 0 {
+			break
+		}
+		n++
+	}
+	return n
+}
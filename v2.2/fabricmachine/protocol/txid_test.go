@@ -0,0 +1,38 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fmprotocol
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTxIdSeedBatchLength(t *testing.T) {
+	// Fabric TX IDs are hex encoded SHA-256 hashes.
+	var txIds []string
+	for i := 0; i < 1000; i++ {
+		txIds = append(txIds, fmt.Sprintf("%064x", i))
+	}
+
+	seeded := 0
+	for len(txIds) > 0 {
+		n := txIdSeedBatchLength(txIds)
+		if n < 1 || n > txIdSeedBatchSize {
+			t.Fatalf("got batch of %d TX IDs", n)
+		}
+		payload, annotations := generateTxIdSeedAnnotation(txIds[:n])
+		size := BCM_TRANSPORT_HEADER_SIZE + len(annotationListToBytes(annotations)) + len(payload) + BCM_AUTH_TRAILER_SIZE
+		if size > BCM_MAX_PACKET_SIZE {
+			t.Fatalf("batch of %d TX IDs takes %d bytes, more than %d", n, size, BCM_MAX_PACKET_SIZE)
+		}
+		seeded += n
+		txIds = txIds[n:]
+	}
+	if seeded != 1000 {
+		t.Errorf("seeded %d TX IDs, want 1000", seeded)
+	}
+}
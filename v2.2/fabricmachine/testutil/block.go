@@ -0,0 +1,236 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package testutil builds blocks and transactions for the tests of the Fabric machine packages.
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// NewCertificate returns a PEM encoded self-signed certificate with the given common name.
+func NewCertificate(commonName string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// Identity returns a serialized identity.
+func Identity(mspId string, certificate []byte) []byte {
+	return Marshal(&msp.SerializedIdentity{Mspid: mspId, IdBytes: certificate})
+}
+
+// Tx describes an endorser transaction.
+type Tx struct {
+	TxId      string
+	Chaincode string
+	Args      []string
+	Creator   []byte // serialized identity
+	Endorsers [][]byte
+
+	// Public writes, keyed by namespace.
+	Writes map[string][]*kvrwset.KVWrite
+
+	// Number of range queries of the chaincode namespace, which carry their raw reads unless
+	// RangeQueryHashes is set.
+	RangeQueries int
+
+	// Range queries carry the merkle summary of their reads instead of raw reads.
+	RangeQueryHashes bool
+
+	// Private data collections written by the transaction, in the chaincode namespace.
+	Collections []string
+}
+
+// NewEnvelope returns the envelope of an endorser transaction.
+func NewEnvelope(tx *Tx) *common.Envelope {
+	chdr := &common.ChannelHeader{
+		Type:      int32(common.HeaderType_ENDORSER_TRANSACTION),
+		ChannelId: "testchannel",
+		TxId:      tx.TxId,
+		Extension: Marshal(&peer.ChaincodeHeaderExtension{ChaincodeId: &peer.ChaincodeID{Name: tx.Chaincode}}),
+	}
+	shdr := &common.SignatureHeader{Creator: tx.Creator, Nonce: []byte("nonce")}
+
+	var args [][]byte
+	for _, arg := range tx.Args {
+		args = append(args, []byte(arg))
+	}
+	proposalPayload := &peer.ChaincodeProposalPayload{
+		Input: Marshal(&peer.ChaincodeInvocationSpec{
+			ChaincodeSpec: &peer.ChaincodeSpec{
+				ChaincodeId: &peer.ChaincodeID{Name: tx.Chaincode},
+				Input:       &peer.ChaincodeInput{Args: args},
+			},
+		}),
+	}
+
+	var endorsements []*peer.Endorsement
+	for _, endorser := range tx.Endorsers {
+		endorsements = append(endorsements, &peer.Endorsement{Endorser: endorser, Signature: []byte("endorsement signature")})
+	}
+	action := &peer.ChaincodeEndorsedAction{
+		ProposalResponsePayload: Marshal(&peer.ProposalResponsePayload{
+			ProposalHash: []byte("proposal hash"),
+			Extension: Marshal(&peer.ChaincodeAction{
+				Results:     Marshal(readWriteSet(tx)),
+				ChaincodeId: &peer.ChaincodeID{Name: tx.Chaincode},
+			}),
+		}),
+		Endorsements: endorsements,
+	}
+
+	transaction := &peer.Transaction{
+		Actions: []*peer.TransactionAction{{
+			Header: Marshal(shdr),
+			Payload: Marshal(&peer.ChaincodeActionPayload{
+				ChaincodeProposalPayload: Marshal(proposalPayload),
+				Action:                   action,
+			}),
+		}},
+	}
+	payload := &common.Payload{
+		Header: &common.Header{ChannelHeader: Marshal(chdr), SignatureHeader: Marshal(shdr)},
+		Data:   Marshal(transaction),
+	}
+	return &common.Envelope{Payload: Marshal(payload), Signature: []byte("tx signature")}
+}
+
+// readWriteSet returns the read/write set of a transaction
+func readWriteSet(tx *Tx) *rwset.TxReadWriteSet {
+	kvRWSet := &kvrwset.KVRWSet{
+		Reads:  []*kvrwset.KVRead{{Key: "key", Version: &kvrwset.Version{BlockNum: 1}}},
+		Writes: tx.Writes[tx.Chaincode],
+	}
+	for i := 0; i < tx.RangeQueries; i++ {
+		rqi := &kvrwset.RangeQueryInfo{
+			StartKey: fmt.Sprintf("key%d", i),
+			EndKey:   fmt.Sprintf("key%d~", i),
+		}
+		if tx.RangeQueryHashes {
+			rqi.ReadsInfo = &kvrwset.RangeQueryInfo_ReadsMerkleHashes{ReadsMerkleHashes: &kvrwset.QueryReadsMerkleSummary{
+				MaxDegree:      50,
+				MaxLevel:       1,
+				MaxLevelHashes: [][]byte{[]byte(fmt.Sprintf("key%d reads hash", i))},
+			}}
+		} else {
+			rqi.ReadsInfo = &kvrwset.RangeQueryInfo_RawReads{RawReads: &kvrwset.QueryReads{
+				KvReads: []*kvrwset.KVRead{{Key: fmt.Sprintf("key%da", i), Version: &kvrwset.Version{BlockNum: 1}}},
+			}}
+		}
+		kvRWSet.RangeQueriesInfo = append(kvRWSet.RangeQueriesInfo, rqi)
+	}
+	nsRWSet := &rwset.NsReadWriteSet{Namespace: tx.Chaincode, Rwset: Marshal(kvRWSet)}
+	for _, collection := range tx.Collections {
+		nsRWSet.CollectionHashedRwset = append(nsRWSet.CollectionHashedRwset, &rwset.CollectionHashedReadWriteSet{
+			CollectionName: collection,
+			HashedRwset: Marshal(&kvrwset.HashedRWSet{
+				HashedWrites: []*kvrwset.KVWriteHash{{KeyHash: []byte(collection + " key hash"), ValueHash: []byte("value hash")}},
+			}),
+			PvtRwsetHash: []byte(collection + " private read/write set hash"),
+		})
+	}
+
+	txRWSet := &rwset.TxReadWriteSet{DataModel: rwset.TxReadWriteSet_KV, NsRwset: []*rwset.NsReadWriteSet{nsRWSet}}
+	var namespaces []string
+	for namespace := range tx.Writes {
+		if namespace != tx.Chaincode {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		txRWSet.NsRwset = append(txRWSet.NsRwset, &rwset.NsReadWriteSet{
+			Namespace: namespace,
+			Rwset:     Marshal(&kvrwset.KVRWSet{Writes: tx.Writes[namespace]}),
+		})
+	}
+	return txRWSet
+}
+
+// NewBlock returns a block signed by orderer holding envelopes, with the metadata set by the
+// orderer.
+func NewBlock(number uint64, orderer []byte, envelopes ...*common.Envelope) *common.Block {
+	block := &common.Block{
+		Header:   &common.BlockHeader{Number: number, PreviousHash: []byte("previous hash"), DataHash: []byte("data hash")},
+		Data:     &common.BlockData{},
+		Metadata: &common.BlockMetadata{Metadata: make([][]byte, len(common.BlockMetadataIndex_name))},
+	}
+	for _, env := range envelopes {
+		block.Data.Data = append(block.Data.Data, Marshal(env))
+	}
+	block.Metadata.Metadata[common.BlockMetadataIndex_SIGNATURES] = Marshal(&common.Metadata{
+		Value: Marshal(&common.OrdererBlockMetadata{LastConfig: &common.LastConfig{Index: 0}}),
+		Signatures: []*common.MetadataSignature{{
+			SignatureHeader: Marshal(&common.SignatureHeader{Creator: orderer, Nonce: []byte("nonce")}),
+			Signature:       []byte("block signature"),
+		}},
+	})
+	block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER] = make([]byte, len(envelopes))
+	return block
+}
+
+// NewConfigBlock returns a config block whose channel config has an application organization
+// per MSP.
+func NewConfigBlock(number uint64, orderer []byte, mspIds ...string) *common.Block {
+	application := &common.ConfigGroup{Groups: make(map[string]*common.ConfigGroup)}
+	for _, mspId := range mspIds {
+		mspConfig := &msp.MSPConfig{Config: Marshal(&msp.FabricMSPConfig{Name: mspId})}
+		application.Groups[mspId] = &common.ConfigGroup{
+			Values: map[string]*common.ConfigValue{"MSP": {Value: Marshal(mspConfig)}},
+		}
+	}
+	config := &common.Config{
+		ChannelGroup: &common.ConfigGroup{Groups: map[string]*common.ConfigGroup{"Application": application}},
+	}
+	chdr := &common.ChannelHeader{Type: int32(common.HeaderType_CONFIG), ChannelId: "testchannel"}
+	payload := &common.Payload{
+		Header: &common.Header{ChannelHeader: Marshal(chdr)},
+		Data:   Marshal(&common.ConfigEnvelope{Config: config}),
+	}
+	block := NewBlock(number, orderer, &common.Envelope{Payload: Marshal(payload)})
+	block.Metadata.Metadata[common.BlockMetadataIndex_SIGNATURES] = Marshal(&common.Metadata{
+		Value: Marshal(&common.OrdererBlockMetadata{LastConfig: &common.LastConfig{Index: number}}),
+	})
+	return block
+}
+
+// Marshal returns the serialized message, panicking on errors.
+func Marshal(m proto.Message) []byte {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
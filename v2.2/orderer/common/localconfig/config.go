@@ -15,6 +15,7 @@ import (
 	"github.com/Shopify/sarama"
 	bccsp "github.com/hyperledger/fabric/bccsp/factory"
 	"github.com/hyperledger/fabric/common/flogging"
+	"github.com/hyperledger/fabric/common/metrics/prometheus"
 	"github.com/hyperledger/fabric/common/viperutil"
 	coreconfig "github.com/hyperledger/fabric/core/config"
 	"github.com/hyperledger/fabric/fabricmachine/api"
@@ -358,7 +359,12 @@ func (c *configCache) load() (*TopLevel, error) {
 	if err = fmapi.InitConfig(config); err != nil {
 		return nil, err
 	}
-	fmprotocol.InitConfig()
+	if err = fmprotocol.InitConfig(); err != nil {
+		return nil, err
+	}
+	if uconf.Metrics.Provider == "prometheus" {
+		fmprotocol.InitMetrics(&prometheus.Provider{})
+	}
 
 	return &uconf, nil
 }
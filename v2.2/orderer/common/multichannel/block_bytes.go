@@ -0,0 +1,23 @@
+/*
+Copyright Xilinx Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package multichannel
+
+import (
+	"github.com/pkg/errors"
+)
+
+// RetrieveBlockBytesByNumber returns a block as it is serialized in the ledger of the channel,
+// when the ledger supports it.
+func (cs *ChainSupport) RetrieveBlockBytesByNumber(number uint64) ([]byte, error) {
+	reader, ok := cs.ledgerResources.ReadWriter.(interface {
+		RetrieveBlockBytesByNumber(number uint64) ([]byte, error)
+	})
+	if !ok {
+		return nil, errors.New("ledger does not return serialized blocks")
+	}
+	return reader.RetrieveBlockBytesByNumber(number)
+}